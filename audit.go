@@ -0,0 +1,180 @@
+package tgstatemanager
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redacted replaces the answers to Sensitive states in audit entries.
+const Redacted = "[redacted]"
+
+// AuditEntry records a move of a user from one state to another.
+type AuditEntry struct {
+	Key     int64
+	Flow    string  `json:",omitempty"`
+	From    string  `json:",omitempty"` // State the user left, empty when entering the flow
+	To      string  `json:",omitempty"` // State the user entered, empty when the flow ended
+	Outcome Outcome `json:",omitempty"` // How the flow ended, when To is empty
+	Update  string  `json:",omitempty"` // Summary of the update causing the move, empty for moves made by the bot
+	Time    time.Time
+}
+
+// AuditStorage appends audit entries to a persistent log.
+type AuditStorage interface {
+	Append(entry AuditEntry) error
+}
+
+// AuditReader reads back the audit log of a user.
+type AuditReader interface {
+	// Entries returns the entries of the user identified by key, oldest
+	// first.
+	Entries(ctx context.Context, key int64) ([]AuditEntry, error)
+}
+
+// AuditFunc adapts a function to the AuditStorage interface, such as one
+// inserting entries into a SQL table.
+type AuditFunc func(entry AuditEntry) error
+
+// Append calls f.
+func (f AuditFunc) Append(entry AuditEntry) error {
+	return f(entry)
+}
+
+// SetAudit makes the manager append every move of a user to storage: answers
+// advancing the user, navigation, cancellations and moves forced by SetState
+// or EndSession. The updates causing moves are summarized by summarize, or by
+// their text when the manager has a TextAccessor; answers to Sensitive states
+// are recorded as Redacted. A failure to append fails the move's Handle call
+// after the state was saved.
+func (m *StateManager[S, U]) SetAudit(storage AuditStorage, summarize func(update U) string) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.auditStorage = storage
+	m.summarize = summarize
+	return nil
+}
+
+// audit appends a move of the user to the audit storage. The update is nil
+// for moves made by the bot.
+func (m *StateManager[S, U]) audit(key int64, userState *UserState[S], from string, update *U) error {
+	if m.auditStorage == nil {
+		return nil
+	}
+	entry := AuditEntry{
+		Key:     key,
+		Flow:    userState.Flow,
+		From:    from,
+		To:      userState.CurrentState,
+		Outcome: userState.Outcome,
+		Time:    userState.UpdatedAt,
+	}
+	switch {
+	case update == nil:
+	case m.states[from] != nil && m.states[from].Sensitive:
+		entry.Update = Redacted
+	case m.summarize != nil:
+		entry.Update = m.summarize(*update)
+	case m.text != nil:
+		entry.Update = m.text.Text(*update)
+	}
+	return m.auditStorage.Append(entry)
+}
+
+// MemoryAuditStorage keeps audit entries in memory, for tests and tools.
+type MemoryAuditStorage struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// Append records the entry.
+func (s *MemoryAuditStorage) Append(entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+// Entries returns the entries of the user identified by key, oldest first.
+func (s *MemoryAuditStorage) Entries(ctx context.Context, key int64) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []AuditEntry
+	for _, entry := range s.entries {
+		if entry.Key == key {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, ctx.Err()
+}
+
+// RedisAuditStorage appends audit entries to a Redis stream per user.
+type RedisAuditStorage struct {
+	client *redis.Client
+	prefix string
+	maxLen int64
+}
+
+// NewRedisAuditStorage creates an audit storage writing the entries of a
+// user to the stream prefix:<key>.
+func NewRedisAuditStorage(client *redis.Client, prefix string) *RedisAuditStorage {
+	return &RedisAuditStorage{client: client, prefix: prefix}
+}
+
+// SetMaxLen caps the streams to about n entries, dropping the oldest ones.
+// Zero, the default, keeps every entry.
+func (s *RedisAuditStorage) SetMaxLen(n int64) {
+	s.maxLen = n
+}
+
+// Append adds the entry to the stream of its user.
+func (s *RedisAuditStorage) Append(entry AuditEntry) error {
+	return s.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: s.stream(entry.Key),
+		MaxLen: s.maxLen,
+		Approx: s.maxLen > 0,
+		Values: []any{
+			"flow", entry.Flow,
+			"from", entry.From,
+			"to", entry.To,
+			"outcome", string(entry.Outcome),
+			"update", entry.Update,
+			"time", entry.Time.Format(time.RFC3339Nano),
+		},
+	}).Err()
+}
+
+// Entries returns the entries of the user identified by key, oldest first.
+func (s *RedisAuditStorage) Entries(ctx context.Context, key int64) ([]AuditEntry, error) {
+	messages, err := s.client.XRange(ctx, s.stream(key), "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditEntry, len(messages))
+	for i, msg := range messages {
+		field := func(name string) string {
+			value, _ := msg.Values[name].(string)
+			return value
+		}
+		at, _ := time.Parse(time.RFC3339Nano, field("time"))
+		entries[i] = AuditEntry{
+			Key:     key,
+			Flow:    field("flow"),
+			From:    field("from"),
+			To:      field("to"),
+			Outcome: Outcome(field("outcome")),
+			Update:  field("update"),
+			Time:    at,
+		}
+	}
+	return entries, nil
+}
+
+// stream returns the name of the stream of a user.
+func (s *RedisAuditStorage) stream(key int64) string {
+	return s.prefix + ":" + strconv.FormatInt(key, 10)
+}
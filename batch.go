@@ -0,0 +1,271 @@
+package tgstatemanager
+
+import (
+	"slices"
+	"time"
+)
+
+// BatchStorage is implemented by storages able to read and write many user
+// states in a single round-trip.
+type BatchStorage[S any] interface {
+	StateStorage[S]
+	// GetMany returns the stored states of ids. Missing states are absent
+	// from the result.
+	GetMany(ids []int64) (map[int64]UserState[S], error)
+	// SetMany stores every state of states.
+	SetMany(states map[int64]UserState[S]) error
+}
+
+// getMany reads the states of ids from storage, with a single GetMany when it
+// implements BatchStorage or one Get per state otherwise.
+func getMany[S any](storage StateStorage[S], ids []int64) (map[int64]UserState[S], error) {
+	if batch, ok := storage.(BatchStorage[S]); ok {
+		return batch.GetMany(ids)
+	}
+	states := make(map[int64]UserState[S], len(ids))
+	for _, id := range ids {
+		state, exists, err := storage.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			states[id] = state
+		}
+	}
+	return states, nil
+}
+
+// setMany stores states in storage, with a single SetMany when it implements
+// BatchStorage or one Set per state otherwise.
+func setMany[S any](storage StateStorage[S], states map[int64]UserState[S]) error {
+	if batch, ok := storage.(BatchStorage[S]); ok {
+		return batch.SetMany(states)
+	}
+	for id, state := range states {
+		if err := storage.Set(id, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchResult is the outcome of handling one update of a batch.
+type BatchResult struct {
+	Handled bool
+	Err     error
+}
+
+// HandleBatch processes updates in order, like calling Handle for each of
+// them. When the storage implements BatchStorage the states of all users in
+// the batch are read with a single GetMany up front and written with a single
+// SetMany at the end, users in states with a TTL of their own being written
+// one by one. With a Locker the locks of all users in the batch are taken
+// before their states are read and held until they are written.
+//
+// As with Handle, prompts are sent before the states are written. The side
+// effects of transitions and cancellations are deferred until the states are
+// written: their events, audit entries, OnFinish and OnCancel hooks and the
+// prompts left to an Outbox or a PromptDispatcher. They are dropped for users
+// whose states failed to be written, so the redelivered updates run them
+// once. The returned error reports a failure to
+// lock, read or write the states, in which case the updates whose states were
+// not written also report it in their results; errors of individual updates
+// are reported in the results.
+func (m *StateManager[S, U]) HandleBatch(updates []U) ([]BatchResult, error) {
+	results := make([]BatchResult, len(updates))
+
+	storage, ok := m.storage.(BatchStorage[S])
+	if !ok {
+		for i, update := range updates {
+			results[i].Handled, results[i].Err = m.Handle(update)
+		}
+		return results, nil
+	}
+
+	keys := make(map[int]int64, len(updates)) // Keys of the updates by index
+	ids := make([]int64, 0, len(updates))
+	seen := make(map[int64]bool, len(updates))
+	for i, update := range updates {
+		key, ok := m.keyFunc(update)
+		if !ok {
+			continue
+		}
+		keys[i] = key
+		if !seen[key] {
+			seen[key] = true
+			ids = append(ids, key)
+		}
+	}
+	unlock, err := m.lockAll(ids)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	states, err := storage.GetMany(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handle the batch on a copy of the manager reading and writing the
+	// prefetched states, the locks being held already
+	overlay := &batchStorage[S]{
+		StateStorage: storage,
+		states:       states,
+		fetched:      seen,
+		dirty:        make(map[int64]bool),
+		ttl:          make(map[int64]time.Duration),
+	}
+	batch := *m
+	batch.storage = overlay
+	batch.locker = nil
+	batch.effects = &batchEffects{}
+	for i, update := range updates {
+		batch.effects.index = i
+		results[i].Handled, results[i].Err = batch.Handle(update)
+	}
+
+	err = overlay.flush(storage)
+	if err != nil {
+		err = overlay.failed(results, keys, err)
+	}
+	// Run the deferred side effects of the users whose states were written,
+	// on the storage and locker of the manager as they may outlive the batch
+	effects := batch.effects.queued
+	batch.storage, batch.locker, batch.effects = m.storage, m.locker, nil
+	for _, effect := range effects {
+		if overlay.dirty[effect.key] {
+			continue // Not written
+		}
+		if err := effect.run(); err != nil {
+			m.emit(errorEvent(effect.key, err))
+			if results[effect.index].Err == nil {
+				results[effect.index].Err = err
+			}
+		}
+	}
+	return results, err
+}
+
+// batchEffects queues the side effects deferred until the states of a batch
+// are written.
+type batchEffects struct {
+	index  int // Index of the update being handled
+	queued []batchEffect
+}
+
+// batchEffect is a side effect of handling an update of a batch.
+type batchEffect struct {
+	index int
+	key   int64
+	run   func() error
+}
+
+// after runs fn, a side effect of writing the state of the user identified by
+// key, right away or, in a batch, once the states of the batch are written.
+func (m *StateManager[S, U]) after(key int64, fn func() error) error {
+	if m.effects == nil {
+		return fn()
+	}
+	m.effects.queued = append(m.effects.queued, batchEffect{index: m.effects.index, key: key, run: fn})
+	return nil
+}
+
+// lockAll acquires the locks of the users identified by ids, in ascending
+// order so concurrent batches do not deadlock, and returns the function
+// releasing them.
+func (m *StateManager[S, U]) lockAll(ids []int64) (func(), error) {
+	sorted := slices.Sorted(slices.Values(ids))
+	unlocks := make([]func() error, 0, len(sorted))
+	unlock := func() {
+		for i, unlock := range slices.Backward(unlocks) {
+			if err := unlock(); err != nil {
+				m.emit(Event{Kind: EventError, Key: sorted[i], Err: err})
+			}
+		}
+	}
+	for _, id := range sorted {
+		release, err := m.lock(id)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, release)
+	}
+	return unlock, nil
+}
+
+// batchStorage serves the states prefetched for a batch and buffers the
+// states written while handling it.
+type batchStorage[S any] struct {
+	StateStorage[S]
+	states  map[int64]UserState[S]
+	fetched map[int64]bool
+	dirty   map[int64]bool
+	ttl     map[int64]time.Duration // TTLs of the states written with one
+}
+
+func (s *batchStorage[S]) Get(id int64) (UserState[S], bool, error) {
+	if !s.fetched[id] {
+		return s.StateStorage.Get(id)
+	}
+	state, ok := s.states[id]
+	return state, ok, nil
+}
+
+func (s *batchStorage[S]) Set(id int64, state UserState[S]) error {
+	return s.SetWithTTL(id, state, 0)
+}
+
+func (s *batchStorage[S]) SetWithTTL(id int64, state UserState[S], ttl time.Duration) error {
+	s.states[id] = state
+	s.fetched[id] = true
+	s.dirty[id] = true
+	s.ttl[id] = ttl
+	return nil
+}
+
+func (s *batchStorage[S]) Delete(id int64) error {
+	if err := deleteState(s.StateStorage, id); err != nil {
+		return err
+	}
+	delete(s.states, id)
+	delete(s.dirty, id)
+	delete(s.ttl, id)
+	s.fetched[id] = true
+	return nil
+}
+
+// flush writes the states written while handling the batch, with a single
+// SetMany but for those with a TTL of their own.
+func (s *batchStorage[S]) flush(storage BatchStorage[S]) error {
+	written := make(map[int64]UserState[S], len(s.dirty))
+	for id := range s.dirty {
+		if ttl := s.ttl[id]; ttl > 0 {
+			if err := setWithTTL(storage, id, s.states[id], ttl); err != nil {
+				return err
+			}
+			delete(s.dirty, id)
+			continue
+		}
+		written[id] = s.states[id]
+	}
+	if len(written) == 0 {
+		return nil
+	}
+	if err := storage.SetMany(written); err != nil {
+		return err
+	}
+	clear(s.dirty)
+	return nil
+}
+
+// failed reports err in the results of the updates whose states are still
+// to be written, and returns it.
+func (s *batchStorage[S]) failed(results []BatchResult, keys map[int]int64, err error) error {
+	for i, key := range keys {
+		if s.dirty[key] && results[i].Err == nil {
+			results[i].Err = err
+		}
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package tgstatemanager
+
+import (
+	"sync"
+	"time"
+)
+
+// Breaker is a circuit breaker guarding a state whose Handle depends on a
+// flaky external service. After Threshold consecutive errors the breaker
+// opens for OpenFor, during which users reaching the state are routed to the
+// Fallback state instead. Once OpenFor has passed the breaker is half-open: a
+// single update is let through as a probe while the others keep being routed
+// to the fallback. The probe's success closes the breaker, its failure reopens
+// it, and a probe never reaching Handle lets the next update probe instead.
+//
+// A Breaker keeps its counters across users, so give every state its own.
+type Breaker struct {
+	Threshold int           // Consecutive errors opening the breaker
+	OpenFor   time.Duration // How long the breaker stays open
+	Fallback  string        // State users are routed to while the breaker is open
+
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+	probes    uint64 // Probes let through so far
+	probing   uint64 // Probe in flight, zero when there is none
+}
+
+// allow reports whether the guarded state may be handled at now. An update
+// let through a half-open breaker is given the non-zero ID of its probe, to
+// be released should it not reach Handle.
+func (b *Breaker) allow(now time.Time) (allowed bool, probe uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true, 0
+	}
+	if now.Before(b.openUntil) || b.probing != 0 {
+		return false, 0
+	}
+	b.probes++
+	b.probing = b.probes
+	return true, b.probing
+}
+
+// admits reports whether the breaker is closed or done waiting at now,
+// without taking the probe of a half-open breaker. FallbackStorage uses it to
+// try its backend again on every call once OpenFor has passed.
+func (b *Breaker) admits(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open || !now.Before(b.openUntil)
+}
+
+// release lets another update probe the breaker when probe ended without
+// recording an outcome.
+func (b *Breaker) release(probe uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.probing == probe {
+		b.probing = 0
+	}
+}
+
+// record records the outcome of handling the guarded state at now and
+// reports whether the breaker is open afterwards.
+func (b *Breaker) record(now time.Time, failed bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = 0
+	if !failed {
+		b.failures = 0
+		b.open = false
+		return false
+	}
+	b.failures++
+	if b.failures < max(b.Threshold, 1) {
+		return false
+	}
+	b.open = true
+	b.openUntil = now.Add(b.OpenFor)
+	b.failures = max(b.Threshold, 1) - 1 // Reopen on the first failure after OpenFor
+	return true
+}
+
+// tripped routes the user to the fallback of the state's open breaker.
+func (m *StateManager[S, U]) tripped(update U, userState *UserState[S], state *State[S, U], key int64) error {
+	userState.History = append(userState.History, state.Name)
+	return m.transition(update, userState, state.Breaker.Fallback, key)
+}
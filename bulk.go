@@ -0,0 +1,40 @@
+package tgstatemanager
+
+import "context"
+
+// Broadcast sends msg through the notifier to every user with a stored state
+// that opts selects. Failed sends are counted and do not stop the job. It
+// requires the storage to implement IterableStorage.
+func (m *StateManager[S, U]) Broadcast(ctx context.Context, msg any, opts JobOptions[S]) (Job, error) {
+	return m.runJob(ctx, JobBroadcast, opts, func(key int64, _ UserState[S]) error {
+		return m.notify(key, msg)
+	})
+}
+
+// BulkReset deletes the states of the users opts selects, so they start over
+// on their next update. It requires the storage to implement IterableStorage
+// and Deleter.
+func (m *StateManager[S, U]) BulkReset(ctx context.Context, opts JobOptions[S]) (Job, error) {
+	if _, ok := m.storage.(Deleter[S]); !ok {
+		return Job{}, ErrNotDeletable
+	}
+	return m.runJob(ctx, JobBulkReset, opts, func(key int64, _ UserState[S]) error {
+		return deleteState(m.storage, key)
+	})
+}
+
+// Migrate passes the states of the users opts selects to fn and stores the
+// results. A nil fn stores the states as read, which upgrades them to the
+// current schema version in storages using Migrations. The states are stored
+// as they are, without being stamped as updated. It requires the storage to
+// implement IterableStorage.
+func (m *StateManager[S, U]) Migrate(ctx context.Context, fn func(key int64, userState *UserState[S]) error, opts JobOptions[S]) (Job, error) {
+	return m.runJob(ctx, JobMigrate, opts, func(key int64, userState UserState[S]) error {
+		if fn != nil {
+			if err := fn(key, &userState); err != nil {
+				return err
+			}
+		}
+		return m.storage.Set(key, userState)
+	})
+}
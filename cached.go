@@ -0,0 +1,255 @@
+package tgstatemanager
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// CachedStorage fronts a persistent storage with an in-memory LRU cache.
+// Writes go through to the backend before the cache is updated, so reads of
+// warm users never reach the backend. The cache is local to the process:
+// states written to the backend by other processes are only seen once the
+// cached copy expires or is invalidated.
+type CachedStorage[S any] struct {
+	backend StateStorage[S]
+	size    int
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[int64]*list.Element
+	lru     *list.List           // Most recently used first
+	reads   map[int64]*cacheRead // Backend reads in flight, by ID
+}
+
+// cacheRead tracks the backend reads of a user state in flight, so their
+// result is not cached over a state written meanwhile.
+type cacheRead struct {
+	readers int
+	writes  uint64 // Writes of the state since the first reader began
+}
+
+// cacheEntry is a cached user state.
+type cacheEntry[S any] struct {
+	id        int64
+	state     UserState[S]
+	expiresAt time.Time // Zero when the entry never expires
+}
+
+// NewCachedStorage creates a storage caching up to size states of backend in
+// memory, each for at most ttl. A zero ttl keeps states cached until they are
+// evicted to make room for others.
+func NewCachedStorage[S any](backend StateStorage[S], size int, ttl time.Duration) *CachedStorage[S] {
+	return &CachedStorage[S]{
+		backend: backend,
+		size:    max(size, 1),
+		ttl:     ttl,
+		entries: make(map[int64]*list.Element),
+		lru:     list.New(),
+		reads:   make(map[int64]*cacheRead),
+	}
+}
+
+// Get retrieves the user state from the cache, falling back to the backend.
+// A state read from the backend is not cached when it was written meanwhile,
+// as the read may have returned the copy the write replaced.
+func (s *CachedStorage[S]) Get(id int64) (UserState[S], bool, error) {
+	if state, ok := s.cached(id); ok {
+		return state, true, nil
+	}
+
+	begun := s.beginRead([]int64{id})
+	state, exists, err := s.backend.Get(id)
+	found := map[int64]UserState[S]{}
+	if err == nil && exists {
+		found[id] = state
+	}
+	s.endRead(begun, found)
+	return state, exists, err
+}
+
+// Set stores the user state in the backend and the cache.
+func (s *CachedStorage[S]) Set(id int64, state UserState[S]) error {
+	return s.SetWithTTL(id, state, 0)
+}
+
+// SetWithTTL stores the user state in the backend with its own TTL and
+// caches it.
+func (s *CachedStorage[S]) SetWithTTL(id int64, state UserState[S], ttl time.Duration) error {
+	if err := setWithTTL(s.backend, id, state, ttl); err != nil {
+		s.Invalidate(id)
+		return err
+	}
+	s.store(id, state)
+	return nil
+}
+
+// Delete removes the user state from the backend and the cache. The cached
+// copy is dropped once the backend deleted the state, so a concurrent Get
+// cannot cache it again.
+func (s *CachedStorage[S]) Delete(id int64) error {
+	err := deleteState(s.backend, id)
+	s.Invalidate(id)
+	return err
+}
+
+// GetMany retrieves the user states for the given IDs from the cache,
+// reading the missing ones from the backend with a single GetMany when it
+// implements BatchStorage.
+func (s *CachedStorage[S]) GetMany(ids []int64) (map[int64]UserState[S], error) {
+	states := make(map[int64]UserState[S], len(ids))
+	var missing []int64
+	for _, id := range ids {
+		if state, ok := s.cached(id); ok {
+			states[id] = state
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return states, nil
+	}
+	begun := s.beginRead(missing)
+	found, err := getMany(s.backend, missing)
+	s.endRead(begun, found)
+	if err != nil {
+		return nil, err
+	}
+	for id, state := range found {
+		states[id] = state
+	}
+	return states, nil
+}
+
+// SetMany stores the given user states in the backend, with a single SetMany
+// when it implements BatchStorage, and caches them.
+func (s *CachedStorage[S]) SetMany(states map[int64]UserState[S]) error {
+	if err := setMany(s.backend, states); err != nil {
+		for id := range states {
+			s.Invalidate(id)
+		}
+		return err
+	}
+	for id, state := range states {
+		s.store(id, state)
+	}
+	return nil
+}
+
+// ForEach calls fn for every state of the backend, which must implement
+// IterableStorage. States are read from the backend, bypassing the cache.
+func (s *CachedStorage[S]) ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error {
+	return forEach(ctx, s.backend, fn)
+}
+
+// Invalidate drops the cached copy of the user state, so the next Get reads
+// it from the backend.
+func (s *CachedStorage[S]) Invalidate(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wrote(id)
+	if elem, ok := s.entries[id]; ok {
+		s.remove(elem)
+	}
+}
+
+// beginRead registers backend reads of ids and returns the writes each had
+// seen when it began.
+func (s *CachedStorage[S]) beginRead(ids []int64) map[int64]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	begun := make(map[int64]uint64, len(ids))
+	for _, id := range ids {
+		read, ok := s.reads[id]
+		if !ok {
+			read = &cacheRead{}
+			s.reads[id] = read
+		}
+		read.readers++
+		begun[id] = read.writes
+	}
+	return begun
+}
+
+// endRead ends the backend reads begun, caching the states found unless they
+// were written since their read began.
+func (s *CachedStorage[S]) endRead(begun map[int64]uint64, found map[int64]UserState[S]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, writes := range begun {
+		read := s.reads[id]
+		if state, ok := found[id]; ok && read.writes == writes {
+			s.cache(id, state)
+		}
+		if read.readers--; read.readers == 0 {
+			delete(s.reads, id)
+		}
+	}
+}
+
+// wrote records a write of the state of id for the reads in flight. The
+// caller must hold the lock.
+func (s *CachedStorage[S]) wrote(id int64) {
+	if read, ok := s.reads[id]; ok {
+		read.writes++
+	}
+}
+
+// cached returns the cached user state unless it is missing or expired.
+func (s *CachedStorage[S]) cached(id int64) (UserState[S], bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[id]
+	if !ok {
+		return UserState[S]{}, false
+	}
+	entry := elem.Value.(*cacheEntry[S])
+	if !entry.expiresAt.IsZero() && !time.Now().Before(entry.expiresAt) {
+		s.remove(elem)
+		return UserState[S]{}, false
+	}
+	s.lru.MoveToFront(elem)
+	return entry.state.detached(), true
+}
+
+// store caches the user state written, evicting the least recently used one
+// when the cache is full.
+func (s *CachedStorage[S]) store(id int64, state UserState[S]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wrote(id)
+	s.cache(id, state)
+}
+
+// cache caches the user state. The caller must hold the lock.
+func (s *CachedStorage[S]) cache(id int64, state UserState[S]) {
+	entry := &cacheEntry[S]{id: id, state: state.detached()}
+	if s.ttl > 0 {
+		entry.expiresAt = time.Now().Add(s.ttl)
+	}
+	if elem, ok := s.entries[id]; ok {
+		elem.Value = entry
+		s.lru.MoveToFront(elem)
+		return
+	}
+
+	s.entries[id] = s.lru.PushFront(entry)
+	if s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+	}
+}
+
+// remove drops a cache element. The caller must hold the lock.
+func (s *CachedStorage[S]) remove(elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.entries, elem.Value.(*cacheEntry[S]).id)
+}
+
+// Ping verifies the connectivity of the backend when it implements
+// HealthChecker.
+func (s *CachedStorage[S]) Ping(ctx context.Context) error {
+	if checker, ok := s.backend.(HealthChecker); ok {
+		return checker.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package tgstatemanager
+
+import "fmt"
+
+// ChatType identifies the kind of chat an update was sent in.
+type ChatType string
+
+const (
+	ChatPrivate    ChatType = "private"
+	ChatGroup      ChatType = "group"
+	ChatSupergroup ChatType = "supergroup"
+	ChatChannel    ChatType = "channel"
+)
+
+// ChatPolicy configures how updates from chats of a type are handled.
+type ChatPolicy struct {
+	Ignore bool   // Leaves updates from such chats unhandled, without loading or saving any state
+	Flow   string // Optional: Named flow new chats of the type start in
+}
+
+// SetChatTypeFunc sets the function telling the type of the chat an update
+// was sent in. Bot adapters provide one. Without it chat policies are not
+// applied.
+func (m *StateManager[S, U]) SetChatTypeFunc(fn func(update U) ChatType) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.chatTypeFunc = fn
+	return nil
+}
+
+// SetChatPolicy sets how updates from chats of chatType are handled, such as
+// ignoring groups and channels so their messages do not start flows meant
+// for private chats. The flow of a policy takes precedence over
+// SetInitialState but not over an InitialStateFunc picking a state. Chats of
+// types without a policy are handled as usual.
+func (m *StateManager[S, U]) SetChatPolicy(chatType ChatType, policy ChatPolicy) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	if _, ok := m.flows[policy.Flow]; policy.Flow != "" && !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownFlow, policy.Flow)
+	}
+	if m.chatPolicies == nil {
+		m.chatPolicies = make(map[ChatType]ChatPolicy)
+	}
+	m.chatPolicies[chatType] = policy
+	return nil
+}
+
+// chatPolicy returns the policy for the chat the update was sent in.
+func (m *StateManager[S, U]) chatPolicy(update U) ChatPolicy {
+	if m.chatTypeFunc == nil {
+		return ChatPolicy{}
+	}
+	return m.chatPolicies[m.chatTypeFunc(update)]
+}
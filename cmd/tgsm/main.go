@@ -0,0 +1,78 @@
+// Command tgsm scaffolds bots built with tg-state-manager.
+//
+// Usage:
+//
+//	tgsm list
+//	tgsm new [-dir dir] [-module path] [-storage memory|redis|file] <template>
+//
+// New writes the bot of the template into dir, the template name by default,
+// including tests of its flow. It can be run by go generate as well:
+//
+//	//go:generate go run github.com/sudosz/tg-state-manager/cmd/tgsm new -dir . quiz
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sudosz/tg-state-manager/scaffold"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "tgsm:", err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command given by args.
+func run(args []string) error {
+	if len(args) == 0 {
+		return usage()
+	}
+	switch args[0] {
+	case "list":
+		for _, t := range scaffold.Templates() {
+			fmt.Printf("%-10s %s\n", t.Name, t.Title)
+		}
+		return nil
+	case "new":
+		return newBot(args[1:])
+	}
+	return usage()
+}
+
+// newBot implements the new command.
+func newBot(args []string) error {
+	flags := flag.NewFlagSet("new", flag.ContinueOnError)
+	dir := flags.String("dir", "", "directory to write the bot to, the template name by default")
+	module := flags.String("module", "", "module path of the bot, the template name by default")
+	storage := flags.String("storage", "memory", "storage of user states: "+strings.Join(scaffold.Storages, ", "))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usage()
+	}
+	name := flags.Arg(0)
+	if *dir == "" {
+		*dir = name
+	}
+
+	written, err := scaffold.Generate(name, *dir, scaffold.Options{Module: *module, Storage: *storage})
+	if err != nil {
+		return err
+	}
+	for _, file := range written {
+		fmt.Println("created", file)
+	}
+	fmt.Printf("\nNext steps:\n\tcd %s\n\tgo mod tidy\n\tgo test ./...\n\tTOKEN=<bot token> go run .\n", *dir)
+	return nil
+}
+
+// usage returns the error describing how to run the command.
+func usage() error {
+	return fmt.Errorf("usage: tgsm list | tgsm new [-dir dir] [-module path] [-storage %s] <template>", strings.Join(scaffold.Storages, "|"))
+}
@@ -0,0 +1,308 @@
+// Command tgsmctl inspects and fixes the user states of bots built with
+// tg-state-manager, straight in their storage.
+//
+// Usage:
+//
+//	tgsmctl [-storage url] list [-state name] [-flow name] [-all]
+//	tgsmctl [-storage url] get <key>
+//	tgsmctl [-storage url] set-state <key> <state>
+//	tgsmctl [-storage url] delete <key>
+//	tgsmctl [-storage url] export
+//	tgsmctl [-storage url] import <file>
+//	tgsmctl [-storage url] check <schema>
+//
+// The storage is given by a URL, $TGSM_STORAGE by default:
+//
+//	redis://localhost:6379/0?prefix=user
+//	mongodb://localhost:27017/bot?collection=states
+//	file:///var/lib/bot/states.log
+//
+// A file storage is kept in memory by the bot using it, which locks the log
+// while it runs, so the command refuses to open it until the bot is stopped.
+//
+// The data of user states is handled as generic JSON, so the command works
+// with any bot as long as the storage holds plain JSON or BSON. Set-state
+// cannot check the state exists in the bot: the name is stored as given.
+// Export writes every stored state as a line of JSON, which import stores back,
+// possibly into another storage. Check reads a schema written by
+// StateManager.ExportSchema, typically by the release about to be deployed,
+// lists the stored sessions in states and flows it lacks and fails when there
+// are any.
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	tgsm "github.com/sudosz/tg-state-manager"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// data is the data of user states, decoded without knowing the bot's struct.
+type data = map[string]any
+
+// storage is a storage opened by the command.
+type storage interface {
+	tgsm.IterableStorage[data]
+	Delete(id int64) error
+	io.Closer
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "tgsmctl:", err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command given by args, writing its output to w.
+func run(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("tgsmctl", flag.ContinueOnError)
+	storageURL := flags.String("storage", os.Getenv("TGSM_STORAGE"), "URL of the storage of user states")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 || *storageURL == "" {
+		return usage()
+	}
+	s, err := open(*storageURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	args = flags.Args()
+	switch args[0] {
+	case "list":
+		return list(s, args[1:], w)
+	case "get":
+		return get(s, args[1:], w)
+	case "set-state":
+		return setState(s, args[1:])
+	case "delete":
+		key, err := parseKey(args[1:], 1)
+		if err != nil {
+			return err
+		}
+		return s.Delete(key)
+	case "export":
+		return tgsm.Export(context.Background(), s, w)
+	case "import":
+		return importStates(s, args[1:], w)
+	case "check":
+		return check(s, args[1:], w)
+	}
+	return usage()
+}
+
+// check implements the check command.
+func check(s storage, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return usage()
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	schema, err := tgsm.ImportSchema(file)
+	if err != nil {
+		return err
+	}
+	compat, err := tgsm.CheckSchema(context.Background(), s, schema)
+	if err != nil {
+		return err
+	}
+	for _, state := range slices.Sorted(maps.Keys(compat.OrphanedStates)) {
+		fmt.Fprintf(w, "state\t%s\t%d\n", state, compat.OrphanedStates[state])
+	}
+	for _, flow := range slices.Sorted(maps.Keys(compat.OrphanedFlows)) {
+		fmt.Fprintf(w, "flow\t%s\t%d\n", flow, compat.OrphanedFlows[flow])
+	}
+	if !compat.Compatible() {
+		return fmt.Errorf("schema orphans sessions: %d states, %d flows", len(compat.OrphanedStates), len(compat.OrphanedFlows))
+	}
+	fmt.Fprintf(w, "checked %d sessions\n", compat.Checked)
+	return nil
+}
+
+// importStates implements the import command.
+func importStates(s storage, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return usage()
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	n, err := tgsm.Import(s, file)
+	fmt.Fprintf(w, "imported %d states\n", n)
+	return err
+}
+
+// list implements the list command.
+func list(s storage, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	state := flags.String("state", "", "only list users in the named state")
+	flow := flags.String("flow", "", "only list users in the named flow")
+	all := flags.Bool("all", false, "list finished sessions as well")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var lines []string
+	err := s.ForEach(context.Background(), func(key int64, userState tgsm.UserState[data]) error {
+		switch {
+		case !*all && (userState.Finished || userState.CurrentState == ""):
+		case *state != "" && userState.CurrentState != *state:
+		case *flow != "" && userState.Flow != *flow:
+		default:
+			lines = append(lines, fmt.Sprintf("%d\t%s\t%s\t%s", key, userState.Flow, userState.CurrentState, userState.UpdatedAt.Format(time.RFC3339)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.Sort(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// get implements the get command.
+func get(s storage, args []string, w io.Writer) error {
+	key, err := parseKey(args, 1)
+	if err != nil {
+		return err
+	}
+	userState, exists, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no state for key %d", key)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(userState)
+}
+
+// setState implements the set-state command. The prompt of the state is sent
+// on the user's next update, as by StateManager.SetState.
+func setState(s storage, args []string) error {
+	key, err := parseKey(args, 2)
+	if err != nil {
+		return err
+	}
+	userState, _, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if userState.CreatedAt.IsZero() {
+		userState.CreatedAt = now
+	}
+	userState.UpdatedAt = now
+	userState.Enter(args[1])
+	userState.Source = tgsm.Source{Kind: tgsm.SourceAdmin, Detail: "tgsmctl"}
+	return s.Set(key, userState)
+}
+
+// parseKey parses the user key of a command taking n arguments.
+func parseKey(args []string, n int) (int64, error) {
+	if len(args) != n {
+		return 0, usage()
+	}
+	key, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid key %q", args[0])
+	}
+	return key, nil
+}
+
+// open opens the storage at the URL.
+func open(rawURL string) (storage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	switch u.Scheme {
+	case "file":
+		s, err := tgsm.NewFileStorage[data](u.Path, nil)
+		if errors.Is(err, tgsm.ErrFileLocked) {
+			return nil, fmt.Errorf("%w: stop the bot before using its file storage", err)
+		}
+		return s, err
+	case "redis", "rediss":
+		prefix := query.Get("prefix")
+		query.Del("prefix")
+		u.RawQuery = query.Encode()
+		opts, err := redis.ParseURL(u.String())
+		if err != nil {
+			return nil, err
+		}
+		client := redis.NewClient(opts)
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return redisStorage{tgsm.NewRedisStorage[data](client, cmp.Or(prefix, "user")), client}, nil
+	case "mongodb", "mongodb+srv":
+		database := strings.TrimPrefix(u.Path, "/")
+		collection := query.Get("collection")
+		if database == "" || collection == "" {
+			return nil, errors.New("mongodb storage needs a database and a collection")
+		}
+		query.Del("collection")
+		u.RawQuery = query.Encode()
+		client, err := mongo.Connect(options.Client().ApplyURI(u.String()).SetBSONOptions(&options.BSONOptions{DefaultDocumentMap: true}))
+		if err != nil {
+			return nil, err
+		}
+		return mongoStorage{tgsm.NewMongoStorage[data](client, database, collection), client}, nil
+	}
+	return nil, fmt.Errorf("unsupported storage %q", u.Scheme)
+}
+
+// redisStorage closes the client of a Redis storage.
+type redisStorage struct {
+	*tgsm.RedisStorage[data]
+	client *redis.Client
+}
+
+func (s redisStorage) Close() error {
+	return s.client.Close()
+}
+
+// mongoStorage closes the client of a MongoDB storage.
+type mongoStorage struct {
+	*tgsm.MongoStorage[data]
+	client *mongo.Client
+}
+
+func (s mongoStorage) Close() error {
+	return s.client.Disconnect(context.Background())
+}
+
+// usage returns the error describing how to run the command.
+func usage() error {
+	return errors.New("usage: tgsmctl [-storage url] list [-state name] [-flow name] [-all] | get <key> | set-state <key> <state> | delete <key> | export | import <file> | check <schema>")
+}
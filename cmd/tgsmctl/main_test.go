@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "states.log")
+	s, err := tgsm.NewFileStorage[data](path, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.Set(1, tgsm.UserState[data]{CurrentState: "email", Data: data{"Name": "Ann"}}))
+	require.NoError(t, s.Set(2, tgsm.UserState[data]{CurrentState: "password", Flow: "signup"}))
+	require.NoError(t, s.Set(3, tgsm.UserState[data]{Finished: true}))
+	require.NoError(t, s.Close())
+
+	storage := "-storage=file://" + path
+	ctl := func(args ...string) (string, error) {
+		return tgsmctl(append([]string{storage}, args...)...)
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		bot, err := tgsm.NewFileStorage[data](path, nil)
+		require.NoError(t, err)
+		_, err = ctl("list")
+		assert.ErrorIs(t, err, tgsm.ErrFileLocked, "the log of a running bot is refused")
+		require.NoError(t, bot.Close())
+	}
+
+	out, err := ctl("list")
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(out, "\n"))
+	out, err = ctl("list", "-flow", "signup")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "2\tsignup\tpassword\t"))
+
+	out, err = ctl("get", "1")
+	require.NoError(t, err)
+	assert.Contains(t, out, `"Name": "Ann"`)
+	_, err = ctl("get", "9")
+	assert.Error(t, err)
+
+	_, err = ctl("set-state", "2", "email")
+	require.NoError(t, err)
+	out, err = ctl("list", "-state", "email")
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(out, "\n"))
+
+	_, err = ctl("delete", "1")
+	require.NoError(t, err)
+	out, err = ctl("export")
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(out, "\n"))
+	assert.Contains(t, out, `"Kind":"admin"`)
+
+	dump := filepath.Join(t.TempDir(), "dump.jsonl")
+	require.NoError(t, os.WriteFile(dump, []byte(out), 0o600))
+	out, err = tgsmctl("-storage=file://"+filepath.Join(t.TempDir(), "new.log"), "import", dump)
+	require.NoError(t, err)
+	assert.Equal(t, "imported 2 states\n", out)
+
+	schema := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(schema, []byte(`{"Flows": {"signup": "email"}, "States": [{"Name": "email"}]}`), 0o600))
+	out, err = ctl("check", schema)
+	require.NoError(t, err)
+	assert.Equal(t, "checked 1 sessions\n", out)
+	require.NoError(t, os.WriteFile(schema, []byte(`{"States": [{"Name": "password"}]}`), 0o600))
+	out, err = ctl("check", schema)
+	assert.Error(t, err)
+	assert.Equal(t, "state\temail\t1\nflow\tsignup\t1\n", out)
+
+	_, err = ctl("set-state", "x", "email")
+	assert.Error(t, err)
+	_, err = ctl("unknown")
+	assert.Error(t, err)
+}
+
+// tgsmctl runs the command with args, returning its output.
+func tgsmctl(args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(args, &out)
+	return out.String(), err
+}
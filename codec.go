@@ -0,0 +1,140 @@
+package tgstatemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrCodecField is returned when codec options name a field the data struct
+// does not have, or when two fields share a stored key.
+var ErrCodecField = errors.New("invalid codec field")
+
+// Codec serializes user states for the storages keeping them as bytes, such
+// as RedisStorage and FileStorage. Migrations and CompactCodec are codecs.
+type Codec[S any] interface {
+	Encode(state UserState[S]) ([]byte, error)
+	Decode(data []byte) (UserState[S], error)
+}
+
+// CompactOptions configure what a CompactCodec stores of the data struct.
+// Fields are named by their Go name.
+type CompactOptions struct {
+	OmitZero bool     // Leave out fields holding the zero value of their type
+	Only     []string // Fields to store, all exported fields when empty
+	Skip     []string // Fields never stored, read back as zero values
+}
+
+// CompactCodec serializes user states as JSON, shrinking the data struct S
+// as configured by its options. A field tagged `codec:"k"` is stored under
+// the key k instead of its name, and fields tagged `json:"-"` are never
+// stored. Data written by a CompactCodec can only be read by a CompactCodec
+// for the same options and tags; it does not support Migrations.
+type CompactCodec[S any] struct {
+	fields   []compactField
+	omitZero bool
+}
+
+// compactField is a stored field of the data struct.
+type compactField struct {
+	index int
+	key   string
+}
+
+// NewCompactCodec creates a codec for S, which must be a struct.
+func NewCompactCodec[S any](opts CompactOptions) (*CompactCodec[S], error) {
+	t := reflect.TypeFor[S]()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%w: %s is not a struct", ErrCodecField, t)
+	}
+	for _, name := range append(opts.Only, opts.Skip...) {
+		if _, ok := t.FieldByName(name); !ok {
+			return nil, fmt.Errorf("%w: %s has no field %s", ErrCodecField, t, name)
+		}
+	}
+
+	only := make(map[string]bool, len(opts.Only))
+	for _, name := range opts.Only {
+		only[name] = true
+	}
+	skip := make(map[string]bool, len(opts.Skip))
+	for _, name := range opts.Skip {
+		skip[name] = true
+	}
+
+	c := &CompactCodec[S]{omitZero: opts.OmitZero}
+	keys := make(map[string]string)
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() || sf.Tag.Get("json") == "-" || skip[sf.Name] || (len(only) > 0 && !only[sf.Name]) {
+			continue
+		}
+		key := sf.Name
+		if tag := sf.Tag.Get("codec"); tag != "" {
+			key = tag
+		}
+		if other, ok := keys[key]; ok {
+			return nil, fmt.Errorf("%w: %s and %s are both stored as %q", ErrCodecField, other, sf.Name, key)
+		}
+		keys[key] = sf.Name
+		c.fields = append(c.fields, compactField{index: i, key: key})
+	}
+	return c, nil
+}
+
+// compactState is a user state with its data replaced by the compacted data,
+// which shadows the embedded Data field.
+type compactState[S any] struct {
+	*UserState[S]
+	Data json.RawMessage
+}
+
+// Encode marshals a user state to JSON with compacted data.
+func (c *CompactCodec[S]) Encode(state UserState[S]) ([]byte, error) {
+	v := reflect.ValueOf(state.Data)
+	fields := make(map[string]json.RawMessage, len(c.fields))
+	for _, field := range c.fields {
+		value := v.Field(field.index)
+		if c.omitZero && value.IsZero() {
+			continue
+		}
+		raw, err := json.Marshal(value.Interface())
+		if err != nil {
+			return nil, err
+		}
+		fields[field.key] = raw
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(compactState[S]{UserState: &state, Data: data})
+}
+
+// Decode unmarshals a user state written by Encode.
+func (c *CompactCodec[S]) Decode(data []byte) (UserState[S], error) {
+	var state UserState[S]
+	wire := compactState[S]{UserState: &state}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return UserState[S]{}, err
+	}
+	var fields map[string]json.RawMessage
+	if len(wire.Data) > 0 {
+		if err := json.Unmarshal(wire.Data, &fields); err != nil {
+			return UserState[S]{}, err
+		}
+	}
+
+	v := reflect.ValueOf(&state.Data).Elem()
+	for _, field := range c.fields {
+		raw, ok := fields[field.key]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(raw, v.Field(field.index).Addr().Interface()); err != nil {
+			return UserState[S]{}, fmt.Errorf("decoding field %s: %w", v.Type().Field(field.index).Name, err)
+		}
+	}
+	return state, nil
+}
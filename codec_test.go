@@ -0,0 +1,76 @@
+package tgstatemanager_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// application is a state struct with mostly empty fields.
+type application struct {
+	Name    string `codec:"n"`
+	Email   string `codec:"e"`
+	Notes   string
+	Tags    []string `codec:"t"`
+	Score   int
+	Session string `json:"-"`
+}
+
+func TestCompactCodec(t *testing.T) {
+	codec, err := tgsm.NewCompactCodec[application](tgsm.CompactOptions{OmitZero: true, Skip: []string{"Score"}})
+	require.NoError(t, err)
+
+	state := tgsm.UserState[application]{
+		CurrentState: "ask_email",
+		PromptSent:   true,
+		History:      []string{"ask_name"},
+		Data:         application{Name: "Ada", Tags: []string{"vip"}, Score: 7, Session: "secret"},
+	}
+	data, err := codec.Encode(state)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"Data":{"n":"Ada","t":["vip"]}`)
+	assert.NotContains(t, string(data), "Notes")
+
+	decoded, err := codec.Decode(data)
+	require.NoError(t, err)
+	want := state
+	want.Data.Score, want.Data.Session = 0, ""
+	assert.Equal(t, want, decoded)
+
+	// Only stores the listed fields
+	codec, err = tgsm.NewCompactCodec[application](tgsm.CompactOptions{Only: []string{"Email"}})
+	require.NoError(t, err)
+	data, err = codec.Encode(tgsm.UserState[application]{Data: application{Name: "Ada"}})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"Data":{"e":""}`)
+
+	_, err = tgsm.NewCompactCodec[application](tgsm.CompactOptions{Skip: []string{"Missing"}})
+	assert.ErrorIs(t, err, tgsm.ErrCodecField)
+	_, err = tgsm.NewCompactCodec[struct {
+		A string `codec:"x"`
+		B string `codec:"x"`
+	}](tgsm.CompactOptions{})
+	assert.ErrorIs(t, err, tgsm.ErrCodecField)
+}
+
+func TestFileStorageCodec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "states.log")
+	codec, err := tgsm.NewCompactCodec[application](tgsm.CompactOptions{OmitZero: true})
+	require.NoError(t, err)
+
+	storage, err := tgsm.NewFileStorage[application](path, codec)
+	require.NoError(t, err)
+	require.NoError(t, storage.Set(1, tgsm.UserState[application]{CurrentState: "ask_email", Data: application{Name: "Ada"}}))
+	require.NoError(t, storage.Close())
+
+	storage, err = tgsm.NewFileStorage[application](path, codec)
+	require.NoError(t, err)
+	defer storage.Close()
+	state, ok, err := storage.Get(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "Ada", state.Data.Name)
+}
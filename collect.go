@@ -0,0 +1,44 @@
+package tgstatemanager
+
+// Collect describes a state accumulating several answers, such as "send all
+// your photos, then press Done". Every accepted update appends an entry to a
+// slice of the state data and keeps the user in the state without sending
+// its prompt again, until the user finishes the collection or Max entries
+// are collected.
+type Collect[S, U, T any] struct {
+	Name    string
+	Prompt  func(ctx PromptContext[U], state *S) error // Optional: Sent when entering the state
+	Entries func(state *S) *[]T                        // Slice collected entries are appended to
+	Parse   func(update U) (T, error)                  // Reads an entry; ErrValidation rejects the update
+	Done    func(update U) bool                        // Reports whether the update finishes the collection, like a Done button
+	Min     int                                        // Entries required before the collection may be finished
+	Max     int                                        // Entries finishing the collection on their own, unlimited when zero
+	Next    string                                     // State entered once the collection is finished
+}
+
+// CollectState creates the state collecting entries as described by c.
+// Finishing the collection with fewer than Min entries fails validation.
+func CollectState[S, U, T any](c Collect[S, U, T]) *State[S, U] {
+	return &State[S, U]{
+		Name:       c.Name,
+		PromptWith: c.Prompt,
+		Handle: func(update U, state *S) (string, error) {
+			entries := c.Entries(state)
+			if c.Done != nil && c.Done(update) {
+				if len(*entries) < c.Min {
+					return "", ErrValidation
+				}
+				return c.Next, nil
+			}
+			entry, err := c.Parse(update)
+			if err != nil {
+				return "", err
+			}
+			*entries = append(*entries, entry)
+			if c.Max > 0 && len(*entries) >= c.Max {
+				return c.Next, nil
+			}
+			return NopState, nil
+		},
+	}
+}
@@ -0,0 +1,26 @@
+package tgstatemanager
+
+import "context"
+
+// HandleContext processes an update like Handle, passing ctx to the HandleWith
+// and PromptWith callbacks it runs, so they can respect its deadline and read
+// request-scoped values such as trace IDs. Waiting for the lock of the user
+// stops when ctx is done as well.
+func (m *StateManager[S, U]) HandleContext(ctx context.Context, update U) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	// Handle the update on a copy of the manager carrying the context
+	call := *m
+	call.ctx = ctx
+	return call.Handle(update)
+}
+
+// requestContext returns the context given to HandleContext, or the
+// background context for updates passed to Handle.
+func (m *StateManager[S, U]) requestContext() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
@@ -0,0 +1,35 @@
+package tgstatemanager
+
+// SetUpdateIDFunc enables the detection of redelivered updates, such as those
+// Telegram sends again after a webhook timed out. fn returns the ID of an
+// update, increasing from one update to the next, and false for updates
+// without one. Bot adapters provide one.
+//
+// The ID of the last update handled for a user is kept in its state, written
+// along with the next change of the state. Updates whose ID is not above it
+// are skipped, Handle reporting them as handled so that no other handler
+// processes them either.
+func (m *StateManager[S, U]) SetUpdateIDFunc(fn func(update U) (int64, bool)) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.updateID = fn
+	return nil
+}
+
+// duplicate reports whether the update was already handled for the user,
+// recording its ID in the user's state otherwise.
+func (m *StateManager[S, U]) duplicate(update U, userState *UserState[S]) bool {
+	if m.updateID == nil {
+		return false
+	}
+	id, ok := m.updateID(update)
+	if !ok {
+		return false
+	}
+	if id <= userState.LastUpdateID {
+		return true
+	}
+	userState.LastUpdateID = id
+	return false
+}
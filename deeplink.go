@@ -0,0 +1,122 @@
+package tgstatemanager
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidPattern is returned when adding a deep link with a malformed
+// pattern.
+var ErrInvalidPattern = errors.New("invalid deep link pattern")
+
+// DeepLink routes users following a deep link whose start payload matches
+// Pattern to an entry state or flow, starting over with fresh data. Payloads
+// are read from the source of the update, see SetSourceFunc.
+type DeepLink[S any] struct {
+	Pattern string                                        // Payload such as "ref_{id}", whose {name} placeholders match letters, digits and hyphens
+	State   string                                        // State entered, in the default flow
+	Flow    string                                        // Optional: Named flow started instead
+	Fill    func(params map[string]string, data *S) error // Optional: Fills the fresh data from the placeholders
+}
+
+// deepLink is a registered deep link with its compiled pattern.
+type deepLink[S any] struct {
+	DeepLink[S]
+	re *regexp.Regexp
+}
+
+// placeholder matches the placeholders of a deep link pattern.
+var placeholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// AddDeepLinks registers deep links, matched in the order they were added.
+// Like triggers, they take precedence over the state the user is in. The
+// state or flow of every deep link must already be registered.
+func (m *StateManager[S, U]) AddDeepLinks(links ...DeepLink[S]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	compiled := make([]deepLink[S], 0, len(links))
+	for _, link := range links {
+		if link.Flow != "" {
+			if _, ok := m.flows[link.Flow]; !ok {
+				return fmt.Errorf("%w: %s", ErrUnknownFlow, link.Flow)
+			}
+		} else if _, ok := m.states[link.State]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownState, link.State)
+		}
+		re, err := compilePattern(link.Pattern)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, deepLink[S]{DeepLink: link, re: re})
+	}
+	m.deepLinks = append(m.deepLinks, compiled...)
+	return nil
+}
+
+// compilePattern turns a deep link pattern into an anchored regexp with a
+// named group per placeholder.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("%w: empty pattern", ErrInvalidPattern)
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, loc := range placeholder.FindAllStringSubmatchIndex(pattern, -1) {
+		b.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		fmt.Fprintf(&b, "(?P<%s>[A-Za-z0-9-]+)", pattern[loc[2]:loc[3]])
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(pattern[last:]))
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidPattern, pattern, err)
+	}
+	return re, nil
+}
+
+// deepLink returns the first deep link matching the start payload of the
+// update, with the values of its placeholders.
+func (m *StateManager[S, U]) deepLink(update U) (deepLink[S], map[string]string, bool) {
+	if len(m.deepLinks) == 0 {
+		return deepLink[S]{}, nil, false
+	}
+	source := m.source(update)
+	if source.Kind != SourceDeepLink {
+		return deepLink[S]{}, nil, false
+	}
+	for _, link := range m.deepLinks {
+		match := link.re.FindStringSubmatch(source.Detail)
+		if match == nil {
+			continue
+		}
+		params := make(map[string]string)
+		for i, name := range link.re.SubexpNames() {
+			if name != "" {
+				params[name] = match[i]
+			}
+		}
+		return link, params, true
+	}
+	return deepLink[S]{}, nil, false
+}
+
+// follow starts the user over at the entry of the deep link and sends its
+// prompt.
+func (m *StateManager[S, U]) follow(update U, userState UserState[S], link deepLink[S], params map[string]string, key int64) error {
+	fresh := UserState[S]{Flow: link.Flow, Source: m.source(update), LastUpdateID: userState.LastUpdateID, Language: userState.Language, Meta: userState.Meta}
+	if link.Fill != nil {
+		if err := link.Fill(params, &fresh.Data); err != nil {
+			return err
+		}
+	}
+	entry := link.State
+	if link.Flow != "" {
+		entry = m.flows[link.Flow]
+	}
+	return m.transition(update, &fresh, entry, key)
+}
@@ -0,0 +1,127 @@
+package tgstatemanager
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrDispatcherClosed is returned when a prompt is sent through a closed
+// PromptDispatcher.
+var ErrDispatcherClosed = errors.New("prompt dispatcher closed")
+
+// PromptError reports a prompt that failed to send asynchronously.
+type PromptError struct {
+	Key   int64
+	State string
+	Err   error
+}
+
+func (e *PromptError) Error() string {
+	return fmt.Sprintf("sending prompt of %s to %d: %v", e.State, e.Key, e.Err)
+}
+
+func (e *PromptError) Unwrap() error {
+	return e.Err
+}
+
+// promptTask is a prompt queued for sending.
+type promptTask struct {
+	key   int64
+	state string
+	send  func() error
+	sent  func() error // Optional: Run once the prompt was sent, off the worker
+}
+
+// PromptDispatcher sends prompts from a fixed pool of workers, so slow sends
+// do not hold up update handling. Prompts of a chat are always sent by the
+// same worker, in the order they were dispatched. Each worker queues a bounded
+// number of prompts, beyond which dispatching blocks until there is room.
+type PromptDispatcher struct {
+	queues  []chan promptTask
+	onError func(err *PromptError)
+	mu      sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewPromptDispatcher starts a dispatcher with workers workers queueing up to
+// queueSize prompts each. Failed sends are passed to onError, which is called
+// from the workers and must be safe for concurrent use.
+func NewPromptDispatcher(workers, queueSize int, onError func(err *PromptError)) *PromptDispatcher {
+	d := &PromptDispatcher{
+		queues:  make([]chan promptTask, max(workers, 1)),
+		onError: onError,
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan promptTask, queueSize)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+// work sends the prompts of a queue until it is closed.
+func (d *PromptDispatcher) work(queue <-chan promptTask) {
+	defer d.wg.Done()
+	for task := range queue {
+		err := task.send()
+		if err == nil && task.sent != nil {
+			// Run apart, as it may wait for the user's lock held by an update
+			// blocked on this very queue
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				d.report(task, task.sent())
+			}()
+		}
+		d.report(task, err)
+	}
+}
+
+// report passes the failure of task to the error hook.
+func (d *PromptDispatcher) report(task promptTask, err error) {
+	if err != nil && d.onError != nil {
+		d.onError(&PromptError{Key: task.key, State: task.state, Err: err})
+	}
+}
+
+// dispatch queues a prompt with the worker of its chat.
+func (d *PromptDispatcher) dispatch(task promptTask) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrDispatcherClosed
+	}
+	d.queues[uint64(task.key)%uint64(len(d.queues))] <- task
+	return nil
+}
+
+// Close stops accepting prompts and waits until the queued ones are sent.
+func (d *PromptDispatcher) Close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, queue := range d.queues {
+			close(queue)
+		}
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// SetPromptDispatcher makes the manager send prompts through the dispatcher
+// instead of on the update handling path. Users are marked as prompted once
+// their prompt is queued, failures are reported to the dispatcher's error
+// hook only. Prompts receive a copy of the user's data, so changes they make
+// to it are not persisted. The copy is shallow: maps, slices and pointers in
+// the data are shared with the handlers of the user's next updates, which may
+// run while the prompt is sent. Prompts must then only read them, and handlers
+// must replace them rather than modify them in place.
+func (m *StateManager[S, U]) SetPromptDispatcher(d *PromptDispatcher) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.dispatcher = d
+	return nil
+}
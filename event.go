@@ -0,0 +1,167 @@
+package tgstatemanager
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EventKind identifies what happened to a user's flow.
+type EventKind string
+
+const (
+	// EventFinished is emitted when a user finishes a flow.
+	EventFinished EventKind = "finished"
+	// EventValidationFailed is emitted when a state rejects an answer.
+	EventValidationFailed EventKind = "validation_failed"
+	// EventError is emitted when handling an update fails.
+	EventError EventKind = "error"
+	// EventTransition is emitted when a user moves from one state to another.
+	// State is empty when the user finished the flow.
+	EventTransition EventKind = "transition"
+	// EventStateExited is emitted along with EventTransition for the state the
+	// user left, given as State.
+	EventStateExited EventKind = "state_exited"
+	// EventStateEntered is emitted along with EventTransition for the state
+	// the user entered, unless the user finished the flow.
+	EventStateEntered EventKind = "state_entered"
+	// EventSessionExpired is emitted when the janitor or a retention policy
+	// deletes an inactive session. State is the state it was left in.
+	EventSessionExpired EventKind = "session_expired"
+	// EventPromptSent is emitted when the prompt of State was sent, whether on
+	// the update handling path, by a PromptDispatcher, a prompt retry or the
+	// outbox relay.
+	EventPromptSent EventKind = "prompt_sent"
+)
+
+// Event describes something that happened to a user's flow.
+type Event struct {
+	Kind     EventKind
+	Key      int64
+	Flow     string
+	State    string
+	From     string  // State the user left, for EventTransition and EventStateEntered
+	Failures int     // Consecutive validation failures, for EventValidationFailed
+	Err      error   // Cause of EventError
+	Outcome  Outcome // How the flow ended, for EventFinished
+	Source   Source  // How the user's session was started
+	Time     time.Time
+}
+
+// OnEvent registers a handler called synchronously for every emitted event.
+// Handlers must not block, as they run on the update handling path.
+func (m *StateManager[S, U]) OnEvent(fn func(event Event)) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.eventFuncs = append(m.eventFuncs, fn)
+	return nil
+}
+
+// emit stamps the event and passes it to the registered handlers.
+func (m *StateManager[S, U]) emit(event Event) {
+	if len(m.eventFuncs) == 0 {
+		return
+	}
+	event.Time = m.now()
+	for _, fn := range m.eventFuncs {
+		fn(event)
+	}
+}
+
+// Subscribe sends the events of the given kinds, or of every kind when none
+// is given, to ch. Events are dropped while ch is full, so a slow subscriber
+// never holds up update handling; give ch a buffer fitting its pace.
+func (m *StateManager[S, U]) Subscribe(ch chan<- Event, kinds ...EventKind) error {
+	return m.OnEvent(func(event Event) {
+		if len(kinds) > 0 && !slices.Contains(kinds, event.Kind) {
+			return
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	})
+}
+
+// moved emits the events of a user moving from one state to the state the
+// user is now in.
+func (m *StateManager[S, U]) moved(key int64, userState *UserState[S], from string) {
+	m.emit(Event{Kind: EventTransition, Key: key, Flow: userState.Flow, State: userState.CurrentState, From: from, Source: userState.Source})
+	if from != "" {
+		m.emit(Event{Kind: EventStateExited, Key: key, Flow: userState.Flow, State: from, Source: userState.Source})
+	}
+	if userState.CurrentState != "" {
+		m.emit(Event{Kind: EventStateEntered, Key: key, Flow: userState.Flow, State: userState.CurrentState, From: from, Source: userState.Source})
+	}
+}
+
+// AdminSink selects the events forwarded to an admin chat.
+type AdminSink struct {
+	ChatID      int64
+	Kinds       []EventKind // Forwarded event kinds, every kind but the transition and prompt ones when empty
+	MinFailures int         // Forward validation failures only from this many consecutive ones on
+}
+
+// AddAdminSink forwards the events selected by the sink to its admin chat as
+// formatted messages sent through the notifier. Delivery errors are dropped
+// so a broken admin chat never disrupts users' flows.
+func (m *StateManager[S, U]) AddAdminSink(sink AdminSink) error {
+	return m.OnEvent(func(event Event) {
+		if sink.accepts(event) {
+			_ = m.notify(sink.ChatID, FormatEvent(event))
+		}
+	})
+}
+
+// accepts reports whether the event is forwarded by the sink.
+func (s AdminSink) accepts(event Event) bool {
+	if len(s.Kinds) == 0 && (event.Kind == EventTransition || event.Kind == EventStateExited || event.Kind == EventStateEntered || event.Kind == EventPromptSent) {
+		return false
+	}
+	if len(s.Kinds) > 0 && !slices.Contains(s.Kinds, event.Kind) {
+		return false
+	}
+	return event.Kind != EventValidationFailed || event.Failures >= s.MinFailures
+}
+
+// FormatEvent renders an event as a human readable message that links to the
+// user it concerns.
+func FormatEvent(event Event) string {
+	var b strings.Builder
+	switch event.Kind {
+	case EventFinished:
+		b.WriteString("Flow finished")
+	case EventValidationFailed:
+		fmt.Fprintf(&b, "Answer rejected %d time(s) in a row", event.Failures)
+	case EventError:
+		b.WriteString("Update handling failed")
+	case EventTransition:
+		fmt.Fprintf(&b, "Moved from %s", event.From)
+	case EventSessionExpired:
+		b.WriteString("Session expired")
+	default:
+		b.WriteString(string(event.Kind))
+	}
+
+	fmt.Fprintf(&b, "\nUser: %d (tg://user?id=%d)", event.Key, event.Key)
+	if event.Flow != "" {
+		fmt.Fprintf(&b, "\nFlow: %s", event.Flow)
+	}
+	if event.State != "" {
+		fmt.Fprintf(&b, "\nState: %s", event.State)
+	}
+	if event.Outcome != "" {
+		fmt.Fprintf(&b, "\nOutcome: %s", event.Outcome)
+	}
+	if se, ok := event.Err.(*StateError); ok {
+		fmt.Fprintf(&b, "\nPhase: %s\nError: %v", se.Phase, se.Err)
+	} else if event.Err != nil {
+		fmt.Fprintf(&b, "\nError: %v", event.Err)
+	}
+	if !event.Time.IsZero() {
+		fmt.Fprintf(&b, "\nTime: %s", event.Time.Format(time.RFC3339))
+	}
+	return b.String()
+}
@@ -0,0 +1,224 @@
+package tgstatemanager_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+func TestStateManagerEvents(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+
+	var events []tgsm.Event
+	var prompts []string
+	sm.OnEvent(func(e tgsm.Event) {
+		if e.Kind == tgsm.EventPromptSent {
+			prompts = append(prompts, e.State)
+			return
+		}
+		events = append(events, e)
+	})
+
+	chatID := int64(21)
+	for _, input := range []string{"", "John", "abc", "-1", "30", "Canada"} {
+		_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: input})
+		require.NoError(t, err)
+	}
+
+	kinds := make([]tgsm.EventKind, len(events))
+	for i, e := range events {
+		kinds[i] = e.Kind
+	}
+	require.Equal(t, []tgsm.EventKind{
+		tgsm.EventTransition, // Entry of the new user
+		tgsm.EventStateEntered,
+		tgsm.EventTransition,
+		tgsm.EventStateExited,
+		tgsm.EventStateEntered,
+		tgsm.EventValidationFailed,
+		tgsm.EventValidationFailed,
+		tgsm.EventTransition,
+		tgsm.EventStateExited,
+		tgsm.EventStateEntered,
+		tgsm.EventTransition,
+		tgsm.EventStateExited,
+		tgsm.EventFinished,
+	}, kinds)
+	assert.Equal(t, []string{"ask_name", "ask_age", "ask_country"}, prompts)
+	assert.Empty(t, events[0].From)
+	assert.Equal(t, "ask_name", events[0].State)
+	assert.Equal(t, "ask_name", events[1].State)
+	events = events[2:]
+	assert.Equal(t, "ask_name", events[0].From)
+	assert.Equal(t, "ask_age", events[0].State)
+	assert.Equal(t, "ask_name", events[1].State)
+	assert.Equal(t, "ask_age", events[2].State)
+	assert.Equal(t, "ask_age", events[3].State)
+	assert.Equal(t, 1, events[3].Failures)
+	assert.Equal(t, 2, events[4].Failures)
+	assert.Equal(t, "ask_country", events[8].From)
+	assert.Empty(t, events[8].State)
+	assert.Equal(t, "ask_country", events[9].State)
+	assert.Equal(t, chatID, events[10].Key)
+	assert.False(t, events[10].Time.IsZero())
+}
+
+func TestStateManagerSubscribe(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+
+	entered := make(chan tgsm.Event, 10)
+	require.NoError(t, sm.Subscribe(entered, tgsm.EventStateEntered))
+	full := make(chan tgsm.Event) // Never read, so every event is dropped
+	require.NoError(t, sm.Subscribe(full))
+	expired := make(chan tgsm.Event, 10)
+	require.NoError(t, sm.Subscribe(expired, tgsm.EventSessionExpired))
+
+	for _, input := range []string{"", "John", "30"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: input})
+		require.NoError(t, err)
+	}
+	require.Len(t, entered, 3)
+	assert.Equal(t, "ask_name", (<-entered).State)
+	assert.Equal(t, "ask_age", (<-entered).State)
+	assert.Equal(t, "ask_country", (<-entered).State)
+
+	require.NoError(t, storage.Set(2, tgsm.UserState[UserProfile]{CurrentState: "ask_age", UpdatedAt: time.Now().Add(-time.Hour)}))
+	_, err := sm.Sweep(context.Background(), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	event := <-expired
+	assert.Equal(t, int64(2), event.Key)
+	assert.Equal(t, "ask_age", event.State)
+}
+
+func TestAdminSink(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+
+	var notified []string
+	sm.SetNotifier(func(chatID int64, msg any) error {
+		assert.Equal(t, int64(-42), chatID)
+		notified = append(notified, msg.(string))
+		return nil
+	})
+	sm.AddAdminSink(tgsm.AdminSink{
+		ChatID:      -42,
+		Kinds:       []tgsm.EventKind{tgsm.EventValidationFailed, tgsm.EventError},
+		MinFailures: 2,
+	})
+
+	failing := errors.New("backend down")
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:   "failing",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "", failing },
+	}))
+
+	chatID := int64(22)
+	for _, input := range []string{"", "John", "abc", "def", "30", "Canada"} {
+		_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: input})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, sm.SetState(chatID, "failing"))
+	_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: "x"})
+	assert.ErrorIs(t, err, failing)
+
+	require.Len(t, notified, 2)
+	assert.Contains(t, notified[0], "Answer rejected 2 time(s) in a row")
+	assert.Contains(t, notified[0], "tg://user?id=22")
+	assert.Contains(t, notified[0], "State: ask_age")
+	assert.Contains(t, notified[1], "State: failing\nPhase: handle\nError: backend down")
+}
+
+func TestStateManagerEntryEvents(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	require.NoError(t, sm.SetUnknownStateHandler(func(u MockUpdate, userState tgsm.UserState[UserProfile]) (string, error) {
+		return "ask_age", nil
+	}))
+	funnel := tgsm.NewFunnel("ask_name", "ask_age", "ask_country")
+	require.NoError(t, sm.OnEvent(funnel.AddEvent))
+	var entered []string
+	require.NoError(t, sm.OnEvent(func(e tgsm.Event) {
+		if e.Kind == tgsm.EventStateEntered {
+			entered = append(entered, fmt.Sprintf("%d %s>%s", e.Key, e.From, e.State))
+		}
+	}))
+
+	// A new user only prompted, one moved by SetState and one recovered from
+	// a removed state
+	_, err := sm.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+	require.NoError(t, err)
+	require.NoError(t, sm.SetState(2, "ask_country"))
+	require.NoError(t, storage.Set(3, tgsm.UserState[UserProfile]{CurrentState: "removed"}))
+	_, err = sm.Handle(MockUpdate{ChatID: 3, Text: "hi"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"1 >ask_name", "2 >ask_country", "3 removed>ask_age"}, entered)
+	users := make(map[string]int)
+	for _, step := range funnel.Report().Steps {
+		users[step.State] = step.Users
+	}
+	assert.Equal(t, map[string]int{"ask_name": 1, "ask_age": 1, "ask_country": 1}, users)
+}
+
+func TestFunnel(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	funnel := tgsm.NewFunnel("ask_name", "ask_age", "ask_country")
+	require.NoError(t, sm.OnEvent(funnel.AddEvent))
+	audit := &tgsm.MemoryAuditStorage{}
+	require.NoError(t, sm.SetAudit(audit, nil))
+
+	conversations := [][]string{
+		{"/start", "John", "30", "Japan"},
+		{"/start", "Jane", "31", "Chile"},
+		{"/start", "Anna", "abc", "32"},
+		{"/start", "Paul"},
+	}
+	for i, texts := range conversations {
+		for _, text := range texts {
+			_, err := sm.Handle(MockUpdate{ChatID: int64(i), Text: text})
+			require.NoError(t, err)
+		}
+	}
+
+	want := tgsm.FunnelReport{
+		Steps: []tgsm.FunnelStep{
+			{State: "ask_name", Users: 4, Conversion: 1, Overall: 1},
+			{State: "ask_age", Users: 4, Conversion: 1, Overall: 1},
+			{State: "ask_country", Users: 3, Conversion: 0.75, Overall: 0.75, DropOff: 1},
+		},
+		Completed:  2,
+		Conversion: 2.0 / 3,
+		Overall:    0.5,
+	}
+	assert.Equal(t, want, funnel.Report())
+
+	replayed := tgsm.NewFunnel("ask_name", "ask_age", "ask_country")
+	for i := range conversations {
+		entries, err := audit.Entries(context.Background(), int64(i))
+		require.NoError(t, err)
+		for _, entry := range entries {
+			replayed.AddEntry(entry)
+		}
+	}
+	assert.Equal(t, want, replayed.Report())
+
+	var b strings.Builder
+	require.NoError(t, want.WriteCSV(&b))
+	assert.Equal(t, "state,users,conversion,overall,drop_off\n"+
+		"ask_name,4,1.0000,1.0000,0\n"+
+		"ask_age,4,1.0000,1.0000,0\n"+
+		"ask_country,3,0.7500,0.7500,1\n"+
+		"completed,2,0.6667,0.5000,1\n", b.String())
+	b.Reset()
+	require.NoError(t, want.WriteJSON(&b))
+	assert.Contains(t, b.String(), `"Completed": 2`)
+}
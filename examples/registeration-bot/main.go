@@ -8,6 +8,7 @@ import (
 
 	"github.com/redis/go-redis/v9"
 	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/tgsmtele"
 	tele "gopkg.in/telebot.v4"
 )
 
@@ -20,18 +21,30 @@ type UserData struct {
 	CooperateType string
 }
 
+// profileTemplate renders the registration data collected for a user.
+const profileTemplate = `Profile:
+Name: {{.Data.FirstName}} {{.Data.LastName}}
+Skills: {{.Data.Skills}}
+Age: {{.Data.Age}}
+Cooperate Type: {{.Data.CooperateType}}`
+
 func main() {
 	// Initialize bot and Redis client
 	bot, stateStorage := initializeServices()
 
 	// Initialize state manager
 	stateManager := initializeStateManager(stateStorage)
+	adapter, err := tgsmtele.New(bot, stateManager)
+	if err != nil {
+		log.Fatalf("Failed to create adapter: %v", err)
+	}
 
 	// Register states
-	registerStates(stateManager, bot)
+	registerStates(stateManager, adapter)
 
 	// Register handlers
-	registerHandlers(bot, stateStorage, stateManager)
+	registerHandlers(bot, stateStorage, adapter)
+	stateManager.Freeze()
 
 	fmt.Println("Bot started successfully.")
 	bot.Start()
@@ -59,50 +72,51 @@ func initializeServices() (*tele.Bot, tgsm.StateStorage[UserData]) {
 
 // initializeStateManager creates and returns the state manager
 func initializeStateManager(storage tgsm.StateStorage[UserData]) *tgsm.StateManager[UserData, tele.Update] {
-	return tgsm.NewStateManager(storage, func(u tele.Update) int64 {
-		return u.Message.Chat.ID
-	})
+	sm := tgsm.NewStateManager(storage, tgsmtele.ChatID)
+	sm.SetKeyFunc(tgsmtele.Key)
+	return sm
 }
 
 // registerStates adds all states to the state manager
-func registerStates(stateManager *tgsm.StateManager[UserData, tele.Update], bot *tele.Bot) {
+func registerStates(stateManager *tgsm.StateManager[UserData, tele.Update], adapter *adapter) {
 	if err := stateManager.Add(
-		NewFirstNameState(bot),
-		NewLastNameState(bot),
-		NewSkillsState(bot),
-		NewAgeState(bot),
-		NewCooperateTypeState(bot),
+		NewFirstNameState(adapter),
+		NewLastNameState(adapter),
+		NewSkillsState(adapter),
+		NewAgeState(adapter),
+		NewCooperateTypeState(adapter),
 	); err != nil {
 		log.Fatalf("Failed to register states: %v", err)
 	}
 	stateManager.SetInitialState("first_name")
+	stateManager.SetInterceptor(tgsmtele.Commands())
+	stateManager.SetReentry(tgsm.Reentry[UserData, tele.Update]{
+		Policy:  tgsm.ReentryConfirm,
+		IsStart: tgsmtele.IsStart,
+		Confirm: "Send /start again to discard your answers and start over.",
+	})
+
+	// Summarize the registration once it is completed
+	summary, err := tgsm.NewTemplateRenderer[UserData]("Registration completed successfully!\n\n" + profileTemplate)
+	if err != nil {
+		log.Fatalf("Failed to parse summary template: %v", err)
+	}
+	stateManager.SetCompletionSummary(summary, true)
 }
 
 // registerHandlers sets up all bot command handlers
-func registerHandlers(bot *tele.Bot, stateStorage tgsm.StateStorage[UserData], stateManager *tgsm.StateManager[UserData, tele.Update]) {
+func registerHandlers(bot *tele.Bot, stateStorage tgsm.StateStorage[UserData], adapter *adapter) {
 	// Middleware for state handling
-	bot.Use(createStateMiddleware(stateManager))
+	bot.Use(adapter.Middleware())
 
 	// Command handlers
 	bot.Handle("/start", createStartHandler(stateStorage))
-	bot.Handle("/profile", createProfileHandler(stateStorage))
-	bot.Handle(tele.OnText, createDefaultHandler())
-}
-
-// createStateMiddleware returns middleware for state handling
-func createStateMiddleware(stateManager *tgsm.StateManager[UserData, tele.Update]) tele.MiddlewareFunc {
-	return func(next tele.HandlerFunc) tele.HandlerFunc {
-		return func(c tele.Context) error {
-			handled, err := stateManager.Handle(c.Update())
-			if err != nil {
-				return fmt.Errorf("state handling error: %w", err)
-			}
-			if handled {
-				return nil
-			}
-			return next(c)
-		}
+	profile, err := tgsm.NewTemplateRenderer[UserData](profileTemplate)
+	if err != nil {
+		log.Fatalf("Failed to parse profile template: %v", err)
 	}
+	bot.Handle("/profile", createProfileHandler(stateStorage, profile))
+	bot.Handle(tele.OnText, createDefaultHandler())
 }
 
 func createStartHandler(stateStorage tgsm.StateStorage[UserData]) tele.HandlerFunc {
@@ -120,7 +134,7 @@ func createStartHandler(stateStorage tgsm.StateStorage[UserData]) tele.HandlerFu
 }
 
 // createProfileHandler returns a handler for the /profile command
-func createProfileHandler(stateStorage tgsm.StateStorage[UserData]) tele.HandlerFunc {
+func createProfileHandler(stateStorage tgsm.StateStorage[UserData], renderer tgsm.Renderer[UserData]) tele.HandlerFunc {
 	return func(c tele.Context) error {
 		userState, exists, err := stateStorage.Get(c.Message().Chat.ID)
 		if err != nil {
@@ -130,14 +144,11 @@ func createProfileHandler(stateStorage tgsm.StateStorage[UserData]) tele.Handler
 			return c.Send("No profile data. Use /start to register.")
 		}
 
-		return c.Send(fmt.Sprintf(
-			"Profile:\nName: %s %s\nSkills: %s\nAge: %d\nCooperate Type: %s",
-			userState.Data.FirstName,
-			userState.Data.LastName,
-			userState.Data.Skills,
-			userState.Data.Age,
-			userState.Data.CooperateType,
-		))
+		profile, err := renderer.Render(userState)
+		if err != nil {
+			return fmt.Errorf("failed to render profile: %w", err)
+		}
+		return c.Send(profile)
 	}
 }
 
@@ -0,0 +1,65 @@
+package tgstatemanager
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// exportRecord is a line of an export.
+type exportRecord[S any] struct {
+	Key   int64
+	State UserState[S]
+}
+
+// Export writes every state stored in storage to w as JSON lines of the form
+// {"Key": ..., "State": {...}}, which Import reads back. It stops when ctx is
+// done.
+func Export[S any](ctx context.Context, storage IterableStorage[S], w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return storage.ForEach(ctx, func(key int64, userState UserState[S]) error {
+		return enc.Encode(exportRecord[S]{Key: key, State: userState})
+	})
+}
+
+// Import stores the states of an export read from r into storage, replacing
+// the stored states of the same users, and returns how many were stored. The
+// states are stored as they are, without being stamped as updated. A malformed
+// line stops the import, reporting its line number.
+func Import[S any](storage StateStorage[S], r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20) // States with large data
+	imported := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record exportRecord[S]
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return imported, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := storage.Set(record.Key, record.State); err != nil {
+			return imported, fmt.Errorf("line %d: %w", line, err)
+		}
+		imported++
+	}
+	return imported, scanner.Err()
+}
+
+// Export writes every stored state to w, as by the Export function. It
+// requires the storage to implement IterableStorage.
+func (m *StateManager[S, U]) Export(ctx context.Context, w io.Writer) error {
+	storage, ok := m.storage.(IterableStorage[S])
+	if !ok {
+		return ErrNotIterable
+	}
+	return Export(ctx, storage, w)
+}
+
+// Import stores the states of an export read from r, as by the Import
+// function, such as one taken from the previous storage of the bot.
+func (m *StateManager[S, U]) Import(r io.Reader) (int, error) {
+	return Import(m.storage, r)
+}
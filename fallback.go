@@ -0,0 +1,264 @@
+package tgstatemanager
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStateUnavailable is returned by FallbackStorage for states written before
+// an outage of its backend, which cannot be read until it recovers.
+var ErrStateUnavailable = errors.New("state unavailable while the storage backend is down")
+
+// FallbackStorage keeps conversations going through short outages of a
+// backend. After threshold consecutive backend failures it opens a circuit
+// breaker and serves from an in-memory store for openFor. Writes made in the
+// meantime are replayed to the backend once it is reachable again, unless
+// the backend holds a copy updated after them, as written by another instance
+// sharing the backend. The comparison relies on the UpdatedAt stamps of the
+// states and is not atomic with the replayed write, so replays may still
+// overwrite a state another instance writes at the same moment.
+//
+// While degraded, states written before the outage are unavailable: reading
+// them fails with ErrStateUnavailable rather than reporting them missing, so
+// their users are not started over. A state first written while degraded
+// without a prior read never replaces a backend copy when replayed.
+type FallbackStorage[S any] struct {
+	backend StateStorage[S]
+	memory  *InMemoryStorage[S]
+	breaker *Breaker
+
+	mu      sync.Mutex
+	pending map[int64]pendingWrite // Written to memory only
+	writes  uint64                 // Writes made to memory, numbering them
+	dirty   atomic.Bool            // Whether pending has entries
+
+	replaying sync.Mutex // Held while pending writes are replayed
+}
+
+// pendingWrite is a write made to memory while the backend was unavailable.
+type pendingWrite struct {
+	seq     uint64
+	deleted bool
+	fresh   bool          // The state was not held in memory before, so a backend copy wins
+	ttl     time.Duration // TTL the state was written with, if any
+	at      time.Time     // When the write was made
+}
+
+// NewFallbackStorage creates a storage falling back to memory after threshold
+// consecutive failures of backend, retrying it after openFor.
+func NewFallbackStorage[S any](backend StateStorage[S], threshold int, openFor time.Duration) *FallbackStorage[S] {
+	return &FallbackStorage[S]{
+		backend: backend,
+		memory:  NewInMemoryStorage[S](),
+		breaker: &Breaker{Threshold: threshold, OpenFor: openFor},
+		pending: make(map[int64]pendingWrite),
+	}
+}
+
+// Degraded reports whether the storage currently serves from memory.
+func (s *FallbackStorage[S]) Degraded() bool {
+	return !s.breaker.admits(time.Now())
+}
+
+// Get retrieves a user state from the backend, or from memory while degraded.
+func (s *FallbackStorage[S]) Get(id int64) (UserState[S], bool, error) {
+	if s.available() {
+		state, exists, err := s.backend.Get(id)
+		if !s.failed(err) {
+			return state, exists, err
+		}
+	}
+	states, err := s.remembered([]int64{id})
+	state, exists := states[id]
+	return state, exists, err
+}
+
+// Set stores a user state in the backend, or in memory while degraded.
+func (s *FallbackStorage[S]) Set(id int64, state UserState[S]) error {
+	return s.SetWithTTL(id, state, 0)
+}
+
+// SetWithTTL stores a user state with its own TTL in the backend, or in
+// memory while degraded.
+func (s *FallbackStorage[S]) SetWithTTL(id int64, state UserState[S], ttl time.Duration) error {
+	if s.available() {
+		if err := setWithTTL(s.backend, id, state, ttl); !s.failed(err) {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(id, ttl)
+	return s.memory.SetWithTTL(id, state, ttl)
+}
+
+// Delete removes a user state from the backend, or from memory while
+// degraded.
+func (s *FallbackStorage[S]) Delete(id int64) error {
+	if s.available() {
+		if err := deleteState(s.backend, id); !s.failed(err) {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	s.pending[id] = pendingWrite{seq: s.writes, deleted: true, at: time.Now()}
+	s.dirty.Store(true)
+	return s.memory.Delete(id)
+}
+
+// GetMany retrieves the user states for the given IDs from the backend, with
+// a single GetMany when it implements BatchStorage, or from memory while
+// degraded.
+func (s *FallbackStorage[S]) GetMany(ids []int64) (map[int64]UserState[S], error) {
+	if s.available() {
+		states, err := getMany(s.backend, ids)
+		if !s.failed(err) {
+			return states, err
+		}
+	}
+	return s.remembered(ids)
+}
+
+// SetMany stores the given user states in the backend, with a single SetMany
+// when it implements BatchStorage, or in memory while degraded.
+func (s *FallbackStorage[S]) SetMany(states map[int64]UserState[S]) error {
+	if s.available() {
+		if err := setMany(s.backend, states); !s.failed(err) {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range states {
+		s.record(id, 0)
+	}
+	return s.memory.SetMany(states)
+}
+
+// record records a write of the state of id with ttl made to memory. The
+// caller holds s.mu.
+func (s *FallbackStorage[S]) record(id int64, ttl time.Duration) {
+	previous, written := s.pending[id]
+	s.writes++
+	s.pending[id] = pendingWrite{
+		seq:   s.writes,
+		fresh: !written || !previous.deleted && previous.fresh,
+		ttl:   ttl,
+		at:    time.Now(),
+	}
+	s.dirty.Store(true)
+}
+
+// remembered returns the states of ids written to memory while degraded,
+// failing with ErrStateUnavailable for those neither written nor deleted
+// since the outage began, which only the backend knows.
+func (s *FallbackStorage[S]) remembered(ids []int64) (map[int64]UserState[S], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states, err := s.memory.GetMany(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, ok := s.pending[id]; !ok {
+			return nil, ErrStateUnavailable
+		}
+	}
+	return states, nil
+}
+
+// ForEach calls fn for every state of the backend, which must implement
+// IterableStorage. While degraded only the states written since the outage
+// began are walked. Failed walks are not retried from memory, as fn may have
+// seen some of the states already.
+func (s *FallbackStorage[S]) ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error {
+	if s.available() {
+		return forEach(ctx, s.backend, fn)
+	}
+	return s.memory.ForEach(ctx, fn)
+}
+
+// Ping verifies the connectivity of the backend when it implements
+// HealthChecker.
+func (s *FallbackStorage[S]) Ping(ctx context.Context) error {
+	if checker, ok := s.backend.(HealthChecker); ok {
+		return checker.Ping(ctx)
+	}
+	return nil
+}
+
+// available reports whether the backend may be used. Writes made while
+// degraded are replayed first, so the backend is not used before it has
+// caught up.
+func (s *FallbackStorage[S]) available() bool {
+	if !s.breaker.admits(time.Now()) {
+		return false
+	}
+	if !s.dirty.Load() {
+		return true
+	}
+
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+	s.mu.Lock()
+	pending := maps.Clone(s.pending)
+	s.mu.Unlock()
+	for id, write := range pending {
+		if err := s.replay(id, write); err != nil {
+			s.breaker.record(time.Now(), true)
+			return false
+		}
+		s.mu.Lock()
+		if s.pending[id] == write { // Not written again meanwhile
+			delete(s.pending, id)
+			_ = s.memory.Delete(id)
+		}
+		s.dirty.Store(len(s.pending) > 0)
+		s.mu.Unlock()
+	}
+	return true
+}
+
+// replay applies a write made while degraded to the backend, unless the
+// backend copy of the state was updated after it. A state written with a TTL
+// keeps what is left of it, and is not replayed once it expired.
+func (s *FallbackStorage[S]) replay(id int64, write pendingWrite) error {
+	current, exists, err := s.backend.Get(id)
+	if err != nil {
+		return err
+	}
+	if write.deleted {
+		if !exists || current.UpdatedAt.After(write.at) {
+			return nil
+		}
+		return deleteState(s.backend, id)
+	}
+	state, ok, _ := s.memory.Get(id)
+	if !ok || exists && (write.fresh || current.UpdatedAt.After(state.UpdatedAt)) {
+		return nil
+	}
+	if write.ttl <= 0 {
+		return s.backend.Set(id, state)
+	}
+	ttl := write.ttl - time.Since(write.at)
+	if ttl <= 0 {
+		return nil
+	}
+	return setWithTTL(s.backend, id, state, ttl)
+}
+
+// failed records the outcome of a backend operation and reports whether the
+// operation should fall back to memory, which is the case once the breaker
+// opens. Failures before that are returned to the caller.
+func (s *FallbackStorage[S]) failed(err error) bool {
+	return s.breaker.record(time.Now(), err != nil)
+}
@@ -0,0 +1,355 @@
+package tgstatemanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrFileLocked is returned by NewFileStorage for a log another storage has
+// open, such as that of a running bot.
+var ErrFileLocked = errors.New("file storage in use by another process")
+
+// FileStorage is a durable storage without external dependencies. States are
+// kept in memory and every change is appended to a log file, which is read
+// back on start. Compaction rewrites the log to hold only the current states.
+//
+// As states are kept in memory, a single storage may have the log open at a
+// time: it holds a lock on a file next to the log, named after it with a
+// .lock suffix, until it is closed. The lock is advisory and only taken on
+// Unix systems.
+type FileStorage[S any] struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	lock    *os.File
+	states  map[int64]UserState[S]
+	records int // Records in the log, compared with len(states) to judge compaction
+	sync    bool
+	codec   Codec[S]
+	failed  error // Set once a torn write could not be undone, failing later writes
+}
+
+// fileRecord is a line of the log.
+type fileRecord struct {
+	ID      int64           `json:"id"`
+	State   json.RawMessage `json:"state,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// NewFileStorage opens the log at path, creating it if needed, and loads the
+// states it holds. A record cut short by a crash at the end of the log is
+// discarded, as is one cut short by a failed write with the next record
+// appended to it. States are serialized by codec, such as Migrations upgrading
+// states logged by older versions of the state struct, or as plain JSON when
+// it is nil. It fails with ErrFileLocked while another storage has the log
+// open.
+func NewFileStorage[S any](path string, codec Codec[S]) (*FileStorage[S], error) {
+	if migrations, ok := codec.(*Migrations[S]); ok && migrations == nil {
+		codec = nil // A nil *Migrations is no codec, not a codec failing every call
+	}
+	s := &FileStorage[S]{
+		path:   path,
+		states: make(map[int64]UserState[S]),
+		codec:  codec,
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	if err := s.load(file); err != nil {
+		file.Close()
+		lock.Close()
+		return nil, err
+	}
+	s.file, s.lock = file, lock
+	return s, nil
+}
+
+// SetSync makes every write wait until the log has been flushed to disk.
+// Without it a crash of the machine may lose the latest writes.
+func (s *FileStorage[S]) SetSync(sync bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sync = sync
+}
+
+// load replays the log and positions the file for appending.
+func (s *FileStorage[S]) load(file *os.File) error {
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				// Torn final write, drop it
+				if err := file.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.apply(line); err != nil {
+			var syntax *json.SyntaxError
+			if rest, ok := gluedRecord(line); ok && errors.As(err, &syntax) {
+				err = s.apply(rest)
+			}
+			if err != nil {
+				return fmt.Errorf("%s at offset %d: %w", s.path, offset, err)
+			}
+		}
+		offset += int64(len(line))
+	}
+	_, err := file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// gluedRecord returns the record appended to a torn one on the same line.
+func gluedRecord(line []byte) ([]byte, bool) {
+	start := []byte(`{"id":`)
+	for i := 1; i < len(line); i++ {
+		next := bytes.Index(line[i:], start)
+		if next < 0 {
+			break
+		}
+		i += next
+		if json.Valid(line[i:]) {
+			return line[i:], true
+		}
+	}
+	return nil, false
+}
+
+// apply replays a log record.
+func (s *FileStorage[S]) apply(line []byte) error {
+	var rec fileRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	s.records++
+	if rec.Deleted {
+		delete(s.states, rec.ID)
+		return nil
+	}
+	state, err := s.decode(rec.State)
+	if err != nil {
+		return err
+	}
+	s.states[rec.ID] = state
+	return nil
+}
+
+// decode unmarshals a logged user state.
+func (s *FileStorage[S]) decode(data []byte) (UserState[S], error) {
+	if s.codec != nil {
+		return s.codec.Decode(data)
+	}
+	var state UserState[S]
+	err := json.Unmarshal(data, &state)
+	return state, err
+}
+
+// encode marshals a log record of a user state.
+func (s *FileStorage[S]) encode(id int64, state UserState[S]) ([]byte, error) {
+	var data []byte
+	var err error
+	if s.codec != nil {
+		data, err = s.codec.Encode(state)
+	} else {
+		data, err = json.Marshal(state)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fileRecord{ID: id, State: data})
+}
+
+// Get retrieves the user state for a given ID.
+func (s *FileStorage[S]) Get(id int64) (UserState[S], bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[id]
+	return state, ok, nil
+}
+
+// Set appends the user state to the log.
+func (s *FileStorage[S]) Set(id int64, state UserState[S]) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line, err := s.encode(id, state)
+	if err != nil {
+		return err
+	}
+	if err := s.append(line); err != nil {
+		return err
+	}
+	s.states[id] = state
+	return nil
+}
+
+// Delete appends the removal of the user state to the log.
+func (s *FileStorage[S]) Delete(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.states[id]; !ok {
+		return nil
+	}
+	line, err := json.Marshal(fileRecord{ID: id, Deleted: true})
+	if err != nil {
+		return err
+	}
+	if err := s.append(line); err != nil {
+		return err
+	}
+	delete(s.states, id)
+	return nil
+}
+
+// ForEach calls fn for every stored state. It walks a snapshot taken up
+// front, so fn may modify the storage.
+func (s *FileStorage[S]) ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error {
+	s.mu.Lock()
+	snapshot := make(map[int64]UserState[S], len(s.states))
+	for id, state := range s.states {
+		snapshot[id] = state
+	}
+	s.mu.Unlock()
+
+	for id, state := range snapshot {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append writes a record to the log. A failed write is truncated off the
+// log, so the next record is not appended to a torn one; when that fails too
+// the storage refuses further writes. The caller must hold the lock.
+func (s *FileStorage[S]) append(line []byte) error {
+	if s.failed != nil {
+		return s.failed
+	}
+	offset, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		if undo := s.truncate(offset); undo != nil {
+			s.failed = fmt.Errorf("%s: torn write at offset %d: %w", s.path, offset, undo)
+		}
+		return err
+	}
+	s.records++
+	if s.sync {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// truncate cuts the log back to offset and positions the file there.
+func (s *FileStorage[S]) truncate(offset int64) error {
+	if err := s.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Compact rewrites the log to hold a single record per stored state. The new
+// log is written next to the old one and atomically renamed over it.
+func (s *FileStorage[S]) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".compact-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+
+	w := bufio.NewWriter(tmp)
+	for id, state := range s.states {
+		line, err := s.encode(id, state)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	s.file.Close()
+	s.file = tmp
+	s.records = len(s.states)
+	s.failed = nil // The torn write is not part of the new log
+	return nil
+}
+
+// StartCompactor starts a goroutine compacting the log every interval until
+// ctx is done, skipping runs while the log holds fewer than twice as many
+// records as there are states. Failed compactions are retried on the next
+// run.
+func (s *FileStorage[S]) StartCompactor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				due := s.records >= 2*max(len(s.states), 1)
+				s.mu.Unlock()
+				if due {
+					_ = s.Compact()
+				}
+			}
+		}
+	}()
+}
+
+// Close closes the log and releases its lock. The storage must not be used
+// afterwards.
+func (s *FileStorage[S]) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Closing the lock file releases the lock
+	return errors.Join(s.file.Close(), s.lock.Close())
+}
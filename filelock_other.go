@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package tgstatemanager
+
+import "os"
+
+// lockFile does nothing on systems without flock.
+func lockFile(f *os.File) error {
+	return nil
+}
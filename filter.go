@@ -0,0 +1,25 @@
+package tgstatemanager
+
+// SetWrongInputReply sets the reply sent through the responder when a state's
+// Filter rejects an update, such as a photo sent where text is expected.
+// States may override it with their own WrongInput reply.
+func (m *StateManager[S, U]) SetWrongInputReply(reply any) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.wrongInput = reply
+	return nil
+}
+
+// accepts reports whether the state takes the update, replying with the wrong
+// input reply when it does not.
+func (m *StateManager[S, U]) accepts(update U, state *State[S, U]) (bool, error) {
+	if state.Filter == nil || state.Filter(update) {
+		return true, nil
+	}
+	reply := state.WrongInput
+	if reply == nil {
+		reply = m.wrongInput
+	}
+	return false, m.reply(update, reply)
+}
@@ -0,0 +1,61 @@
+package tgstatemanager
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	// ErrUnknownFlow is returned when a flow name is not registered with the manager.
+	ErrUnknownFlow = errors.New("unknown flow")
+	// ErrDuplicateFlow is returned when attempting to add a flow with a name that already exists.
+	ErrDuplicateFlow = errors.New("duplicate flow name")
+	// ErrEmptyFlowName is returned when attempting to add a flow with an empty name.
+	ErrEmptyFlowName = errors.New("empty flow name")
+)
+
+// AddFlow registers an independent named flow starting at initialState and
+// adds its states to the manager. State names are shared between flows, so
+// they must be unique across the whole manager. The initial state is one of
+// states or an already registered state; otherwise nothing is added. Users
+// outside of any named flow start at the state set by SetInitialState.
+func (m *StateManager[S, U]) AddFlow(name, initialState string, states ...*State[S, U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	if name == "" {
+		return ErrEmptyFlowName
+	}
+	if _, exists := m.flows[name]; exists {
+		return fmt.Errorf("%w: %s", ErrDuplicateFlow, name)
+	}
+	_, registered := m.states[initialState]
+	added := slices.ContainsFunc(states, func(state *State[S, U]) bool { return state.Name == initialState })
+	if !registered && !added {
+		return fmt.Errorf("%w: %s", ErrUnknownState, initialState)
+	}
+	if err := m.Add(states...); err != nil {
+		return err
+	}
+
+	m.flows[name] = initialState
+	return nil
+}
+
+// StartFlow begins the named flow for the user identified by key, discarding
+// any state and data of the flow the user was in. The initial state's prompt
+// is sent on the user's next update unless WithPrompt is given.
+func (m *StateManager[S, U]) StartFlow(key int64, flow string, opts ...SetStateOption[U]) error {
+	initialState, ok := m.flows[flow]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownFlow, flow)
+	}
+
+	unlock, err := m.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return m.jump(key, &UserState[S]{Flow: flow}, initialState, opts)
+}
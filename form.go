@@ -0,0 +1,181 @@
+package tgstatemanager
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrFormTag is returned when a form struct carries an invalid tgsm tag.
+var ErrFormTag = errors.New("invalid form tag")
+
+// FormField is a question parsed from the tgsm tag of a struct field.
+type FormField struct {
+	Index   int          // Index of the struct field
+	Type    reflect.Type // Type of the struct field
+	Name    string       // State name
+	Prompt  string
+	Invalid string
+	Min     *int64         // Lower bound of numbers or of the length of strings
+	Max     *int64         // Upper bound of numbers or of the length of strings
+	Layout  string         // time.Parse layout of time.Time fields
+	Options []string       // Allowed answers of string fields
+	Pattern *regexp.Regexp // Regexp string answers must match
+}
+
+// FormFields parses the tgsm tags of the fields of S and returns the
+// questions they describe in field order. Bot adapters build form states from
+// them, such as the Form of package tgsmtele, whose documentation lists the
+// tag options.
+func FormFields[S any]() ([]FormField, error) {
+	t := reflect.TypeFor[S]()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%w: %s is not a struct", ErrFormTag, t)
+	}
+
+	var fields []FormField
+	for i := range t.NumField() {
+		tag, ok := t.Field(i).Tag.Lookup("tgsm")
+		if !ok {
+			continue
+		}
+		field, err := parseFormTag(t.Field(i), tag)
+		if err != nil {
+			return nil, fmt.Errorf("%w: field %s: %v", ErrFormTag, t.Field(i).Name, err)
+		}
+		field.Index = i
+		field.Type = t.Field(i).Type
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// InRange reports whether n is within the bounds of the field.
+func (f FormField) InRange(n int64) bool {
+	return (f.Min == nil || n >= *f.Min) && (f.Max == nil || n <= *f.Max)
+}
+
+// parseFormTag parses the tgsm tag of a form field.
+func parseFormTag(sf reflect.StructField, tag string) (FormField, error) {
+	field := FormField{Name: sf.Name, Layout: time.DateOnly}
+
+	opts := map[string]string{}
+	var last string
+	for tag != "" {
+		var part string
+		part, tag, _ = strings.Cut(tag, ",")
+		key, value, ok := strings.Cut(part, "=")
+		switch {
+		case ok && key == "pattern":
+			if tag != "" {
+				value += "," + tag
+			}
+			opts[key], tag = value, ""
+		case ok && isFormOption(key):
+			opts[key], last = value, key
+		case last != "":
+			opts[last] += "," + part
+		default:
+			return field, fmt.Errorf("unknown option %q", part)
+		}
+	}
+
+	isTime := sf.Type == reflect.TypeFor[time.Time]()
+	isString := sf.Type.Kind() == reflect.String
+	isInt := reflect.Int <= sf.Type.Kind() && sf.Type.Kind() <= reflect.Int64
+	if !isTime && !isString && !isInt {
+		return field, fmt.Errorf("unsupported type %s", sf.Type)
+	}
+
+	for key, value := range opts {
+		switch key {
+		case "name":
+			field.Name = value
+		case "prompt":
+			field.Prompt = value
+		case "invalid":
+			field.Invalid = value
+		case "min", "max":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || isTime {
+				return field, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "min" {
+				field.Min = &n
+			} else {
+				field.Max = &n
+			}
+		case "layout":
+			if !isTime {
+				return field, fmt.Errorf("layout on %s field", sf.Type)
+			}
+			field.Layout = value
+		case "options":
+			if !isString {
+				return field, fmt.Errorf("options on %s field", sf.Type)
+			}
+			field.Options = strings.Split(value, "|")
+		case "pattern":
+			if !isString {
+				return field, fmt.Errorf("pattern on %s field", sf.Type)
+			}
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return field, err
+			}
+			field.Pattern = re
+		}
+	}
+
+	if field.Prompt == "" {
+		field.Prompt = "Please enter " + sf.Name + "."
+	}
+	if field.Invalid == "" {
+		field.Invalid = field.describe(isInt, isTime)
+	}
+	return field, nil
+}
+
+// isFormOption reports whether key names a form tag option.
+func isFormOption(key string) bool {
+	switch key {
+	case "name", "prompt", "invalid", "min", "max", "layout", "options", "pattern":
+		return true
+	}
+	return false
+}
+
+// describe returns the default reply to an answer the field rejects.
+func (f FormField) describe(isInt, isTime bool) string {
+	switch {
+	case isTime:
+		return "Invalid date. Please use the format " + f.Layout + "."
+	case len(f.Options) > 0:
+		return "Invalid selection. Please choose one of: " + strings.Join(f.Options, ", ") + "."
+	}
+
+	if isInt {
+		switch {
+		case f.Min != nil && f.Max != nil:
+			return fmt.Sprintf("Invalid answer. Please enter a number between %d and %d.", *f.Min, *f.Max)
+		case f.Min != nil:
+			return fmt.Sprintf("Invalid answer. Please enter a number of at least %d.", *f.Min)
+		case f.Max != nil:
+			return fmt.Sprintf("Invalid answer. Please enter a number of at most %d.", *f.Max)
+		}
+		return "Invalid answer. Please enter a number."
+	}
+	switch {
+	case f.Min != nil && f.Max != nil:
+		return fmt.Sprintf("Invalid answer. Please use %d-%d characters.", *f.Min, *f.Max)
+	case f.Min != nil:
+		return fmt.Sprintf("Invalid answer. Please use at least %d characters.", *f.Min)
+	case f.Max != nil:
+		return fmt.Sprintf("Invalid answer. Please use at most %d characters.", *f.Max)
+	}
+	return "Invalid answer. Please try again."
+}
@@ -0,0 +1,19 @@
+package tgstatemanager
+
+import "errors"
+
+// ErrFrozen is returned when configuring a manager after Freeze.
+var ErrFrozen = errors.New("state manager is frozen")
+
+// Freeze ends the setup of the manager. Afterwards adding states and flows
+// and every configuration setter fail with ErrFrozen, so the configuration
+// read while handling updates can no longer change under concurrent
+// handlers. Call it once setup is complete, before serving updates.
+func (m *StateManager[S, U]) Freeze() {
+	m.frozen.Store(true)
+}
+
+// Frozen reports whether Freeze has been called.
+func (m *StateManager[S, U]) Frozen() bool {
+	return m.frozen.Load()
+}
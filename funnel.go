@@ -0,0 +1,143 @@
+package tgstatemanager
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Funnel measures how far users get through a flow: how many reached each of
+// its states, in order, and how many completed it. Feed it the entries of an
+// audit log with AddEntry, or live events by registering AddEvent with
+// OnEvent. Users are counted once per state however often they visit it;
+// neither source records users who never answered the first state, so they
+// are missing from the first step. A Funnel is safe for concurrent use.
+type Funnel struct {
+	steps []string
+
+	mu        sync.Mutex
+	reached   map[string]map[int64]struct{}
+	completed map[int64]struct{}
+}
+
+// FunnelStep is a state of a funnel report.
+type FunnelStep struct {
+	State      string
+	Users      int     // Users who reached the state
+	Conversion float64 // Share of the users of the previous step who reached the state
+	Overall    float64 // Share of the users of the first step who reached the state
+	DropOff    int     // Users of the previous step who did not reach the state
+}
+
+// FunnelReport is the outcome of a funnel, ready to be written as JSON or CSV.
+type FunnelReport struct {
+	Steps      []FunnelStep
+	Completed  int     // Users who completed the flow
+	Conversion float64 // Share of the users of the last step who completed the flow
+	Overall    float64 // Share of the users of the first step who completed the flow
+}
+
+// NewFunnel creates a funnel over the given states of a flow, in the order
+// users go through them.
+func NewFunnel(steps ...string) *Funnel {
+	reached := make(map[string]map[int64]struct{}, len(steps))
+	for _, step := range steps {
+		reached[step] = make(map[int64]struct{})
+	}
+	return &Funnel{steps: steps, reached: reached, completed: make(map[int64]struct{})}
+}
+
+// AddEntry counts an audit log entry: the user reached both states it moved
+// between, and completed the flow when it ended with OutcomeCompleted.
+func (f *Funnel) AddEntry(entry AuditEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reach(entry.Key, entry.From)
+	f.reach(entry.Key, entry.To)
+	if entry.To == "" && entry.Outcome == OutcomeCompleted {
+		f.completed[entry.Key] = struct{}{}
+	}
+}
+
+// AddEvent counts an event: transitions and entered states mark the states
+// the user reached, finished events with OutcomeCompleted the completion of
+// the flow. Other events are ignored.
+func (f *Funnel) AddEvent(event Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch event.Kind {
+	case EventTransition, EventStateEntered:
+		f.reach(event.Key, event.From)
+		f.reach(event.Key, event.State)
+	case EventFinished:
+		if event.Outcome == OutcomeCompleted {
+			f.completed[event.Key] = struct{}{}
+		}
+	}
+}
+
+// reach records that the user reached the state, when it is a step of the
+// funnel. The caller must hold the lock.
+func (f *Funnel) reach(key int64, state string) {
+	if users, ok := f.reached[state]; ok {
+		users[key] = struct{}{}
+	}
+}
+
+// Report computes the conversion between consecutive steps.
+func (f *Funnel) Report() FunnelReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var report FunnelReport
+	first, previous := 0, 0
+	for i, state := range f.steps {
+		step := FunnelStep{State: state, Users: len(f.reached[state])}
+		if i == 0 {
+			first, previous = step.Users, step.Users
+		}
+		step.Conversion = ratio(step.Users, previous)
+		step.Overall = ratio(step.Users, first)
+		step.DropOff = max(previous-step.Users, 0)
+		report.Steps = append(report.Steps, step)
+		previous = step.Users
+	}
+	report.Completed = len(f.completed)
+	report.Conversion = ratio(report.Completed, previous)
+	report.Overall = ratio(report.Completed, first)
+	return report
+}
+
+// ratio returns n/of, or zero when of is zero.
+func ratio(n, of int) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) / float64(of)
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r FunnelReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes the report as CSV with a header row, a row per step and a
+// final row for the completed flows, whose state column reads "completed".
+func (r FunnelReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	format := func(f float64) string { return strconv.FormatFloat(f, 'f', 4, 64) }
+	rows := [][]string{{"state", "users", "conversion", "overall", "drop_off"}}
+	previous := 0
+	for _, step := range r.Steps {
+		rows = append(rows, []string{step.State, strconv.Itoa(step.Users), format(step.Conversion), format(step.Overall), strconv.Itoa(step.DropOff)})
+		previous = step.Users
+	}
+	rows = append(rows, []string{"completed", strconv.Itoa(r.Completed), format(r.Conversion), format(r.Overall), strconv.Itoa(max(previous-r.Completed, 0))})
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
@@ -0,0 +1,65 @@
+package tgstatemanager
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDenied is returned by the Guard of a state refusing to let the user in.
+var ErrDenied = errors.New("entry denied")
+
+// DeniedError refuses a user entry into a state like ErrDenied, with a reply
+// telling them why.
+type DeniedError struct {
+	Reply any // Sent to the update's chat through the responder
+}
+
+// DenyEntry returns a DeniedError replying reply to the user.
+func DenyEntry(reply any) error {
+	return &DeniedError{Reply: reply}
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrDenied, e.Reply)
+}
+
+func (e *DeniedError) Unwrap() error {
+	return ErrDenied
+}
+
+// SetOnDenied sets the hook called whenever the Guard of a state denies a
+// user entry, such as to keep an audit trail of refused access. It is given
+// the user state as the update's handler left it, with the changes made to
+// Data and History although they are not saved, and the name of the guarded
+// state. Guards only see moves made by updates and by SetState or StartFlow
+// with WithPrompt; other SetState and StartFlow calls and the recovery from
+// an unknown state enter the state without running its Guard.
+func (m *StateManager[S, U]) SetOnDenied(fn func(update U, userState UserState[S], state string, err error)) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.onDenied = fn
+	return nil
+}
+
+// guard runs the Guard of state, reporting whether the user was kept out.
+// Denials are replied to and passed to the OnDenied hook; other guard errors
+// are returned.
+func (m *StateManager[S, U]) guard(update U, userState *UserState[S], state *State[S, U], key int64) (bool, error) {
+	data := userState.Data
+	err := state.Guard(update, &data)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, ErrDenied) {
+		return true, stateError(err, key, state.Name, PhaseHandle)
+	}
+	if m.onDenied != nil {
+		m.onDenied(update, *userState, state.Name, err)
+	}
+	var denied *DeniedError
+	if errors.As(err, &denied) {
+		return true, m.reply(update, denied.Reply)
+	}
+	return true, nil
+}
@@ -0,0 +1,18 @@
+package tgstatemanager
+
+import "context"
+
+// HealthChecker is implemented by storages able to verify their connectivity.
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+}
+
+// Health verifies that the manager's storage is reachable, suitable for
+// readiness probes. Storages not implementing HealthChecker are assumed to be
+// healthy.
+func (m *StateManager[S, U]) Health(ctx context.Context) error {
+	if checker, ok := m.storage.(HealthChecker); ok {
+		return checker.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+// Package httpauth authenticates the HTTP surfaces of tg-state-manager: bearer
+// tokens and HMAC request signatures backed by a rotating keyring, and IP
+// allowlists.
+package httpauth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+const (
+	// TimestampHeader carries the Unix time a request was signed at.
+	TimestampHeader = "X-Signature-Timestamp"
+	// SignatureHeader carries the HMAC-SHA256 signature of a request.
+	SignatureHeader = "X-Signature"
+	// MaxSignedBody is the size of the largest body RequireSignature reads.
+	MaxSignedBody = 1 << 20
+)
+
+// ErrNoKeys is returned when signing with a keyring holding no valid key.
+var ErrNoKeys = errors.New("keyring has no valid key")
+
+// Keyring holds the secrets tokens and signatures are checked against. The
+// newest secret is used for signing, while secrets it replaced stay valid for
+// the overlap window given when rotating, so clients can switch over without
+// downtime. A Keyring is safe for concurrent use.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys []key // Newest first
+	now  func() time.Time
+}
+
+// key is a secret of a keyring.
+type key struct {
+	secret    []byte
+	expiresAt time.Time // Zero for the current key
+}
+
+// NewKeyring creates a keyring holding secret.
+func NewKeyring(secret []byte) *Keyring {
+	return &Keyring{keys: []key{{secret: secret}}, now: time.Now}
+}
+
+// SetClock sets the function the keyring reads the current time from.
+func (k *Keyring) SetClock(now func() time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.now = now
+}
+
+// clock returns the current time.
+func (k *Keyring) clock() time.Time {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.now()
+}
+
+// Rotate makes secret the current secret. The secrets it replaces stay valid
+// for overlap, or until their own overlap ends if that is sooner.
+func (k *Keyring) Rotate(secret []byte, overlap time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	expiresAt := k.now().Add(overlap)
+	keys := []key{{secret: secret}}
+	for _, old := range k.keys {
+		if old.expiresAt.IsZero() || old.expiresAt.After(expiresAt) {
+			old.expiresAt = expiresAt
+		}
+		keys = append(keys, old)
+	}
+	k.keys = keys
+}
+
+// secrets returns the secrets currently valid, newest first.
+func (k *Keyring) secrets() [][]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := k.now()
+	var secrets [][]byte
+	for _, key := range k.keys {
+		if key.expiresAt.IsZero() || now.Before(key.expiresAt) {
+			secrets = append(secrets, key.secret)
+		}
+	}
+	return secrets
+}
+
+// VerifyToken reports whether token equals any valid secret.
+func (k *Keyring) VerifyToken(token string) bool {
+	valid := false
+	for _, secret := range k.secrets() {
+		if subtle.ConstantTimeCompare([]byte(token), secret) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// Sign returns the signature of a request with method to uri, the path and
+// query of its URL, carrying body and sent at the given time, made with the
+// current secret.
+func (k *Keyring) Sign(at time.Time, method, uri string, body []byte) (string, error) {
+	secrets := k.secrets()
+	if len(secrets) == 0 {
+		return "", ErrNoKeys
+	}
+	return tgsm.HashSecret(signedPayload(at.Unix(), method, uri, body), secrets[0]), nil
+}
+
+// VerifySignature reports whether signature was made by any valid secret for
+// a request with method to uri carrying body, sent at the Unix time
+// timestamp no further than tolerance from now.
+func (k *Keyring) VerifySignature(timestamp, signature, method, uri string, body []byte, tolerance time.Duration) bool {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := k.clock().Sub(time.Unix(unix, 0))
+	if skew > tolerance || skew < -tolerance {
+		return false
+	}
+
+	for _, secret := range k.secrets() {
+		if tgsm.VerifySecret(signedPayload(unix, method, uri, body), secret, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignRequest signs an outgoing request carrying body with the current
+// secret, setting the timestamp and signature headers. The signature covers
+// the method and the path and query of the URL, so it cannot be replayed
+// against another endpoint.
+func (k *Keyring) SignRequest(r *http.Request, body []byte) error {
+	now := k.clock()
+	signature, err := k.Sign(now, r.Method, r.URL.RequestURI(), body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	r.Header.Set(SignatureHeader, signature)
+	return nil
+}
+
+// RequireToken returns middleware rejecting requests without an
+// "Authorization: Bearer" header carrying a valid secret.
+func (k *Keyring) RequireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !k.VerifyToken(token) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireSignature returns middleware rejecting requests whose method, URL
+// path and query and body are not signed by a valid secret within tolerance of the current time. The body is
+// restored for the next handler. Bodies larger than MaxSignedBody are
+// rejected before being verified.
+func (k *Keyring) RequireSignature(tolerance time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxSignedBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if !k.VerifySignature(r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader), r.Method, r.URL.RequestURI(), body, tolerance) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// signedPayload returns the string signed for a request with method to uri
+// carrying body, sent at the Unix time.
+func signedPayload(unix int64, method, uri string, body []byte) string {
+	return strconv.FormatInt(unix, 10) + "." + method + " " + uri + "." + string(body)
+}
+
+// Allowlist is a set of IP ranges allowed to reach an HTTP surface.
+type Allowlist struct {
+	prefixes []netip.Prefix
+}
+
+// ParseAllowlist parses IP addresses and CIDR ranges into an allowlist.
+func ParseAllowlist(entries ...string) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowlist entry %q: %w", entry, err)
+			}
+			a.prefixes = append(a.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist entry %q: %w", entry, err)
+		}
+		a.prefixes = append(a.prefixes, prefix.Masked())
+	}
+	return a, nil
+}
+
+// Allows reports whether addr is within any range of the allowlist.
+func (a *Allowlist) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Require returns middleware rejecting requests from addresses outside the
+// allowlist. The address is taken from the connection, so deployments
+// behind a proxy must restore it before this middleware runs.
+func (a *Allowlist) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil || !a.Allows(addr) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,93 @@
+package httpauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/sudosz/tg-state-manager/httpauth"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestKeyringRotation(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	ring := httpauth.NewKeyring([]byte("old"))
+	ring.SetClock(func() time.Time { return now })
+	handler := ring.RequireToken(ok)
+
+	status := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	ring.Rotate([]byte("new"), time.Hour)
+	assert.Equal(t, http.StatusOK, status("old"), "replaced secrets stay valid during the overlap")
+	assert.Equal(t, http.StatusOK, status("new"))
+
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, http.StatusUnauthorized, status("old"))
+	assert.Equal(t, http.StatusOK, status("new"))
+}
+
+func TestRequireSignature(t *testing.T) {
+	ring := httpauth.NewKeyring([]byte("secret"))
+	handler := ring.RequireSignature(time.Minute, ok)
+
+	send := func(body string, sign bool) int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if sign {
+			require.NoError(t, ring.SignRequest(r, []byte(body)))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	replay := func(method, target string) int {
+		signed := httptest.NewRequest(http.MethodGet, "/sessions?limit=5", nil)
+		require.NoError(t, ring.SignRequest(signed, nil))
+		r := httptest.NewRequest(method, target, nil)
+		r.Header = signed.Header
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, replay(http.MethodGet, "/sessions?limit=5"))
+	assert.Equal(t, http.StatusUnauthorized, replay(http.MethodDelete, "/sessions/1"), "signatures are bound to their endpoint")
+	assert.Equal(t, http.StatusUnauthorized, replay(http.MethodGet, "/sessions?limit=500"))
+	assert.Equal(t, http.StatusOK, send(`{"key":1}`, true))
+	assert.Equal(t, http.StatusUnauthorized, send(`{"key":1}`, false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(strings.Repeat("x", httpauth.MaxSignedBody+1), true))
+
+	signature, err := ring.Sign(time.Now().Add(-time.Hour), http.MethodGet, "/", nil)
+	require.NoError(t, err)
+	assert.False(t, ring.VerifySignature("0", signature, http.MethodGet, "/", nil, time.Minute), "stale signatures are rejected")
+}
+
+func TestAllowlist(t *testing.T) {
+	list, err := httpauth.ParseAllowlist("10.0.0.0/8", "2001:db8::1")
+	require.NoError(t, err)
+	handler := list.Require(ok)
+
+	for addr, want := range map[string]int{
+		"10.1.2.3:4000":      http.StatusOK,
+		"[2001:db8::1]:4000": http.StatusOK,
+		"192.168.0.1:4000":   http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, want, w.Code, addr)
+	}
+
+	_, err = httpauth.ParseAllowlist("not an ip")
+	assert.Error(t, err)
+}
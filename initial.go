@@ -0,0 +1,55 @@
+package tgstatemanager
+
+import "fmt"
+
+// InitialStateFunc picks where a new user starts from their first update,
+// such as by the parameter of a deep link, the chat type or a referral
+// payload. It returns the name of a state, or of a named flow to start at its
+// initial state, along with the initial data. An empty name starts the user
+// at the state set by SetInitialState, or in the flow of their chat policy.
+type InitialStateFunc[S, U any] func(update U) (string, S, error)
+
+// SetInitialStateFunc sets the function picking where new users start,
+// taking precedence over SetInitialState. It also decides where users of the
+// default flow start over, when restarting or reset by an
+// UnknownStateHandler.
+func (m *StateManager[S, U]) SetInitialStateFunc(fn InitialStateFunc[S, U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.initialFunc = fn
+	return nil
+}
+
+// initial resolves the flow and state a user starts in, and their initial
+// data.
+func (m *StateManager[S, U]) initial(update U) (flow, state string, data S, err error) {
+	if m.initialFunc == nil {
+		flow, state = m.defaultInitial(update)
+		return flow, state, data, nil
+	}
+	name, data, err := m.initialFunc(update)
+	if err != nil {
+		return "", "", data, err
+	}
+	if _, ok := m.states[name]; ok {
+		return "", name, data, nil
+	}
+	if initialState, ok := m.flows[name]; ok {
+		return name, initialState, data, nil
+	}
+	if name == "" {
+		flow, state = m.defaultInitial(update)
+		return flow, state, data, nil
+	}
+	return "", "", data, fmt.Errorf("%w: %s", ErrUnknownState, name)
+}
+
+// defaultInitial returns the flow of the chat policy of the update, if any,
+// and otherwise the initial state.
+func (m *StateManager[S, U]) defaultInitial(update U) (flow, state string) {
+	if flow := m.chatPolicy(update).Flow; flow != "" {
+		return flow, m.flows[flow]
+	}
+	return "", m.initialState
+}
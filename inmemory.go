@@ -1,32 +1,330 @@
 package tgstatemanager
 
-import "sync"
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
 
 // InMemoryStorage provides a thread-safe in-memory storage for user states.
 type InMemoryStorage[S any] struct {
-	states map[int64]UserState[S]
-	mu     sync.RWMutex
+	states   map[int64]memoryEntry[S]
+	mu       sync.RWMutex
+	ttl      time.Duration
+	jitter   time.Duration
+	random   Random
+	onExpire func(id int64, state UserState[S])
+	now      func() time.Time
+	writes   uint64 // Sets and deletes made, to skip unchanged snapshots
+	saved    uint64 // Value of writes when the last snapshot was taken
+
+	capacity int
+	policy   EvictionPolicy
+	onEvict  func(id int64, state UserState[S])
+	orderMu  sync.Mutex              // Guards order, which Get updates under the read lock
+	order    *list.List              // IDs from the next to evict to the last, nil without a capacity
+	elements map[int64]*list.Element // Elements of order by ID
+}
+
+// EvictionPolicy chooses the state a full InMemoryStorage evicts to make room
+// for a new one.
+type EvictionPolicy int
+
+const (
+	EvictLRU    EvictionPolicy = iota // The least recently read or stored state
+	EvictOldest                       // The least recently stored state
+)
+
+// memoryEntry is a stored user state with its expiry time.
+type memoryEntry[S any] struct {
+	state     UserState[S]
+	expiresAt time.Time // Zero when the state never expires
+}
+
+// expired reports whether the entry has expired at now.
+func (e memoryEntry[S]) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
 }
 
 // NewInMemoryStorage creates a new in-memory storage instance.
 func NewInMemoryStorage[S any]() *InMemoryStorage[S] {
 	return &InMemoryStorage[S]{
-		states: make(map[int64]UserState[S]),
+		states: make(map[int64]memoryEntry[S]),
+		now:    time.Now,
 	}
 }
 
+// SetTTL makes states expire ttl after they were last stored, extended by a
+// random duration of up to jitter to spread the expiry of states stored in a
+// burst. Expired states are no longer returned by Get and are removed by the
+// sweeper. A zero ttl disables expiry.
+func (s *InMemoryStorage[S]) SetTTL(ttl, jitter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+	s.jitter = jitter
+}
+
+// SetRandom sets the source TTL jitter is drawn from, the global source of
+// math/rand/v2 by default.
+func (s *InMemoryStorage[S]) SetRandom(r Random) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.random = r
+}
+
+// SetOnExpire sets the callback receiving the states removed by the sweeper.
+func (s *InMemoryStorage[S]) SetOnExpire(fn func(id int64, state UserState[S])) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onExpire = fn
+}
+
+// SetCapacity bounds the storage to capacity states. Storing a new state in a
+// full storage evicts one chosen by policy, which is passed to the callback
+// set by SetOnEvict. A zero capacity removes the bound.
+func (s *InMemoryStorage[S]) SetCapacity(capacity int, policy EvictionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+	s.capacity = capacity
+	s.policy = policy
+	s.order, s.elements = nil, nil
+	if capacity <= 0 {
+		return
+	}
+	s.order = list.New()
+	s.elements = make(map[int64]*list.Element, len(s.states))
+	for id := range s.states {
+		s.elements[id] = s.order.PushBack(id)
+	}
+}
+
+// SetOnEvict sets the callback receiving the states evicted to respect the
+// capacity of the storage.
+func (s *InMemoryStorage[S]) SetOnEvict(fn func(id int64, state UserState[S])) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onEvict = fn
+}
+
+// SetClock sets the function the storage reads the current time from when
+// computing expiry, time.Now by default.
+func (s *InMemoryStorage[S]) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
 // Get retrieves the user state for a given ID.
 func (s *InMemoryStorage[S]) Get(id int64) (UserState[S], bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	state, ok := s.states[id]
-	return state, ok, nil
+	entry, ok := s.states[id]
+	if !ok || entry.expired(s.now()) {
+		return UserState[S]{}, false, nil
+	}
+	s.used(id)
+	return entry.state.detached(), true, nil
 }
 
-// Set stores the user state for a given ID.
+// Set stores the user state for a given ID, evicting another one when the
+// storage is full.
 func (s *InMemoryStorage[S]) Set(id int64, userState UserState[S]) error {
+	return s.SetWithTTL(id, userState, 0)
+}
+
+// SetWithTTL stores the user state for a given ID expiring ttl after now, or
+// after the storage's TTL when ttl is zero.
+func (s *InMemoryStorage[S]) SetWithTTL(id int64, userState UserState[S], ttl time.Duration) error {
+	s.mu.Lock()
+	entry := memoryEntry[S]{state: userState.detached()}
+	if ttl <= 0 {
+		ttl = s.ttl
+	}
+	if ttl > 0 {
+		entry.expiresAt = s.now().Add(jittered(s.random, ttl, s.jitter))
+	}
+	s.states[id] = entry
+	s.writes++
+	evicted := s.evict(id)
+	onEvict := s.onEvict
+	s.mu.Unlock()
+
+	if onEvict != nil {
+		for evictedID, state := range evicted {
+			onEvict(evictedID, state)
+		}
+	}
+	return nil
+}
+
+// evict records the storing of id and removes the states over capacity,
+// returning them. The caller must hold the write lock.
+func (s *InMemoryStorage[S]) evict(id int64) map[int64]UserState[S] {
+	if s.order == nil {
+		return nil
+	}
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+	if element, ok := s.elements[id]; ok {
+		s.order.MoveToBack(element)
+	} else {
+		s.elements[id] = s.order.PushBack(id)
+	}
+
+	var evicted map[int64]UserState[S]
+	for len(s.states) > s.capacity {
+		victim := s.order.Remove(s.order.Front()).(int64)
+		delete(s.elements, victim)
+		if evicted == nil {
+			evicted = make(map[int64]UserState[S])
+		}
+		evicted[victim] = s.states[victim].state
+		delete(s.states, victim)
+	}
+	return evicted
+}
+
+// used records the reading of id for the LRU policy.
+func (s *InMemoryStorage[S]) used(id int64) {
+	if s.order == nil || s.policy != EvictLRU {
+		return
+	}
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+	if element, ok := s.elements[id]; ok {
+		s.order.MoveToBack(element)
+	}
+}
+
+// forget removes id from the eviction order. The caller must hold the write
+// lock.
+func (s *InMemoryStorage[S]) forget(id int64) {
+	if s.order == nil {
+		return
+	}
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+	if element, ok := s.elements[id]; ok {
+		s.order.Remove(element)
+		delete(s.elements, id)
+	}
+}
+
+// GetMany retrieves the user states for the given IDs.
+func (s *InMemoryStorage[S]) GetMany(ids []int64) (map[int64]UserState[S], error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := s.now()
+	states := make(map[int64]UserState[S], len(ids))
+	for _, id := range ids {
+		if entry, ok := s.states[id]; ok && !entry.expired(now) {
+			states[id] = entry.state.detached()
+			s.used(id)
+		}
+	}
+	return states, nil
+}
+
+// SetMany stores the given user states.
+func (s *InMemoryStorage[S]) SetMany(states map[int64]UserState[S]) error {
+	for id, state := range states {
+		if err := s.Set(id, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the user state for a given ID.
+func (s *InMemoryStorage[S]) Delete(id int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.states[id] = userState
+	delete(s.states, id)
+	s.forget(id)
+	s.writes++
+	return nil
+}
+
+// ForEach calls fn for every unexpired state. It walks a snapshot taken up
+// front, so fn may modify the storage.
+func (s *InMemoryStorage[S]) ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error {
+	s.mu.RLock()
+	now := s.now()
+	snapshot := make(map[int64]UserState[S], len(s.states))
+	for id, entry := range s.states {
+		if !entry.expired(now) {
+			snapshot[id] = entry.state.detached()
+		}
+	}
+	s.mu.RUnlock()
+
+	for id, state := range snapshot {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id, state); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// StartSweeper starts a goroutine removing expired states every interval
+// until ctx is done. Expired states are removed in batches of at most
+// batchSize, releasing the lock and running the expiry callback between
+// batches, so sweeping a burst of expired states does not stall other
+// operations.
+func (s *InMemoryStorage[S]) StartSweeper(ctx context.Context, interval time.Duration, batchSize int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.sweep(ctx, batchSize)
+			}
+		}
+	}()
+}
+
+// sweep removes expired states batch by batch.
+func (s *InMemoryStorage[S]) sweep(ctx context.Context, batchSize int) {
+	type expiredState struct {
+		id    int64
+		state UserState[S]
+	}
+
+	batch := make([]expiredState, 0, max(batchSize, 1))
+	for ctx.Err() == nil {
+		batch = batch[:0]
+		s.mu.Lock()
+		now := s.now()
+		for id, entry := range s.states {
+			if entry.expired(now) {
+				delete(s.states, id)
+				s.forget(id)
+				batch = append(batch, expiredState{id: id, state: entry.state})
+				if len(batch) == cap(batch) {
+					break
+				}
+			}
+		}
+		onExpire := s.onExpire
+		s.mu.Unlock()
+
+		if onExpire != nil {
+			for _, e := range batch {
+				onExpire(e.id, e.state)
+			}
+		}
+		if len(batch) < cap(batch) {
+			return
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package tgstatemanager
+
+// Interception tells the manager what to do with an update before it is fed
+// into the current state.
+type Interception int
+
+const (
+	// InterceptContinue feeds the update into the current state as usual.
+	InterceptContinue Interception = iota
+	// InterceptBypass leaves the update unhandled, keeping the user's state,
+	// so the bot's other handlers can process it.
+	InterceptBypass
+	// InterceptCancel clears the user's state like ActionCancel and reports
+	// the update handled, so it does not reach the bot's other handlers.
+	InterceptCancel
+)
+
+// Interceptor decides whether an update escapes the current state, e.g. so
+// commands sent mid-flow are not treated as answers.
+type Interceptor[U any] func(update U) Interception
+
+// SetInterceptor sets the interceptor consulted for every update of a user
+// in a state. Navigation actions are recognized before it runs.
+func (m *StateManager[S, U]) SetInterceptor(fn Interceptor[U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.interceptor = fn
+	return nil
+}
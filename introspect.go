@@ -0,0 +1,56 @@
+package tgstatemanager
+
+import (
+	"slices"
+	"strings"
+)
+
+// StateInfo describes a registered state for tooling such as graph exports
+// and admin interfaces.
+type StateInfo struct {
+	Name        string
+	Description string
+	Owner       string
+	Tags        []string
+	Flows       []string // Named flows starting at the state
+	Initial     bool     // The state is the initial state set by SetInitialState
+	Transitions []string // Targets of the state's guarded transitions, in order
+	SkipTo      string
+	Optional    bool
+	Sensitive   bool
+	PromptKey   string
+}
+
+// States returns a description of every registered state, sorted by name.
+// Next states decided by Handle at runtime are not known up front and are
+// therefore missing from the transitions.
+func (m *StateManager[S, U]) States() []StateInfo {
+	infos := make([]StateInfo, 0, len(m.states))
+	for _, state := range m.states {
+		info := StateInfo{
+			Name:        state.Name,
+			Description: state.Description,
+			Owner:       state.Owner,
+			Tags:        slices.Clone(state.Tags),
+			Initial:     state.Name == m.initialState,
+			SkipTo:      state.SkipTo,
+			Optional:    state.Optional,
+			Sensitive:   state.Sensitive,
+			PromptKey:   state.PromptKey,
+		}
+		for flow, initialState := range m.flows {
+			if initialState == state.Name {
+				info.Flows = append(info.Flows, flow)
+			}
+		}
+		slices.Sort(info.Flows)
+		for _, t := range state.Transitions {
+			info.Transitions = append(info.Transitions, t.To)
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b StateInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return infos
+}
@@ -0,0 +1,29 @@
+package tgstatemanager
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotIterable is returned by features walking every stored state when the
+// storage does not implement IterableStorage.
+var ErrNotIterable = errors.New("storage is not iterable")
+
+// IterableStorage is implemented by storages able to walk all stored states.
+type IterableStorage[S any] interface {
+	StateStorage[S]
+	// ForEach calls fn for every stored state until fn returns an error or
+	// ctx is done, and returns that error. States may be set or deleted by
+	// fn, in which case they may or may not be visited.
+	ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error
+}
+
+// forEach walks the states of storage, failing with ErrNotIterable when it
+// does not implement IterableStorage.
+func forEach[S any](ctx context.Context, storage StateStorage[S], fn func(id int64, state UserState[S]) error) error {
+	iterable, ok := storage.(IterableStorage[S])
+	if !ok {
+		return ErrNotIterable
+	}
+	return iterable.ForEach(ctx, fn)
+}
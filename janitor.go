@@ -0,0 +1,100 @@
+package tgstatemanager
+
+import (
+	"context"
+	"time"
+)
+
+// SetOnEvicted sets the hook called with every session the janitor deletes,
+// before it is deleted, such as to archive it. A session whose hook fails is
+// kept and stops the sweep.
+func (m *StateManager[S, U]) SetOnEvicted(fn func(key int64, userState UserState[S]) error) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.onEvicted = fn
+	return nil
+}
+
+// Sweep walks every stored session once, deleting those not updated for
+// olderThan, finished or not, and returns how many were deleted. Unlike
+// retention policies it applies to every flow alike. Each session is read
+// again under the user's lock before it is deleted, so sessions updated since
+// the walk are kept. It requires the storage to implement IterableStorage and
+// Deleter.
+func (m *StateManager[S, U]) Sweep(ctx context.Context, olderThan time.Duration) (int, error) {
+	storage, ok := m.storage.(IterableStorage[S])
+	if !ok {
+		return 0, ErrNotIterable
+	}
+
+	now := m.now()
+	stale := func(_ int64, userState UserState[S]) bool {
+		return !userState.UpdatedAt.IsZero() && now.Sub(userState.UpdatedAt) >= olderThan
+	}
+	var keys []int64
+	err := storage.ForEach(ctx, func(key int64, userState UserState[S]) error {
+		if stale(key, userState) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		evicted, err := m.applyJob(ctx, key, stale, m.evict)
+		if err != nil {
+			return deleted, err
+		}
+		if evicted {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// evict passes a session to the OnEvicted hook and deletes it.
+func (m *StateManager[S, U]) evict(key int64, userState UserState[S]) error {
+	if m.onEvicted != nil {
+		if err := m.onEvicted(key, userState); err != nil {
+			return err
+		}
+	}
+	if err := deleteState(m.storage, key); err != nil {
+		return err
+	}
+	m.expired(key, userState)
+	return nil
+}
+
+// StartJanitor starts a goroutine sweeping sessions not updated for olderThan
+// every interval until ctx is done, so storages without expiry of their own,
+// such as InMemoryStorage, do not grow forever. Failed sweeps are reported as
+// EventError events.
+func (m *StateManager[S, U]) StartJanitor(ctx context.Context, olderThan, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := m.Sweep(ctx, olderThan); err != nil && ctx.Err() == nil {
+					m.emit(Event{Kind: EventError, Err: err})
+				}
+			}
+		}
+	}()
+}
+
+// expired emits the expiry of a deleted session.
+func (m *StateManager[S, U]) expired(key int64, userState UserState[S]) {
+	m.emit(Event{Kind: EventSessionExpired, Key: key, Flow: userState.Flow, State: userState.CurrentState, Source: userState.Source})
+}
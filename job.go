@@ -0,0 +1,262 @@
+package tgstatemanager
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrJobKind is returned when a job ID is reused for a job of another kind.
+var ErrJobKind = errors.New("job kind mismatch")
+
+// JobKind identifies the operation a job performs.
+type JobKind string
+
+const (
+	JobBroadcast JobKind = "broadcast"
+	JobBulkReset JobKind = "bulk_reset"
+	JobMigrate   JobKind = "migrate"
+)
+
+// Job is the progress of a batch operation walking stored user states. Keys
+// are processed in ascending order, so a job resumed after a restart picks up
+// after Cursor.
+type Job struct {
+	ID        string
+	Kind      JobKind
+	Cursor    *int64 `json:",omitempty"` // Last processed key, nil before the first one
+	Total     int    // Keys selected, including those processed by earlier runs
+	Done      int
+	Failed    int
+	Skipped   int // Keys whose state was deleted or no longer selected when reached
+	Finished  bool
+	StartedAt time.Time
+	UpdatedAt time.Time
+}
+
+// JobStore persists the progress of jobs so they can resume after restarts.
+type JobStore interface {
+	LoadJob(id string) (Job, bool, error)
+	SaveJob(job Job) error
+}
+
+// JobOptions configures a batch operation.
+type JobOptions[S any] struct {
+	ID         string                                       // Identifies the job in Store, required to resume it
+	Store      JobStore                                     // Optional: Persists progress, jobs without one start over
+	Rate       float64                                      // Keys processed per second, unlimited when zero
+	Filter     func(key int64, userState UserState[S]) bool // Optional: Selects the users the job applies to
+	OnProgress func(job Job)                                // Optional: Receives the progress whenever it is saved
+	SaveEvery  int                                          // Keys processed between saves of the progress, 100 by default
+}
+
+// runJob applies fn to the stored states selected by opts, holding the lock of
+// every user in turn. Failures of fn are counted and do not stop the job. Progress is saved every
+// opts.SaveEvery keys, when the job finishes and when ctx is done, in which
+// case the error of ctx is returned and a key whose lock was still awaited is
+// left for the resumed job. A finished job found in the store is returned as
+// is.
+func (m *StateManager[S, U]) runJob(ctx context.Context, kind JobKind, opts JobOptions[S], fn func(key int64, userState UserState[S]) error) (Job, error) {
+	storage, ok := m.storage.(IterableStorage[S])
+	if !ok {
+		return Job{}, ErrNotIterable
+	}
+
+	job := Job{ID: opts.ID, Kind: kind, StartedAt: m.now()}
+	if opts.Store != nil && opts.ID != "" {
+		saved, found, err := opts.Store.LoadJob(opts.ID)
+		if err != nil {
+			return job, err
+		}
+		if found && saved.Kind != kind {
+			return saved, fmt.Errorf("%w: job %s is a %s job", ErrJobKind, opts.ID, saved.Kind)
+		}
+		if found && saved.Finished {
+			return saved, nil
+		}
+		if found {
+			job = saved
+		}
+	}
+
+	selected := func(key int64, userState UserState[S]) bool {
+		return opts.Filter == nil || opts.Filter(key, userState)
+	}
+	var keys []int64
+	err := storage.ForEach(ctx, func(key int64, userState UserState[S]) error {
+		if (job.Cursor == nil || key > *job.Cursor) && selected(key, userState) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return job, err
+	}
+	slices.Sort(keys)
+	job.Total = job.Done + job.Failed + job.Skipped + len(keys)
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	every := cmp.Or(opts.SaveEvery, 100)
+
+	for i, key := range keys {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+			case <-tick:
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return job, cmp.Or(m.saveJob(&job, opts), err)
+		}
+
+		applied, err := m.applyJob(ctx, key, selected, fn)
+		if !applied && err != nil && ctx.Err() != nil {
+			// Given up waiting for the user's lock, the key is left for the
+			// job to resume from
+			return job, cmp.Or(m.saveJob(&job, opts), ctx.Err())
+		}
+		switch {
+		case err != nil:
+			job.Failed++
+		case !applied:
+			job.Skipped++
+		default:
+			job.Done++
+		}
+		job.Cursor = &key
+
+		if (i+1)%every == 0 {
+			if err := m.saveJob(&job, opts); err != nil {
+				return job, err
+			}
+		}
+	}
+
+	job.Finished = true
+	return job, m.saveJob(&job, opts)
+}
+
+// applyJob applies fn to the state of the user identified by key, holding the
+// user's lock, and reports whether the user was still selected.
+func (m *StateManager[S, U]) applyJob(ctx context.Context, key int64, selected func(key int64, userState UserState[S]) bool, fn func(key int64, userState UserState[S]) error) (bool, error) {
+	unlock, err := m.lockContext(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	// Read again, the state may have changed since the keys were listed
+	userState, found, err := m.storage.Get(key)
+	if err != nil || !found || !selected(key, userState) {
+		return false, err
+	}
+	return true, fn(key, userState)
+}
+
+// saveJob stamps the job, persists it and reports the progress.
+func (m *StateManager[S, U]) saveJob(job *Job, opts JobOptions[S]) error {
+	job.UpdatedAt = m.now()
+	if opts.Store != nil && job.ID != "" {
+		if err := opts.Store.SaveJob(*job); err != nil {
+			return err
+		}
+	}
+	if opts.OnProgress != nil {
+		opts.OnProgress(*job)
+	}
+	return nil
+}
+
+// MemoryJobStore keeps job progress in memory. Jobs survive being cancelled
+// but not the process exiting.
+type MemoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+// NewMemoryJobStore creates an empty in-memory job store.
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{jobs: make(map[string]Job)}
+}
+
+// LoadJob returns the saved progress of the job.
+func (s *MemoryJobStore) LoadJob(id string) (Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	return job, ok, nil
+}
+
+// SaveJob saves the progress of the job.
+func (s *MemoryJobStore) SaveJob(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	return nil
+}
+
+// FileJobStore keeps the progress of every job in a JSON file of its own
+// within a directory.
+type FileJobStore struct {
+	dir string
+}
+
+// NewFileJobStore creates a job store in dir, which must exist.
+func NewFileJobStore(dir string) *FileJobStore {
+	return &FileJobStore{dir: dir}
+}
+
+// path returns the file holding the job.
+func (s *FileJobStore) path(id string) string {
+	return filepath.Join(s.dir, url.PathEscape(id)+".json")
+}
+
+// LoadJob returns the saved progress of the job.
+func (s *FileJobStore) LoadJob(id string) (Job, bool, error) {
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+// SaveJob saves the progress of the job, replacing the file atomically.
+func (s *FileJobStore) SaveJob(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".job-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(job.ID))
+}
@@ -0,0 +1,22 @@
+package tgstatemanager
+
+// KeyFunc returns the key of the user an update belongs to. It returns false
+// for updates not belonging to any user, such as a callback query without a
+// sender or a channel post, which Handle then ignores.
+type KeyFunc[U any] func(update U) (int64, bool)
+
+// SetKeyFunc replaces the key function given to NewStateManager by one able
+// to reject updates not belonging to any user.
+func (m *StateManager[S, U]) SetKeyFunc(fn KeyFunc[U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.keyFunc = fn
+	return nil
+}
+
+// Key returns the key of the user the update belongs to, as the key function
+// reports it.
+func (m *StateManager[S, U]) Key(update U) (int64, bool) {
+	return m.keyFunc(update)
+}
@@ -0,0 +1,202 @@
+// Package loadtest simulates concurrent conversations against a state
+// storage backend to measure the throughput and latency of a bot's state
+// handling.
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/tgsmtest"
+)
+
+// Data is the state data collected by simulated conversations.
+type Data struct {
+	Answers []string
+}
+
+// Update is a simulated user message.
+type Update struct {
+	Key  int64
+	Text string
+}
+
+// Config describes a load test run.
+type Config struct {
+	Storage       tgsm.StateStorage[Data] // Backend under test
+	Conversations int                     // Number of simulated conversations
+	Concurrency   int                     // Conversations run at once, 1 when zero
+	Steps         int                     // Questions answered per conversation, 1 when zero
+	AnswerSize    int                     // Length of every answer in bytes
+	FirstKey      int64                   // Key of the first conversation, keys of others follow
+	Seed          uint64                  // Seed of the generated answers
+}
+
+// Report summarizes a load test run.
+type Report struct {
+	Conversations int           // Conversations run to the end
+	Updates       int           // Updates handled, failed ones included
+	Errors        int           // Updates failing with an error
+	Duration      time.Duration // Wall time of the run
+	P50           time.Duration // Median latency of handling an update
+	P90           time.Duration
+	P99           time.Duration
+	Max           time.Duration
+}
+
+// Throughput returns the number of updates handled per second.
+func (r Report) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Updates) / r.Duration.Seconds()
+}
+
+// ErrorRate returns the share of updates failing with an error.
+func (r Report) ErrorRate() float64 {
+	if r.Updates == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Updates)
+}
+
+// String formats the report for humans.
+func (r Report) String() string {
+	return fmt.Sprintf(
+		"conversations=%d updates=%d errors=%d (%.2f%%) duration=%s throughput=%.0f/s p50=%s p90=%s p99=%s max=%s",
+		r.Conversations, r.Updates, r.Errors, r.ErrorRate()*100, r.Duration.Round(time.Millisecond),
+		r.Throughput(), r.P50, r.P90, r.P99, r.Max,
+	)
+}
+
+// Run simulates the configured conversations, each starting a flow and
+// answering all its questions, until they are done or ctx is canceled. A
+// conversation is abandoned at its first error.
+func Run(ctx context.Context, cfg Config) (Report, error) {
+	steps := max(cfg.Steps, 1)
+	manager, err := newManager(cfg.Storage, steps)
+	if err != nil {
+		return Report{}, err
+	}
+	gen, err := tgsmtest.NewGenerator[Data](cfg.Seed)
+	if err != nil {
+		return Report{}, err
+	}
+	answer := func() string { return gen.Text(cfg.AnswerSize) }
+
+	keys := make(chan int64)
+	go func() {
+		defer close(keys)
+		for i := range cfg.Conversations {
+			select {
+			case keys <- cfg.FirstKey + int64(i):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		mu        sync.Mutex
+		report    Report
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for range max(cfg.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local Report
+			var observed []time.Duration
+			for key := range keys {
+				if converse(ctx, manager, key, steps+1, answer, &local, &observed) {
+					local.Conversations++
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Conversations += local.Conversations
+			report.Updates += local.Updates
+			report.Errors += local.Errors
+			latencies = append(latencies, observed...)
+		}()
+	}
+	wg.Wait()
+	report.Duration = time.Since(start)
+
+	slices.Sort(latencies)
+	report.P50 = percentile(latencies, 50)
+	report.P90 = percentile(latencies, 90)
+	report.P99 = percentile(latencies, 99)
+	if len(latencies) > 0 {
+		report.Max = latencies[len(latencies)-1]
+	}
+	return report, ctx.Err()
+}
+
+// converse sends the given number of updates in the conversation identified by key and
+// reports whether all of them succeeded. Answers are generated before the
+// latency of handling them is measured.
+func converse(ctx context.Context, manager *tgsm.StateManager[Data, Update], key int64, updates int, answer func() string, report *Report, latencies *[]time.Duration) bool {
+	for range updates {
+		if ctx.Err() != nil {
+			return false
+		}
+		u := Update{Key: key, Text: answer()}
+		start := time.Now()
+		_, err := manager.Handle(u)
+		*latencies = append(*latencies, time.Since(start))
+		report.Updates++
+		if err != nil {
+			report.Errors++
+			return false
+		}
+	}
+	return true
+}
+
+// newManager creates a manager running a flow of steps questions against
+// storage.
+func newManager(storage tgsm.StateStorage[Data], steps int) (*tgsm.StateManager[Data, Update], error) {
+	manager := tgsm.NewStateManager(storage, func(u Update) int64 { return u.Key })
+	for i := range steps {
+		next := ""
+		if i+1 < steps {
+			next = stepName(i + 1)
+		}
+		err := manager.Add(&tgsm.State[Data, Update]{
+			Name:   stepName(i),
+			Prompt: func(Update, *Data) error { return nil },
+			Handle: func(u Update, data *Data) (string, error) {
+				data.Answers = append(data.Answers, u.Text)
+				return next, nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := manager.SetInitialState(stepName(0)); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+// stepName returns the name of the i-th simulated question.
+func stepName(i int) string {
+	return "step_" + strconv.Itoa(i)
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
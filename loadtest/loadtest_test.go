@@ -0,0 +1,34 @@
+package loadtest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/loadtest"
+)
+
+func TestRun(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[loadtest.Data]()
+	report, err := loadtest.Run(context.Background(), loadtest.Config{
+		Storage:       storage,
+		Conversations: 200,
+		Concurrency:   8,
+		Steps:         3,
+		AnswerSize:    16,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 200, report.Conversations)
+	assert.Equal(t, 200*4, report.Updates) // The first update of a conversation is answered by a prompt
+	assert.Zero(t, report.Errors)
+	assert.LessOrEqual(t, report.P50, report.P99)
+	assert.Positive(t, report.Throughput())
+
+	state, _, err := storage.Get(199)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+	assert.Len(t, state.Data.Answers, 3)
+}
@@ -0,0 +1,162 @@
+package tgstatemanager
+
+import (
+	"errors"
+	"strings"
+	"text/template"
+)
+
+// Localizer translates messages by key into the language of a user. Package
+// tgsmi18n provides one for go-i18n bundles; adapt other message catalogs
+// with LocalizerFunc.
+type Localizer interface {
+	// Localize renders the message key in language with data. An empty
+	// language asks for the default one.
+	Localize(language, key string, data any) (string, error)
+}
+
+// LocalizerFunc adapts a function to the Localizer interface.
+type LocalizerFunc func(language, key string, data any) (string, error)
+
+// Localize calls f(language, key, data).
+func (f LocalizerFunc) Localize(language, key string, data any) (string, error) {
+	return f(language, key, data)
+}
+
+// ValidationError rejects an answer like ErrValidation, naming the message
+// explaining why. The message is localized and replied to the user, taking
+// precedence over the InvalidKey of the state.
+type ValidationError struct {
+	Key  string // Message key passed to the Localizer
+	Data any    // Optional: Template data of the message, the user's data when nil
+}
+
+// Invalid returns a ValidationError for the message key.
+func Invalid(key string) error {
+	return &ValidationError{Key: key}
+}
+
+func (e *ValidationError) Error() string {
+	return "validation error: " + e.Key
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+// SetLocalizer sets the localizer translating keyed prompts, when no
+// PromptProvider is set, and the messages of rejected answers. The language
+// of a user is read from their updates by language, when given, until set
+// explicitly with SetLanguage, and kept in UserState.Language.
+func (m *StateManager[S, U]) SetLocalizer(localizer Localizer, language func(update U) string) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.localizer = localizer
+	m.languageFunc = language
+	return nil
+}
+
+// SetLanguage sets the language of the user identified by key, such as one
+// picked from a settings menu, so it is no longer read from updates.
+func (m *StateManager[S, U]) SetLanguage(key int64, language string) error {
+	unlock, err := m.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	userState, _, err := m.storage.Get(key)
+	if err != nil {
+		return err
+	}
+	userState.Language = language
+	return m.save(key, &userState)
+}
+
+// detectLanguage fills in the language of the user from the update.
+func (m *StateManager[S, U]) detectLanguage(update U, userState *UserState[S]) {
+	if userState.Language == "" && m.languageFunc != nil {
+		userState.Language = m.languageFunc(update)
+	}
+}
+
+// language returns the language of the user: the one of their user state,
+// or of their profile when a ProfileResolver is set.
+func (m *StateManager[S, U]) language(key int64, userState *UserState[S]) string {
+	if userState.Language != "" || m.profiles == nil {
+		return userState.Language
+	}
+	profile, err := m.Profile(key)
+	if err != nil {
+		return ""
+	}
+	return profile.LanguageCode
+}
+
+// invalid replies to a rejected answer with the localized message of the
+// validation error, or else of the state's InvalidKey.
+func (m *StateManager[S, U]) invalid(update U, userState *UserState[S], state *State[S, U], err error, key int64) error {
+	if m.localizer == nil {
+		return nil
+	}
+	var data any = userState.Data
+	msgKey := state.InvalidKey
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		msgKey = verr.Key
+		if verr.Data != nil {
+			data = verr.Data
+		}
+	}
+	if msgKey == "" {
+		return nil
+	}
+	text, err := m.localizer.Localize(m.language(key, userState), msgKey, data)
+	if err != nil {
+		return err
+	}
+	return m.reply(update, text)
+}
+
+// MapLocalizer is a Localizer holding text/template messages per language,
+// falling back to a default language for messages missing from the user's
+// one. The messages are kept in a TemplatePrompts, so the same catalog can
+// also serve as the PromptProvider. It is safe for concurrent use.
+type MapLocalizer struct {
+	*TemplatePrompts
+}
+
+// NewMapLocalizer creates a localizer falling back to the messages of the
+// fallback language.
+func NewMapLocalizer(fallback string) *MapLocalizer {
+	return &MapLocalizer{NewTemplatePrompts(fallback)}
+}
+
+// Add parses the messages of language, keyed by message key, replacing any
+// messages already there. When a message fails to parse none is added.
+func (l *MapLocalizer) Add(language string, messages map[string]string) error {
+	parsed := make(map[string]*template.Template, len(messages))
+	for key, text := range messages {
+		tmpl, err := template.New(key).Parse(text)
+		if err != nil {
+			return err
+		}
+		parsed[key] = tmpl
+	}
+	l.store(language, parsed)
+	return nil
+}
+
+// Localize renders the message key of language, or of the fallback language
+// when language lacks it.
+func (l *MapLocalizer) Localize(language, key string, data any) (string, error) {
+	tmpl, err := l.Template(key, language)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,189 @@
+package tgstatemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrLockTimeout is returned by Handle when the lock of the user could not be
+// acquired in time, because another instance is still handling an update of
+// the same user.
+var ErrLockTimeout = errors.New("timed out acquiring user lock")
+
+// Locker serializes the handling of the updates of a user, such as across the
+// instances of a bot deployed on several machines.
+type Locker interface {
+	// Lock acquires the lock of key, waiting until ctx is done, and returns
+	// the function releasing it.
+	Lock(ctx context.Context, key int64) (unlock func() error, err error)
+}
+
+// SetLocker makes Handle hold the lock of the user while handling an update,
+// so two instances never advance the state of the same user at once. Handle
+// waits up to wait for the lock before failing with ErrLockTimeout; a zero
+// wait sets no timeout of its own, waiting as long as the context allows.
+//
+// The methods changing the state of a user outside of Handle, such as
+// SetState, StartFlow, EndSession, SetMeta, Reprompt and jobs, take the lock
+// as well. They must not be called for a user from the hooks and handlers
+// run while an update of the same user is handled, as the lock is already
+// held.
+func (m *StateManager[S, U]) SetLocker(locker Locker, wait time.Duration) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.locker = locker
+	m.lockWait = wait
+	return nil
+}
+
+// lock acquires the lock of the user through the locker, if any.
+func (m *StateManager[S, U]) lock(key int64) (func() error, error) {
+	return m.lockContext(m.requestContext(), key)
+}
+
+// lockContext acquires the lock of the user identified by key, giving up
+// once ctx is done.
+func (m *StateManager[S, U]) lockContext(ctx context.Context, key int64) (func() error, error) {
+	if m.locker == nil {
+		return func() error { return nil }, nil
+	}
+	if m.lockWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.lockWait)
+		defer cancel()
+	}
+	unlock, err := m.locker.Lock(ctx, key)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %d", ErrLockTimeout, key)
+	}
+	return unlock, err
+}
+
+// LocalLocker locks users within a single process.
+type LocalLocker struct {
+	mu    sync.Mutex
+	locks map[int64]*localLock
+}
+
+// localLock is the lock of a user, dropped once nobody holds or awaits it.
+type localLock struct {
+	held chan struct{}
+	refs int
+}
+
+// NewLocalLocker creates a locker for a single process.
+func NewLocalLocker() *LocalLocker {
+	return &LocalLocker{locks: make(map[int64]*localLock)}
+}
+
+// Lock acquires the lock of key, waiting until ctx is done.
+func (l *LocalLocker) Lock(ctx context.Context, key int64) (func() error, error) {
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &localLock{held: make(chan struct{}, 1)}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+		return func() error {
+			<-lock.held
+			l.release(key, lock)
+			return nil
+		}, nil
+	case <-ctx.Done():
+		l.release(key, lock)
+		return nil, ctx.Err()
+	}
+}
+
+// release drops a reference to the lock of key.
+func (l *LocalLocker) release(key int64, lock *localLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lock.refs--; lock.refs == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// unlockScript deletes a lock only if it still holds the token of its owner,
+// so a lock that expired and was taken by another instance is left alone.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// RedisLocker locks users across processes with Redis SET NX PX. Locks expire
+// after a TTL, so the lock of a crashed instance is eventually released; the
+// TTL must be longer than handling an update ever takes.
+type RedisLocker struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+	retry  time.Duration
+	random Random
+}
+
+// NewRedisLocker creates a locker storing locks under prefix, expiring after
+// ttl.
+func NewRedisLocker(client *redis.Client, prefix string, ttl time.Duration) *RedisLocker {
+	return &RedisLocker{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+		retry:  10 * time.Millisecond,
+	}
+}
+
+// SetRetryInterval sets how often a held lock is tried again, 10ms by default.
+func (l *RedisLocker) SetRetryInterval(d time.Duration) {
+	l.retry = d
+}
+
+// SetRandom sets the source the tokens identifying the owners of locks are
+// drawn from, crypto/rand by default.
+func (l *RedisLocker) SetRandom(r Random) {
+	l.random = r
+}
+
+// token returns a token identifying the owner of a lock.
+func (l *RedisLocker) token() string {
+	if l.random == nil {
+		return rand.Text()
+	}
+	return randomID(l.random)
+}
+
+// Lock acquires the lock of key, waiting until ctx is done.
+func (l *RedisLocker) Lock(ctx context.Context, key int64) (func() error, error) {
+	name := l.prefix + ":" + strconv.FormatInt(key, 10)
+	token := l.token()
+	for {
+		ok, err := l.client.SetNX(ctx, name, token, l.ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() error {
+				return unlockScript.Run(context.Background(), l.client, []string{name}, token).Err()
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.retry):
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package tgstatemanager
+
+import "maps"
+
+// SetMeta sets a metadata attribute of the user state, such as an A/B test
+// bucket or the campaign the user came from.
+func (s *UserState[S]) SetMeta(name, value string) {
+	if s.Meta == nil {
+		s.Meta = make(map[string]string)
+	}
+	s.Meta[name] = value
+}
+
+// detached returns the user state with its metadata copied, so storages
+// keeping states in memory do not share the map with their callers.
+func (s UserState[S]) detached() UserState[S] {
+	s.Meta = maps.Clone(s.Meta)
+	return s
+}
+
+// Meta returns a metadata attribute of the user identified by key. The
+// boolean reports whether it is set.
+func (m *StateManager[S, U]) Meta(key int64, name string) (string, bool, error) {
+	userState, _, err := m.storage.Get(key)
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := userState.Meta[name]
+	return value, ok, nil
+}
+
+// SetMeta sets a metadata attribute of the user identified by key. Metadata
+// outlives the flows of the user, kept when they cancel or start over.
+func (m *StateManager[S, U]) SetMeta(key int64, name, value string) error {
+	unlock, err := m.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	userState, _, err := m.storage.Get(key)
+	if err != nil {
+		return err
+	}
+	userState.SetMeta(name, value)
+	return m.save(key, &userState)
+}
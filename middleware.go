@@ -0,0 +1,60 @@
+package tgstatemanager
+
+import (
+	"context"
+	"slices"
+)
+
+// Call is the handling of an update by a state, as passed through middleware.
+type Call[S, U any] struct {
+	Context context.Context // Context passed to HandleContext, the background context otherwise
+	Key     int64
+	State   string // Name of the state handling the update
+	Update  U
+	Data    *S // Data of the user, changed in place by the state
+}
+
+// HandlerFunc handles an update in a state, as the Handle of the state does.
+type HandlerFunc[S, U any] func(call Call[S, U]) (Response, error)
+
+// Middleware wraps the handling of updates by states, such as to check
+// permissions or log answers. It may change the update before calling next,
+// decide the response itself without calling next, or inspect the response.
+// Returning ErrValidation rejects the answer as Handle would.
+type Middleware[S, U any] func(next HandlerFunc[S, U]) HandlerFunc[S, U]
+
+// Use adds middleware wrapping the handling of updates by every state. The
+// manager's middleware runs in the order added, around the middleware of the
+// state.
+func (m *StateManager[S, U]) Use(middleware ...Middleware[S, U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.middleware = append(m.middleware, middleware...)
+	return nil
+}
+
+// handler returns the handler of state wrapped in the middleware of the
+// manager and of the state.
+func (m *StateManager[S, U]) handler(state *State[S, U]) HandlerFunc[S, U] {
+	handler := func(call Call[S, U]) (Response, error) {
+		var resp Response
+		var err error
+		switch {
+		case state.HandleWith != nil:
+			resp.Next, err = state.HandleWith(call.Context, call.Update, call.Data)
+		case state.HandleReply != nil:
+			resp, err = state.HandleReply(call.Update, call.Data)
+		default:
+			resp.Next, err = state.Handle(call.Update, call.Data)
+		}
+		return resp, err
+	}
+	for _, mw := range slices.Backward(state.Middleware) {
+		handler = mw(handler)
+	}
+	for _, mw := range slices.Backward(m.middleware) {
+		handler = mw(handler)
+	}
+	return handler
+}
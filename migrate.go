@@ -0,0 +1,98 @@
+package tgstatemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrDuplicateMigration is returned when registering a second migration
+	// from the same schema version.
+	ErrDuplicateMigration = errors.New("duplicate migration")
+	// ErrNoMigration is returned when decoding data of a schema version no
+	// migration starts from.
+	ErrNoMigration = errors.New("no migration")
+)
+
+// MigrationFunc converts state data serialized by one schema version into
+// the data of the next one.
+type MigrationFunc[S any] func(old json.RawMessage) (S, error)
+
+// Migrations upgrades state data serialized as JSON by older versions of the
+// state struct. Versions start at zero, the version of data stored before
+// migrations were introduced; every registered migration moves data one
+// version up, so the current version is one above the highest version
+// migrated from. Storages serializing to JSON apply the migrations when
+// reading states and stamp the current version when writing them.
+type Migrations[S any] struct {
+	steps   map[int]MigrationFunc[S]
+	version int
+}
+
+// NewMigrations creates an empty migration registry.
+func NewMigrations[S any]() *Migrations[S] {
+	return &Migrations[S]{steps: make(map[int]MigrationFunc[S])}
+}
+
+// Register adds the migration upgrading data of fromVersion.
+func (m *Migrations[S]) Register(fromVersion int, fn MigrationFunc[S]) error {
+	if _, exists := m.steps[fromVersion]; exists {
+		return fmt.Errorf("%w: from version %d", ErrDuplicateMigration, fromVersion)
+	}
+	m.steps[fromVersion] = fn
+	m.version = max(m.version, fromVersion+1)
+	return nil
+}
+
+// Version returns the current schema version.
+func (m *Migrations[S]) Version() int {
+	return m.version
+}
+
+// Decode unmarshals a user state serialized as JSON, upgrading its data to
+// the current version.
+func (m *Migrations[S]) Decode(data []byte) (UserState[S], error) {
+	var state UserState[S]
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return state, err
+	}
+
+	var version int
+	if raw, ok := envelope["SchemaVersion"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return state, err
+		}
+	}
+
+	if version < m.version {
+		for ; version < m.version; version++ {
+			step, ok := m.steps[version]
+			if !ok {
+				return state, fmt.Errorf("%w: from version %d", ErrNoMigration, version)
+			}
+			upgraded, err := step(envelope["Data"])
+			if err != nil {
+				return state, fmt.Errorf("migrating from version %d: %w", version, err)
+			}
+			if envelope["Data"], err = json.Marshal(upgraded); err != nil {
+				return state, err
+			}
+		}
+		envelope["SchemaVersion"], _ = json.Marshal(version)
+		var err error
+		if data, err = json.Marshal(envelope); err != nil {
+			return state, err
+		}
+	}
+
+	err := json.Unmarshal(data, &state)
+	return state, err
+}
+
+// Encode marshals a user state to JSON stamped with the current version.
+func (m *Migrations[S]) Encode(state UserState[S]) ([]byte, error) {
+	state.SchemaVersion = m.version
+	return json.Marshal(state)
+}
@@ -0,0 +1,59 @@
+package tgstatemanager_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// contactV2 is the current version of a state struct whose first version
+// stored a single FullName.
+type contactV2 struct {
+	FirstName string
+	LastName  string
+	Phone     string
+}
+
+func TestMigrations(t *testing.T) {
+	migrations := tgsm.NewMigrations[contactV2]()
+	require.NoError(t, migrations.Register(0, func(old json.RawMessage) (contactV2, error) {
+		var v0 struct{ FullName string }
+		if err := json.Unmarshal(old, &v0); err != nil {
+			return contactV2{}, err
+		}
+		first, last, _ := strings.Cut(v0.FullName, " ")
+		return contactV2{FirstName: first, LastName: last}, nil
+	}))
+	require.NoError(t, migrations.Register(1, func(old json.RawMessage) (contactV2, error) {
+		var v1 contactV2
+		err := json.Unmarshal(old, &v1)
+		v1.Phone = "unknown"
+		return v1, err
+	}))
+	assert.ErrorIs(t, migrations.Register(1, nil), tgsm.ErrDuplicateMigration)
+	assert.Equal(t, 2, migrations.Version())
+
+	state, err := migrations.Decode([]byte(`{"CurrentState":"ask_phone","Data":{"FullName":"Ada Lovelace"},"PromptSent":true}`))
+	require.NoError(t, err)
+	assert.Equal(t, "ask_phone", state.CurrentState)
+	assert.True(t, state.PromptSent)
+	assert.Equal(t, contactV2{FirstName: "Ada", LastName: "Lovelace", Phone: "unknown"}, state.Data)
+	assert.Equal(t, 2, state.SchemaVersion)
+
+	data, err := migrations.Encode(tgsm.UserState[contactV2]{Data: contactV2{Phone: "+1"}})
+	require.NoError(t, err)
+	state, err = migrations.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, "+1", state.Data.Phone, "current data is not migrated again")
+
+	_, err = tgsm.NewMigrations[contactV2]().Decode(data)
+	require.NoError(t, err)
+	sparse := tgsm.NewMigrations[contactV2]()
+	require.NoError(t, sparse.Register(1, nil))
+	_, err = sparse.Decode([]byte(`{"Data":{}}`))
+	assert.ErrorIs(t, err, tgsm.ErrNoMigration)
+}
@@ -0,0 +1,66 @@
+package tgstatemanager
+
+// Verdict is the outcome of moderating an answer.
+type Verdict int
+
+const (
+	// Allow accepts the answer.
+	Allow Verdict = iota
+	// Deny rejects the answer, keeping the user in the current state.
+	Deny
+	// Flag accepts the answer but reports it for review.
+	Flag
+)
+
+// Moderator screens an answer before it reaches a state's Handle. The text is
+// read through the manager's TextAccessor and is empty when none is set.
+type Moderator[U any] func(update U, text string) (Verdict, error)
+
+// SetModerator sets the moderator screening every answer. Denied answers are
+// replied to with warning through the responder and keep the user in the
+// current state.
+func (m *StateManager[S, U]) SetModerator(moderator Moderator[U], warning any) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.moderator = moderator
+	m.moderationWarning = warning
+	return nil
+}
+
+// SetOnFlagged sets the hook receiving answers the moderator flagged.
+func (m *StateManager[S, U]) SetOnFlagged(fn func(update U, text string)) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.onFlagged = fn
+	return nil
+}
+
+// moderate runs the moderator over the answer and reports whether it may be
+// handled by the state.
+func (m *StateManager[S, U]) moderate(update U) (bool, error) {
+	if m.moderator == nil {
+		return true, nil
+	}
+
+	var text string
+	if m.text != nil {
+		text = m.text.Text(update)
+	}
+
+	verdict, err := m.moderator(update, text)
+	if err != nil {
+		return false, err
+	}
+
+	switch verdict {
+	case Deny:
+		return false, m.reply(update, m.moderationWarning)
+	case Flag:
+		if m.onFlagged != nil {
+			m.onFlagged(update, text)
+		}
+	}
+	return true, nil
+}
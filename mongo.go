@@ -0,0 +1,178 @@
+package tgstatemanager
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// MongoStorage provides MongoDB-backed storage for user states. Every user
+// state is stored as a document keyed by the user ID.
+type MongoStorage[S any] struct {
+	collection *mongo.Collection
+	ctx        context.Context
+	ttl        time.Duration
+	jitter     time.Duration
+	random     Random
+}
+
+// mongoDocument is the document a user state is stored as.
+type mongoDocument[S any] struct {
+	ID        int64        `bson:"_id"`
+	State     UserState[S] `bson:"state"`
+	ExpiresAt *time.Time   `bson:"expiresAt,omitempty"`
+}
+
+// NewMongoStorage creates a new MongoDB storage instance using the given
+// database and collection.
+func NewMongoStorage[S any](client *mongo.Client, database, collection string) *MongoStorage[S] {
+	return &MongoStorage[S]{
+		collection: client.Database(database).Collection(collection),
+		ctx:        context.Background(),
+	}
+}
+
+// SetTTL makes states expire ttl after they were last stored, extended by a
+// random duration of up to jitter to spread the expiry of states stored in a
+// burst. Expired states are no longer returned by Get and are removed by the
+// TTL index created with EnsureIndexes. A zero ttl disables expiry.
+func (s *MongoStorage[S]) SetTTL(ttl, jitter time.Duration) {
+	s.ttl = ttl
+	s.jitter = jitter
+}
+
+// SetRandom sets the source TTL jitter is drawn from, the global source of
+// math/rand/v2 by default.
+func (s *MongoStorage[S]) SetRandom(r Random) {
+	s.random = r
+}
+
+// EnsureIndexes creates the TTL index MongoDB removes expired states with.
+func (s *MongoStorage[S]) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Get retrieves a user state from MongoDB.
+func (s *MongoStorage[S]) Get(id int64) (UserState[S], bool, error) {
+	var doc mongoDocument[S]
+	err := s.collection.FindOne(s.ctx, unexpired(bson.E{Key: "_id", Value: id})).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return UserState[S]{}, false, nil
+	}
+	if err != nil {
+		return UserState[S]{}, false, err
+	}
+	return doc.State, true, nil
+}
+
+// GetMany retrieves the user states for the given IDs with a single query.
+func (s *MongoStorage[S]) GetMany(ids []int64) (map[int64]UserState[S], error) {
+	cursor, err := s.collection.Find(s.ctx, unexpired(bson.E{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoDocument[S]
+	if err := cursor.All(s.ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	states := make(map[int64]UserState[S], len(docs))
+	for _, doc := range docs {
+		states[doc.ID] = doc.State
+	}
+	return states, nil
+}
+
+// ForEach calls fn for every unexpired state.
+func (s *MongoStorage[S]) ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error {
+	cursor, err := s.collection.Find(ctx, unexpired(bson.E{Key: "_id", Value: bson.D{{Key: "$exists", Value: true}}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc mongoDocument[S]
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if err := fn(doc.ID, doc.State); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// Set stores a user state in MongoDB.
+func (s *MongoStorage[S]) Set(id int64, state UserState[S]) error {
+	return s.SetWithTTL(id, state, 0)
+}
+
+// SetWithTTL stores a user state in MongoDB expiring ttl after now, or after
+// the storage's TTL when ttl is zero.
+func (s *MongoStorage[S]) SetWithTTL(id int64, state UserState[S], ttl time.Duration) error {
+	_, err := s.collection.ReplaceOne(s.ctx, bson.D{{Key: "_id", Value: id}}, s.document(id, state, ttl), options.Replace().SetUpsert(true))
+	return err
+}
+
+// SetMany stores the given user states with a single bulk write.
+func (s *MongoStorage[S]) SetMany(states map[int64]UserState[S]) error {
+	if len(states) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(states))
+	for id, state := range states {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: id}}).
+			SetReplacement(s.document(id, state, 0)).
+			SetUpsert(true))
+	}
+	_, err := s.collection.BulkWrite(s.ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// document creates the document a user state is stored as, expiring ttl
+// after now or after the storage's TTL when ttl is zero.
+func (s *MongoStorage[S]) document(id int64, state UserState[S], ttl time.Duration) mongoDocument[S] {
+	doc := mongoDocument[S]{ID: id, State: state}
+	if ttl <= 0 {
+		ttl = s.ttl
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(jittered(s.random, ttl, s.jitter))
+		doc.ExpiresAt = &expiresAt
+	}
+	return doc
+}
+
+// unexpired returns a filter matching documents by cond that have not
+// expired. The TTL monitor runs periodically, so expired documents may still
+// be around.
+func unexpired(cond bson.E) bson.D {
+	return bson.D{
+		cond,
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$exists", Value: false}}}},
+			bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$gt", Value: time.Now()}}}},
+		}},
+	}
+}
+
+// Delete removes a user state from MongoDB.
+func (s *MongoStorage[S]) Delete(id int64) error {
+	_, err := s.collection.DeleteOne(s.ctx, bson.D{{Key: "_id", Value: id}})
+	return err
+}
+
+// Ping verifies the connection to MongoDB.
+func (s *MongoStorage[S]) Ping(ctx context.Context) error {
+	return s.collection.Database().Client().Ping(ctx, nil)
+}
@@ -0,0 +1,136 @@
+package tgstatemanager
+
+// Action is a navigation action a user can take from any state.
+type Action string
+
+const (
+	// ActionBack returns to the previously visited state.
+	ActionBack Action = "back"
+	// ActionCancel abandons the flow and clears the user's state.
+	ActionCancel Action = "cancel"
+	// ActionSkip leaves a skippable state. Optional states get their Default
+	// applied and follow their transitions, falling back to SkipTo, which
+	// End lets end the flow.
+	ActionSkip Action = "skip"
+)
+
+// Navigation holds the button labels of the navigation row bot adapters attach
+// to prompts. An empty label hides the corresponding button.
+type Navigation struct {
+	Back   string
+	Cancel string
+	Skip   string
+}
+
+// SetNavigation configures the navigation row attached to prompts.
+func (m *StateManager[S, U]) SetNavigation(nav Navigation) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.navigation = nav
+	return nil
+}
+
+// Navigation returns the configured navigation row.
+func (m *StateManager[S, U]) Navigation() Navigation {
+	return m.navigation
+}
+
+// SetActionFunc sets the function recognizing navigation actions in updates.
+// Bot adapters install it to map button presses to actions.
+func (m *StateManager[S, U]) SetActionFunc(fn func(update U) (Action, bool)) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.actionFunc = fn
+	return nil
+}
+
+// navigate applies a navigation action to the user's current state.
+func (m *StateManager[S, U]) navigate(update U, userState *UserState[S], state *State[S, U], key int64, action Action) (bool, error) {
+	switch action {
+	case ActionBack:
+		if len(userState.History) == 0 {
+			return true, nil // Nowhere to go back to
+		}
+		prev := userState.History[len(userState.History)-1]
+		userState.History = userState.History[:len(userState.History)-1]
+		if state, ok := m.states[prev]; ok && state.Rollback != nil {
+			state.Rollback(&userState.Data) // The user answers it again
+		}
+		return true, m.transition(update, userState, prev, key)
+	case ActionSkip:
+		next := state.SkipTo
+		if state.Optional {
+			if state.Default != nil {
+				state.Default(&userState.Data)
+			}
+			next = state.next(update, &userState.Data, next)
+		}
+		if moves(next) {
+			userState.History = append(userState.History, state.Name)
+		}
+		return true, m.transition(update, userState, next, key)
+	case ActionCancel:
+		return true, m.cancel(update, *userState, key)
+	}
+	return false, nil
+}
+
+// SetOnCancel sets the hook called after a user's flow has been cancelled. It
+// receives the state the user was in before it was cleared.
+func (m *StateManager[S, U]) SetOnCancel(fn func(update U, userState UserState[S]) error) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.onCancel = fn
+	return nil
+}
+
+// Cancel abandons the flow of the user the update belongs to, clearing its
+// state and data, and runs the OnCancel hook. The flow is recorded as finished
+// with OutcomeCancelled. Users outside of any state and updates the key
+// function rejects are left untouched.
+func (m *StateManager[S, U]) Cancel(update U) error {
+	key, ok := m.keyFunc(update)
+	if !ok {
+		return nil
+	}
+	unlock, err := m.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	userState, exists, err := m.storage.Get(key)
+	if err != nil || !exists || userState.CurrentState == "" {
+		return err
+	}
+	return m.cancel(update, userState, key)
+}
+
+// cancel clears the user's state and runs the OnCancel hook.
+func (m *StateManager[S, U]) cancel(update U, userState UserState[S], key int64) error {
+	cleared := UserState[S]{
+		Flow:         userState.Flow,
+		Source:       userState.Source,
+		Finished:     true,
+		Outcome:      OutcomeCancelled,
+		CreatedAt:    userState.CreatedAt,
+		LastUpdateID: userState.LastUpdateID,
+		Language:     userState.Language,
+		Meta:         userState.Meta,
+	}
+	if err := m.save(key, &cleared); err != nil {
+		return err
+	}
+	return m.after(key, func() error {
+		m.emit(Event{Kind: EventFinished, Key: key, Flow: cleared.Flow, Outcome: OutcomeCancelled, Source: cleared.Source})
+		if err := m.audit(key, &cleared, userState.CurrentState, &update); err != nil {
+			return err
+		}
+		if m.onCancel != nil {
+			return m.onCancel(update, userState)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,130 @@
+package tgstatemanager
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Normalizer rewrites the text of an answer before it reaches a state's Handle.
+type Normalizer func(text string) string
+
+// TextAccessor reads and rewrites the text carried by an update. Bot adapters
+// provide one so the manager can work with answers of any update type.
+type TextAccessor[U any] interface {
+	Text(update U) string
+	WithText(update U, text string) U
+}
+
+// SetTextAccessor sets the accessor used to read and rewrite answer texts.
+// Normalizers only run once an accessor is set.
+func (m *StateManager[S, U]) SetTextAccessor(accessor TextAccessor[U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.text = accessor
+	return nil
+}
+
+// SetNormalizers sets the normalizers applied to every answer before the
+// state's own Normalizers.
+func (m *StateManager[S, U]) SetNormalizers(normalizers ...Normalizer) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.normalizers = normalizers
+	return nil
+}
+
+// normalize runs the global and the state's normalizers over the answer.
+func (m *StateManager[S, U]) normalize(update U, state *State[S, U]) U {
+	if m.text == nil || len(m.normalizers)+len(state.Normalizers) == 0 {
+		return update
+	}
+
+	text := m.text.Text(update)
+	for _, n := range m.normalizers {
+		text = n(text)
+	}
+	for _, n := range state.Normalizers {
+		text = n(text)
+	}
+	return m.text.WithText(update, text)
+}
+
+// TrimSpace removes leading and trailing white space.
+func TrimSpace(text string) string {
+	return strings.TrimSpace(text)
+}
+
+// CollapseSpace replaces every run of white space with a single space and
+// trims the result.
+func CollapseSpace(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// ToLower maps the text to lower case.
+func ToLower(text string) string {
+	return strings.ToLower(text)
+}
+
+// StripEmoji removes emoji, including their variation selectors and joiners.
+func StripEmoji(text string) string {
+	return strings.Map(func(r rune) rune {
+		if isEmoji(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// isEmoji reports whether r belongs to the emoji and pictograph blocks.
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, // Pictographs, emoticons, flags, skin tones
+		r >= 0x2300 && r <= 0x23FF,   // Miscellaneous technical
+		r >= 0x2600 && r <= 0x27BF,   // Miscellaneous symbols and dingbats
+		r >= 0x2B00 && r <= 0x2BFF,   // Arrows and shapes
+		r >= 0xFE00 && r <= 0xFE0F,   // Variation selectors
+		r >= 0xE0020 && r <= 0xE007F, // Tag sequences
+		r == 0x200D, r == 0x20E3:     // Zero width joiner and keycap
+		return true
+	}
+	return false
+}
+
+// Transliterate replaces accented Latin and Cyrillic letters with their closest
+// ASCII spelling, leaving other characters untouched.
+func Transliterate(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+	for _, r := range text {
+		repl, ok := transliterations[unicode.ToLower(r)]
+		switch {
+		case !ok:
+			b.WriteRune(r)
+		case unicode.IsUpper(r) && repl != "":
+			b.WriteString(strings.ToUpper(repl[:1]) + repl[1:])
+		default:
+			b.WriteString(repl)
+		}
+	}
+	return b.String()
+}
+
+// transliterations maps lower case letters to their ASCII spelling.
+var transliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ł': "l", 'ľ': "l", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe",
+	'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g",
+}
@@ -0,0 +1,68 @@
+package tgstatemanager_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// mockText implements tgsm.TextAccessor for MockUpdate.
+type mockText struct{}
+
+func (mockText) Text(u MockUpdate) string { return u.Text }
+
+func (mockText) WithText(u MockUpdate, text string) MockUpdate {
+	u.Text = text
+	return u
+}
+
+func TestNormalizers(t *testing.T) {
+	testCases := []struct {
+		name       string
+		normalizer tgsm.Normalizer
+		input      string
+		want       string
+	}{
+		{"TrimSpace", tgsm.TrimSpace, "  John \n", "John"},
+		{"CollapseSpace", tgsm.CollapseSpace, " John \t  Doe ", "John Doe"},
+		{"ToLower", tgsm.ToLower, "Part-Time", "part-time"},
+		{"StripEmoji", tgsm.StripEmoji, "Hi 👋🏽 there ❤️", "Hi  there "},
+		{"Transliterate", tgsm.Transliterate, "José Müller Щукин", "Jose Muller Shchukin"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.normalizer(tc.input))
+		})
+	}
+}
+
+func TestStateManagerNormalization(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	sm.SetTextAccessor(mockText{})
+	sm.SetNormalizers(tgsm.StripEmoji, tgsm.CollapseSpace)
+
+	countryState := createCountryState()
+	countryState.Name = "ask_country_lower"
+	countryState.Normalizers = []tgsm.Normalizer{tgsm.ToLower}
+	require.NoError(t, sm.Add(countryState))
+
+	chatID := int64(4242)
+	for _, input := range []string{"", "  John   Doe 🙂 ", " 30 "} {
+		_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: input})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, sm.SetState(chatID, "ask_country_lower", tgsm.WithPrompt(MockUpdate{ChatID: chatID})))
+	_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: " United   STATES "})
+	require.NoError(t, err)
+
+	state, _, err := storage.Get(chatID)
+	require.NoError(t, err)
+	assert.Equal(t, "John Doe", state.Data.Name)
+	assert.Equal(t, 30, state.Data.Age)
+	assert.Equal(t, "united states", state.Data.Country)
+}
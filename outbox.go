@@ -0,0 +1,209 @@
+package tgstatemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrNoOutbox is returned by DeliverOutbox when no outbox is set.
+	ErrNoOutbox = errors.New("no outbox set")
+	// ErrPromptUndelivered is reported when the outbox relay gives up on a
+	// prompt after Outbox.MaxAttempts failed deliveries.
+	ErrPromptUndelivered = errors.New("prompt undelivered")
+)
+
+// defaultOutboxGrace is the age at which the relay takes over prompts when
+// Outbox.Grace is unset.
+const defaultOutboxGrace = time.Minute
+
+// OutboxPrompt is the intent to send the prompt of a state, stored with the
+// user state before the prompt is sent and cleared once it was delivered.
+type OutboxPrompt struct {
+	ID       string       `json:",omitempty"`
+	State    string       `json:",omitempty"`
+	Reason   PromptReason `json:",omitempty"`
+	Previous string       `json:",omitempty"`
+	Queued   time.Time    `json:",omitzero"`
+	Attempts int          `json:",omitempty"` // Failed deliveries by the relay
+}
+
+// pending reports whether the prompt is still to be delivered.
+func (o OutboxPrompt) pending() bool {
+	return o.ID != ""
+}
+
+// Outbox configures the outbox of prompt sends.
+type Outbox struct {
+	Grace       time.Duration // Age at which the relay delivers prompts left undelivered, one minute by default
+	MaxAttempts int           // Optional: Failed deliveries after which the relay gives up on a prompt
+}
+
+// SetOutbox makes the manager store the intent to send a prompt together with
+// the user state before sending it, and clear it once the prompt is
+// delivered. A crash or failed send in between leaves the intent in storage,
+// where DeliverOutbox finds and delivers it, rather than leaving the user in
+// a state whose prompt they never got. Delivery is at least once: a crash
+// right after sending delivers the prompt again.
+//
+// Prompts sent through a PromptDispatcher are cleared once sent, under the
+// user's lock but apart from the worker, which keeps sending while updates of
+// the user wait for room in its queue. Set a Locker along with the outbox, so
+// the clearing does not race the handling of the update.
+func (m *StateManager[S, U]) SetOutbox(outbox Outbox) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	if outbox.Grace <= 0 {
+		outbox.Grace = defaultOutboxGrace
+	}
+	m.outbox = &outbox
+	return nil
+}
+
+// DeliverOutbox walks every stored session once, sending the prompts left
+// undelivered for longer than the grace period of the outbox, and returns how
+// many were delivered. Prompts of states the user has left are dropped.
+// Prompts relying on Prompt rather than PromptWith need an update and are
+// left for the user's next one, as are keyed prompts without a notifier.
+// Failed deliveries are reported as EventError events. It requires an outbox
+// and a storage implementing IterableStorage.
+func (m *StateManager[S, U]) DeliverOutbox(ctx context.Context) (int, error) {
+	if m.outbox == nil {
+		return 0, ErrNoOutbox
+	}
+	storage, ok := m.storage.(IterableStorage[S])
+	if !ok {
+		return 0, ErrNotIterable
+	}
+
+	var keys []int64
+	now := m.now()
+	err := storage.ForEach(ctx, func(key int64, userState UserState[S]) error {
+		if userState.Outbox.pending() && now.Sub(userState.Outbox.Queued) >= m.outbox.Grace {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return delivered, err
+		}
+		sent, err := m.redeliver(ctx, key)
+		if err != nil {
+			m.emit(Event{Kind: EventError, Key: key, Err: err})
+		}
+		if sent {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// redeliver sends the undelivered prompt of the user identified by key under
+// their lock, recording the outcome in the user state.
+func (m *StateManager[S, U]) redeliver(ctx context.Context, key int64) (sent bool, err error) {
+	unlock, err := m.lockContext(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	userState, exists, err := m.storage.Get(key)
+	if err != nil || !exists || !userState.Outbox.pending() {
+		return false, err
+	}
+	intent := userState.Outbox
+	state, ok := m.states[userState.CurrentState]
+	if !ok || userState.Finished || intent.State != userState.CurrentState {
+		userState.Outbox = OutboxPrompt{}
+		return false, m.persist(key, userState)
+	}
+	if m.outbox.MaxAttempts > 0 && intent.Attempts >= m.outbox.MaxAttempts {
+		userState.Outbox = OutboxPrompt{}
+		if err := m.persist(key, userState); err != nil {
+			return false, err
+		}
+		return false, stateError(fmt.Errorf("%w after %d attempts", ErrPromptUndelivered, intent.Attempts), key, state.Name, PhasePrompt)
+	}
+
+	pc := PromptContext[U]{
+		Key:      key,
+		State:    state.Name,
+		Previous: intent.Previous,
+		Reason:   intent.Reason,
+		Sent:     userState.PromptParts,
+		Page:     userState.Page,
+		Language: m.language(key, &userState),
+		Context:  ctx,
+	}
+	send, err := m.sender(pc, state)
+	if send == nil {
+		return false, err
+	}
+	if err := send(&userState.Data); err != nil {
+		var partial *PartialPromptError
+		if errors.As(err, &partial) {
+			userState.PromptParts = partial.Sent
+		}
+		userState.Outbox.Attempts++
+		if persistErr := m.persist(key, userState); persistErr != nil {
+			return false, persistErr
+		}
+		return false, stateError(err, key, state.Name, PhasePrompt)
+	}
+	userState.Outbox = OutboxPrompt{}
+	userState.PromptSent = true
+	userState.PromptParts = 0
+	return true, m.persist(key, userState)
+}
+
+// delivered clears the outbox intent of the user identified by key once a
+// PromptDispatcher worker sent its prompt, unless a newer intent replaced it.
+func (m *StateManager[S, U]) delivered(key int64, intent OutboxPrompt) error {
+	if !intent.pending() {
+		return nil
+	}
+	unlock, err := m.lockContext(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	userState, exists, err := m.storage.Get(key)
+	if err != nil || !exists || userState.Outbox.ID != intent.ID {
+		return err
+	}
+	userState.Outbox = OutboxPrompt{}
+	return m.persist(key, userState)
+}
+
+// StartOutboxRelay starts a goroutine delivering the prompts left in the
+// outbox every interval until ctx is done, as by DeliverOutbox. Failed runs
+// are reported as EventError events.
+func (m *StateManager[S, U]) StartOutboxRelay(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := m.DeliverOutbox(ctx); err != nil && ctx.Err() == nil {
+					m.emit(Event{Kind: EventError, Err: err})
+				}
+			}
+		}
+	}()
+}
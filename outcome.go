@@ -0,0 +1,75 @@
+package tgstatemanager
+
+import "strings"
+
+// Outcome tells how a flow ended.
+type Outcome string
+
+const (
+	// OutcomeCompleted is the outcome of flows ended by an empty next state.
+	OutcomeCompleted Outcome = "completed"
+	// OutcomeCancelled is the outcome of flows the user cancelled.
+	OutcomeCancelled Outcome = "cancelled"
+	// OutcomeRejected is the outcome of flows ending in the user being turned
+	// down, such as an application that was declined.
+	OutcomeRejected Outcome = "rejected"
+	// OutcomeTimedOut is the outcome of flows the user abandoned.
+	OutcomeTimedOut Outcome = "timed_out"
+)
+
+// endPrefix starts the state names returned by End.
+const endPrefix = "<end:"
+
+// End returns the next state name ending the flow with the given outcome.
+// Handle, Transitions and SkipTo may all use it; an empty next state still
+// ends the flow as OutcomeCompleted.
+func End(outcome Outcome) string {
+	return endPrefix + string(outcome) + ">"
+}
+
+// ending reports whether the next state name ends the flow, and with which
+// outcome.
+func ending(nextState string) (Outcome, bool) {
+	if nextState == "" {
+		return OutcomeCompleted, true
+	}
+	if name, ok := strings.CutPrefix(nextState, endPrefix); ok {
+		return Outcome(strings.TrimSuffix(name, ">")), true
+	}
+	return "", false
+}
+
+// moves reports whether the next state name moves the user to another state
+// of the flow, as opposed to ending it, staying or turning the page.
+func moves(nextState string) bool {
+	_, ends := ending(nextState)
+	_, pages := paging(nextState)
+	return !ends && !pages && nextState != NopState
+}
+
+// EndSession ends the flow of the user identified by key with the given
+// outcome, without an update, as reminder timers do for users who abandoned
+// their flow. An EventFinished event is emitted, but as there is no update
+// the OnFinish hook and the completion summary are skipped. Users without an
+// unfinished state are left untouched.
+func (m *StateManager[S, U]) EndSession(key int64, outcome Outcome) error {
+	unlock, err := m.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	userState, exists, err := m.storage.Get(key)
+	if err != nil || !exists || userState.Finished {
+		return err
+	}
+	prevState := userState.CurrentState
+	userState.Enter("")
+	userState.Finished = true
+	userState.Outcome = outcome
+	if err := m.save(key, &userState); err != nil {
+		return err
+	}
+	m.moved(key, &userState, prevState)
+	m.emit(Event{Kind: EventFinished, Key: key, Flow: userState.Flow, Outcome: outcome, Source: userState.Source})
+	return m.audit(key, &userState, prevState, nil)
+}
@@ -0,0 +1,47 @@
+package tgstatemanager
+
+import (
+	"strconv"
+	"strings"
+)
+
+// pagePrefix starts the next state names returned by Page.
+const pagePrefix = "<page:"
+
+// Page returns the next state name a Handle returns to show another page of
+// the current state's prompt, such as the next page of a long option list.
+// The user stays in the state, the page is recorded in UserState.Page and the
+// prompt is sent again with PromptPaged.
+func Page(n int) string {
+	return pagePrefix + strconv.Itoa(n) + ">"
+}
+
+// paging reports whether the next state name turns the page, and to which.
+func paging(nextState string) (int, bool) {
+	rest, ok := strings.CutPrefix(nextState, pagePrefix)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(rest, ">"))
+	return n, err == nil
+}
+
+// turnPage records the page the user turned to and sends the prompt of the
+// current state showing it.
+func (m *StateManager[S, U]) turnPage(update U, userState *UserState[S], page int, key int64) error {
+	userState.Page = page
+	userState.Failures = 0
+	var promptErr error
+	var deliver func() error
+	if state, ok := m.states[userState.CurrentState]; ok && state.hasPrompt() {
+		pc := PromptContext[U]{Previous: previousState(userState), Reason: PromptPaged, Update: &update}
+		_, deliver, promptErr = m.prompt(pc, userState, state, key)
+	}
+	if err := m.save(key, userState); err != nil {
+		return err
+	}
+	if deliver != nil {
+		promptErr = deliver()
+	}
+	return promptErr
+}
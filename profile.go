@@ -0,0 +1,126 @@
+package tgstatemanager
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoProfileResolver is returned when a profile is requested from a manager
+// without a ProfileResolver.
+var ErrNoProfileResolver = errors.New("no profile resolver")
+
+// ErrProfileTTL is returned by SetProfileResolver for a ttl that is not
+// positive, which would let the profile cache grow without bound.
+var ErrProfileTTL = errors.New("profile cache ttl must be positive")
+
+// Profile describes the Telegram user behind a key.
+type Profile struct {
+	ID           int64
+	Username     string
+	FirstName    string
+	LastName     string
+	LanguageCode string
+	Premium      bool
+}
+
+// ProfileResolver looks up the profile of a user by ID.
+type ProfileResolver interface {
+	Resolve(id int64) (Profile, error)
+}
+
+// ProfileResolverFunc adapts a function to the ProfileResolver interface.
+type ProfileResolverFunc func(id int64) (Profile, error)
+
+// Resolve calls f(id).
+func (f ProfileResolverFunc) Resolve(id int64) (Profile, error) {
+	return f(id)
+}
+
+// SetProfileResolver sets the resolver used by Profile. Resolved profiles are
+// cached for ttl, which must be positive, and expired ones are swept as the
+// cache grows.
+func (m *StateManager[S, U]) SetProfileResolver(resolver ProfileResolver, ttl time.Duration) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	if ttl <= 0 {
+		return ErrProfileTTL
+	}
+	m.profiles = &profileCache{
+		resolver: resolver,
+		ttl:      ttl,
+		entries:  make(map[int64]cachedProfile),
+	}
+	return nil
+}
+
+// Profile returns the profile of the user identified by key, resolving it
+// only when it is not cached yet. Prompts and transition guards call it to
+// personalize flows without querying the Telegram API themselves.
+func (m *StateManager[S, U]) Profile(key int64) (Profile, error) {
+	if m.profiles == nil {
+		return Profile{}, ErrNoProfileResolver
+	}
+	return m.profiles.get(key, m.now())
+}
+
+// CacheProfile stores the profile of the user identified by key, known from
+// an update, sparing a resolver round-trip. The key is the one of Profile, not
+// necessarily the ID of the Telegram user. It does nothing when no resolver
+// is set.
+func (m *StateManager[S, U]) CacheProfile(key int64, profile Profile) {
+	if m.profiles != nil {
+		m.profiles.put(key, profile, m.now())
+	}
+}
+
+// profileCache caches resolved profiles in memory.
+type profileCache struct {
+	resolver ProfileResolver
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	entries   map[int64]cachedProfile
+	nextSweep int
+}
+
+type cachedProfile struct {
+	profile   Profile
+	expiresAt time.Time
+}
+
+// get returns the cached profile or resolves and caches it.
+func (c *profileCache) get(id int64, now time.Time) (Profile, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[id]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.profile, nil
+	}
+
+	profile, err := c.resolver.Resolve(id)
+	if err != nil {
+		return Profile{}, err
+	}
+	c.put(id, profile, now)
+	return profile, nil
+}
+
+// put caches the profile, sweeping expired entries whenever the cache has
+// doubled in size since the last sweep.
+func (c *profileCache) put(id int64, profile Profile, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[id] = cachedProfile{profile: profile, expiresAt: now.Add(c.ttl)}
+
+	if len(c.entries) > c.nextSweep {
+		for id, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, id)
+			}
+		}
+		c.nextSweep = max(2*len(c.entries), 64)
+	}
+}
@@ -0,0 +1,126 @@
+package tgstatemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNoPrompt is returned by Reprompt when the user has no prompt that can be
+// sent without an inbound update.
+var ErrNoPrompt = errors.New("no prompt to send")
+
+// PromptReason tells why a state's prompt is sent.
+type PromptReason string
+
+const (
+	// PromptEntered is given when the user has just moved into the state.
+	PromptEntered PromptReason = "entered"
+	// PromptPending is given when the prompt is sent on the user's first
+	// update in the state, as for new users or after SetState.
+	PromptPending PromptReason = "pending"
+	// PromptResumed is given when a returning user resumes their flow.
+	PromptResumed PromptReason = "resumed"
+	// PromptForced is given when the prompt is sent without an inbound
+	// update, as by SetState with WithPromptNow.
+	PromptForced PromptReason = "forced"
+	// PromptReprompted is given when Reprompt sends the prompt again.
+	PromptReprompted PromptReason = "reprompted"
+	// PromptPaged is given when the user turned the page of the prompt.
+	PromptPaged PromptReason = "paged"
+)
+
+// PromptContext describes a prompt about to be sent.
+type PromptContext[U any] struct {
+	Key      int64
+	State    string          // State whose prompt is sent
+	Previous string          // State the user was in before, empty when unknown
+	Reason   PromptReason    // Why the prompt is sent
+	Update   *U              // Update that triggered the prompt, nil when there is none
+	Sent     int             // Parts of a multi-part prompt delivered by earlier attempts
+	Page     int             // Page of the prompt to show, see Page
+	Language string          // Language code of the user, empty when unknown
+	Context  context.Context // Context passed to HandleContext, the background context otherwise
+}
+
+// PartialPromptError is returned by a multi-part prompt that failed after
+// sending some of its parts.
+type PartialPromptError struct {
+	Sent int // Parts delivered, including those of earlier attempts
+	Err  error
+}
+
+func (e *PartialPromptError) Error() string {
+	return fmt.Sprintf("prompt failed after %d parts: %v", e.Sent, e.Err)
+}
+
+func (e *PartialPromptError) Unwrap() error {
+	return e.Err
+}
+
+// PromptParts combines prompts sending one message each, such as an intro
+// text, an example image and a question with a keyboard, into a PromptWith
+// prompt sending them as a unit. When a part fails the prompt stays pending
+// and the parts already delivered are recorded, so the next attempt sends the
+// remaining parts only. Sending the prompt again once it went through, as on
+// Reprompt, starts over from the first part. Progress is not recorded for
+// prompts sent through a PromptDispatcher.
+func PromptParts[S, U any](parts ...func(ctx PromptContext[U], state *S) error) func(ctx PromptContext[U], state *S) error {
+	return func(ctx PromptContext[U], state *S) error {
+		for i := ctx.Sent; i < len(parts); i++ {
+			if err := parts[i](ctx, state); err != nil {
+				return &PartialPromptError{Sent: i, Err: err}
+			}
+		}
+		return nil
+	}
+}
+
+// hasPrompt reports whether the state sends a prompt.
+func (s *State[S, U]) hasPrompt() bool {
+	return s.Prompt != nil || s.PromptWith != nil || s.PromptKey != ""
+}
+
+// previousState returns the state the user was in before the current one.
+func previousState[S any](userState *UserState[S]) string {
+	if n := len(userState.History); n > 0 {
+		return userState.History[n-1]
+	}
+	return ""
+}
+
+// WithPromptNow makes SetState send the target state's prompt right away
+// without an inbound update. States relying on Prompt rather than PromptWith
+// need an update, so their prompt is left for the user's next update; keyed
+// prompts are sent through the notifier.
+func WithPromptNow[U any]() SetStateOption[U] {
+	return func(c *setStateConfig[U]) {
+		c.promptNow = true
+	}
+}
+
+// Reprompt sends the prompt of the user's current state again without an
+// inbound update, to nudge users who stopped answering from reminder timers or
+// admin tooling. It returns ErrNoPrompt when the user has no state, finished
+// their flow or is in a state without a PromptWith prompt or a PromptKey the
+// notifier can deliver. It holds the lock of the user while doing so.
+func (m *StateManager[S, U]) Reprompt(key int64) error {
+	unlock, err := m.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	userState, exists, err := m.storage.Get(key)
+	if err != nil {
+		return err
+	}
+	if !exists || userState.Finished {
+		return fmt.Errorf("%w: user %d has no active state", ErrNoPrompt, key)
+	}
+	state, ok := m.states[userState.CurrentState]
+	if !ok || state.PromptWith == nil && (state.PromptKey == "" || m.promptProvider == nil && m.localizer == nil || m.notifier == nil) {
+		return fmt.Errorf("%w: state %q", ErrNoPrompt, userState.CurrentState)
+	}
+	pc := PromptContext[U]{Previous: previousState(&userState), Reason: PromptReprompted}
+	return m.sendPrompt(pc, &userState, state, key)
+}
@@ -0,0 +1,156 @@
+package tgstatemanager
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// PromptRetryPolicy decides what happens after a prompt failed to send.
+type PromptRetryPolicy int
+
+const (
+	// RetryOnNextUpdate leaves the prompt pending, so the user's next update
+	// sends it again rather than being handled as the answer to a question
+	// the user never saw.
+	RetryOnNextUpdate PromptRetryPolicy = iota
+	// RetryWithBackoff also retries the prompt in the background, waiting
+	// longer before every retry, so users get the question without having to
+	// write first.
+	RetryWithBackoff
+)
+
+// PromptRetry configures the handling of prompts that failed to send, such as
+// on rate limiting by Telegram.
+type PromptRetry struct {
+	Policy     PromptRetryPolicy
+	Attempts   int                           // Background retries for RetryWithBackoff, 3 by default
+	BaseDelay  time.Duration                 // Delay before the first retry, doubled for every next one, one second by default
+	MaxDelay   time.Duration                 // Cap of the delay between retries, one minute by default
+	RetryAfter func(err error) time.Duration // Optional: Delay requested by the error, such as the retry_after of a 429 response, zero when none
+}
+
+// SetPromptRetry configures what happens after a prompt failed to send.
+// Prompts sent on the update handling path always stay pending on failure;
+// with a PromptDispatcher, which marks users as prompted once their prompt is
+// queued, the mark is withdrawn when the send fails, so the next update
+// re-sends the prompt as well; set a Locker so withdrawing it does not race
+// the handling of the update. Background retries need a prompt that can be
+// sent again later: a PromptWith prompt, a Prompt with the update that
+// triggered it, or a keyed prompt with a notifier.
+func (m *StateManager[S, U]) SetPromptRetry(retry PromptRetry) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	if retry.Attempts <= 0 {
+		retry.Attempts = 3
+	}
+	if retry.BaseDelay <= 0 {
+		retry.BaseDelay = time.Second
+	}
+	if retry.MaxDelay <= 0 {
+		retry.MaxDelay = time.Minute
+	}
+	m.promptRetry = &retry
+	return nil
+}
+
+// retriesInBackground reports whether failed prompts are retried in the
+// background.
+func (m *StateManager[S, U]) retriesInBackground() bool {
+	return m.promptRetry != nil && m.promptRetry.Policy == RetryWithBackoff
+}
+
+// promptFailed applies the retry policy to a prompt of state that failed to
+// send with err. Prompts sent by a dispatcher worker are marked pending again
+// first.
+func (m *StateManager[S, U]) promptFailed(pc PromptContext[U], state string, err error, dispatched bool) {
+	if m.promptRetry == nil {
+		return
+	}
+	if dispatched {
+		if err := m.withdraw(pc.Key, state); err != nil {
+			m.emit(Event{Kind: EventError, Key: pc.Key, State: state, Err: err})
+		}
+	}
+	if m.retriesInBackground() {
+		m.scheduleRetry(pc, state, 1, err)
+	}
+}
+
+// withdraw marks the prompt of state pending again, unless the user has moved
+// on since.
+func (m *StateManager[S, U]) withdraw(key int64, state string) error {
+	unlock, err := m.lockContext(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	userState, exists, err := m.storage.Get(key)
+	if err != nil || !exists || userState.CurrentState != state || !userState.PromptSent {
+		return err
+	}
+	userState.PromptSent = false
+	return m.persist(key, userState)
+}
+
+// scheduleRetry retries the prompt of state after the backoff of the given
+// attempt, or the delay err asks for.
+func (m *StateManager[S, U]) scheduleRetry(pc PromptContext[U], state string, attempt int, err error) {
+	retry := m.promptRetry
+	delay := min(retry.BaseDelay<<min(attempt-1, 30), retry.MaxDelay)
+	if retry.RetryAfter != nil {
+		if after := retry.RetryAfter(err); after > 0 {
+			delay = after
+		}
+	}
+	pc.Context = context.WithoutCancel(pc.Context)
+	time.AfterFunc(delay, func() {
+		err := m.retryPrompt(pc, state)
+		if err == nil {
+			return
+		}
+		m.emit(Event{Kind: EventError, Key: pc.Key, State: state, Err: err})
+		if attempt < retry.Attempts {
+			m.scheduleRetry(pc, state, attempt+1, err)
+		}
+	})
+}
+
+// retryPrompt sends the prompt of state again, unless the user has moved on
+// or got it in the meantime.
+func (m *StateManager[S, U]) retryPrompt(pc PromptContext[U], stateName string) error {
+	unlock, err := m.lockContext(pc.Context, pc.Key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	userState, exists, err := m.storage.Get(pc.Key)
+	if err != nil || !exists || userState.Finished || userState.CurrentState != stateName || userState.PromptSent {
+		return err
+	}
+	state, ok := m.states[stateName]
+	if !ok {
+		return nil
+	}
+	pc.Sent, pc.Page = userState.PromptParts, userState.Page
+	send, err := m.sender(pc, state)
+	if send == nil {
+		return err
+	}
+	if err := send(&userState.Data); err != nil {
+		var partial *PartialPromptError
+		if errors.As(err, &partial) {
+			userState.PromptParts = partial.Sent
+			if persistErr := m.persist(pc.Key, userState); persistErr != nil {
+				return persistErr
+			}
+		}
+		return stateError(err, pc.Key, stateName, PhasePrompt)
+	}
+	userState.PromptSent = true
+	userState.PromptParts = 0
+	userState.Outbox = OutboxPrompt{}
+	return m.persist(pc.Key, userState)
+}
@@ -0,0 +1,384 @@
+package tgstatemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is matched by the QuotaError of an operation a quota
+// refused.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaLimit names the limit of a quota that was exceeded.
+type QuotaLimit string
+
+const (
+	QuotaSessions QuotaLimit = "sessions"
+	QuotaRate     QuotaLimit = "rate"
+)
+
+// QuotaError reports an operation refused by the quota of a namespace.
+type QuotaError struct {
+	Namespace string
+	Limit     QuotaLimit
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota of namespace %q exceeded", e.Limit, e.Namespace)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Quota limits the use of a storage by the sessions of a namespace. As with
+// retention policies, the namespace is the flow of a session, empty for
+// sessions outside of any named flow.
+type Quota struct {
+	Namespace    string
+	MaxSessions  int     // Unfinished sessions stored at once, unlimited when zero
+	OpsPerSecond float64 // Storage operations per second, unlimited when zero
+	Burst        int     // Operations allowed at once, OpsPerSecond rounded up by default
+}
+
+// QuotaStorage enforces per-namespace quotas on the storage it wraps, so
+// tenants sharing it cannot exhaust its capacity. Refused operations fail
+// with a QuotaError and never reach the backend. Namespaces without a quota
+// are not limited.
+//
+// Sessions are counted as they are written, so sessions stored before the
+// storage was created are only counted after Load, and sessions expired by
+// the backend keep counting until they are written or deleted again. A write
+// reserves its place in the session quota before it reaches the backend and
+// gives it back should it fail. The namespace of every key seen is kept in
+// memory.
+type QuotaStorage[S any] struct {
+	backend  StateStorage[S]
+	quotas   map[string]Quota
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	sessions map[string]int   // Unfinished sessions by namespace
+	active   map[int64]string // Namespaces of unfinished sessions
+	known    map[int64]string // Namespaces reads are charged to
+	now      func() time.Time
+}
+
+// NewQuotaStorage creates a storage enforcing quotas, at most one per
+// namespace, on backend.
+func NewQuotaStorage[S any](backend StateStorage[S], quotas ...Quota) *QuotaStorage[S] {
+	s := &QuotaStorage[S]{
+		backend:  backend,
+		quotas:   make(map[string]Quota, len(quotas)),
+		buckets:  make(map[string]*tokenBucket),
+		sessions: make(map[string]int),
+		active:   make(map[int64]string),
+		known:    make(map[int64]string),
+		now:      time.Now,
+	}
+	for _, quota := range quotas {
+		s.quotas[quota.Namespace] = quota
+	}
+	return s
+}
+
+// SetClock sets the function the storage reads the current time from when
+// refilling rate quotas, time.Now by default.
+func (s *QuotaStorage[S]) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// Load counts the sessions already stored in the backend, which must
+// implement IterableStorage. The stored sessions are not refused even if they
+// exceed a quota.
+func (s *QuotaStorage[S]) Load(ctx context.Context) error {
+	storage, ok := s.backend.(IterableStorage[S])
+	if !ok {
+		return ErrNotIterable
+	}
+	return storage.ForEach(ctx, func(id int64, state UserState[S]) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.known[id] = state.Flow
+		s.track(id, state)
+		return nil
+	})
+}
+
+// Usage returns the number of unfinished sessions counted in the namespace.
+func (s *QuotaStorage[S]) Usage(namespace string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[namespace]
+}
+
+// Get retrieves the user state for a given ID, charged to the namespace the
+// state was last seen in.
+func (s *QuotaStorage[S]) Get(id int64) (UserState[S], bool, error) {
+	s.mu.Lock()
+	err := s.charge(s.known[id])
+	s.mu.Unlock()
+	if err != nil {
+		return UserState[S]{}, false, err
+	}
+
+	state, exists, err := s.backend.Get(id)
+	if err == nil && exists {
+		s.mu.Lock()
+		s.known[id] = state.Flow
+		s.mu.Unlock()
+	}
+	return state, exists, err
+}
+
+// Set stores the user state for a given ID, charged to the namespace of the
+// state. Starting an unfinished session in a namespace at its session quota
+// is refused.
+func (s *QuotaStorage[S]) Set(id int64, state UserState[S]) error {
+	return s.SetWithTTL(id, state, 0)
+}
+
+// SetWithTTL stores the user state for a given ID with its own TTL, charged
+// like Set.
+func (s *QuotaStorage[S]) SetWithTTL(id int64, state UserState[S], ttl time.Duration) error {
+	s.mu.Lock()
+	namespace := state.Flow
+	rollback, err := func() (func(), error) {
+		if err := s.charge(namespace); err != nil {
+			return nil, err
+		}
+		return s.reserve(id, state)
+	}()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := setWithTTL(s.backend, id, state, ttl); err != nil {
+		s.mu.Lock()
+		rollback()
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.known[id] = namespace
+	return nil
+}
+
+// Delete removes the user state for a given ID, charged to the namespace the
+// state was last seen in.
+func (s *QuotaStorage[S]) Delete(id int64) error {
+	s.mu.Lock()
+	err := s.charge(s.known[id])
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := deleteState(s.backend, id); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.untrack(id)
+	delete(s.known, id)
+	return nil
+}
+
+// GetMany retrieves the user states for the given IDs, with a single GetMany
+// when the backend implements BatchStorage, each charged like Get.
+func (s *QuotaStorage[S]) GetMany(ids []int64) (map[int64]UserState[S], error) {
+	s.mu.Lock()
+	var err error
+	for _, id := range ids {
+		if err = s.charge(s.known[id]); err != nil {
+			break
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := getMany(s.backend, ids)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, state := range states {
+		s.known[id] = state.Flow
+	}
+	return states, nil
+}
+
+// SetMany stores the given user states, with a single SetMany when the
+// backend implements BatchStorage, each charged like Set. When any of them is
+// refused none is stored.
+func (s *QuotaStorage[S]) SetMany(states map[int64]UserState[S]) error {
+	s.mu.Lock()
+	var err error
+	rollbacks := make([]func(), 0, len(states))
+	for id, state := range states {
+		if err = s.charge(state.Flow); err != nil {
+			break
+		}
+		var rollback func()
+		if rollback, err = s.reserve(id, state); err != nil {
+			break
+		}
+		rollbacks = append(rollbacks, rollback)
+	}
+	if err != nil {
+		undo(rollbacks)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := setMany(s.backend, states); err != nil {
+		s.mu.Lock()
+		undo(rollbacks)
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, state := range states {
+		s.known[id] = state.Flow
+	}
+	return nil
+}
+
+// ForEach calls fn for every state of the backend, which must implement
+// IterableStorage. Walks are not charged to any quota.
+func (s *QuotaStorage[S]) ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error {
+	return forEach(ctx, s.backend, fn)
+}
+
+// charge takes an operation from the rate quota of the namespace. The caller
+// must hold the lock.
+func (s *QuotaStorage[S]) charge(namespace string) error {
+	quota := s.quotas[namespace]
+	if quota.OpsPerSecond <= 0 {
+		return nil
+	}
+	bucket, ok := s.buckets[namespace]
+	if !ok {
+		burst := quota.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(quota.OpsPerSecond))
+		}
+		bucket = newTokenBucket(quota.OpsPerSecond, burst, s.now())
+		s.buckets[namespace] = bucket
+	}
+	if !bucket.take(s.now()) {
+		return &QuotaError{Namespace: namespace, Limit: QuotaRate}
+	}
+	return nil
+}
+
+// reserve counts the session of state ahead of writing it, so concurrent
+// writes cannot start more sessions than the quota of the namespace allows,
+// and returns the function undoing the reservation should the write fail.
+// Starting an unfinished session in a namespace at its session quota is
+// refused. The caller must hold the lock, also when undoing.
+func (s *QuotaStorage[S]) reserve(id int64, state UserState[S]) (func(), error) {
+	previous, tracked := s.active[id]
+	if !state.Finished && (!tracked || previous != state.Flow) {
+		if limit := s.quotas[state.Flow].MaxSessions; limit > 0 && s.sessions[state.Flow] >= limit {
+			return nil, &QuotaError{Namespace: state.Flow, Limit: QuotaSessions}
+		}
+	}
+	s.track(id, state)
+	return func() {
+		s.untrack(id)
+		if tracked {
+			s.active[id] = previous
+			s.sessions[previous]++
+		}
+	}, nil
+}
+
+// undo undoes reservations in the reverse order they were made. The caller
+// must hold the lock.
+func undo(rollbacks []func()) {
+	for i := len(rollbacks) - 1; i >= 0; i-- {
+		rollbacks[i]()
+	}
+}
+
+// track counts the session of a stored state. The caller must hold the lock.
+func (s *QuotaStorage[S]) track(id int64, state UserState[S]) {
+	s.untrack(id)
+	if !state.Finished {
+		s.active[id] = state.Flow
+		s.sessions[state.Flow]++
+	}
+}
+
+// untrack stops counting the session of id. The caller must hold the lock.
+func (s *QuotaStorage[S]) untrack(id int64) {
+	if namespace, ok := s.active[id]; ok {
+		delete(s.active, id)
+		s.sessions[namespace]--
+	}
+}
+
+// tokenBucket is a token bucket rate limiter. It is not safe for concurrent
+// use.
+type tokenBucket struct {
+	rate   float64 // Tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket.
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take refills the bucket up to now and takes a token from it, reporting
+// whether there was one.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve refills the bucket up to now and takes a token from it, which may
+// be one that is yet to be added. It returns how long it takes until the
+// token is added, or false when that is longer than maxWait.
+func (b *tokenBucket) reserve(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	b.refill(now)
+	wait := time.Duration(max(1-b.tokens, 0) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// full reports whether the bucket is full at now.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// refill adds the tokens accrued since the bucket was last refilled.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
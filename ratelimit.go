@@ -0,0 +1,120 @@
+package tgstatemanager
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitPolicy decides what happens to updates of users over their rate
+// limit.
+type RateLimitPolicy int
+
+const (
+	// RateLimitDrop reports over-limit updates as handled without handling
+	// them.
+	RateLimitDrop RateLimitPolicy = iota
+	// RateLimitQueue holds over-limit updates until the user's limit allows
+	// them, for up to MaxWait, and drops them afterwards. Updates whose
+	// HandleContext context is done while they are held are not handled and
+	// fail with the context's error.
+	RateLimitQueue
+	// RateLimitHook passes over-limit updates to OnLimited instead of handling
+	// them.
+	RateLimitHook
+)
+
+// RateLimit limits the rate at which the updates of each user are handled,
+// using a token bucket per user.
+type RateLimit[U any] struct {
+	Rate      float64              // Updates per second a user may send
+	Burst     int                  // Updates a user may send at once, Rate rounded up by default
+	Policy    RateLimitPolicy      // What to do with over-limit updates
+	MaxWait   time.Duration        // Longest an update is held with RateLimitQueue
+	OnLimited func(update U) error // Receives over-limit updates with RateLimitHook
+}
+
+// SetRateLimit limits the rate at which the updates of each user are handled.
+// Limits are checked before the user's state is read, so over-limit updates
+// never reach the storage. A zero Rate removes the limit.
+func (m *StateManager[S, U]) SetRateLimit(limit RateLimit[U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.rateLimit = nil
+	if limit.Rate > 0 {
+		m.rateLimit = &rateLimiter[U]{limit: limit, buckets: make(map[int64]*tokenBucket)}
+	}
+	return nil
+}
+
+// limited applies the rate limit to an update of the user identified by key,
+// reporting whether the update must not be handled along with the result to
+// return for it.
+func (m *StateManager[S, U]) limited(update U, key int64) (bool, error) {
+	if m.rateLimit == nil {
+		return false, nil
+	}
+	limit := m.rateLimit.limit
+	wait, ok := m.rateLimit.reserve(key, m.now())
+	switch {
+	case ok && wait > 0:
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return false, nil
+		case <-m.requestContext().Done():
+			return true, m.requestContext().Err()
+		}
+	case ok:
+		return false, nil
+	case limit.Policy == RateLimitHook && limit.OnLimited != nil:
+		return true, limit.OnLimited(update)
+	}
+	return true, nil
+}
+
+// rateLimiter holds the token buckets of users.
+type rateLimiter[U any] struct {
+	limit     RateLimit[U]
+	mu        sync.Mutex
+	buckets   map[int64]*tokenBucket
+	lastPrune time.Time
+}
+
+// reserve takes a token from the user's bucket, reporting how long the update
+// has to wait for it, or false when it is over the limit.
+func (l *rateLimiter[U]) reserve(key int64, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		burst := l.limit.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(l.limit.Rate))
+		}
+		bucket = newTokenBucket(l.limit.Rate, burst, now)
+		l.buckets[key] = bucket
+	}
+	if l.limit.Policy != RateLimitQueue {
+		return 0, bucket.take(now)
+	}
+	return bucket.reserve(now, l.limit.MaxWait)
+}
+
+// prune forgets the buckets that have refilled, at most once a minute. The
+// caller must hold the lock.
+func (l *rateLimiter[U]) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -3,7 +3,9 @@ package tgstatemanager
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -13,20 +15,97 @@ type RedisStorage[S any] struct {
 	client *redis.Client
 	ctx    context.Context
 	prefix string
+	ttl    time.Duration
+	jitter time.Duration
+	random Random
+
+	separator    string
+	keyFormatter KeyFormatter
+	codec        Codec[S]
 }
 
+// KeyFormatter builds the Redis key a user state is stored under from the
+// storage prefix and the user ID.
+type KeyFormatter func(prefix string, id int64) string
+
 // NewRedisStorage creates a new Redis storage instance.
 func NewRedisStorage[S any](client *redis.Client, prefix string) *RedisStorage[S] {
 	return &RedisStorage[S]{
 		client: client,
 		ctx:    context.Background(),
 		prefix: prefix,
+
+		separator: ":",
 	}
 }
 
+// SetSeparator sets the separator between the prefix and the user ID in keys,
+// ":" by default.
+func (s *RedisStorage[S]) SetSeparator(separator string) {
+	s.separator = separator
+}
+
+// SetKeyFormatter replaces the default "<prefix><separator><id>" key format,
+// e.g. to add environment segments or hash tags for cluster co-location.
+// Keys of a custom format cannot be walked, so ForEach then fails with
+// ErrNotIterable.
+func (s *RedisStorage[S]) SetKeyFormatter(fn KeyFormatter) {
+	s.keyFormatter = fn
+}
+
+// SetTTL makes states expire ttl after they were last stored, extended by a
+// random duration of up to jitter to spread the expiry of states stored in a
+// burst. A zero ttl disables expiry.
+func (s *RedisStorage[S]) SetTTL(ttl, jitter time.Duration) {
+	s.ttl = ttl
+	s.jitter = jitter
+}
+
+// SetRandom sets the source TTL jitter is drawn from, the global source of
+// math/rand/v2 by default.
+func (s *RedisStorage[S]) SetRandom(r Random) {
+	s.random = r
+}
+
+// SetMigrations sets the migrations upgrading states stored by older versions
+// of the state struct when they are read.
+func (s *RedisStorage[S]) SetMigrations(migrations *Migrations[S]) {
+	s.codec = nil
+	if migrations != nil {
+		s.codec = migrations
+	}
+}
+
+// SetCodec sets the codec serializing states, plain JSON by default. It
+// replaces the migrations set by SetMigrations.
+func (s *RedisStorage[S]) SetCodec(codec Codec[S]) {
+	s.codec = codec
+}
+
+// decode unmarshals a stored user state.
+func (s *RedisStorage[S]) decode(data []byte) (UserState[S], error) {
+	if s.codec != nil {
+		return s.codec.Decode(data)
+	}
+	var state UserState[S]
+	err := json.Unmarshal(data, &state)
+	return state, err
+}
+
+// encode marshals a user state for storage.
+func (s *RedisStorage[S]) encode(state UserState[S]) ([]byte, error) {
+	if s.codec != nil {
+		return s.codec.Encode(state)
+	}
+	return json.Marshal(state)
+}
+
 // formatKey creates a consistent Redis key for a user ID.
 func (s *RedisStorage[S]) formatKey(id int64) string {
-	return fmt.Sprintf("%s:%d", s.prefix, id)
+	if s.keyFormatter != nil {
+		return s.keyFormatter(s.prefix, id)
+	}
+	return s.prefix + s.separator + strconv.FormatInt(id, 10)
 }
 
 // Get retrieves a user state from Redis.
@@ -44,8 +123,8 @@ func (s *RedisStorage[S]) Get(id int64) (UserState[S], bool, error) {
 	}
 
 	// Unmarshal data
-	var state UserState[S]
-	if err := json.Unmarshal(data, &state); err != nil {
+	state, err := s.decode(data)
+	if err != nil {
 		return UserState[S]{}, false, err
 	}
 
@@ -54,10 +133,101 @@ func (s *RedisStorage[S]) Get(id int64) (UserState[S], bool, error) {
 
 // Set stores a user state in Redis.
 func (s *RedisStorage[S]) Set(id int64, state UserState[S]) error {
-	data, err := json.Marshal(state)
+	return s.SetWithTTL(id, state, 0)
+}
+
+// SetWithTTL stores a user state in Redis expiring ttl after now, or after
+// the storage's TTL when ttl is zero.
+func (s *RedisStorage[S]) SetWithTTL(id int64, state UserState[S], ttl time.Duration) error {
+	data, err := s.encode(state)
 	if err != nil {
 		return err
 	}
+	if ttl <= 0 {
+		ttl = s.ttl
+	}
+
+	return s.client.Set(s.ctx, s.formatKey(id), data, jittered(s.random, ttl, s.jitter)).Err()
+}
+
+// GetMany retrieves the user states for the given IDs with a single MGET.
+func (s *RedisStorage[S]) GetMany(ids []int64) (map[int64]UserState[S], error) {
+	if len(ids) == 0 {
+		return map[int64]UserState[S]{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.formatKey(id)
+	}
+
+	values, err := s.client.MGet(s.ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[int64]UserState[S], len(ids))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue // Missing key
+		}
+		state, err := s.decode([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+		states[ids[i]] = state
+	}
+	return states, nil
+}
+
+// SetMany stores the given user states in a single pipeline.
+func (s *RedisStorage[S]) SetMany(states map[int64]UserState[S]) error {
+	pipe := s.client.Pipeline()
+	for id, state := range states {
+		data, err := s.encode(state)
+		if err != nil {
+			return err
+		}
+		pipe.Set(s.ctx, s.formatKey(id), data, jittered(s.random, s.ttl, s.jitter))
+	}
+	_, err := pipe.Exec(s.ctx)
+	return err
+}
+
+// ForEach calls fn for every state stored under the prefix, walking the keys
+// with SCAN. Keys not ending in a user ID are skipped. It requires the default
+// key format, failing with ErrNotIterable when SetKeyFormatter was used.
+func (s *RedisStorage[S]) ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error {
+	if s.keyFormatter != nil {
+		return ErrNotIterable
+	}
+	prefix := s.prefix + s.separator
+	iter := s.client.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		id, err := strconv.ParseInt(strings.TrimPrefix(iter.Val(), prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		state, exists, err := s.Get(id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue // Deleted or expired since the scan saw it
+		}
+		if err := fn(id, state); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// Delete removes a user state from Redis.
+func (s *RedisStorage[S]) Delete(id int64) error {
+	return s.client.Del(s.ctx, s.formatKey(id)).Err()
+}
 
-	return s.client.Set(s.ctx, s.formatKey(id), data, 0).Err()
+// Ping verifies the connection to Redis.
+func (s *RedisStorage[S]) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
 }
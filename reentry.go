@@ -0,0 +1,94 @@
+package tgstatemanager
+
+// ReentryPolicy decides what happens when a user in the middle of a flow sends
+// the start command again.
+type ReentryPolicy int
+
+const (
+	// ReentryIgnore drops the start command, leaving the user where they are.
+	ReentryIgnore ReentryPolicy = iota
+	// ReentryConfirm asks the user to send the start command once more before
+	// restarting. Any other update withdraws the request.
+	ReentryConfirm
+	// ReentryRestart restarts the user's flow right away, discarding the data
+	// collected so far.
+	ReentryRestart
+	// ReentryResume keeps the collected data, replies with a summary of it and
+	// repeats the prompt of the current state.
+	ReentryResume
+)
+
+// Reentry configures the handling of start commands sent mid-flow.
+type Reentry[S, U any] struct {
+	Policy  ReentryPolicy
+	IsStart func(update U) bool // Recognizes the start command
+	Confirm any                 // Optional: Reply asking to confirm a restart, for ReentryConfirm
+	Summary Renderer[S]         // Optional: Renders the data collected so far, for ReentryResume
+}
+
+// SetReentry configures what happens when a user in the middle of a flow sends
+// the start command again. Users outside of any flow are not affected.
+// Without it the start command is handled by the current state like any other
+// update.
+func (m *StateManager[S, U]) SetReentry(r Reentry[S, U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.reentry = &r
+	return nil
+}
+
+// reenter applies the reentry policy to an update of a user in the middle of
+// a flow. It reports whether the update was consumed.
+func (m *StateManager[S, U]) reenter(update U, userState *UserState[S], state *State[S, U], key int64) (bool, error) {
+	if !m.reentry.IsStart(update) {
+		if userState.RestartPending {
+			userState.RestartPending = false
+			return false, m.save(key, userState)
+		}
+		return false, nil
+	}
+
+	switch m.reentry.Policy {
+	case ReentryConfirm:
+		if userState.RestartPending {
+			return true, m.restart(update, userState, key)
+		}
+		userState.RestartPending = true
+		if err := m.save(key, userState); err != nil {
+			return true, err
+		}
+		return true, m.reply(update, m.reentry.Confirm)
+	case ReentryRestart:
+		return true, m.restart(update, userState, key)
+	case ReentryResume:
+		if m.reentry.Summary != nil {
+			summary, err := m.reentry.Summary.Render(*userState)
+			if err != nil {
+				return true, err
+			}
+			if err := m.reply(update, summary); err != nil {
+				return true, err
+			}
+		}
+		if state.hasPrompt() {
+			pc := PromptContext[U]{Previous: previousState(userState), Reason: PromptResumed, Update: &update}
+			return true, m.sendPrompt(pc, userState, state, key)
+		}
+	}
+	return true, nil
+}
+
+// restart moves the user back to the initial state of their flow with fresh
+// data and sends its prompt.
+func (m *StateManager[S, U]) restart(update U, userState *UserState[S], key int64) error {
+	fresh := UserState[S]{Flow: userState.Flow, Source: m.source(update), LastUpdateID: userState.LastUpdateID, Language: userState.Language, Meta: userState.Meta}
+	initialState := m.flows[userState.Flow]
+	if userState.Flow == "" {
+		var err error
+		if fresh.Flow, initialState, fresh.Data, err = m.initial(update); err != nil {
+			return err
+		}
+	}
+	return m.transition(update, &fresh, initialState, key)
+}
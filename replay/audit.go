@@ -0,0 +1,91 @@
+package replay
+
+import (
+	"context"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// AuditStep is the outcome of replaying one entry of an audit log.
+type AuditStep[S, U any] struct {
+	Entry   tgsm.AuditEntry
+	Update  *U // Update rebuilt from the recorded answer, nil when the move was forced
+	Handled bool
+	Err     error
+	State   tgsm.UserState[S] // State of the user after the step
+}
+
+// Diverged reports whether the step left the user elsewhere than the entry
+// recorded.
+func (s AuditStep[S, U]) Diverged() bool {
+	return s.State.CurrentState != s.Entry.To || s.State.Outcome != s.Entry.Outcome
+}
+
+// Audit replays the audit log of the user identified by key against a fresh
+// manager made by build, which must use the in-memory storage it is given and
+// should send no prompts, so the replay has no effect outside the sandbox.
+// Recorded answers are rebuilt into updates by update and handled by the
+// current state definitions; moves made by the bot, and answers recorded as
+// tgsm.Redacted, are forced with SetState or EndSession.
+//
+// The replay stops at the first step failing or leaving the user elsewhere
+// than recorded, which is the last step returned. The audit log only holds
+// answers moving the user, so answers that were rejected are not replayed.
+func Audit[S, U any](ctx context.Context, log tgsm.AuditReader, key int64, build func(storage tgsm.StateStorage[S]) (*tgsm.StateManager[S, U], error), update func(key int64, text string) U) ([]AuditStep[S, U], error) {
+	entries, err := log.Entries(ctx, key)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	storage := tgsm.NewInMemoryStorage[S]()
+	manager, err := build(storage)
+	if err != nil {
+		return nil, err
+	}
+	// Start the user where the log starts rather than replaying how the
+	// flow was entered, which the log does not record
+	if first := entries[0]; first.From != "" {
+		if err := storage.Set(key, tgsm.UserState[S]{CurrentState: first.From, Flow: first.Flow, PromptSent: true}); err != nil {
+			return nil, err
+		}
+	}
+
+	steps := make([]AuditStep[S, U], 0, len(entries))
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return steps, err
+		}
+		step := AuditStep[S, U]{Entry: entry}
+		switch {
+		case entry.Update != "" && entry.Update != tgsm.Redacted:
+			u := update(key, entry.Update)
+			step.Update = &u
+			step.Handled, step.Err = manager.Handle(u)
+		case entry.To != "":
+			step.Err = forceState(storage, manager, key, entry.To)
+		default:
+			step.Err = manager.EndSession(key, entry.Outcome)
+		}
+		if step.Err == nil {
+			step.State, _, step.Err = manager.Current(key)
+		}
+		steps = append(steps, step)
+		if step.Err != nil || step.Diverged() {
+			break
+		}
+	}
+	return steps, nil
+}
+
+// forceState moves the user to the named state with its prompt marked as
+// sent, as the answer replayed next was given to that prompt.
+func forceState[S, U any](storage tgsm.StateStorage[S], manager *tgsm.StateManager[S, U], key int64, state string) error {
+	if err := manager.SetState(key, state); err != nil {
+		return err
+	}
+	userState, _, err := storage.Get(key)
+	if err != nil {
+		return err
+	}
+	userState.PromptSent = true
+	return storage.Set(key, userState)
+}
@@ -0,0 +1,77 @@
+// Package replay records updates to a file and replays them against a state
+// manager, so conversations seen in production can be reproduced locally
+// with in-memory storage. Audit replays the answers kept in the audit log of a
+// user instead, to check whether the current state definitions still take
+// the user down the recorded path.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// record is a recorded update, stored as a line of JSON.
+type record[U any] struct {
+	Time   time.Time `json:"time"`
+	Update U         `json:"update"`
+}
+
+// Recorder writes updates to a stream as lines of JSON. A Recorder is safe
+// for concurrent use.
+type Recorder[U any] struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	sanitize func(update U) U
+}
+
+// NewRecorder creates a recorder writing to w. Every update is passed through
+// sanitize, when given, to strip personal data before it is written.
+func NewRecorder[U any](w io.Writer, sanitize func(update U) U) *Recorder[U] {
+	return &Recorder[U]{enc: json.NewEncoder(w), sanitize: sanitize}
+}
+
+// Record writes the update.
+func (r *Recorder[U]) Record(update U) error {
+	if r.sanitize != nil {
+		update = r.sanitize(update)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(record[U]{Time: time.Now(), Update: update})
+}
+
+// Step is the outcome of replaying one update.
+type Step[U any] struct {
+	Time    time.Time // When the update was recorded
+	Update  U
+	Handled bool
+	Err     error
+}
+
+// Replay feeds the updates recorded in r to manager in order. Errors of
+// individual updates are reported in the steps and do not stop the replay;
+// the returned error reports a malformed recording.
+func Replay[S, U any](r io.Reader, manager *tgsm.StateManager[S, U]) ([]Step[U], error) {
+	var steps []Step[U]
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec record[U]
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return steps, fmt.Errorf("line %d: %w", line, err)
+		}
+		step := Step[U]{Time: rec.Time, Update: rec.Update}
+		step.Handled, step.Err = manager.Handle(rec.Update)
+		steps = append(steps, step)
+	}
+	return steps, scanner.Err()
+}
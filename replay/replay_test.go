@@ -0,0 +1,117 @@
+package replay_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/replay"
+)
+
+type update struct {
+	ChatID int64
+	Name   string
+	Text   string
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := replay.NewRecorder(&buf, func(u update) update {
+		u.Name = ""
+		return u
+	})
+	for _, text := range []string{"hi", "", "Tokyo"} {
+		require.NoError(t, recorder.Record(update{ChatID: 7, Name: "Alice", Text: text}))
+	}
+	assert.NotContains(t, buf.String(), "Alice")
+
+	sm := tgsm.NewStateManager[string, update](tgsm.NewInMemoryStorage[string](), func(u update) int64 { return u.ChatID })
+	sm.SetInitialState("city")
+	require.NoError(t, sm.Add(&tgsm.State[string, update]{
+		Name: "city",
+		Handle: func(u update, city *string) (string, error) {
+			if u.Text == "" || strings.HasPrefix(u.Text, "h") {
+				return "", tgsm.ErrValidation
+			}
+			*city = u.Text
+			return "", nil
+		},
+	}))
+
+	steps, err := replay.Replay(&buf, sm)
+	require.NoError(t, err)
+	require.Len(t, steps, 3)
+	assert.Equal(t, "Tokyo", steps[2].Update.Text)
+	assert.False(t, steps[0].Time.IsZero())
+
+	state, _, err := sm.Current(7)
+	require.NoError(t, err)
+	assert.Equal(t, "Tokyo", state.Data)
+	assert.Equal(t, 0, state.Failures)
+
+	_, err = replay.Replay(strings.NewReader("{not json"), sm)
+	assert.Error(t, err)
+}
+
+func TestAudit(t *testing.T) {
+	build := func(minAge int) func(storage tgsm.StateStorage[string]) (*tgsm.StateManager[string, update], error) {
+		return func(storage tgsm.StateStorage[string]) (*tgsm.StateManager[string, update], error) {
+			sm := tgsm.NewStateManager[string, update](storage, func(u update) int64 { return u.ChatID })
+			sm.SetInitialState("name")
+			return sm, sm.Add(
+				&tgsm.State[string, update]{
+					Name:   "name",
+					Prompt: func(update, *string) error { return nil },
+					Handle: func(u update, data *string) (string, error) {
+						*data = u.Text
+						return "age", nil
+					},
+				},
+				&tgsm.State[string, update]{
+					Name:   "age",
+					Prompt: func(update, *string) error { return nil },
+					Handle: func(u update, data *string) (string, error) {
+						if len(u.Text) < minAge {
+							return "", tgsm.ErrValidation
+						}
+						return "", nil
+					},
+				},
+			)
+		}
+	}
+
+	audit := &tgsm.MemoryAuditStorage{}
+	sm, err := build(1)(tgsm.NewInMemoryStorage[string]())
+	require.NoError(t, err)
+	require.NoError(t, sm.SetAudit(audit, func(u update) string { return u.Text }))
+	for _, text := range []string{"hi", "Alice", "30"} {
+		_, err := sm.Handle(update{ChatID: 7, Text: text})
+		require.NoError(t, err)
+	}
+	require.NoError(t, sm.SetState(7, "age", tgsm.WithPrompt(update{ChatID: 7})))
+	_, err = sm.Handle(update{ChatID: 7, Text: "41"})
+	require.NoError(t, err)
+
+	toUpdate := func(key int64, text string) update { return update{ChatID: key, Text: text} }
+	steps, err := replay.Audit(context.Background(), audit, 7, build(1), toUpdate)
+	require.NoError(t, err)
+	require.Len(t, steps, 4)
+	for _, step := range steps {
+		assert.NoError(t, step.Err)
+		assert.False(t, step.Diverged())
+	}
+	assert.Nil(t, steps[2].Update)
+	assert.Equal(t, "Alice", steps[3].State.Data)
+
+	// A stricter age check no longer accepts the recorded answer
+	steps, err = replay.Audit(context.Background(), audit, 7, build(3), toUpdate)
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+	assert.True(t, steps[1].Diverged())
+	assert.Equal(t, "age", steps[1].State.CurrentState)
+}
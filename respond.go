@@ -0,0 +1,56 @@
+package tgstatemanager
+
+// ResponderFunc sends a reply to the chat an update came from. Bot adapters
+// install one so the manager can answer users on its own.
+type ResponderFunc[U any] func(update U, reply any) error
+
+// Response is what a HandleReply handler decides: the next state, as returned
+// by Handle, and a reply sent through the responder before moving on. A
+// reply returned along with ErrValidation is sent as the reason the answer
+// was rejected.
+type Response struct {
+	Next  string
+	Reply any // Optional: Sent to the update's chat through the responder
+}
+
+// NotifierFunc sends a message to the chat with the given ID. Bot adapters
+// install one so the manager can message chats other than the update's one.
+// The manager passes the keys of users as chat IDs, such as for keyed prompts
+// sent without an update, so the notifier of a manager whose keys are not
+// chat IDs must map them to chats.
+type NotifierFunc func(chatID int64, msg any) error
+
+// SetResponder sets the function the manager uses to reply to users.
+func (m *StateManager[S, U]) SetResponder(fn ResponderFunc[U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.responder = fn
+	return nil
+}
+
+// SetNotifier sets the function the manager uses to message chats by ID.
+func (m *StateManager[S, U]) SetNotifier(fn NotifierFunc) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.notifier = fn
+	return nil
+}
+
+// reply sends reply through the responder. It does nothing when either the
+// responder or the reply is missing.
+func (m *StateManager[S, U]) reply(update U, reply any) error {
+	if m.responder == nil || reply == nil {
+		return nil
+	}
+	return m.responder(update, reply)
+}
+
+// notify sends msg through the notifier. It does nothing when no notifier is set.
+func (m *StateManager[S, U]) notify(chatID int64, msg any) error {
+	if m.notifier == nil {
+		return nil
+	}
+	return m.notifier(chatID, msg)
+}
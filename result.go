@@ -0,0 +1,35 @@
+package tgstatemanager
+
+// Result describes what handling an update did to the user.
+type Result struct {
+	Handled  bool
+	From     string  // State the user was in before the update, empty for new or finished users
+	To       string  // State the user is in after the update, empty once finished
+	Finished bool    // The user is done with their flow
+	Outcome  Outcome // How the flow ended, once Finished
+}
+
+// handleRecord collects the states a single update moved the user between.
+type handleRecord[S any] struct {
+	from  string
+	state UserState[S]
+}
+
+// HandleResult processes an update like Handle and reports where it left the
+// user, so callers can act on the outcome, such as a finished flow, without
+// reading the state back from storage.
+func (m *StateManager[S, U]) HandleResult(update U) (Result, error) {
+	// Handle the update on a copy of the manager recording the states it
+	// reads and saves
+	var rec handleRecord[S]
+	call := *m
+	call.record = &rec
+	handled, err := call.Handle(update)
+	return Result{
+		Handled:  handled,
+		From:     rec.from,
+		To:       rec.state.CurrentState,
+		Finished: rec.state.Finished,
+		Outcome:  rec.state.Outcome,
+	}, err
+}
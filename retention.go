@@ -0,0 +1,138 @@
+package tgstatemanager
+
+import (
+	"context"
+	"time"
+)
+
+// RetentionPolicy sets how long the sessions of a namespace are kept. The
+// namespace is the flow of a session, empty for sessions outside of any named
+// flow. Sessions are aged by the time they were last updated.
+type RetentionPolicy struct {
+	Namespace    string
+	InactiveFor  time.Duration // Delete unfinished sessions idle for this long, never when zero
+	ArchiveAfter time.Duration // Archive and delete finished sessions this old, never when zero
+}
+
+// ArchiveFunc receives finished sessions before retention deletes them.
+type ArchiveFunc[S any] func(id int64, userState UserState[S]) error
+
+// RetentionResult counts the sessions removed by a retention run.
+type RetentionResult struct {
+	Deleted  int // Inactive unfinished sessions
+	Archived int // Finished sessions
+}
+
+// SetRetention sets the retention policies applied by ApplyRetention and
+// StartRetention, at most one per namespace. Finished sessions are passed to
+// archive, when given, before they are deleted. Sessions of namespaces
+// without a policy are kept.
+func (m *StateManager[S, U]) SetRetention(archive ArchiveFunc[S], policies ...RetentionPolicy) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.retention = make(map[string]RetentionPolicy, len(policies))
+	for _, policy := range policies {
+		m.retention[policy.Namespace] = policy
+	}
+	m.archive = archive
+	return nil
+}
+
+// ApplyRetention walks every stored session once, deleting and archiving
+// those the retention policies expire. Each session is read again under the
+// user's lock before it is removed, so sessions updated since the walk are
+// kept. It requires the storage to implement IterableStorage and Deleter. A
+// session failing to archive is kept and stops the run.
+func (m *StateManager[S, U]) ApplyRetention(ctx context.Context) (RetentionResult, error) {
+	var result RetentionResult
+	storage, ok := m.storage.(IterableStorage[S])
+	if !ok {
+		return result, ErrNotIterable
+	}
+	if len(m.retention) == 0 {
+		return result, nil
+	}
+
+	now := m.now()
+	expires := func(_ int64, userState UserState[S]) bool {
+		expired, _ := m.retires(userState, now)
+		return expired
+	}
+	var ids []int64
+	err := storage.ForEach(ctx, func(id int64, userState UserState[S]) error {
+		if expires(id, userState) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		_, err := m.applyJob(ctx, id, expires, func(id int64, userState UserState[S]) error {
+			if _, archived := m.retires(userState, now); archived {
+				if m.archive != nil {
+					if err := m.archive(id, userState); err != nil {
+						return err
+					}
+				}
+				if err := deleteState(m.storage, id); err != nil {
+					return err
+				}
+				result.Archived++
+				return nil
+			}
+			if err := deleteState(m.storage, id); err != nil {
+				return err
+			}
+			m.expired(id, userState)
+			result.Deleted++
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// retires reports whether the retention policies expire the session at now,
+// and whether it is archived as finished rather than deleted as inactive.
+func (m *StateManager[S, U]) retires(userState UserState[S], now time.Time) (expired, archived bool) {
+	policy, ok := m.retention[userState.Flow]
+	if !ok || userState.UpdatedAt.IsZero() {
+		return false, false
+	}
+	age := now.Sub(userState.UpdatedAt)
+	switch {
+	case userState.Finished && policy.ArchiveAfter > 0 && age >= policy.ArchiveAfter:
+		return true, true
+	case !userState.Finished && policy.InactiveFor > 0 && age >= policy.InactiveFor:
+		return true, false
+	}
+	return false, false
+}
+
+// StartRetention starts a goroutine applying the retention policies every
+// interval until ctx is done. Failed runs are reported as EventError events.
+func (m *StateManager[S, U]) StartRetention(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := m.ApplyRetention(ctx); err != nil && ctx.Err() == nil {
+					m.emit(Event{Kind: EventError, Err: err})
+				}
+			}
+		}
+	}()
+}
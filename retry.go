@@ -0,0 +1,152 @@
+package tgstatemanager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// RetryingStorage retries the operations of a storage failing with transient
+// errors, such as timeouts and connection resets, with exponential backoff
+// and jitter, so a momentary outage of the backend does not drop answers.
+type RetryingStorage[S any] struct {
+	backend   StateStorage[S]
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	retryable func(err error) bool
+	random    Random
+}
+
+// NewRetryingStorage creates a storage making up to attempts attempts of
+// every backend operation. The n-th retry waits up to baseDelay*2^(n-1),
+// at most one second by default, with the actual delay drawn at random.
+func NewRetryingStorage[S any](backend StateStorage[S], attempts int, baseDelay time.Duration) *RetryingStorage[S] {
+	return &RetryingStorage[S]{
+		backend:   backend,
+		attempts:  max(attempts, 1),
+		baseDelay: baseDelay,
+		maxDelay:  time.Second,
+		retryable: IsTransient,
+	}
+}
+
+// SetMaxDelay caps the delay between two attempts.
+func (s *RetryingStorage[S]) SetMaxDelay(d time.Duration) {
+	s.maxDelay = d
+}
+
+// SetRetryable sets the function deciding which errors are retried,
+// IsTransient by default.
+func (s *RetryingStorage[S]) SetRetryable(fn func(err error) bool) {
+	s.retryable = fn
+}
+
+// SetRandom sets the source backoff jitter is drawn from, the global source
+// of math/rand/v2 by default.
+func (s *RetryingStorage[S]) SetRandom(r Random) {
+	s.random = r
+}
+
+// Get retrieves a user state from the backend, retrying transient errors.
+func (s *RetryingStorage[S]) Get(id int64) (UserState[S], bool, error) {
+	var state UserState[S]
+	var exists bool
+	err := s.retry(func() (err error) {
+		state, exists, err = s.backend.Get(id)
+		return err
+	})
+	return state, exists, err
+}
+
+// Set stores a user state in the backend, retrying transient errors.
+func (s *RetryingStorage[S]) Set(id int64, state UserState[S]) error {
+	return s.retry(func() error { return s.backend.Set(id, state) })
+}
+
+// SetWithTTL stores a user state in the backend with its own TTL, retrying
+// transient errors.
+func (s *RetryingStorage[S]) SetWithTTL(id int64, state UserState[S], ttl time.Duration) error {
+	return s.retry(func() error { return setWithTTL(s.backend, id, state, ttl) })
+}
+
+// Delete removes a user state from the backend, retrying transient errors.
+func (s *RetryingStorage[S]) Delete(id int64) error {
+	return s.retry(func() error { return deleteState(s.backend, id) })
+}
+
+// GetMany retrieves the user states for the given IDs from the backend,
+// with a single GetMany when it implements BatchStorage, retrying transient
+// errors.
+func (s *RetryingStorage[S]) GetMany(ids []int64) (map[int64]UserState[S], error) {
+	var states map[int64]UserState[S]
+	err := s.retry(func() (err error) {
+		states, err = getMany(s.backend, ids)
+		return err
+	})
+	return states, err
+}
+
+// SetMany stores the given user states in the backend, with a single SetMany
+// when it implements BatchStorage, retrying transient errors.
+func (s *RetryingStorage[S]) SetMany(states map[int64]UserState[S]) error {
+	return s.retry(func() error { return setMany(s.backend, states) })
+}
+
+// ForEach calls fn for every state of the backend, which must implement
+// IterableStorage. Walks are not retried, as fn may have seen some of the
+// states already.
+func (s *RetryingStorage[S]) ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error {
+	return forEach(ctx, s.backend, fn)
+}
+
+// Ping verifies the connectivity of the backend when it implements
+// HealthChecker. Health checks are not retried.
+func (s *RetryingStorage[S]) Ping(ctx context.Context) error {
+	if checker, ok := s.backend.(HealthChecker); ok {
+		return checker.Ping(ctx)
+	}
+	return nil
+}
+
+// retry calls op until it succeeds, fails with an error that is not
+// retryable or runs out of attempts.
+func (s *RetryingStorage[S]) retry(op func() error) error {
+	var err error
+	for attempt := range s.attempts {
+		if attempt > 0 {
+			time.Sleep(s.backoff(attempt))
+		}
+		if err = op(); err == nil || !s.retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns the delay before the given retry.
+func (s *RetryingStorage[S]) backoff(retry int) time.Duration {
+	ceiling := s.baseDelay << min(retry-1, 30)
+	if ceiling <= 0 || ceiling > s.maxDelay {
+		ceiling = s.maxDelay
+	}
+	return randomDuration(s.random, ceiling)
+}
+
+// IsTransient reports whether err is likely to go away on retry: network
+// timeouts, deadline expiry and dropped or refused connections.
+func IsTransient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
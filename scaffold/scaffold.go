@@ -0,0 +1,149 @@
+// Package scaffold generates starter bots built with tg-state-manager from a
+// set of templates, each a working flow with its states, storage setup and
+// tests. It backs the tgsm new command.
+package scaffold
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"go/format"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+var (
+	// ErrUnknownTemplate is returned when generating from a template that
+	// does not exist.
+	ErrUnknownTemplate = errors.New("unknown template")
+	// ErrUnknownStorage is returned for a storage other than those listed by
+	// Storages.
+	ErrUnknownStorage = errors.New("unknown storage")
+)
+
+//go:embed templates
+var files embed.FS
+
+// Template describes a starter bot.
+type Template struct {
+	Name  string
+	Title string
+}
+
+// templates lists the available templates.
+var templates = []Template{
+	{Name: "booking", Title: "booking bot scheduling appointments"},
+	{Name: "captcha", Title: "group captcha bot challenging members"},
+	{Name: "quiz", Title: "quiz bot scoring multiple-choice answers"},
+	{Name: "support", Title: "support bot filing tickets"},
+}
+
+// Storages lists the storages a generated bot may keep its states in.
+var Storages = []string{"memory", "redis", "file"}
+
+// Templates returns the available templates, sorted by name.
+func Templates() []Template {
+	return slices.Clone(templates)
+}
+
+// Options configure a generated bot.
+type Options struct {
+	Module  string // Module path of the bot, the template name by default
+	Storage string // One of Storages, memory by default
+}
+
+// data is what the files of a template are rendered with.
+type data struct {
+	Template
+	Module  string
+	Storage string
+}
+
+// Generate writes the bot of the named template into dir, creating it if
+// needed, and returns the paths of the written files. Existing files are
+// never overwritten: Generate fails before writing anything if one of the
+// files exists.
+func Generate(name, dir string, opts Options) ([]string, error) {
+	i := slices.IndexFunc(templates, func(t Template) bool { return t.Name == name })
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTemplate, name)
+	}
+	d := data{Template: templates[i], Module: opts.Module, Storage: opts.Storage}
+	if d.Module == "" {
+		d.Module = name
+	}
+	if d.Storage == "" {
+		d.Storage = "memory"
+	}
+	if !slices.Contains(Storages, d.Storage) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStorage, d.Storage)
+	}
+
+	rendered := make(map[string][]byte)
+	for _, src := range []string{"templates/common", "templates/" + name} {
+		entries, err := fs.ReadDir(files, src)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			out, err := render(path.Join(src, entry.Name()), d)
+			if err != nil {
+				return nil, err
+			}
+			rendered[strings.TrimSuffix(entry.Name(), ".tmpl")] = out
+		}
+	}
+
+	names := make([]string, 0, len(rendered))
+	for file := range rendered {
+		names = append(names, file)
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, file), fs.ErrExist)
+		}
+	}
+	slices.Sort(names)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	written := make([]string, len(names))
+	for i, file := range names {
+		written[i] = filepath.Join(dir, file)
+		if err := os.WriteFile(written[i], rendered[file], 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return written, nil
+}
+
+// render executes a template file, formatting the result when it is Go code.
+// Templates use [[ ]] as delimiters, leaving {{ }} to the Go templates of the
+// generated code.
+func render(name string, d data) ([]byte, error) {
+	src, err := files.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Delims("[[", "]]").Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, ".go.tmpl") {
+		return buf.Bytes(), nil
+	}
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting %s: %w", name, err)
+	}
+	return out, nil
+}
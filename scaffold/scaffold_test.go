@@ -0,0 +1,88 @@
+package scaffold_test
+
+import (
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/sudosz/tg-state-manager/scaffold"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, tmpl := range scaffold.Templates() {
+		t.Run(tmpl.Name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), tmpl.Name)
+			written, err := scaffold.Generate(tmpl.Name, dir, scaffold.Options{Module: "example.com/bot", Storage: "redis"})
+			require.NoError(t, err)
+			assert.Len(t, written, 5)
+
+			for _, file := range written {
+				if strings.HasSuffix(file, ".go") {
+					_, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.AllErrors)
+					assert.NoError(t, err)
+				}
+			}
+			mod, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+			require.NoError(t, err)
+			assert.Contains(t, string(mod), "module example.com/bot")
+			main, err := os.ReadFile(filepath.Join(dir, "main.go"))
+			require.NoError(t, err)
+			assert.Contains(t, string(main), "tgsm.NewRedisStorage")
+
+			vet(t, dir)
+		})
+	}
+}
+
+// vet type-checks the project generated in dir against this repository with
+// go vet, offline, using the requirements and checksums of the repository.
+func vet(t *testing.T, dir string) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping go vet of the generated project in short mode")
+	}
+	gotool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	root, err := filepath.Abs("..")
+	require.NoError(t, err)
+	repoMod, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	require.NoError(t, err)
+	_, requires, ok := strings.Cut(string(repoMod), "\nrequire")
+	require.True(t, ok)
+	mod := "module example.com/bot\n\ngo 1.24\n\n" +
+		"require github.com/sudosz/tg-state-manager v0.0.0\n\n" +
+		"replace github.com/sudosz/tg-state-manager => " + root + "\n\nrequire" + requires
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte(mod), 0o644))
+	sum, err := os.ReadFile(filepath.Join(root, "go.sum"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.sum"), sum, 0o644))
+
+	cmd := exec.Command(gotool, "vet", "./...")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=-mod=mod", "GOPROXY=off")
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, "go vet of the generated project:\n%s", out)
+}
+
+func TestGenerateErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := scaffold.Generate("chess", dir, scaffold.Options{})
+	assert.ErrorIs(t, err, scaffold.ErrUnknownTemplate)
+	_, err = scaffold.Generate("quiz", dir, scaffold.Options{Storage: "sqlite"})
+	assert.ErrorIs(t, err, scaffold.ErrUnknownStorage)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0o644))
+	_, err = scaffold.Generate("quiz", dir, scaffold.Options{})
+	assert.ErrorIs(t, err, fs.ErrExist)
+	_, err = os.Stat(filepath.Join(dir, "flow.go"))
+	assert.ErrorIs(t, err, fs.ErrNotExist, "nothing is written when a file exists")
+}
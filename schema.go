@@ -0,0 +1,135 @@
+package tgstatemanager
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"slices"
+)
+
+// Schema describes the configuration of a manager: its registered states,
+// named flows and initial state. Written by ExportSchema at build or deploy
+// time, it lets the next release be checked against the sessions stored by
+// the running one before they are switched over.
+type Schema struct {
+	InitialState string            `json:",omitempty"`
+	Flows        map[string]string `json:",omitempty"` // Initial state by flow name
+	States       []StateInfo
+}
+
+// SchemaDiff lists what changed between two schemas.
+type SchemaDiff struct {
+	AddedStates   []string
+	RemovedStates []string
+	AddedFlows    []string
+	RemovedFlows  []string
+}
+
+// Compatibility reports the stored sessions a schema would orphan: active
+// sessions in states or flows it does not register, by name.
+type Compatibility struct {
+	Checked        int            // Active sessions checked
+	OrphanedStates map[string]int // Sessions per current state missing from the schema
+	OrphanedFlows  map[string]int // Sessions per flow missing from the schema
+}
+
+// Schema returns the configuration of the manager.
+func (m *StateManager[S, U]) Schema() Schema {
+	return Schema{
+		InitialState: m.initialState,
+		Flows:        maps.Clone(m.flows),
+		States:       m.States(),
+	}
+}
+
+// ExportSchema writes the configuration of the manager to w as indented
+// JSON, which ImportSchema reads back.
+func (m *StateManager[S, U]) ExportSchema(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m.Schema())
+}
+
+// ImportSchema reads a schema written by ExportSchema.
+func ImportSchema(r io.Reader) (Schema, error) {
+	var schema Schema
+	err := json.NewDecoder(r).Decode(&schema)
+	return schema, err
+}
+
+// HasState reports whether the schema registers the state.
+func (s Schema) HasState(name string) bool {
+	return slices.ContainsFunc(s.States, func(info StateInfo) bool { return info.Name == name })
+}
+
+// Diff lists the states and flows added and removed by next, sorted by name.
+func (s Schema) Diff(next Schema) SchemaDiff {
+	var diff SchemaDiff
+	for _, info := range next.States {
+		if !s.HasState(info.Name) {
+			diff.AddedStates = append(diff.AddedStates, info.Name)
+		}
+	}
+	for _, info := range s.States {
+		if !next.HasState(info.Name) {
+			diff.RemovedStates = append(diff.RemovedStates, info.Name)
+		}
+	}
+	for _, flow := range slices.Sorted(maps.Keys(next.Flows)) {
+		if _, ok := s.Flows[flow]; !ok {
+			diff.AddedFlows = append(diff.AddedFlows, flow)
+		}
+	}
+	for _, flow := range slices.Sorted(maps.Keys(s.Flows)) {
+		if _, ok := next.Flows[flow]; !ok {
+			diff.RemovedFlows = append(diff.RemovedFlows, flow)
+		}
+	}
+	slices.Sort(diff.AddedStates)
+	slices.Sort(diff.RemovedStates)
+	return diff
+}
+
+// CheckSchema walks storage once, finding the active sessions schema would
+// orphan. Run it before deploying a release, with the schema the release
+// exports, to catch states removed or renamed while users are still in them.
+func CheckSchema[S any](ctx context.Context, storage IterableStorage[S], schema Schema) (Compatibility, error) {
+	compat := Compatibility{
+		OrphanedStates: make(map[string]int),
+		OrphanedFlows:  make(map[string]int),
+	}
+	states := make(map[string]bool, len(schema.States))
+	for _, info := range schema.States {
+		states[info.Name] = true
+	}
+	err := storage.ForEach(ctx, func(_ int64, userState UserState[S]) error {
+		if userState.Finished || userState.CurrentState == "" {
+			return nil
+		}
+		compat.Checked++
+		if !states[userState.CurrentState] {
+			compat.OrphanedStates[userState.CurrentState]++
+		}
+		if _, ok := schema.Flows[userState.Flow]; userState.Flow != "" && !ok {
+			compat.OrphanedFlows[userState.Flow]++
+		}
+		return nil
+	})
+	return compat, err
+}
+
+// Compatible reports whether no session would be orphaned.
+func (c Compatibility) Compatible() bool {
+	return len(c.OrphanedStates) == 0 && len(c.OrphanedFlows) == 0
+}
+
+// CheckSchema checks the stored sessions against schema, as by the
+// CheckSchema function. It requires the storage to implement IterableStorage.
+func (m *StateManager[S, U]) CheckSchema(ctx context.Context, schema Schema) (Compatibility, error) {
+	storage, ok := m.storage.(IterableStorage[S])
+	if !ok {
+		return Compatibility{}, ErrNotIterable
+	}
+	return CheckSchema(ctx, storage, schema)
+}
@@ -0,0 +1,26 @@
+package tgstatemanager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HashSecret derives a keyed SHA-256 digest of a secret answer, so sensitive
+// input can be stored and verified later without keeping the plain text.
+func HashSecret(secret string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySecret reports whether secret matches a digest produced by HashSecret.
+func VerifySecret(secret string, key []byte, digest string) bool {
+	want, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(secret))
+	return hmac.Equal(mac.Sum(nil), want)
+}
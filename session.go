@@ -0,0 +1,102 @@
+package tgstatemanager
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Session is a read-only snapshot of a user's session, shaped for services
+// other than the bot, such as a website showing a "finish your registration"
+// banner. It carries only the data fields and metadata selected by
+// SetSessionFields.
+type Session struct {
+	Key       int64
+	Flow      string `json:",omitempty"`
+	State     string `json:",omitempty"` // Empty once the flow is finished
+	Finished  bool
+	Outcome   Outcome           `json:",omitempty"`
+	Fields    map[string]any    `json:",omitempty"`
+	Meta      map[string]string `json:",omitempty"`
+	CreatedAt time.Time         `json:",omitzero"`
+	UpdatedAt time.Time         `json:",omitzero"`
+}
+
+// SessionReader reads session snapshots. It is implemented by StateManager
+// and lets other services depend on reading sessions only.
+type SessionReader interface {
+	Session(key int64) (Session, bool, error)
+}
+
+// SetSessionFields sets the function selecting the data fields exposed by
+// Session, along with the names of the metadata entries exposed. Without
+// them, sessions expose no data and no metadata at all, so sensitive fields
+// cannot leak by accident.
+func (m *StateManager[S, U]) SetSessionFields(fn func(data S) map[string]any, meta ...string) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.sessionFields = fn
+	m.sessionMeta = slices.Clone(meta)
+	return nil
+}
+
+// Session returns a snapshot of the session of the user identified by key.
+// The boolean reports whether the user has a session at all.
+func (m *StateManager[S, U]) Session(key int64) (Session, bool, error) {
+	userState, exists, err := m.storage.Get(key)
+	if err != nil || !exists {
+		return Session{}, false, err
+	}
+	return m.session(key, userState), true, nil
+}
+
+// Sessions calls fn with the snapshot of every stored session until fn returns
+// an error or ctx is done, and returns that error. It requires the storage to
+// implement IterableStorage.
+func (m *StateManager[S, U]) Sessions(ctx context.Context, fn func(session Session) error) error {
+	storage, ok := m.storage.(IterableStorage[S])
+	if !ok {
+		return ErrNotIterable
+	}
+	return storage.ForEach(ctx, func(key int64, userState UserState[S]) error {
+		return fn(m.session(key, userState))
+	})
+}
+
+// DeleteSession deletes the state and data of the user identified by key, who
+// starts over on their next update. No hook is run. It requires the storage
+// to implement Deleter.
+func (m *StateManager[S, U]) DeleteSession(key int64) error {
+	unlock, err := m.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return deleteState(m.storage, key)
+}
+
+// session returns the snapshot of a stored user state.
+func (m *StateManager[S, U]) session(key int64, userState UserState[S]) Session {
+	session := Session{
+		Key:       key,
+		Flow:      userState.Flow,
+		State:     userState.CurrentState,
+		Finished:  userState.Finished,
+		Outcome:   userState.Outcome,
+		CreatedAt: userState.CreatedAt,
+		UpdatedAt: userState.UpdatedAt,
+	}
+	if m.sessionFields != nil {
+		session.Fields = m.sessionFields(userState.Data)
+	}
+	for _, name := range m.sessionMeta {
+		if value, ok := userState.Meta[name]; ok {
+			if session.Meta == nil {
+				session.Meta = make(map[string]string, len(m.sessionMeta))
+			}
+			session.Meta[name] = value
+		}
+	}
+	return session
+}
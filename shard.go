@@ -0,0 +1,116 @@
+package tgstatemanager
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"time"
+)
+
+// ShardedStorage spreads user states over several storages by a hash of the
+// user ID. Sharding InMemoryStorage spreads its lock, which otherwise becomes
+// a point of contention with tens of thousands of concurrent chats.
+type ShardedStorage[S any] struct {
+	shards []StateStorage[S]
+}
+
+// NewShardedStorage creates a storage of n shards made by newShard, such as
+// in-memory storages configured with a TTL. Settings bounding a shard, such
+// as a capacity, apply to each shard on its own.
+func NewShardedStorage[S any](n int, newShard func() StateStorage[S]) *ShardedStorage[S] {
+	shards := make([]StateStorage[S], max(n, 1))
+	for i := range shards {
+		shards[i] = newShard()
+	}
+	return &ShardedStorage[S]{shards: shards}
+}
+
+// NewShardedInMemoryStorage creates a storage of n in-memory shards.
+func NewShardedInMemoryStorage[S any](n int) *ShardedStorage[S] {
+	return NewShardedStorage(n, func() StateStorage[S] { return NewInMemoryStorage[S]() })
+}
+
+// shard returns the index of the shard holding id. The ID is hashed so that
+// sequential IDs land on different shards.
+func (s *ShardedStorage[S]) shard(id int64) int {
+	return int((uint64(id) * 0x9E3779B97F4A7C15 >> 32) % uint64(len(s.shards)))
+}
+
+// Get retrieves a user state from its shard.
+func (s *ShardedStorage[S]) Get(id int64) (UserState[S], bool, error) {
+	return s.shards[s.shard(id)].Get(id)
+}
+
+// Set stores a user state in its shard.
+func (s *ShardedStorage[S]) Set(id int64, state UserState[S]) error {
+	return s.shards[s.shard(id)].Set(id, state)
+}
+
+// SetWithTTL stores a user state in its shard with its own TTL.
+func (s *ShardedStorage[S]) SetWithTTL(id int64, state UserState[S], ttl time.Duration) error {
+	return setWithTTL(s.shards[s.shard(id)], id, state, ttl)
+}
+
+// Delete removes a user state from its shard.
+func (s *ShardedStorage[S]) Delete(id int64) error {
+	return deleteState(s.shards[s.shard(id)], id)
+}
+
+// GetMany retrieves the user states for the given IDs, with one GetMany per
+// shard implementing BatchStorage.
+func (s *ShardedStorage[S]) GetMany(ids []int64) (map[int64]UserState[S], error) {
+	byShard := make(map[int][]int64)
+	for _, id := range ids {
+		byShard[s.shard(id)] = append(byShard[s.shard(id)], id)
+	}
+	states := make(map[int64]UserState[S], len(ids))
+	for i, ids := range byShard {
+		found, err := getMany(s.shards[i], ids)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(states, found)
+	}
+	return states, nil
+}
+
+// SetMany stores the given user states, with one SetMany per shard
+// implementing BatchStorage.
+func (s *ShardedStorage[S]) SetMany(states map[int64]UserState[S]) error {
+	byShard := make(map[int]map[int64]UserState[S])
+	for id, state := range states {
+		i := s.shard(id)
+		if byShard[i] == nil {
+			byShard[i] = make(map[int64]UserState[S])
+		}
+		byShard[i][id] = state
+	}
+	for i, states := range byShard {
+		if err := setMany(s.shards[i], states); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEach calls fn for every state of every shard, shard after shard. It
+// returns ErrNotIterable when a shard does not implement IterableStorage.
+func (s *ShardedStorage[S]) ForEach(ctx context.Context, fn func(id int64, state UserState[S]) error) error {
+	for _, shard := range s.shards {
+		if err := forEach(ctx, shard, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping verifies the connectivity of the shards implementing HealthChecker.
+func (s *ShardedStorage[S]) Ping(ctx context.Context) error {
+	var errs []error
+	for _, shard := range s.shards {
+		if checker, ok := shard.(HealthChecker); ok {
+			errs = append(errs, checker.Ping(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
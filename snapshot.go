@@ -0,0 +1,92 @@
+package tgstatemanager
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SaveSnapshot writes every unexpired state to the file at path, in the
+// format of Export. The snapshot is written next to the file and atomically
+// renamed over it, so a crash while saving keeps the previous snapshot.
+func (s *InMemoryStorage[S]) SaveSnapshot(path string) error {
+	s.mu.RLock()
+	writes := s.writes
+	s.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+
+	w := bufio.NewWriter(tmp)
+	if err := Export[S](context.Background(), s, w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.saved = writes
+	s.mu.Unlock()
+	return nil
+}
+
+// LoadSnapshot stores the states of the snapshot at path, as on startup. A
+// missing snapshot is not an error. Loaded states expire a full TTL after
+// being loaded.
+func (s *InMemoryStorage[S]) LoadSnapshot(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = Import[S](s, file)
+	return err
+}
+
+// StartSnapshots starts a goroutine saving a snapshot to path every interval
+// until ctx is done, skipping runs when no state was stored or deleted since
+// the last snapshot. Failed snapshots are retried on the next run. Writes
+// made after the last snapshot are lost on a crash; call SaveSnapshot on
+// shutdown to keep them.
+func (s *InMemoryStorage[S]) StartSnapshots(ctx context.Context, path string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.mu.RLock()
+				due := s.writes != s.saved
+				s.mu.RUnlock()
+				if due {
+					_ = s.SaveSnapshot(path)
+				}
+			}
+		}
+	}()
+}
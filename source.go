@@ -0,0 +1,51 @@
+package tgstatemanager
+
+// SourceKind identifies how a user's session was started.
+type SourceKind string
+
+const (
+	// SourceDeepLink marks sessions started through a deep link, with the
+	// link payload as detail.
+	SourceDeepLink SourceKind = "deeplink"
+	// SourceCommand marks sessions started by a bot command, with the command
+	// as detail.
+	SourceCommand SourceKind = "command"
+	// SourceAdmin marks sessions forced on the user by an administrator.
+	SourceAdmin SourceKind = "admin"
+	// SourceEvent marks sessions started in reaction to an external event.
+	SourceEvent SourceKind = "event"
+)
+
+// Source records how a user's session was started, so analytics can segment
+// users by acquisition source.
+type Source struct {
+	Kind   SourceKind `json:",omitempty"`
+	Detail string     `json:",omitempty"` // Deep link payload, command or event name
+}
+
+// SetSourceFunc sets the function recognizing the source of the update that
+// starts a new user's session. Bot adapters provide one recognizing deep
+// links and commands.
+func (m *StateManager[S, U]) SetSourceFunc(fn func(update U) Source) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.sourceFunc = fn
+	return nil
+}
+
+// WithSource records source as the origin of the session started by SetState
+// or StartFlow.
+func WithSource[U any](source Source) SetStateOption[U] {
+	return func(c *setStateConfig[U]) {
+		c.source = &source
+	}
+}
+
+// source returns the source of the session started by update.
+func (m *StateManager[S, U]) source(update U) Source {
+	if m.sourceFunc == nil {
+		return Source{}
+	}
+	return m.sourceFunc(update)
+}
@@ -1,8 +1,11 @@
 package tgstatemanager
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -12,38 +15,140 @@ var (
 	ErrDuplicateState = errors.New("duplicate state name")
 	// ErrEmptyStateName is returned when attempting to add a state with an empty name.
 	ErrEmptyStateName = errors.New("empty state name")
+	// ErrUnknownState is returned when a state name is not registered with the manager.
+	ErrUnknownState = errors.New("unknown state")
 )
 
-// NopState is a special state name indicating no state transition should occur.
+// NopState is a special state name indicating no state transition should
+// occur. A Handle returning it keeps the user in the current state, without
+// sending its prompt again, and persists the changes it made to the data.
 const NopState = "<nop>"
 
 // State defines a state in the state machine.
 type State[S, U any] struct {
-	Name   string
-	Prompt func(update U, state *S) error           // Optional: Runs when entering the state
-	Handle func(update U, state *S) (string, error) // Handles updates, returns next state
+	Name        string
+	Prompt      func(update U, state *S) error                                // Optional: Runs when entering the state
+	PromptWith  func(ctx PromptContext[U], state *S) error                    // Optional: Like Prompt, given the context of the prompt; takes precedence
+	PromptKey   string                                                        // Optional: Message rendered by the manager's PromptProvider when Prompt and PromptWith are missing
+	InvalidKey  string                                                        // Optional: Message localized and replied when Handle rejects an answer
+	Handle      func(update U, state *S) (string, error)                      // Handles updates, returns next state
+	HandleWith  func(ctx context.Context, update U, state *S) (string, error) // Optional: Like Handle, given the context passed to HandleContext; takes precedence
+	HandleReply func(update U, state *S) (Response, error)                    // Optional: Like Handle, also returning a reply to send; takes precedence over Handle
+	Transitions []Transition[S, U]                                            // Optional: Guarded transitions evaluated after Handle
+	Sensitive   bool                                                          // Discard the user's input right after Handle reads it
+	SkipTo      string                                                        // Optional: State entered when the user skips this one
+	Optional    bool                                                          // The user may skip the question, leaving Default applied; requires SkipTo
+	Default     func(state *S)                                                // Optional: Writes the default answer of an Optional state
+	Normalizers []Normalizer                                                  // Optional: Applied to answers after the global normalizers
+	SendOptions SendOptions                                                   // Optional: Delivery preferences applied by bot adapters
+	Description string                                                        // Optional: What the state asks for, surfaced by tooling
+	Owner       string                                                        // Optional: Team or person maintaining the state
+	Tags        []string                                                      // Optional: Free-form labels for grouping states in tooling
+	Breaker     *Breaker                                                      // Optional: Routes users elsewhere while Handle keeps failing
+	Filter      func(update U) bool                                           // Optional: Reports whether Handle accepts the kind of update
+	WrongInput  any                                                           // Optional: Reply to updates Filter rejects, overriding the manager's
+	Rollback    func(state *S)                                                // Optional: Reverts the answer to the state when the user goes Back to it
+	TTL         time.Duration                                                 // Optional: Session lifetime while in the state, overriding the storage's
+	Middleware  []Middleware[S, U]                                            // Optional: Wraps the handling of updates by the state, inside the manager's middleware
+	Guard       func(update U, state *S) error                                // Optional: Checked before an update moves the user into the state (see SetOnDenied); ErrDenied or DenyEntry keeps them out
+}
+
+// SendOptions describes how a bot adapter should deliver a state's prompts.
+type SendOptions struct {
+	Silent         bool   // Deliver without a notification sound
+	ProtectContent bool   // Forbid forwarding and saving of the prompt
+	ParseMode      string // Formatting of the prompt text, e.g. "HTML" or "MarkdownV2"
+}
+
+// Transition is a guarded edge to another state. Transitions of a state are
+// evaluated in order after its Handle succeeds and the first one whose When
+// guard reports true decides the next state. A nil When always matches.
+type Transition[S, U any] struct {
+	To   string
+	When func(update U, state *S) bool
 }
 
 // StateManager manages states for Telegram bots.
 type StateManager[S, U any] struct {
 	states       map[string]*State[S, U]
 	storage      StateStorage[S]
-	keyFunc      func(update U) int64
+	keyFunc      KeyFunc[U]
 	initialState string
+	onSensitive  func(update U) error
+	navigation   Navigation
+	actionFunc   func(update U) (Action, bool)
+	now          func() time.Time
+	random       Random
+	text         TextAccessor[U]
+	normalizers  []Normalizer
+	onFinish     func(update U, userState UserState[S]) error
+	onCancel     func(update U, userState UserState[S]) error
+	flows        map[string]string
+	responder    ResponderFunc[U]
+	interceptor  Interceptor[U]
+	profiles     *profileCache
+	notifier     NotifierFunc
+	summary      *completionSummary[S]
+	eventFuncs   []func(event Event)
+	reentry      *Reentry[S, U]
+	sourceFunc   func(update U) Source
+	retention    map[string]RetentionPolicy
+	archive      ArchiveFunc[S]
+	onUnknown    UnknownStateHandler[S, U]
+	dispatcher   *PromptDispatcher
+	rateLimit    *rateLimiter[U]
+	triggers     []Trigger[U]
+	frozen       *atomic.Bool // Shared with the copies made by HandleBatch
+
+	moderator         Moderator[U]
+	moderationWarning any
+	onFlagged         func(update U, text string)
+	sessionFields     func(data S) map[string]any
+	sessionMeta       []string
+	wrongInput        any
+	onEvicted         func(key int64, userState UserState[S]) error
+	updateID          func(update U) (int64, bool)
+	locker            Locker
+	lockWait          time.Duration
+	auditStorage      AuditStorage
+	summarize         func(update U) string
+	promptProvider    PromptProvider
+	localizer         Localizer
+	languageFunc      func(update U) string
+	validation        *validation      // Shared with the copies made by HandleBatch
+	record            *handleRecord[S] // Set on the copies made by HandleResult
+	effects           *batchEffects    // Set on the copies made by HandleBatch
+	ctx               context.Context  // Set on the copies made by HandleContext
+	initialFunc       InitialStateFunc[S, U]
+	deepLinks         []deepLink[S]
+	outbox            *Outbox
+	promptRetry       *PromptRetry
+	middleware        []Middleware[S, U]
+	chatTypeFunc      func(update U) ChatType
+	chatPolicies      map[ChatType]ChatPolicy
+	onDenied          func(update U, userState UserState[S], state string, err error)
 }
 
 // NewStateManager creates a new StateManager.
 func NewStateManager[S, U any](storage StateStorage[S], keyFunc func(update U) int64) *StateManager[S, U] {
 	return &StateManager[S, U]{
-		states:  make(map[string]*State[S, U]),
-		storage: storage,
-		keyFunc: keyFunc,
+		states:     make(map[string]*State[S, U]),
+		storage:    storage,
+		keyFunc:    func(update U) (int64, bool) { return keyFunc(update), true },
+		now:        time.Now,
+		flows:      make(map[string]string),
+		frozen:     new(atomic.Bool),
+		validation: new(validation),
 	}
 }
 
 // Add adds states to the manager and returns an error if any duplicate state names are found.
-// It returns an error if any duplicate state names are found or if any state names are empty.
+// It returns an error if any duplicate state names are found, if any state names are empty or
+// if the manager is frozen.
 func (m *StateManager[S, U]) Add(states ...*State[S, U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
 	for _, state := range states {
 		if state.Name == "" {
 			return ErrEmptyStateName
@@ -57,71 +162,604 @@ func (m *StateManager[S, U]) Add(states ...*State[S, U]) error {
 	return nil
 }
 
-// SetInitialState sets the initial state for new users.
-func (m *StateManager[S, U]) SetInitialState(name string) {
+// SetInitialState sets the initial state for new users, see also
+// SetInitialStateFunc.
+func (m *StateManager[S, U]) SetInitialState(name string) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
 	m.initialState = name
+	return nil
+}
+
+// SetStateOption configures a programmatic state change made by SetState.
+type SetStateOption[U any] func(*setStateConfig[U])
+
+type setStateConfig[U any] struct {
+	update    U
+	prompt    bool
+	promptNow bool
+	source    *Source
+}
+
+// WithPrompt makes SetState send the target state's prompt right away in
+// response to update, instead of on the user's next update.
+func WithPrompt[U any](update U) SetStateOption[U] {
+	return func(c *setStateConfig[U]) {
+		c.update = update
+		c.prompt = true
+	}
+}
+
+// SetState moves the user identified by key to the named state, keeping the
+// collected data. The state's prompt is sent on the user's next update unless
+// WithPrompt is given, which also runs the state's Guard like a move made by
+// an update.
+func (m *StateManager[S, U]) SetState(key int64, stateName string, opts ...SetStateOption[U]) error {
+	if _, ok := m.states[stateName]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownState, stateName)
+	}
+
+	unlock, err := m.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	userState, _, err := m.storage.Get(key)
+	if err != nil {
+		return err
+	}
+
+	return m.jump(key, &userState, stateName, opts)
+}
+
+// jump moves the user to the named state on behalf of SetState and StartFlow.
+func (m *StateManager[S, U]) jump(key int64, userState *UserState[S], stateName string, opts []SetStateOption[U]) error {
+	var cfg setStateConfig[U]
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.source != nil {
+		userState.Source = *cfg.source
+	}
+
+	if cfg.prompt {
+		return m.transition(cfg.update, userState, stateName, key)
+	}
+	previous := userState.CurrentState
+	userState.Enter(stateName)
+	var promptErr error
+	var deliver func() error
+	if state := m.states[stateName]; cfg.promptNow && state.hasPrompt() {
+		_, deliver, promptErr = m.prompt(PromptContext[U]{Previous: previous, Reason: PromptForced}, userState, state, key)
+	}
+	if err := m.save(key, userState); err != nil {
+		return err
+	}
+	if deliver != nil {
+		promptErr = deliver()
+	}
+	m.moved(key, userState, previous)
+	if err := m.audit(key, userState, previous, nil); err != nil {
+		return err
+	}
+	return promptErr
+}
+
+// Current returns a snapshot of the user's state: the current state name, a
+// copy of the collected data, whether the prompt was sent and when the state
+// was created and last updated. The boolean reports whether the user has any
+// state at all.
+func (m *StateManager[S, U]) Current(key int64) (UserState[S], bool, error) {
+	return m.storage.Get(key)
 }
 
-// Handle processes an update, managing state transitions.
+// SetOnFinish sets the hook called once when a user finishes a flow, that is
+// when a state's Handle returns an empty next state or one made by End. The
+// hook receives the final state after it has been persisted with Finished and
+// Outcome set.
+func (m *StateManager[S, U]) SetOnFinish(fn func(update U, userState UserState[S]) error) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.onFinish = fn
+	return nil
+}
+
+// SetClock sets the function the manager reads the current time from,
+// time.Now by default. It stamps user states and events and drives breakers
+// and retention.
+func (m *StateManager[S, U]) SetClock(now func() time.Time) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.now = now
+	return nil
+}
+
+// SetRandom sets the source the IDs of outbox intents are drawn from, the
+// global source of math/rand/v2 by default.
+func (m *StateManager[S, U]) SetRandom(r Random) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.random = r
+	return nil
+}
+
+// SetSensitiveInputHandler sets the function invoked with every update handled
+// by a Sensitive state, typically to delete the user's message from the chat.
+// Its errors are reported as EventError events and do not stop the answer
+// from being handled.
+func (m *StateManager[S, U]) SetSensitiveInputHandler(fn func(update U) error) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.onSensitive = fn
+	return nil
+}
+
+// Handle processes an update, managing state transitions. Updates the key
+// function rejects are not handled. Handle fails while the configuration is
+// invalid, see Validate.
 func (m *StateManager[S, U]) Handle(update U) (bool, error) {
-	key := m.keyFunc(update)
-	userState, exists, err := m.storage.Get(key)
+	if err := m.validated(); err != nil {
+		return false, err
+	}
+	if m.chatPolicy(update).Ignore {
+		return false, nil
+	}
+	key, ok := m.keyFunc(update)
+	if !ok {
+		return false, nil
+	}
+	if limited, err := m.limited(update, key); limited {
+		return true, err
+	}
+	unlock, err := m.lock(key)
 	if err != nil {
+		m.emit(Event{Kind: EventError, Key: key, Err: err})
 		return false, err
 	}
+	handled, err := m.handle(update, key)
+	if unlockErr := unlock(); unlockErr != nil {
+		m.emit(Event{Kind: EventError, Key: key, Err: unlockErr})
+	}
+	if err != nil {
+		m.emit(errorEvent(key, err))
+	}
+	return handled, err
+}
 
-	if !exists {
-		userState.CurrentState = m.initialState
+// errorEvent returns the EventError event reporting the failure of an update
+// of the user identified by key.
+func errorEvent(key int64, err error) Event {
+	event := Event{Kind: EventError, Key: key, Err: err}
+	if se, ok := err.(*StateError); ok {
+		event.State = se.State
+	}
+	return event
+}
+
+// handle implements Handle.
+func (m *StateManager[S, U]) handle(update U, key int64) (bool, error) {
+	userState, exists, err := m.storage.Get(key)
+	if err != nil {
+		return false, stateError(err, key, "", PhaseLoad)
+	}
+
+	// Users known only by metadata set for them have not started yet
+	started := !exists || userState.CurrentState == "" && !userState.Finished
+	if started {
+		userState.Flow, userState.CurrentState, userState.Data, err = m.initial(update)
+		if err != nil {
+			return false, err
+		}
+		userState.Source = m.source(update)
+	} else if m.record != nil {
+		m.record.from = userState.CurrentState
+	}
+	if m.record != nil {
+		m.record.state = userState
+	}
+	if m.duplicate(update, &userState) {
+		return true, nil // Redelivered
+	}
+	m.detectLanguage(update, &userState)
+
+	if link, params, ok := m.deepLink(update); ok {
+		return true, m.follow(update, userState, link, params, key)
+	}
+	if trigger, ok := m.trigger(update); ok {
+		if !exists {
+			userState.CurrentState = "" // Never entered
+		}
+		return true, m.fire(update, userState, trigger, key)
 	}
 
 	state, ok := m.states[userState.CurrentState]
 	if !ok {
+		if exists && m.onUnknown != nil && userState.CurrentState != "" && userState.CurrentState != NopState {
+			return m.recover(update, userState, key)
+		}
 		return false, nil // Invalid state, ignore
 	}
+	if started {
+		userState.entering = state.Name
+	}
+	return m.handleIn(update, userState, exists, state, key)
+}
+
+// handleIn handles the update in state, the user's current state, once the
+// user state is loaded and the update is known not to be a redelivery.
+func (m *StateManager[S, U]) handleIn(update U, userState UserState[S], exists bool, state *State[S, U], key int64) (bool, error) {
+
+	if exists && m.reentry != nil {
+		if consumed, err := m.reenter(update, &userState, state, key); consumed || err != nil {
+			return consumed, err
+		}
+	}
+
+	// Navigation actions take precedence over the state itself
+	if m.actionFunc != nil {
+		if action, ok := m.actionFunc(update); ok && (action != ActionSkip || state.Skippable()) {
+			return m.navigate(update, &userState, state, key, action)
+		}
+	}
+
+	if m.interceptor != nil {
+		switch m.interceptor(update) {
+		case InterceptBypass:
+			return false, nil
+		case InterceptCancel:
+			return true, m.cancel(update, userState, key)
+		}
+	}
+
+	if state.Breaker != nil {
+		allowed, probe := state.Breaker.allow(m.now())
+		if !allowed {
+			return true, m.tripped(update, &userState, state, key)
+		}
+		if probe != 0 {
+			defer state.Breaker.release(probe)
+		}
+	}
 
 	// Send prompt if needed
-	if state.Prompt != nil && !userState.PromptSent {
-		return true, m.sendPrompt(update, &userState, state, key)
+	if state.hasPrompt() && !userState.PromptSent {
+		pc := PromptContext[U]{Previous: previousState(&userState), Reason: PromptPending, Update: &update}
+		return true, m.sendPrompt(pc, &userState, state, key)
 	}
 
 	// Handle the update
-	if state.Handle == nil {
+	if state.Handle == nil && state.HandleWith == nil && state.HandleReply == nil {
 		return false, nil
 	}
 
-	nextState, err := state.Handle(update, &userState.Data)
+	if accepted, err := m.accepts(update, state); !accepted {
+		return true, err // Stay in current state
+	}
+
+	update = m.normalize(update, state)
+	if allowed, err := m.moderate(update); !allowed {
+		return err == nil, err
+	}
+
+	answered := userState
+	call := Call[S, U]{Context: m.requestContext(), Key: key, State: state.Name, Update: update, Data: &userState.Data}
+	resp, err := m.handler(state)(call)
+	nextState := resp.Next
+	if state.Sensitive && m.onSensitive != nil {
+		if err := m.onSensitive(update); err != nil {
+			// The answer was read, so the user moves on regardless
+			m.emit(Event{Kind: EventError, Key: key, Flow: answered.Flow, State: state.Name, Err: err, Source: answered.Source})
+		}
+	}
+	if errors.Is(err, ErrValidation) {
+		if err := m.reject(key, answered); err != nil {
+			return true, err
+		}
+		if err := m.reply(update, resp.Reply); err != nil {
+			return true, err
+		}
+		return true, m.invalid(update, &answered, state, err, key) // Stay in current state
+	}
+	if state.Breaker != nil && state.Breaker.record(m.now(), err != nil) {
+		// The error is reported as an event, the user moves on to the fallback
+		m.emit(Event{Kind: EventError, Key: key, Flow: answered.Flow, State: state.Name, Err: err, Source: answered.Source})
+		return true, m.tripped(update, &answered, state, key)
+	}
 	if err != nil {
-		if errors.Is(err, ErrValidation) {
-			return true, nil // Stay in current state
+		return false, stateError(err, key, state.Name, PhaseHandle)
+	}
+
+	if err := m.reply(update, resp.Reply); err != nil {
+		return false, stateError(err, key, state.Name, PhaseHandle)
+	}
+	nextState = state.next(update, &userState.Data, nextState)
+	if moves(nextState) && nextState != state.Name {
+		userState.History = append(userState.History, state.Name)
+	}
+
+	return true, m.transition(update, &userState, nextState, key)
+}
+
+// transition moves the user to the next state, sends the prompt of the next
+// state if it has one and persists the result in a single write. A prompt
+// failing to send leaves the user in the next state with the prompt pending,
+// so it is sent again on the user's next update. NopState only persists the
+// user state and Page turns the page of the current state. A Guard of the
+// next state denying entry leaves the stored user state as it was.
+func (m *StateManager[S, U]) transition(update U, userState *UserState[S], nextState string, key int64) error {
+	if nextState == NopState {
+		userState.Failures = 0
+		return m.save(key, userState)
+	}
+	if page, ok := paging(nextState); ok {
+		return m.turnPage(update, userState, page, key)
+	}
+
+	if next, exists := m.states[nextState]; exists && next.Guard != nil {
+		if denied, err := m.guard(update, userState, next, key); denied {
+			return err
 		}
-		return false, err
 	}
 
-	// Update state
-	userState.CurrentState = nextState
-	userState.PromptSent = false
-	if err := m.storage.Set(key, userState); err != nil {
-		return false, err
+	prevState := userState.CurrentState
+	outcome, ends := ending(nextState)
+	if ends {
+		nextState = ""
 	}
+	userState.Enter(nextState)
+	userState.Finished = ends
+	userState.Outcome = outcome
 
-	// End of flow or no state transition
-	if nextState == "" || nextState == NopState {
-		return true, nil // End of flow
+	var promptErr error
+	var deliver func() error
+	if next, exists := m.states[nextState]; exists && next.hasPrompt() {
+		_, deliver, promptErr = m.prompt(PromptContext[U]{Previous: prevState, Reason: PromptEntered, Update: &update}, userState, next, key)
+	}
+	if err := m.save(key, userState); err != nil {
+		return err
 	}
+	return m.after(key, func() error {
+		if deliver != nil {
+			promptErr = deliver()
+		}
+		m.moved(key, userState, prevState)
+		if err := m.audit(key, userState, prevState, &update); err != nil {
+			return err
+		}
 
-	// Handle transition to next state
-	if next, exists := m.states[nextState]; exists && next.Prompt != nil {
-		return true, m.sendPrompt(update, &userState, next, key)
+		// End of flow
+		if nextState == "" {
+			return m.finish(update, *userState, key)
+		}
+		return promptErr
+	})
+}
+
+// reject records a validation failure, persisting the user state as it was
+// before the rejected answer was handled.
+func (m *StateManager[S, U]) reject(key int64, userState UserState[S]) error {
+	userState.Failures++
+	if err := m.save(key, &userState); err != nil {
+		return err
 	}
+	m.emit(Event{
+		Kind:     EventValidationFailed,
+		Key:      key,
+		Flow:     userState.Flow,
+		State:    userState.CurrentState,
+		Failures: userState.Failures,
+		Source:   userState.Source,
+	})
+	return nil
+}
 
-	return true, nil
+// finish runs the OnFinish hook and, for completed flows, sends the
+// completion summary of a flow the user has just finished.
+func (m *StateManager[S, U]) finish(update U, userState UserState[S], key int64) error {
+	m.emit(Event{Kind: EventFinished, Key: key, Flow: userState.Flow, Outcome: userState.Outcome, Source: userState.Source})
+	if m.onFinish != nil {
+		if err := m.onFinish(update, userState); err != nil {
+			return err
+		}
+	}
+	if userState.Outcome != OutcomeCompleted {
+		return nil
+	}
+	return m.sendSummary(update, userState)
 }
 
-// sendPrompt is a helper function to send a prompt and update the state.
-func (m *StateManager[S, U]) sendPrompt(update U, userState *UserState[S], state *State[S, U], key int64) error {
-	if err := state.Prompt(update, &userState.Data); err != nil {
+// sendPrompt sends the prompt of state and persists the user state marked as
+// prompted. A Prompt without an update to answer is left for the user's next
+// update. The progress of a multi-part prompt failing part way is persisted
+// as well, as is a failed prompt retried in the background.
+func (m *StateManager[S, U]) sendPrompt(pc PromptContext[U], userState *UserState[S], state *State[S, U], key int64) error {
+	parts := userState.PromptParts
+	sent, deliver, err := m.prompt(pc, userState, state, key)
+	if deliver == nil && !sent && userState.PromptParts == parts && (err == nil || !m.retriesInBackground()) {
+		return err
+	}
+	if err := m.save(key, userState); err != nil {
 		return err
 	}
+	if deliver != nil {
+		return m.after(key, deliver)
+	}
+	return err
+}
+
+// prompt sends the prompt of state and marks the user state as prompted,
+// leaving persisting it to the caller. It reports whether the prompt was sent.
+// A multi-part prompt failing part way records its progress instead, so the
+// next attempt sends the remaining parts only.
+//
+// Prompts recorded in the outbox or queued with a dispatcher must not go out
+// before the user state is persisted, so the intent is in storage before the
+// send and a worker does not read the user state before the caller wrote it.
+// Their send is returned as deliver instead, which the caller runs right
+// after its save. It persists the outcome of the send when it changes the
+// user state.
+func (m *StateManager[S, U]) prompt(pc PromptContext[U], userState *UserState[S], state *State[S, U], key int64) (sent bool, deliver func() error, err error) {
+	pc.Key, pc.State, pc.Page = key, state.Name, userState.Page
+	pc.Language = m.language(key, userState)
+	pc.Context = m.requestContext()
+	if !userState.PromptSent {
+		pc.Sent = userState.PromptParts
+	}
+	send, err := m.sender(pc, state)
+	if send == nil {
+		return false, nil, err
+	}
+	if m.outbox != nil {
+		userState.Outbox = OutboxPrompt{ID: randomID(m.random), State: state.Name, Reason: pc.Reason, Previous: pc.Previous, Queued: m.now()}
+	}
+
+	switch {
+	case m.dispatcher != nil:
+		parts := userState.PromptParts
+		data, outbox := userState.Data, userState.Outbox // Shallow, see SetPromptDispatcher
+		userState.PromptSent = true
+		userState.PromptParts = 0
+		return true, func() error {
+			err := m.dispatcher.dispatch(promptTask{key: key, state: state.Name, send: func() error {
+				if err := send(&data); err != nil {
+					m.promptFailed(pc, state.Name, err, true)
+					return err
+				}
+				return nil
+			}, sent: func() error {
+				return m.delivered(key, outbox)
+			}})
+			if err == nil {
+				return nil
+			}
+			userState.PromptSent = false
+			userState.PromptParts = parts
+			if saveErr := m.save(key, userState); saveErr != nil {
+				return saveErr
+			}
+			return stateError(err, key, state.Name, PhasePrompt)
+		}, nil
+	case m.outbox != nil:
+		return false, func() error {
+			parts := userState.PromptParts
+			sent, err := m.sendNow(pc, userState, state, send)
+			if !sent && userState.PromptParts == parts {
+				return err
+			}
+			if saveErr := m.save(key, userState); saveErr != nil {
+				return saveErr
+			}
+			return err
+		}, nil
+	}
+	sent, err = m.sendNow(pc, userState, state, send)
+	return sent, nil, err
+}
+
+// sendNow sends the prompt of state on the update handling path, recording the
+// outcome in the user state.
+func (m *StateManager[S, U]) sendNow(pc PromptContext[U], userState *UserState[S], state *State[S, U], send func(data *S) error) (bool, error) {
+	if err := send(&userState.Data); err != nil {
+		m.promptFailed(pc, state.Name, err, false)
+		var partial *PartialPromptError
+		if errors.As(err, &partial) {
+			userState.PromptSent = false
+			userState.PromptParts = partial.Sent
+		}
+		return false, stateError(err, pc.Key, state.Name, PhasePrompt)
+	}
+	userState.Outbox = OutboxPrompt{}
 	userState.PromptSent = true
-	return m.storage.Set(key, *userState)
+	userState.PromptParts = 0
+	return true, nil
+}
+
+// sender returns the function sending the prompt of state, or nil when it
+// cannot be sent in the prompt context, with an error when it should have
+// been. The function emits EventPromptSent once the prompt was sent.
+func (m *StateManager[S, U]) sender(pc PromptContext[U], state *State[S, U]) (func(data *S) error, error) {
+	var send func(data *S) error
+	switch {
+	case state.PromptWith != nil:
+		send = func(data *S) error { return state.PromptWith(pc, data) }
+	case state.Prompt != nil && pc.Update != nil:
+		send = func(data *S) error { return state.Prompt(*pc.Update, data) }
+	case state.PromptKey != "" && m.canRender(pc):
+		send = func(data *S) error { return m.render(pc, state.PromptKey, data) }
+	case state.PromptKey != "" && pc.Update != nil:
+		err := fmt.Errorf("%w: no prompt provider, localizer or responder to render %q", ErrNoPrompt, state.PromptKey)
+		return nil, stateError(err, pc.Key, state.Name, PhasePrompt)
+	default:
+		return nil, nil
+	}
+	return func(data *S) error {
+		if err := send(data); err != nil {
+			return err
+		}
+		m.emit(Event{Kind: EventPromptSent, Key: pc.Key, State: state.Name})
+		return nil
+	}, nil
+}
+
+// save stamps the user state with the current time and persists it. The first
+// save of a new user emits their entry into the initial state.
+func (m *StateManager[S, U]) save(key int64, userState *UserState[S]) error {
+	now := m.now()
+	if userState.CreatedAt.IsZero() {
+		userState.CreatedAt = now
+	}
+	userState.UpdatedAt = now
+	entering := userState.entering
+	userState.entering = ""
+	if err := m.persist(key, *userState); err != nil {
+		userState.entering = entering
+		return err
+	}
+	if m.record != nil {
+		m.record.state = *userState
+	}
+	if entering != "" {
+		entered := *userState
+		entered.CurrentState, entered.Finished = entering, false
+		return m.after(key, func() error {
+			m.moved(key, &entered, "")
+			return nil
+		})
+	}
+	return nil
+}
+
+// persist stores the user state, with the TTL of its current state if any.
+func (m *StateManager[S, U]) persist(key int64, userState UserState[S]) error {
+	var err error
+	if state, ok := m.states[userState.CurrentState]; ok && state.TTL > 0 {
+		err = setWithTTL(m.storage, key, userState, state.TTL)
+	} else {
+		err = m.storage.Set(key, userState)
+	}
+	if err != nil {
+		return stateError(err, key, userState.CurrentState, PhasePersist)
+	}
+	return nil
+}
+
+// Skippable reports whether the user may skip the state.
+func (s *State[S, U]) Skippable() bool {
+	return s.Optional || s.SkipTo != ""
+}
+
+// next picks the next state from the state's transitions, falling back to the
+// state returned by Handle when no transition matches.
+func (s *State[S, U]) next(update U, data *S, fallback string) string {
+	for _, t := range s.Transitions {
+		if t.When == nil || t.When(update, data) {
+			return t.To
+		}
+	}
+	return fallback
 }
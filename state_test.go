@@ -1,9 +1,15 @@
 package tgstatemanager_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,13 +17,15 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/tgsmtest"
 )
 
 type (
 	// MockUpdate simulates a Telegram update
 	MockUpdate struct {
-		ChatID int64
-		Text   string
+		ChatID   int64
+		Text     string
+		UpdateID int64
 	}
 
 	// UserProfile represents user data collected during conversation
@@ -186,16 +194,26 @@ func verifyFinalState(t *testing.T, storage tgsm.StateStorage[UserProfile], chat
 }
 
 func FuzzStateManager(f *testing.F) {
-	f.Add("John", "25", "USA")
-	f.Add("", "-1", "")
-	f.Add("Alice", "abc", "Canada")
+	f.Add("John", "25", "USA", uint64(1))
+	f.Add("", "-1", "", uint64(2))
+	f.Add("Alice", "abc", "Canada", uint64(3))
 
-	f.Fuzz(func(t *testing.T, name, age, country string) {
+	f.Fuzz(func(t *testing.T, name, age, country string, seed uint64) {
 		storage := tgsm.NewInMemoryStorage[UserProfile]()
 		sm := setupStateManager(t, storage)
-		chatID := int64(1)
 
-		runFuzzTest(t, sm, storage, chatID, name, age, country)
+		runFuzzTest(t, sm, storage, 1, name, age, country)
+
+		// A generated profile always makes it through the flow.
+		gen, err := tgsmtest.NewGenerator[UserProfile](seed)
+		require.NoError(t, err)
+		profile := gen.Data()
+		runFuzzTest(t, sm, storage, 2, profile.Name, strconv.Itoa(profile.Age), profile.Country)
+		state, exists, err := storage.Get(2)
+		require.NoError(t, err)
+		require.True(t, exists)
+		assert.Empty(t, state.CurrentState)
+		assert.Equal(t, profile, state.Data)
 	})
 }
 
@@ -320,3 +338,2702 @@ func TestStateManagerValidation(t *testing.T) {
 		assert.Equal(t, tc.wantState, state.CurrentState)
 	}
 }
+
+func TestStateManagerTransitions(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](storage, func(u MockUpdate) int64 {
+		return u.ChatID
+	})
+
+	sm.SetInitialState("ask_age")
+	ageState := createAgeState()
+	ageState.Transitions = []tgsm.Transition[UserProfile, MockUpdate]{
+		{To: "parental_consent", When: func(u MockUpdate, data *UserProfile) bool { return data.Age < 18 }},
+	}
+	require.NoError(t, sm.Add(ageState, createCountryState(), &tgsm.State[UserProfile, MockUpdate]{
+		Name:   "parental_consent",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+	}))
+
+	testCases := []struct {
+		chatID    int64
+		age       string
+		wantState string
+	}{
+		{1, "12", "parental_consent"},
+		{2, "30", "ask_country"},
+	}
+
+	for _, tc := range testCases {
+		_, err := sm.Handle(MockUpdate{ChatID: tc.chatID})
+		require.NoError(t, err)
+
+		handled, err := sm.Handle(MockUpdate{ChatID: tc.chatID, Text: tc.age})
+		assert.NoError(t, err)
+		assert.True(t, handled)
+
+		state, exists, err := storage.Get(tc.chatID)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, tc.wantState, state.CurrentState)
+	}
+}
+
+func TestStateManagerSensitiveInput(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](storage, func(u MockUpdate) int64 {
+		return u.ChatID
+	})
+
+	var discarded []string
+	sm.SetSensitiveInputHandler(func(u MockUpdate) error {
+		discarded = append(discarded, u.Text)
+		return nil
+	})
+
+	key := []byte("pepper")
+	sm.SetInitialState("ask_password")
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:      "ask_password",
+		Sensitive: true,
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+			if len(u.Text) < 6 {
+				return "", tgsm.ErrValidation
+			}
+			data.Name = tgsm.HashSecret(u.Text, key)
+			return "", nil
+		},
+	}))
+
+	chatID := int64(42)
+	for _, input := range []string{"short", "s3cr3t-pass"} {
+		handled, err := sm.Handle(MockUpdate{ChatID: chatID, Text: input})
+		assert.NoError(t, err)
+		assert.True(t, handled)
+	}
+
+	assert.Equal(t, []string{"short", "s3cr3t-pass"}, discarded)
+
+	state, exists, err := storage.Get(chatID)
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.NotEqual(t, "s3cr3t-pass", state.Data.Name)
+	assert.True(t, tgsm.VerifySecret("s3cr3t-pass", key, state.Data.Name))
+	assert.False(t, tgsm.VerifySecret("wrong-pass", key, state.Data.Name))
+
+	// A message failing to be deleted does not hold the user back
+	sm.SetSensitiveInputHandler(func(u MockUpdate) error { return assert.AnError })
+	var failures []error
+	sm.OnEvent(func(e tgsm.Event) {
+		if e.Kind == tgsm.EventError {
+			failures = append(failures, e.Err)
+		}
+	})
+	handled, err := sm.Handle(MockUpdate{ChatID: 43, Text: "s3cr3t-pass"})
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, []error{assert.AnError}, failures)
+	state, _, err = storage.Get(43)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+}
+
+func TestStateManagerNavigation(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	sm.SetActionFunc(func(u MockUpdate) (tgsm.Action, bool) {
+		switch u.Text {
+		case "<back>":
+			return tgsm.ActionBack, true
+		case "<skip>":
+			return tgsm.ActionSkip, true
+		case "<cancel>":
+			return tgsm.ActionCancel, true
+		}
+		return "", false
+	})
+
+	chatID := int64(555)
+	testCases := []struct {
+		input     string
+		wantState string
+	}{
+		{"", "ask_name"},
+		{"<back>", "ask_name"},
+		{"Jane", "ask_age"},
+		{"<back>", "ask_name"},
+		{"Jane", "ask_age"},
+		{"<skip>", "ask_age"},
+		{"41", "ask_country"},
+		{"<cancel>", ""},
+	}
+
+	for _, tc := range testCases {
+		handled, err := sm.Handle(MockUpdate{ChatID: chatID, Text: tc.input})
+		assert.NoError(t, err)
+		assert.True(t, handled, tc.input)
+
+		state, exists, err := storage.Get(chatID)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, tc.wantState, state.CurrentState, tc.input)
+	}
+
+	state, _, err := storage.Get(chatID)
+	require.NoError(t, err)
+	assert.Empty(t, state.History)
+	assert.Empty(t, state.Data.Name)
+}
+
+func TestStateManagerSetState(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+
+	var prompted []string
+	countryState := createCountryState()
+	countryState.Name = "ask_country_again"
+	countryState.Prompt = func(u MockUpdate, data *UserProfile) error {
+		prompted = append(prompted, u.Text)
+		return nil
+	}
+	require.NoError(t, sm.Add(countryState))
+
+	chatID := int64(77)
+	assert.ErrorIs(t, sm.SetState(chatID, "missing"), tgsm.ErrUnknownState)
+
+	require.NoError(t, sm.SetState(chatID, "ask_age"))
+	state, exists, err := storage.Get(chatID)
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.Equal(t, "ask_age", state.CurrentState)
+	assert.False(t, state.PromptSent)
+
+	require.NoError(t, sm.SetState(chatID, "ask_country_again", tgsm.WithPrompt(MockUpdate{ChatID: chatID, Text: "/restart"})))
+	state, _, err = storage.Get(chatID)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_country_again", state.CurrentState)
+	assert.True(t, state.PromptSent)
+	assert.Equal(t, []string{"/restart"}, prompted)
+}
+
+func TestStateManagerCurrent(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	chatID := int64(31337)
+
+	_, exists, err := sm.Current(chatID)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	for _, input := range []string{"", "Jane"} {
+		_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: input})
+		require.NoError(t, err)
+	}
+
+	current, exists, err := sm.Current(chatID)
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.Equal(t, "ask_age", current.CurrentState)
+	assert.Equal(t, "Jane", current.Data.Name)
+	assert.True(t, current.PromptSent)
+	assert.False(t, current.CreatedAt.IsZero())
+	assert.False(t, current.UpdatedAt.Before(current.CreatedAt))
+}
+
+func TestStateManagerOptionalState(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	sm.SetActionFunc(func(u MockUpdate) (tgsm.Action, bool) {
+		return tgsm.ActionSkip, u.Text == "/skip"
+	})
+
+	countryState := createCountryState()
+	countryState.Name = "ask_country_optional"
+	countryState.Optional = true
+	countryState.Default = func(data *UserProfile) { data.Country = "Unknown" }
+	countryState.SkipTo = tgsm.End(tgsm.OutcomeCompleted)
+	countryState.Transitions = []tgsm.Transition[UserProfile, MockUpdate]{
+		{To: "ask_name", When: func(u MockUpdate, data *UserProfile) bool { return data.Name == "" }},
+	}
+	require.NoError(t, sm.Add(countryState))
+
+	chatID := int64(808)
+	require.NoError(t, sm.SetState(chatID, "ask_age"))
+	testCases := []struct {
+		input     string
+		wantState string
+	}{
+		{"", "ask_age"},
+		{"/skip", "ask_age"},
+	}
+	for _, tc := range testCases {
+		_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: tc.input})
+		require.NoError(t, err)
+		state, _, err := storage.Get(chatID)
+		require.NoError(t, err)
+		assert.Equal(t, tc.wantState, state.CurrentState, tc.input)
+	}
+
+	// Skipping an optional state applies the default and evaluates transitions
+	require.NoError(t, sm.SetState(chatID, "ask_country_optional", tgsm.WithPrompt(MockUpdate{ChatID: chatID})))
+	handled, err := sm.Handle(MockUpdate{ChatID: chatID, Text: "/skip"})
+	require.NoError(t, err)
+	assert.True(t, handled)
+
+	state, _, err := storage.Get(chatID)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_name", state.CurrentState)
+	assert.Equal(t, "Unknown", state.Data.Country)
+}
+
+func TestStateManagerOnFinish(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+
+	var finished []UserProfile
+	sm.SetOnFinish(func(u MockUpdate, state tgsm.UserState[UserProfile]) error {
+		assert.True(t, state.Finished)
+		finished = append(finished, state.Data)
+		return nil
+	})
+
+	chatID := int64(9000)
+	for _, input := range []string{"", "John", "30", "Canada", "extra", "more"} {
+		_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: input})
+		require.NoError(t, err)
+	}
+
+	require.Len(t, finished, 1)
+	assert.Equal(t, UserProfile{Name: "John", Age: 30, Country: "Canada"}, finished[0])
+
+	state, _, err := sm.Current(chatID)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+
+	require.NoError(t, sm.SetState(chatID, "ask_country"))
+	state, _, err = sm.Current(chatID)
+	require.NoError(t, err)
+	assert.False(t, state.Finished)
+}
+
+func TestStateManagerFlows(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+
+	require.NoError(t, sm.AddFlow("feedback", "ask_feedback", &tgsm.State[UserProfile, MockUpdate]{
+		Name: "ask_feedback",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+			data.Country = u.Text
+			return "", nil
+		},
+	}))
+	assert.ErrorIs(t, sm.AddFlow("feedback", "ask_feedback"), tgsm.ErrDuplicateFlow)
+	question := &tgsm.State[UserProfile, MockUpdate]{Name: "ask_question"}
+	assert.ErrorIs(t, sm.AddFlow("support", "missing", question), tgsm.ErrUnknownState)
+	require.NoError(t, sm.Add(question), "states of a refused flow are not added")
+	assert.ErrorIs(t, sm.StartFlow(1, "missing"), tgsm.ErrUnknownFlow)
+
+	var finishedFlows []string
+	sm.SetOnFinish(func(u MockUpdate, state tgsm.UserState[UserProfile]) error {
+		finishedFlows = append(finishedFlows, state.Flow)
+		return nil
+	})
+
+	chatID := int64(100)
+	for _, input := range []string{"", "John"} {
+		_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: input})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, sm.StartFlow(chatID, "feedback"))
+	state, _, err := sm.Current(chatID)
+	require.NoError(t, err)
+	assert.Equal(t, "feedback", state.Flow)
+	assert.Equal(t, "ask_feedback", state.CurrentState)
+	assert.Empty(t, state.Data.Name, "starting a flow discards previous data")
+
+	handled, err := sm.Handle(MockUpdate{ChatID: chatID, Text: "Great bot"})
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, []string{"feedback"}, finishedFlows)
+}
+
+func TestStateManagerModeration(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	sm.SetTextAccessor(mockText{})
+
+	var replies []any
+	sm.SetResponder(func(u MockUpdate, reply any) error {
+		replies = append(replies, reply)
+		return nil
+	})
+
+	var flagged []string
+	sm.SetModerator(func(u MockUpdate, text string) (tgsm.Verdict, error) {
+		switch {
+		case strings.Contains(text, "badword"):
+			return tgsm.Deny, nil
+		case strings.Contains(text, "hmm"):
+			return tgsm.Flag, nil
+		}
+		return tgsm.Allow, nil
+	}, "Please keep it civil.")
+	sm.SetOnFlagged(func(u MockUpdate, text string) { flagged = append(flagged, text) })
+
+	chatID := int64(66)
+	testCases := []struct {
+		input     string
+		wantState string
+	}{
+		{"", "ask_name"},
+		{"badword", "ask_name"},
+		{"hmm John", "ask_age"},
+	}
+
+	for _, tc := range testCases {
+		handled, err := sm.Handle(MockUpdate{ChatID: chatID, Text: tc.input})
+		require.NoError(t, err)
+		assert.True(t, handled)
+
+		state, _, err := storage.Get(chatID)
+		require.NoError(t, err)
+		assert.Equal(t, tc.wantState, state.CurrentState, tc.input)
+	}
+
+	assert.Equal(t, []any{"Please keep it civil."}, replies)
+	assert.Equal(t, []string{"hmm John"}, flagged)
+}
+
+func TestStateManagerInterceptor(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	sm.SetInterceptor(func(u MockUpdate) tgsm.Interception {
+		switch {
+		case u.Text == "/cancel":
+			return tgsm.InterceptCancel
+		case strings.HasPrefix(u.Text, "/"):
+			return tgsm.InterceptBypass
+		}
+		return tgsm.InterceptContinue
+	})
+
+	chatID := int64(12)
+	testCases := []struct {
+		input       string
+		wantState   string
+		wantHandled bool
+	}{
+		{"", "ask_name", true},
+		{"/help", "ask_name", false},
+		{"John", "ask_age", true},
+		{"/cancel", "", true},
+		{"anything", "", false},
+	}
+
+	for _, tc := range testCases {
+		handled, err := sm.Handle(MockUpdate{ChatID: chatID, Text: tc.input})
+		require.NoError(t, err)
+		assert.Equal(t, tc.wantHandled, handled, tc.input)
+
+		state, _, err := storage.Get(chatID)
+		require.NoError(t, err)
+		assert.Equal(t, tc.wantState, state.CurrentState, tc.input)
+	}
+}
+
+func TestStateManagerProfiles(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+
+	_, err := sm.Profile(1)
+	assert.ErrorIs(t, err, tgsm.ErrNoProfileResolver)
+	resolver := tgsm.ProfileResolverFunc(func(id int64) (tgsm.Profile, error) { return tgsm.Profile{}, nil })
+	assert.ErrorIs(t, sm.SetProfileResolver(resolver, 0), tgsm.ErrProfileTTL, "unbounded caches are refused")
+
+	calls := 0
+	sm.SetProfileResolver(tgsm.ProfileResolverFunc(func(id int64) (tgsm.Profile, error) {
+		calls++
+		return tgsm.Profile{ID: id, Username: "user" + strconv.FormatInt(id, 10)}, nil
+	}), time.Hour)
+
+	for range 3 {
+		profile, err := sm.Profile(1)
+		require.NoError(t, err)
+		assert.Equal(t, "user1", profile.Username)
+	}
+	assert.Equal(t, 1, calls)
+
+	sm.CacheProfile(2, tgsm.Profile{ID: 2, Username: "known", LanguageCode: "de"})
+	profile, err := sm.Profile(2)
+	require.NoError(t, err)
+	assert.Equal(t, "de", profile.LanguageCode)
+	assert.Equal(t, 1, calls)
+}
+
+func TestStateManagerCancel(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+
+	var cancelled []tgsm.UserState[UserProfile]
+	sm.SetOnCancel(func(u MockUpdate, state tgsm.UserState[UserProfile]) error {
+		cancelled = append(cancelled, state)
+		return nil
+	})
+
+	chatID := int64(13)
+	require.NoError(t, sm.Cancel(MockUpdate{ChatID: chatID}), "cancelling without a flow is a no-op")
+	assert.Empty(t, cancelled)
+
+	for _, input := range []string{"", "John"} {
+		_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: input})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, sm.Cancel(MockUpdate{ChatID: chatID, Text: "/cancel"}))
+	require.Len(t, cancelled, 1)
+	assert.Equal(t, "ask_age", cancelled[0].CurrentState)
+	assert.Equal(t, "John", cancelled[0].Data.Name)
+
+	state, exists, err := sm.Current(chatID)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Empty(t, state.CurrentState)
+	assert.Empty(t, state.Data.Name)
+
+	require.NoError(t, sm.Cancel(MockUpdate{ChatID: chatID}))
+	assert.Len(t, cancelled, 1, "cancelled flows are not cancelled again")
+}
+
+func TestStateManagerCompletionSummary(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+
+	var replies []any
+	sm.SetResponder(func(u MockUpdate, reply any) error {
+		replies = append(replies, reply)
+		return nil
+	})
+	notified := make(map[int64][]any)
+	sm.SetNotifier(func(chatID int64, msg any) error {
+		notified[chatID] = append(notified[chatID], msg)
+		return nil
+	})
+
+	renderer, err := tgsm.NewTemplateRenderer[UserProfile]("{{.Data.Name}}, {{.Data.Age}}, {{.Data.Country}}")
+	require.NoError(t, err)
+	sm.SetCompletionSummary(renderer, true, -100)
+
+	for _, input := range []string{"", "John", "30", "Canada"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 5, Text: input})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []any{"John, 30, Canada"}, replies)
+	assert.Equal(t, map[int64][]any{-100: {"John, 30, Canada"}}, notified)
+}
+
+func TestStateManagerReentry(t *testing.T) {
+	isStart := func(u MockUpdate) bool { return u.Text == "/start" }
+	setup := func(t *testing.T, reentry tgsm.Reentry[UserProfile, MockUpdate]) (*tgsm.StateManager[UserProfile, MockUpdate], *[]any) {
+		sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+		reentry.IsStart = isStart
+		sm.SetReentry(reentry)
+		var replies []any
+		sm.SetResponder(func(u MockUpdate, reply any) error {
+			replies = append(replies, reply)
+			return nil
+		})
+		for _, input := range []string{"/start", "John"} {
+			_, err := sm.Handle(MockUpdate{ChatID: 1, Text: input})
+			require.NoError(t, err)
+		}
+		return sm, &replies
+	}
+	current := func(t *testing.T, sm *tgsm.StateManager[UserProfile, MockUpdate]) tgsm.UserState[UserProfile] {
+		state, _, err := sm.Current(1)
+		require.NoError(t, err)
+		return state
+	}
+
+	t.Run("Ignore", func(t *testing.T) {
+		sm, _ := setup(t, tgsm.Reentry[UserProfile, MockUpdate]{Policy: tgsm.ReentryIgnore})
+		handled, err := sm.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+		require.NoError(t, err)
+		assert.True(t, handled)
+		assert.Equal(t, "ask_age", current(t, sm).CurrentState)
+	})
+
+	t.Run("Confirm", func(t *testing.T) {
+		sm, replies := setup(t, tgsm.Reentry[UserProfile, MockUpdate]{Policy: tgsm.ReentryConfirm, Confirm: "Sure?"})
+		for _, input := range []string{"/start", "oops", "/start"} {
+			_, err := sm.Handle(MockUpdate{ChatID: 1, Text: input})
+			require.NoError(t, err)
+		}
+		assert.Equal(t, "ask_age", current(t, sm).CurrentState, "other updates withdraw the restart")
+		assert.True(t, current(t, sm).RestartPending)
+
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+		require.NoError(t, err)
+		state := current(t, sm)
+		assert.Equal(t, "ask_name", state.CurrentState)
+		assert.Empty(t, state.Data.Name)
+		assert.False(t, state.RestartPending)
+		assert.Equal(t, []any{"Sure?", "Sure?"}, *replies)
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		sm, _ := setup(t, tgsm.Reentry[UserProfile, MockUpdate]{Policy: tgsm.ReentryRestart})
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+		require.NoError(t, err)
+		assert.Equal(t, UserProfile{}, current(t, sm).Data)
+		assert.Equal(t, "ask_name", current(t, sm).CurrentState)
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		summary, err := tgsm.NewTemplateRenderer[UserProfile]("So far: {{.Data.Name}}")
+		require.NoError(t, err)
+		sm, replies := setup(t, tgsm.Reentry[UserProfile, MockUpdate]{Policy: tgsm.ReentryResume, Summary: summary})
+		_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+		require.NoError(t, err)
+		assert.Equal(t, []any{"So far: John"}, *replies)
+		assert.Equal(t, "ask_age", current(t, sm).CurrentState)
+		assert.Equal(t, "John", current(t, sm).Data.Name)
+	})
+}
+
+func TestStateManagerStates(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	review := &tgsm.State[UserProfile, MockUpdate]{
+		Name:        "review",
+		Description: "Lets moderators review the profile",
+		Owner:       "trust-and-safety",
+		Tags:        []string{"moderation"},
+		Transitions: []tgsm.Transition[UserProfile, MockUpdate]{{To: "ask_name"}},
+	}
+	require.NoError(t, sm.AddFlow("moderation", "review", review))
+
+	states := sm.States()
+	require.Len(t, states, 4)
+	assert.Equal(t, "ask_age", states[0].Name)
+	assert.True(t, states[2].Initial)
+	assert.Equal(t, tgsm.StateInfo{
+		Name:        "review",
+		Description: "Lets moderators review the profile",
+		Owner:       "trust-and-safety",
+		Tags:        []string{"moderation"},
+		Flows:       []string{"moderation"},
+		Transitions: []string{"ask_name"},
+	}, states[3])
+}
+
+// batchCountingStorage counts the round-trips reaching a batch storage.
+type batchCountingStorage struct {
+	*tgsm.InMemoryStorage[UserProfile]
+	calls   int
+	ttls    map[int64]time.Duration
+	failing error // Returned by SetMany when set
+}
+
+func (s *batchCountingStorage) Get(id int64) (tgsm.UserState[UserProfile], bool, error) {
+	s.calls++
+	return s.InMemoryStorage.Get(id)
+}
+
+func (s *batchCountingStorage) Set(id int64, state tgsm.UserState[UserProfile]) error {
+	s.calls++
+	return s.InMemoryStorage.Set(id, state)
+}
+
+func (s *batchCountingStorage) SetWithTTL(id int64, state tgsm.UserState[UserProfile], ttl time.Duration) error {
+	s.calls++
+	if s.ttls == nil {
+		s.ttls = make(map[int64]time.Duration)
+	}
+	s.ttls[id] = ttl
+	return s.InMemoryStorage.SetWithTTL(id, state, ttl)
+}
+
+func (s *batchCountingStorage) GetMany(ids []int64) (map[int64]tgsm.UserState[UserProfile], error) {
+	s.calls++
+	return s.InMemoryStorage.GetMany(ids)
+}
+
+func (s *batchCountingStorage) SetMany(states map[int64]tgsm.UserState[UserProfile]) error {
+	s.calls++
+	if s.failing != nil {
+		return s.failing
+	}
+	return s.InMemoryStorage.SetMany(states)
+}
+
+func TestStateManagerHandleBatch(t *testing.T) {
+	storage := &batchCountingStorage{InMemoryStorage: tgsm.NewInMemoryStorage[UserProfile]()}
+	sm := setupStateManager(t, storage)
+
+	results, err := sm.HandleBatch([]MockUpdate{
+		{ChatID: 1}, {ChatID: 2}, {ChatID: 1, Text: "John"}, {ChatID: 2, Text: "Jane"}, {ChatID: 1, Text: "abc"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []tgsm.BatchResult{{Handled: true}, {Handled: true}, {Handled: true}, {Handled: true}, {Handled: true}}, results)
+	assert.Equal(t, 2, storage.calls, "a batch reads and writes states once")
+
+	john, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_age", john.CurrentState)
+	assert.Equal(t, 1, john.Failures)
+	jane, _, err := sm.Current(2)
+	require.NoError(t, err)
+	assert.Equal(t, "Jane", jane.Data.Name)
+
+	// States with a TTL of their own keep it
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:   "otp",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return tgsm.NopState, nil },
+		TTL:    time.Minute,
+	}))
+	require.NoError(t, sm.SetState(3, "otp"))
+	_, err = sm.HandleBatch([]MockUpdate{{ChatID: 3, Text: "1234"}, {ChatID: 1, Text: "30"}})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, storage.ttls[3])
+
+	// The users of the batch are locked until their states are written
+	locker := tgsm.NewLocalLocker()
+	require.NoError(t, sm.SetLocker(locker, 10*time.Millisecond))
+	unlock, err := locker.Lock(context.Background(), 2)
+	require.NoError(t, err)
+	_, err = sm.HandleBatch([]MockUpdate{{ChatID: 1, Text: "Norway"}, {ChatID: 2, Text: "30"}})
+	assert.ErrorIs(t, err, tgsm.ErrLockTimeout)
+	require.NoError(t, unlock())
+	_, err = locker.Lock(context.Background(), 1)
+	require.NoError(t, err, "locks taken by a failed batch are released")
+}
+
+func TestStateManagerHandleBatchWriteFailure(t *testing.T) {
+	storage := &batchCountingStorage{InMemoryStorage: tgsm.NewInMemoryStorage[UserProfile]()}
+	sm := setupStateManager(t, storage)
+	finished := 0
+	sm.SetOnFinish(func(u MockUpdate, state tgsm.UserState[UserProfile]) error {
+		finished++
+		return nil
+	})
+	var events []tgsm.EventKind
+	require.NoError(t, sm.OnEvent(func(e tgsm.Event) { events = append(events, e.Kind) }))
+	for _, text := range []string{"", "John", "30"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: text})
+		require.NoError(t, err)
+	}
+
+	storage.failing = errors.New("write failed")
+	events = nil
+	results, err := sm.HandleBatch([]MockUpdate{{ChatID: 1, Text: "Canada"}})
+	assert.ErrorIs(t, err, storage.failing)
+	assert.ErrorIs(t, results[0].Err, storage.failing)
+	assert.Zero(t, finished, "side effects wait for the states to be written")
+	assert.NotContains(t, events, tgsm.EventFinished)
+
+	storage.failing = nil
+	results, err = sm.HandleBatch([]MockUpdate{{ChatID: 1, Text: "Canada"}})
+	require.NoError(t, err)
+	require.NoError(t, results[0].Err)
+	assert.Equal(t, 1, finished, "the redelivered update finishes the flow once")
+	assert.Contains(t, events, tgsm.EventFinished)
+}
+
+func TestStateManagerSource(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	sm.SetSourceFunc(func(u MockUpdate) tgsm.Source {
+		payload, ok := strings.CutPrefix(u.Text, "/start ")
+		if !ok {
+			return tgsm.Source{}
+		}
+		return tgsm.Source{Kind: tgsm.SourceDeepLink, Detail: payload}
+	})
+	var events []tgsm.Event
+	sm.OnEvent(func(event tgsm.Event) { events = append(events, event) })
+
+	for _, input := range []string{"/start promo", "John", "30", "Canada"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: input})
+		require.NoError(t, err)
+	}
+	require.NotEmpty(t, events)
+	finished := events[len(events)-1]
+	assert.Equal(t, tgsm.EventFinished, finished.Kind)
+	assert.Equal(t, tgsm.Source{Kind: tgsm.SourceDeepLink, Detail: "promo"}, finished.Source)
+
+	require.NoError(t, sm.SetState(2, "ask_age", tgsm.WithSource[MockUpdate](tgsm.Source{Kind: tgsm.SourceAdmin})))
+	state, _, err := sm.Current(2)
+	require.NoError(t, err)
+	assert.Equal(t, tgsm.SourceAdmin, state.Source.Kind)
+}
+
+func TestStateManagerBreaker(t *testing.T) {
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("lookup")
+
+	failing := true
+	breaker := &tgsm.Breaker{Threshold: 2, OpenFor: 50 * time.Millisecond, Fallback: "later"}
+	require.NoError(t, sm.Add(
+		&tgsm.State[UserProfile, MockUpdate]{
+			Name: "lookup",
+			Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+				if failing {
+					return "", assert.AnError
+				}
+				return "", nil
+			},
+			Breaker: breaker,
+		},
+		&tgsm.State[UserProfile, MockUpdate]{
+			Name:   "later",
+			Handle: func(u MockUpdate, data *UserProfile) (string, error) { return tgsm.NopState, nil },
+		},
+	))
+	stateOf := func(chatID int64) string {
+		state, _, err := sm.Current(chatID)
+		require.NoError(t, err)
+		return state.CurrentState
+	}
+
+	_, err := sm.Handle(MockUpdate{ChatID: 1})
+	assert.ErrorIs(t, err, assert.AnError)
+	_, err = sm.Handle(MockUpdate{ChatID: 2})
+	require.NoError(t, err, "the failure opening the breaker routes to the fallback")
+	assert.Equal(t, "later", stateOf(2))
+
+	_, err = sm.Handle(MockUpdate{ChatID: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "later", stateOf(3), "users are routed to the fallback while the breaker is open")
+
+	time.Sleep(60 * time.Millisecond)
+	failing = false
+	_, err = sm.Handle(MockUpdate{ChatID: 4})
+	require.NoError(t, err)
+	state, _, err := sm.Current(4)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+}
+
+func TestStateManagerBreakerProbe(t *testing.T) {
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("lookup")
+
+	probing := make(chan struct{})
+	done := make(chan struct{})
+	var handled atomic.Int32
+	require.NoError(t, sm.Add(
+		&tgsm.State[UserProfile, MockUpdate]{
+			Name: "lookup",
+			Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+				handled.Add(1)
+				if u.ChatID == 2 {
+					close(probing)
+					<-done
+					return "", nil
+				}
+				return "", assert.AnError
+			},
+			Breaker: &tgsm.Breaker{Threshold: 1, OpenFor: 20 * time.Millisecond, Fallback: "later"},
+		},
+		&tgsm.State[UserProfile, MockUpdate]{
+			Name:   "later",
+			Handle: func(u MockUpdate, data *UserProfile) (string, error) { return tgsm.NopState, nil },
+		},
+	))
+	stateOf := func(chatID int64) string {
+		state, _, err := sm.Current(chatID)
+		require.NoError(t, err)
+		return state.CurrentState
+	}
+
+	_, err := sm.Handle(MockUpdate{ChatID: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "later", stateOf(1))
+	time.Sleep(30 * time.Millisecond)
+
+	probed := make(chan error)
+	go func() {
+		_, err := sm.Handle(MockUpdate{ChatID: 2})
+		probed <- err
+	}()
+	<-probing
+	_, err = sm.Handle(MockUpdate{ChatID: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "later", stateOf(3), "a single update probes a half-open breaker")
+
+	close(done)
+	require.NoError(t, <-probed)
+	state, _, err := sm.Current(2)
+	require.NoError(t, err)
+	assert.True(t, state.Finished, "the probe's success closes the breaker")
+	assert.Equal(t, int32(2), handled.Load(), "only the probe reached Handle")
+}
+
+func TestStateManagerFreeze(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	require.NoError(t, sm.SetInitialState("ask_age"))
+
+	sm.Freeze()
+	assert.True(t, sm.Frozen())
+	assert.ErrorIs(t, sm.SetInitialState("ask_name"), tgsm.ErrFrozen)
+	assert.ErrorIs(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{Name: "late"}), tgsm.ErrFrozen)
+	assert.ErrorIs(t, sm.AddFlow("late", "ask_name"), tgsm.ErrFrozen)
+	assert.ErrorIs(t, sm.SetNormalizers(tgsm.TrimSpace), tgsm.ErrFrozen)
+
+	for _, input := range []string{"", "30"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: input})
+		require.NoError(t, err)
+	}
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, 30, state.Data.Age, "the configuration made before freezing is kept")
+}
+
+func TestStateManagerRetention(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+
+	var archived []int64
+	require.NoError(t, sm.SetRetention(func(id int64, state tgsm.UserState[UserProfile]) error {
+		archived = append(archived, id)
+		return nil
+	},
+		tgsm.RetentionPolicy{InactiveFor: 24 * time.Hour, ArchiveAfter: 7 * 24 * time.Hour},
+		tgsm.RetentionPolicy{Namespace: "survey", InactiveFor: time.Hour},
+	))
+
+	now := time.Now()
+	for id, state := range map[int64]tgsm.UserState[UserProfile]{
+		1: {CurrentState: "ask_age", UpdatedAt: now.Add(-48 * time.Hour)},                      // Inactive
+		2: {CurrentState: "ask_age", UpdatedAt: now.Add(-time.Hour)},                           // Active
+		3: {Finished: true, UpdatedAt: now.Add(-8 * 24 * time.Hour)},                           // Archived
+		4: {Finished: true, UpdatedAt: now.Add(-48 * time.Hour)},                               // Recently finished
+		5: {Flow: "survey", CurrentState: "ask_age", UpdatedAt: now.Add(-2 * time.Hour)},       // Inactive
+		6: {Flow: "other", CurrentState: "ask_age", UpdatedAt: now.Add(-100 * 24 * time.Hour)}, // No policy
+	} {
+		require.NoError(t, storage.Set(id, state))
+	}
+
+	result, err := sm.ApplyRetention(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, tgsm.RetentionResult{Deleted: 2, Archived: 1}, result)
+	assert.Equal(t, []int64{3}, archived)
+
+	for id, kept := range map[int64]bool{1: false, 2: true, 3: false, 4: true, 5: false, 6: true} {
+		_, exists, err := storage.Get(id)
+		require.NoError(t, err)
+		assert.Equal(t, kept, exists, "session %d", id)
+	}
+}
+
+// touchingStorage updates a session right after every walk over the storage
+// it wraps, as a user answering while the walk's results are acted on.
+type touchingStorage struct {
+	*tgsm.InMemoryStorage[UserProfile]
+	key int64
+}
+
+func (s *touchingStorage) ForEach(ctx context.Context, fn func(key int64, state tgsm.UserState[UserProfile]) error) error {
+	if err := s.InMemoryStorage.ForEach(ctx, fn); err != nil {
+		return err
+	}
+	return s.Set(s.key, tgsm.UserState[UserProfile]{CurrentState: "ask_age", UpdatedAt: time.Now()})
+}
+
+func TestStateManagerCleanupRechecks(t *testing.T) {
+	storage := &touchingStorage{InMemoryStorage: tgsm.NewInMemoryStorage[UserProfile](), key: 1}
+	sm := setupStateManager(t, storage)
+	require.NoError(t, sm.SetRetention(nil, tgsm.RetentionPolicy{InactiveFor: time.Hour}))
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, key := range []int64{1, 2} {
+		require.NoError(t, storage.Set(key, tgsm.UserState[UserProfile]{CurrentState: "ask_age", UpdatedAt: old}))
+	}
+	deleted, err := sm.Sweep(context.Background(), 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted, "sessions updated since the walk are kept")
+	_, exists, err := storage.Get(1)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	require.NoError(t, storage.Set(1, tgsm.UserState[UserProfile]{CurrentState: "ask_age", UpdatedAt: old}))
+	result, err := sm.ApplyRetention(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, tgsm.RetentionResult{}, result)
+	_, exists, err = storage.Get(1)
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestStateManagerJanitor(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+
+	var evicted []int64
+	require.NoError(t, sm.SetOnEvicted(func(key int64, state tgsm.UserState[UserProfile]) error {
+		if key == 4 {
+			return errors.New("archive down")
+		}
+		evicted = append(evicted, key)
+		return nil
+	}))
+
+	now := time.Now()
+	require.NoError(t, storage.Set(1, tgsm.UserState[UserProfile]{CurrentState: "ask_age", UpdatedAt: now.Add(-48 * time.Hour)}))
+	require.NoError(t, storage.Set(2, tgsm.UserState[UserProfile]{Flow: "survey", Finished: true, UpdatedAt: now.Add(-48 * time.Hour)}))
+	require.NoError(t, storage.Set(3, tgsm.UserState[UserProfile]{CurrentState: "ask_age", UpdatedAt: now.Add(-time.Hour)}))
+
+	deleted, err := sm.Sweep(context.Background(), 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.ElementsMatch(t, []int64{1, 2}, evicted)
+	for id, kept := range map[int64]bool{1: false, 2: false, 3: true} {
+		_, exists, err := storage.Get(id)
+		require.NoError(t, err)
+		assert.Equal(t, kept, exists, "session %d", id)
+	}
+
+	require.NoError(t, storage.Set(4, tgsm.UserState[UserProfile]{CurrentState: "ask_age", UpdatedAt: now.Add(-48 * time.Hour)}))
+	errs := make(chan error, 1)
+	require.NoError(t, sm.OnEvent(func(event tgsm.Event) {
+		if event.Kind == tgsm.EventError {
+			select {
+			case errs <- event.Err:
+			default:
+			}
+		}
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sm.StartJanitor(ctx, 24*time.Hour, time.Millisecond)
+	select {
+	case err := <-errs:
+		assert.ErrorContains(t, err, "archive down")
+	case <-time.After(time.Second):
+		t.Fatal("janitor did not run")
+	}
+	_, exists, err := storage.Get(4)
+	require.NoError(t, err)
+	assert.True(t, exists, "sessions failing to evict are kept")
+}
+
+func TestStateManagerStateTTL(t *testing.T) {
+	now := time.Now()
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	storage.SetClock(func() time.Time { return now })
+	storage.SetTTL(7*24*time.Hour, 0)
+
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](storage, func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("ask_name")
+	otp := createAgeState()
+	otp.TTL = 5 * time.Minute
+	require.NoError(t, sm.Add(createNameState(), otp, createCountryState()))
+
+	for _, text := range []string{"/start", "John"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: text})
+		require.NoError(t, err)
+	}
+	now = now.Add(4 * time.Minute)
+	_, exists, err := storage.Get(1)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	now = now.Add(2 * time.Minute)
+	_, exists, err = storage.Get(1)
+	require.NoError(t, err)
+	assert.False(t, exists, "the session expires after the TTL of its state")
+
+	for _, text := range []string{"/start", "John", "30"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 2, Text: text})
+		require.NoError(t, err)
+	}
+	now = now.Add(24 * time.Hour)
+	state, exists, err := storage.Get(2)
+	require.NoError(t, err)
+	require.True(t, exists, "leaving the state restores the storage's TTL")
+	assert.Equal(t, "ask_country", state.CurrentState)
+}
+
+func TestStateManagerDuplicateUpdates(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	require.NoError(t, sm.SetUpdateIDFunc(func(u MockUpdate) (int64, bool) {
+		return u.UpdateID, u.UpdateID != 0
+	}))
+
+	for _, u := range []MockUpdate{
+		{ChatID: 1, Text: "/start", UpdateID: 10},
+		{ChatID: 1, Text: "John", UpdateID: 11},
+		{ChatID: 1, Text: "John", UpdateID: 11}, // Redelivered
+		{ChatID: 1, Text: "30", UpdateID: 12},
+		{ChatID: 1, Text: "40", UpdateID: 12}, // Redelivered
+	} {
+		handled, err := sm.Handle(u)
+		require.NoError(t, err)
+		assert.True(t, handled)
+	}
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_country", state.CurrentState)
+	assert.Equal(t, 30, state.Data.Age)
+	assert.Equal(t, int64(12), state.LastUpdateID)
+
+	// Updates without an ID are never skipped
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: ""})
+	require.NoError(t, err)
+	require.NoError(t, sm.Cancel(MockUpdate{ChatID: 1}))
+	state, _, err = sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), state.LastUpdateID, "cancelling keeps the last update ID")
+}
+
+func TestStateManagerLocker(t *testing.T) {
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("count")
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name: "count",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+			data.Age++
+			return tgsm.NopState, nil
+		},
+	}))
+	locker := tgsm.NewLocalLocker()
+	require.NoError(t, sm.SetLocker(locker, time.Second))
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := sm.Handle(MockUpdate{ChatID: 1})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, 50, state.Data.Age, "no increment is lost")
+
+	unlock, err := locker.Lock(context.Background(), 1)
+	require.NoError(t, err)
+	require.NoError(t, sm.SetLocker(locker, 10*time.Millisecond))
+	_, err = sm.Handle(MockUpdate{ChatID: 1})
+	assert.ErrorIs(t, err, tgsm.ErrLockTimeout)
+	_, err = sm.Handle(MockUpdate{ChatID: 2})
+	assert.NoError(t, err, "other users are not held up")
+	assert.ErrorIs(t, sm.SetState(1, "count"), tgsm.ErrLockTimeout, "state changes outside of Handle take the lock too")
+	assert.ErrorIs(t, sm.SetMeta(1, "bucket", "a"), tgsm.ErrLockTimeout)
+	assert.ErrorIs(t, sm.Reprompt(1), tgsm.ErrLockTimeout)
+	require.NoError(t, unlock())
+	_, err = sm.Handle(MockUpdate{ChatID: 1})
+	assert.NoError(t, err)
+
+	// Without a wait of its own, an uncontended lock is always acquired
+	require.NoError(t, sm.SetLocker(locker, 0))
+	for range 50 {
+		_, err = sm.Handle(MockUpdate{ChatID: 1})
+		require.NoError(t, err)
+	}
+}
+
+func TestStateManagerUnknownState(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+
+	require.NoError(t, storage.Set(1, tgsm.UserState[UserProfile]{CurrentState: "age", Data: UserProfile{Name: "John"}, PromptSent: true}))
+	handled, err := sm.Handle(MockUpdate{ChatID: 1, Text: "30"})
+	require.NoError(t, err)
+	assert.False(t, handled, "unknown states are ignored by default")
+
+	require.NoError(t, sm.SetUnknownStateHandler(tgsm.RemapStates[UserProfile, MockUpdate](map[string]string{"age": "ask_age"})))
+	for _, input := range []string{"", "30"} {
+		handled, err = sm.Handle(MockUpdate{ChatID: 1, Text: input})
+		require.NoError(t, err)
+		assert.True(t, handled)
+	}
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_country", state.CurrentState)
+	assert.Equal(t, UserProfile{Name: "John", Age: 30}, state.Data)
+
+	require.NoError(t, storage.Set(2, tgsm.UserState[UserProfile]{CurrentState: "gone", Data: UserProfile{Name: "Jane"}}))
+	_, err = sm.Handle(MockUpdate{ChatID: 2})
+	require.NoError(t, err)
+	state, _, err = sm.Current(2)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_name", state.CurrentState)
+	assert.Empty(t, state.Data.Name, "reset users start over with fresh data")
+
+	require.NoError(t, sm.SetUnknownStateHandler(func(u MockUpdate, state tgsm.UserState[UserProfile]) (string, error) {
+		return "missing", nil
+	}))
+	require.NoError(t, storage.Set(3, tgsm.UserState[UserProfile]{CurrentState: "gone"}))
+	_, err = sm.Handle(MockUpdate{ChatID: 3})
+	assert.ErrorIs(t, err, tgsm.ErrUnknownState)
+}
+
+func TestStateManagerUnknownStateDedup(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	require.NoError(t, sm.SetUpdateIDFunc(func(u MockUpdate) (int64, bool) {
+		return u.UpdateID, u.UpdateID != 0
+	}))
+	require.NoError(t, sm.SetUnknownStateHandler(tgsm.RemapStates[UserProfile, MockUpdate](map[string]string{"city": "ask_town"})))
+	prompts := 0
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:   "ask_town",
+		Prompt: func(u MockUpdate, data *UserProfile) error { prompts++; return nil },
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+	}))
+
+	require.NoError(t, storage.Set(1, tgsm.UserState[UserProfile]{CurrentState: "city", PromptSent: true, LastUpdateID: 4}))
+	handled, err := sm.Handle(MockUpdate{ChatID: 1, Text: "Oslo", UpdateID: 5})
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, 1, prompts, "the remapped update is not mistaken for a redelivery")
+	state, _, err := storage.Get(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_town", state.CurrentState)
+	assert.True(t, state.PromptSent)
+	assert.Equal(t, int64(5), state.LastUpdateID)
+
+	handled, err = sm.Handle(MockUpdate{ChatID: 1, Text: "Oslo", UpdateID: 5})
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, 1, prompts, "redeliveries are still skipped")
+}
+
+func TestStateManagerPromptContext(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+
+	var prompts []tgsm.PromptContext[MockUpdate]
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name: "confirm",
+		PromptWith: func(pc tgsm.PromptContext[MockUpdate], data *UserProfile) error {
+			prompts = append(prompts, pc)
+			return nil
+		},
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+	}))
+
+	chatID := int64(40)
+	_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: "/start"})
+	require.NoError(t, err)
+
+	// Forced without an update, Prompt based states wait for the next update
+	require.NoError(t, sm.SetState(chatID, "ask_age", tgsm.WithPromptNow[MockUpdate]()))
+	state, _, err := sm.Current(chatID)
+	require.NoError(t, err)
+	assert.False(t, state.PromptSent)
+
+	require.NoError(t, sm.SetState(chatID, "confirm", tgsm.WithPromptNow[MockUpdate]()))
+	require.Len(t, prompts, 1)
+	assert.Equal(t, tgsm.PromptForced, prompts[0].Reason)
+	assert.Equal(t, chatID, prompts[0].Key)
+	assert.Equal(t, "confirm", prompts[0].State)
+	assert.Equal(t, "ask_age", prompts[0].Previous)
+	assert.Nil(t, prompts[0].Update)
+	state, _, err = sm.Current(chatID)
+	require.NoError(t, err)
+	assert.True(t, state.PromptSent)
+
+	update := MockUpdate{ChatID: chatID, Text: "John"}
+	require.NoError(t, sm.SetState(chatID, "ask_name"))
+	require.NoError(t, sm.SetState(chatID, "confirm", tgsm.WithPrompt(update)))
+	require.Len(t, prompts, 2)
+	assert.Equal(t, tgsm.PromptEntered, prompts[1].Reason)
+	assert.Equal(t, "ask_name", prompts[1].Previous)
+	require.NotNil(t, prompts[1].Update)
+	assert.Equal(t, update, *prompts[1].Update)
+
+	require.NoError(t, sm.Reprompt(chatID))
+	require.Len(t, prompts, 3)
+	assert.Equal(t, tgsm.PromptReprompted, prompts[2].Reason)
+	assert.Nil(t, prompts[2].Update)
+
+	require.NoError(t, sm.SetState(chatID, "ask_age"))
+	assert.ErrorIs(t, sm.Reprompt(chatID), tgsm.ErrNoPrompt)
+}
+
+func TestStateManagerJobs(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	for key := int64(1); key <= 10; key++ {
+		require.NoError(t, storage.Set(key, tgsm.UserState[UserProfile]{
+			CurrentState: "ask_age",
+			Data:         UserProfile{Name: "user", Age: int(key)},
+		}))
+	}
+
+	var sent []int64
+	sm.SetNotifier(func(chatID int64, msg any) error {
+		if chatID == 3 {
+			return errors.New("blocked by user")
+		}
+		sent = append(sent, chatID)
+		return nil
+	})
+	job, err := sm.Broadcast(context.Background(), "hello", tgsm.JobOptions[UserProfile]{
+		Filter: func(key int64, userState tgsm.UserState[UserProfile]) bool { return key <= 5 },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 4, 5}, sent)
+	assert.Equal(t, 5, job.Total)
+	assert.Equal(t, 4, job.Done)
+	assert.Equal(t, 1, job.Failed)
+	assert.True(t, job.Finished)
+
+	job, err = sm.Migrate(context.Background(), func(key int64, userState *tgsm.UserState[UserProfile]) error {
+		userState.Data.Country = "unknown"
+		return nil
+	}, tgsm.JobOptions[UserProfile]{})
+	require.NoError(t, err)
+	assert.Equal(t, 10, job.Done)
+	state, _, err := sm.Current(7)
+	require.NoError(t, err)
+	assert.Equal(t, "unknown", state.Data.Country)
+
+	// Cancelled after a few keys, then resumed from the saved progress
+	store := tgsm.NewFileJobStore(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := tgsm.JobOptions[UserProfile]{
+		ID:        "reset-1",
+		Store:     store,
+		SaveEvery: 1,
+		OnProgress: func(job tgsm.Job) {
+			if job.Done == 3 {
+				cancel()
+			}
+		},
+	}
+	job, err = sm.BulkReset(ctx, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 3, job.Done)
+	assert.False(t, job.Finished)
+
+	saved, found, err := store.LoadJob("reset-1")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, int64(3), *saved.Cursor)
+
+	opts.OnProgress = nil
+	job, err = sm.BulkReset(context.Background(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, 10, job.Total)
+	assert.Equal(t, 10, job.Done)
+	assert.True(t, job.Finished)
+	_, exists, err := sm.Current(10)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = sm.Migrate(context.Background(), nil, opts)
+	assert.ErrorIs(t, err, tgsm.ErrJobKind)
+
+	sm = setupStateManager(t, struct {
+		tgsm.IterableStorage[UserProfile]
+	}{storage})
+	_, err = sm.BulkReset(context.Background(), tgsm.JobOptions[UserProfile]{})
+	assert.ErrorIs(t, err, tgsm.ErrNotDeletable)
+}
+
+func TestStateManagerJobCancelledWaitingForLock(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	locker := tgsm.NewLocalLocker()
+	require.NoError(t, sm.SetLocker(locker, 0))
+	for key := int64(1); key <= 3; key++ {
+		require.NoError(t, storage.Set(key, tgsm.UserState[UserProfile]{CurrentState: "ask_age"}))
+	}
+	unlock, err := locker.Lock(context.Background(), 2)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	store := tgsm.NewMemoryJobStore()
+	opts := tgsm.JobOptions[UserProfile]{ID: "reset", Store: store}
+	job, err := sm.BulkReset(ctx, opts)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, job.Done)
+	assert.Zero(t, job.Failed, "keys given up on are not counted")
+	assert.Equal(t, int64(1), *job.Cursor, "nor passed")
+
+	require.NoError(t, unlock())
+	job, err = sm.BulkReset(context.Background(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, 3, job.Done)
+	_, exists, err := storage.Get(2)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestStateManagerSingleWritePerTransition(t *testing.T) {
+	storage := tgsmtest.NewRecordingStorage[UserProfile](nil)
+	sm := setupStateManager(t, storage)
+
+	chatID := int64(50)
+	_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: "/start"})
+	require.NoError(t, err)
+	storage.Reset()
+
+	_, err = sm.Handle(MockUpdate{ChatID: chatID, Text: "John"})
+	require.NoError(t, err)
+	sets := storage.Calls(tgsmtest.OpSet)
+	require.Len(t, sets, 1)
+	assert.Equal(t, "ask_age", sets[0].State.CurrentState)
+	assert.True(t, sets[0].State.PromptSent)
+
+	// A failed prompt is retried on the next update
+	failing := errors.New("send failed")
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:   "flaky",
+		Prompt: func(u MockUpdate, data *UserProfile) error { return failing },
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+	}))
+	require.NoError(t, sm.SetState(chatID, "ask_country"))
+	storage.Reset()
+	err = sm.SetState(chatID, "flaky", tgsm.WithPrompt(MockUpdate{ChatID: chatID}))
+	assert.ErrorIs(t, err, failing)
+	assert.Equal(t, 1, storage.Count(tgsmtest.OpSet))
+	state, _, err := sm.Current(chatID)
+	require.NoError(t, err)
+	assert.Equal(t, "flaky", state.CurrentState)
+	assert.False(t, state.PromptSent)
+}
+
+// writeCounter counts the writes made to the storage it wraps.
+type writeCounter struct {
+	tgsm.StateStorage[UserProfile]
+	writes int
+}
+
+func (s *writeCounter) Set(id int64, state tgsm.UserState[UserProfile]) error {
+	s.writes++
+	return s.StateStorage.Set(id, state)
+}
+
+func BenchmarkHandleTransition(b *testing.B) {
+	storage := &writeCounter{StateStorage: tgsm.NewInMemoryStorage[UserProfile]()}
+	sm := setupStateManager(b, storage)
+	conversation := []string{"/start", "John", "30", "Canada"}
+
+	b.ReportAllocs()
+	key := int64(0)
+	for b.Loop() {
+		key++
+		for _, text := range conversation {
+			if _, err := sm.Handle(MockUpdate{ChatID: key, Text: text}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	// The first update only sends a prompt, the others each make a transition
+	b.ReportMetric(float64(storage.writes-int(key))/float64(key*int64(len(conversation)-1)), "writes/transition")
+}
+
+func TestStateManagerPromptDispatcher(t *testing.T) {
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("ask_name")
+
+	var mu sync.Mutex
+	sent := map[int64][]string{}
+	prompt := func(name string) func(u MockUpdate, data *UserProfile) error {
+		return func(u MockUpdate, data *UserProfile) error {
+			time.Sleep(time.Millisecond)
+			if u.ChatID == 2 && name == "ask_country" {
+				return errors.New("chat not found")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			sent[u.ChatID] = append(sent[u.ChatID], name)
+			return nil
+		}
+	}
+	states := []*tgsm.State[UserProfile, MockUpdate]{createNameState(), createAgeState(), createCountryState()}
+	for _, state := range states {
+		state.Prompt = prompt(state.Name)
+	}
+	require.NoError(t, sm.Add(states...))
+
+	var failed []*tgsm.PromptError
+	dispatcher := tgsm.NewPromptDispatcher(2, 4, func(err *tgsm.PromptError) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, err)
+	})
+	require.NoError(t, sm.SetPromptDispatcher(dispatcher))
+
+	for _, text := range []string{"/start", "John", "30"} {
+		for _, chatID := range []int64{1, 2, 3} {
+			_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: text})
+			require.NoError(t, err)
+		}
+	}
+	dispatcher.Close()
+
+	want := []string{"ask_name", "ask_age", "ask_country"}
+	assert.Equal(t, want, sent[1])
+	assert.Equal(t, want[:2], sent[2])
+	assert.Equal(t, want, sent[3])
+	require.Len(t, failed, 1)
+	assert.Equal(t, int64(2), failed[0].Key)
+	assert.Equal(t, "ask_country", failed[0].State)
+
+	_, err := sm.Handle(MockUpdate{ChatID: 4, Text: "/start"})
+	assert.ErrorIs(t, err, tgsm.ErrDispatcherClosed)
+}
+
+// outboxLog records the outbox intents of the states written to the storage
+// it wraps.
+type outboxLog struct {
+	tgsm.StateStorage[UserProfile]
+	mu     sync.Mutex
+	writes []string
+}
+
+func (s *outboxLog) Set(id int64, state tgsm.UserState[UserProfile]) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes = append(s.writes, state.CurrentState+" "+state.Outbox.ID)
+	return s.StateStorage.Set(id, state)
+}
+
+func TestStateManagerOutboxDispatched(t *testing.T) {
+	storage := &outboxLog{StateStorage: tgsm.NewInMemoryStorage[UserProfile]()}
+	sm := setupStateManager(t, storage)
+	require.NoError(t, sm.SetOutbox(tgsm.Outbox{}))
+	require.NoError(t, sm.SetRandom(tgsm.NewRandom(1)))
+	dispatcher := tgsm.NewPromptDispatcher(1, 1, nil)
+	require.NoError(t, sm.SetPromptDispatcher(dispatcher))
+
+	for _, text := range []string{"/start", "John"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: text})
+		require.NoError(t, err)
+	}
+	dispatcher.Close()
+
+	// Each prompt is queued after the single write recording its intent, so
+	// the worker clearing the intent writes last
+	var intents []string
+	for _, write := range storage.writes {
+		if state, id, _ := strings.Cut(write, " "); id != "" {
+			intents = append(intents, state)
+		}
+	}
+	assert.Equal(t, []string{"ask_name", "ask_age"}, intents)
+	assert.Equal(t, "ask_age ", storage.writes[len(storage.writes)-1])
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.True(t, state.PromptSent)
+	assert.Equal(t, tgsm.OutboxPrompt{}, state.Outbox)
+}
+
+func TestStateManagerOutboxDispatchedLocked(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	require.NoError(t, sm.SetOutbox(tgsm.Outbox{}))
+	require.NoError(t, sm.SetLocker(tgsm.NewLocalLocker(), 0))
+	dispatcher := tgsm.NewPromptDispatcher(1, 0, nil)
+	require.NoError(t, sm.SetPromptDispatcher(dispatcher))
+
+	// Updates waiting on the worker's queue under the user's lock do not
+	// hold up the worker clearing the intents of the prompts it sent
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, text := range []string{"/start", "John", "30"} {
+			_, err := sm.Handle(MockUpdate{ChatID: 1, Text: text})
+			assert.NoError(t, err)
+		}
+		dispatcher.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handling deadlocked with the dispatcher")
+	}
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_country", state.CurrentState)
+	assert.Equal(t, tgsm.OutboxPrompt{}, state.Outbox)
+}
+
+func TestStateManagerOutcomes(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name: "screening",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+			if u.Text == "no" {
+				return tgsm.End(tgsm.OutcomeRejected), nil
+			}
+			return "", nil
+		},
+	}))
+
+	var outcomes []tgsm.Outcome
+	sm.OnEvent(func(e tgsm.Event) {
+		if e.Kind == tgsm.EventFinished {
+			outcomes = append(outcomes, e.Outcome)
+		}
+	})
+	var finished tgsm.UserState[UserProfile]
+	sm.SetOnFinish(func(u MockUpdate, userState tgsm.UserState[UserProfile]) error {
+		finished = userState
+		return nil
+	})
+
+	require.NoError(t, sm.SetState(1, "screening"))
+	_, err := sm.Handle(MockUpdate{ChatID: 1, Text: "no"})
+	require.NoError(t, err)
+	assert.Equal(t, tgsm.OutcomeRejected, finished.Outcome)
+	assert.Empty(t, finished.History)
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+	assert.Empty(t, state.CurrentState)
+	assert.Equal(t, tgsm.OutcomeRejected, state.Outcome)
+
+	require.NoError(t, sm.SetState(2, "screening"))
+	_, err = sm.Handle(MockUpdate{ChatID: 2, Text: "yes"})
+	require.NoError(t, err)
+	assert.Equal(t, tgsm.OutcomeCompleted, finished.Outcome)
+
+	require.NoError(t, sm.SetState(3, "ask_age"))
+	require.NoError(t, sm.Cancel(MockUpdate{ChatID: 3}))
+	state, _, err = sm.Current(3)
+	require.NoError(t, err)
+	assert.Equal(t, tgsm.OutcomeCancelled, state.Outcome)
+
+	require.NoError(t, sm.SetState(4, "ask_age"))
+	require.NoError(t, sm.EndSession(4, tgsm.OutcomeTimedOut))
+	state, _, err = sm.Current(4)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+	assert.Equal(t, tgsm.OutcomeTimedOut, state.Outcome)
+
+	// Starting over clears the outcome
+	require.NoError(t, sm.SetState(4, "ask_name"))
+	state, _, err = sm.Current(4)
+	require.NoError(t, err)
+	assert.Empty(t, state.Outcome)
+
+	assert.Equal(t, []tgsm.Outcome{tgsm.OutcomeRejected, tgsm.OutcomeCompleted, tgsm.OutcomeCancelled, tgsm.OutcomeTimedOut}, outcomes)
+}
+
+func TestStateManagerRateLimit(t *testing.T) {
+	storage := tgsmtest.NewRecordingStorage[UserProfile](nil)
+	sm := setupStateManager(t, storage)
+	clock := tgsmtest.NewFakeClock(time.Now())
+	require.NoError(t, sm.SetClock(clock.Now))
+	require.NoError(t, sm.SetRateLimit(tgsm.RateLimit[MockUpdate]{Rate: 1, Burst: 2}))
+
+	for _, text := range []string{"/start", "John", "30"} {
+		handled, err := sm.Handle(MockUpdate{ChatID: 1, Text: text})
+		require.NoError(t, err)
+		assert.True(t, handled)
+	}
+	assert.Equal(t, 2, storage.Count(tgsmtest.OpGet), "dropped updates never reach the storage")
+	tester := tgsmtest.NewFlowTester(t, sm)
+	tester.AssertState(1, "ask_age")
+
+	// Other users have buckets of their own
+	tester.Send(MockUpdate{ChatID: 2, Text: "/start"})
+	tester.AssertState(2, "ask_name")
+	clock.Advance(time.Second)
+	tester.Send(MockUpdate{ChatID: 1, Text: "30"})
+	tester.AssertState(1, "ask_country")
+
+	var limited []string
+	require.NoError(t, sm.SetRateLimit(tgsm.RateLimit[MockUpdate]{
+		Rate:   1,
+		Policy: tgsm.RateLimitHook,
+		OnLimited: func(u MockUpdate) error {
+			limited = append(limited, u.Text)
+			return nil
+		},
+	}))
+	tester.Send(MockUpdate{ChatID: 3, Text: "/start"}, MockUpdate{ChatID: 3, Text: "John"})
+	assert.Equal(t, []string{"John"}, limited)
+	tester.AssertState(3, "ask_name")
+
+	require.NoError(t, sm.SetClock(time.Now))
+	require.NoError(t, sm.SetRateLimit(tgsm.RateLimit[MockUpdate]{
+		Rate:    100,
+		Burst:   1,
+		Policy:  tgsm.RateLimitQueue,
+		MaxWait: time.Second,
+	}))
+	start := time.Now()
+	tester.Send(MockUpdate{ChatID: 4, Text: "/start"}, MockUpdate{ChatID: 4, Text: "John"})
+	assert.GreaterOrEqual(t, time.Since(start), 5*time.Millisecond)
+	tester.AssertState(4, "ask_age")
+
+	// Held updates give up when their context is done
+	require.NoError(t, sm.SetRateLimit(tgsm.RateLimit[MockUpdate]{
+		Rate:    0.1,
+		Burst:   1,
+		Policy:  tgsm.RateLimitQueue,
+		MaxWait: time.Minute,
+	}))
+	tester.Send(MockUpdate{ChatID: 5, Text: "/start"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err := sm.HandleContext(ctx, MockUpdate{ChatID: 5, Text: "John"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	tester.AssertState(5, "ask_name")
+}
+
+func TestStateManagerTriggers(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	var menus int
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:   "menu",
+		Prompt: func(u MockUpdate, data *UserProfile) error { menus++; return nil },
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "ask_age", nil },
+	}))
+	require.NoError(t, sm.AddFlow("support", "ask_country"))
+
+	assert.ErrorIs(t, sm.AddTriggers(tgsm.Trigger[MockUpdate]{State: "missing"}), tgsm.ErrUnknownState)
+	assert.ErrorIs(t, sm.AddTriggers(tgsm.Trigger[MockUpdate]{Flow: "missing"}), tgsm.ErrUnknownFlow)
+	require.NoError(t, sm.AddTriggers(
+		tgsm.Trigger[MockUpdate]{When: func(u MockUpdate) bool { return u.Text == "Main menu" }, State: "menu"},
+		tgsm.Trigger[MockUpdate]{When: func(u MockUpdate) bool { return u.Text == "Help" }, Flow: "support"},
+	))
+
+	tester := tgsmtest.NewFlowTester(t, sm)
+	tester.Send(MockUpdate{ChatID: 1, Text: "/start"}, MockUpdate{ChatID: 1, Text: "John"})
+	tester.AssertState(1, "ask_age")
+
+	assert.True(t, tester.Send(MockUpdate{ChatID: 1, Text: "Main menu"}))
+	tester.AssertState(1, "menu")
+	assert.Equal(t, 1, menus)
+	assert.Equal(t, "John", tester.State(1).Data.Name)
+	assert.Equal(t, []string{"ask_name", "ask_age"}, tester.State(1).History)
+
+	tester.Send(MockUpdate{ChatID: 1, Text: "Help"})
+	state := tester.State(1)
+	assert.Equal(t, "support", state.Flow)
+	assert.Equal(t, "ask_country", state.CurrentState)
+	assert.Empty(t, state.Data.Name)
+
+	// Finished and new users are caught as well
+	tester.Send(MockUpdate{ChatID: 1, Text: "Canada"})
+	tester.AssertState(1, "")
+	tester.Send(MockUpdate{ChatID: 1, Text: "Main menu"}, MockUpdate{ChatID: 2, Text: "Main menu"})
+	tester.AssertState(1, "menu")
+	tester.AssertState(2, "menu")
+	assert.Empty(t, tester.State(2).History)
+}
+
+func TestStateManagerKeyFunc(t *testing.T) {
+	storage := tgsmtest.NewRecordingStorage[UserProfile](nil)
+	sm := setupStateManager(t, storage)
+	require.NoError(t, sm.SetKeyFunc(func(u MockUpdate) (int64, bool) { return u.ChatID, u.ChatID != 0 }))
+
+	handled, err := sm.Handle(MockUpdate{Text: "John"})
+	assert.NoError(t, err)
+	assert.False(t, handled)
+	assert.NoError(t, sm.Cancel(MockUpdate{}))
+	assert.Empty(t, storage.Calls())
+
+	results, err := sm.HandleBatch([]MockUpdate{{Text: "John"}, {ChatID: 1, Text: "John"}})
+	require.NoError(t, err)
+	assert.False(t, results[0].Handled)
+	assert.True(t, results[1].Handled)
+
+	sm.Freeze()
+	assert.ErrorIs(t, sm.SetKeyFunc(nil), tgsm.ErrFrozen)
+}
+
+func TestStateManagerFilter(t *testing.T) {
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("photo")
+	var replies []any
+	require.NoError(t, sm.SetResponder(func(u MockUpdate, reply any) error {
+		replies = append(replies, reply)
+		return nil
+	}))
+	require.NoError(t, sm.SetWrongInputReply("Please answer with text."))
+	isPhoto := func(u MockUpdate) bool { return strings.HasPrefix(u.Text, "photo:") }
+	require.NoError(t, sm.Add(
+		&tgsm.State[UserProfile, MockUpdate]{
+			Name:       "photo",
+			Filter:     isPhoto,
+			WrongInput: "Please send a photo.",
+			Handle:     func(u MockUpdate, data *UserProfile) (string, error) { return "name", nil },
+		},
+		&tgsm.State[UserProfile, MockUpdate]{
+			Name:   "name",
+			Filter: func(u MockUpdate) bool { return !isPhoto(u) },
+			Handle: func(u MockUpdate, data *UserProfile) (string, error) { data.Name = u.Text; return "", nil },
+		},
+	))
+
+	tester := tgsmtest.NewFlowTester(t, sm)
+	assert.True(t, tester.Send(MockUpdate{ChatID: 1, Text: "John"}))
+	tester.Send(MockUpdate{ChatID: 1, Text: "photo:1"}, MockUpdate{ChatID: 1, Text: "photo:2"})
+	tester.AssertState(1, "name")
+	tester.Send(MockUpdate{ChatID: 1, Text: "John"})
+	tester.AssertState(1, "")
+	assert.Equal(t, []any{"Please send a photo.", "Please answer with text."}, replies)
+}
+
+func TestStateManagerPromptParts(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	var sent []string
+	failing := errors.New("network down")
+	fail := true
+	part := func(name string) func(tgsm.PromptContext[MockUpdate], *UserProfile) error {
+		return func(pc tgsm.PromptContext[MockUpdate], data *UserProfile) error {
+			if name == "question" && fail {
+				fail = false
+				return failing
+			}
+			sent = append(sent, name)
+			return nil
+		}
+	}
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:       "example",
+		PromptWith: tgsm.PromptParts(part("intro"), part("image"), part("question")),
+		Handle:     func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+	}))
+	require.NoError(t, sm.SetInitialState("example"))
+
+	_, err := sm.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+	var partial *tgsm.PartialPromptError
+	require.ErrorAs(t, err, &partial)
+	assert.ErrorIs(t, err, failing)
+	assert.Equal(t, 2, partial.Sent)
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.False(t, state.PromptSent)
+	assert.Equal(t, 2, state.PromptParts)
+
+	// Only the remaining part is sent again
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"intro", "image", "question"}, sent)
+	state, _, err = sm.Current(1)
+	require.NoError(t, err)
+	assert.True(t, state.PromptSent)
+	assert.Zero(t, state.PromptParts)
+
+	// Sending it again starts over
+	require.NoError(t, sm.Reprompt(1))
+	assert.Equal(t, []string{"intro", "image", "question", "intro", "image", "question"}, sent)
+}
+
+func TestCollectState(t *testing.T) {
+	type album struct{ Photos []string }
+	var prompts int
+	sm := tgsm.NewStateManager[album, MockUpdate](tgsm.NewInMemoryStorage[album](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("photos")
+	require.NoError(t, sm.Add(tgsm.CollectState(tgsm.Collect[album, MockUpdate, string]{
+		Name:    "photos",
+		Prompt:  func(pc tgsm.PromptContext[MockUpdate], data *album) error { prompts++; return nil },
+		Entries: func(data *album) *[]string { return &data.Photos },
+		Parse: func(u MockUpdate) (string, error) {
+			photo, ok := strings.CutPrefix(u.Text, "photo:")
+			if !ok {
+				return "", tgsm.ErrValidation
+			}
+			return photo, nil
+		},
+		Done: func(u MockUpdate) bool { return u.Text == "Done" },
+		Min:  2,
+		Max:  3,
+	})))
+
+	tester := tgsmtest.NewFlowTester(t, sm)
+	tester.Send(MockUpdate{ChatID: 1}, MockUpdate{ChatID: 1, Text: "photo:a"}, MockUpdate{ChatID: 1, Text: "Done"})
+	tester.AssertState(1, "photos")
+	tester.Send(MockUpdate{ChatID: 1, Text: "hello"}, MockUpdate{ChatID: 1, Text: "photo:b"})
+	assert.Equal(t, []string{"a", "b"}, tester.State(1).Data.Photos)
+	assert.Equal(t, 1, prompts, "staying in the state does not prompt again")
+	tester.Send(MockUpdate{ChatID: 1, Text: "Done"})
+	tester.AssertState(1, "")
+
+	// Max entries finish the collection on their own
+	tester.Send(MockUpdate{ChatID: 2}, MockUpdate{ChatID: 2, Text: "photo:a"}, MockUpdate{ChatID: 2, Text: "photo:b"}, MockUpdate{ChatID: 2, Text: "photo:c"})
+	tester.AssertState(2, "")
+	assert.Len(t, tester.State(2).Data.Photos, 3)
+}
+
+func TestStateManagerPage(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	var shown []int
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name: "pick",
+		PromptWith: func(pc tgsm.PromptContext[MockUpdate], data *UserProfile) error {
+			shown = append(shown, pc.Page)
+			return nil
+		},
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+			if page, err := strconv.Atoi(u.Text); err == nil {
+				return tgsm.Page(page), nil
+			}
+			return "", nil
+		},
+	}))
+	require.NoError(t, sm.SetInitialState("pick"))
+
+	tester := tgsmtest.NewFlowTester(t, sm)
+	tester.Send(MockUpdate{ChatID: 1}, MockUpdate{ChatID: 1, Text: "1"}, MockUpdate{ChatID: 1, Text: "2"})
+	tester.AssertState(1, "pick")
+	assert.Equal(t, 2, tester.State(1).Page)
+	assert.Empty(t, tester.State(1).History)
+	require.NoError(t, sm.Reprompt(1))
+	assert.Equal(t, []int{0, 1, 2, 2}, shown)
+
+	tester.Send(MockUpdate{ChatID: 1, Text: "Germany"})
+	tester.AssertState(1, "")
+	assert.Zero(t, tester.State(1).Page)
+}
+
+func TestStateManagerBackRollback(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	sm.SetActionFunc(func(u MockUpdate) (tgsm.Action, bool) { return tgsm.ActionBack, u.Text == "<back>" })
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name: "nickname",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+			data.Name = u.Text
+			return "ask_country", nil
+		},
+		Rollback: func(data *UserProfile) { data.Name = "" },
+	}))
+	require.NoError(t, sm.SetInitialState("nickname"))
+
+	tester := tgsmtest.NewFlowTester(t, sm)
+	tester.Send(MockUpdate{ChatID: 1, Text: "John"})
+	tester.AssertData(1, UserProfile{Name: "John"})
+	tester.Send(MockUpdate{ChatID: 1, Text: "<back>"})
+	tester.AssertState(1, "nickname")
+	tester.AssertData(1, UserProfile{})
+}
+
+func TestStateManagerStats(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	answers := map[int64][]string{
+		1: {"hi", "Ann"},
+		2: {"hi", "Bob", "30"},
+		3: {"hi", "Cid", "40"},
+		4: {"hi", "Dee", "50", "NL"},
+	}
+	for chatID, texts := range answers {
+		for _, text := range texts {
+			_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: text})
+			require.NoError(t, err)
+		}
+	}
+
+	stats, err := sm.Stats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, stats.Total)
+	assert.Equal(t, 3, stats.Active)
+	assert.Equal(t, map[string]int{"ask_age": 1, "ask_country": 2}, stats.States)
+	assert.Equal(t, map[string]int{"": 3}, stats.Flows)
+	assert.Equal(t, map[tgsm.Outcome]int{tgsm.OutcomeCompleted: 1}, stats.Outcomes)
+}
+
+func TestStateManagerAudit(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	require.NoError(t, sm.SetTextAccessor(mockText{}))
+	audit := &tgsm.MemoryAuditStorage{}
+	require.NoError(t, sm.SetAudit(audit, nil))
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:      "ask_pin",
+		Sensitive: true,
+		Handle:    func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+	}))
+
+	for _, text := range []string{"/start", "John", "30", "Japan"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: text})
+		require.NoError(t, err)
+	}
+	type move struct{ From, To, Update string }
+	entries, err := audit.Entries(context.Background(), 1)
+	require.NoError(t, err)
+	var moves []move
+	for _, entry := range entries {
+		moves = append(moves, move{entry.From, entry.To, entry.Update})
+		assert.False(t, entry.Time.IsZero())
+	}
+	assert.Equal(t, []move{
+		{"ask_name", "ask_age", "John"},
+		{"ask_age", "ask_country", "30"},
+		{"ask_country", "", "Japan"},
+	}, moves)
+	assert.Equal(t, tgsm.OutcomeCompleted, entries[2].Outcome)
+
+	_, err = sm.Handle(MockUpdate{ChatID: 2, Text: "/start"})
+	require.NoError(t, err)
+	require.NoError(t, sm.SetState(2, "ask_pin"))
+	_, err = sm.Handle(MockUpdate{ChatID: 2, Text: "1234"})
+	require.NoError(t, err)
+	entries, err = audit.Entries(context.Background(), 2)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "ask_pin", entries[0].To)
+	assert.Empty(t, entries[0].Update)
+	assert.Equal(t, tgsm.Redacted, entries[1].Update)
+
+	_, err = sm.Handle(MockUpdate{ChatID: 3, Text: "/start"})
+	require.NoError(t, err)
+	require.NoError(t, sm.EndSession(3, tgsm.OutcomeRejected))
+	entries, err = audit.Entries(context.Background(), 3)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "ask_name", entries[0].From)
+	assert.Equal(t, tgsm.OutcomeRejected, entries[0].Outcome)
+
+	failing := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	require.NoError(t, failing.SetAudit(tgsm.AuditFunc(func(tgsm.AuditEntry) error { return assert.AnError }), nil))
+	_, err = failing.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+	require.NoError(t, err)
+	_, err = failing.Handle(MockUpdate{ChatID: 1, Text: "John"})
+	assert.ErrorIs(t, err, assert.AnError)
+}
+
+func TestStateManagerPromptTemplates(t *testing.T) {
+	prompts := tgsm.NewTemplatePrompts("en")
+	require.NoError(t, prompts.Add("en", "name", "What is your name?"))
+	require.NoError(t, prompts.Add("en", "age", "How old are you, {{.Data.Name}}?"))
+	require.NoError(t, prompts.Add("de", "age", "Wie alt bist du, {{.Data.Name}}?"))
+	assert.Error(t, prompts.Add("en", "broken", "{{.Data"))
+
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("ask_name")
+	require.NoError(t, sm.Add(
+		&tgsm.State[UserProfile, MockUpdate]{
+			Name:      "ask_name",
+			PromptKey: "name",
+			Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+				data.Name = u.Text
+				return "ask_age", nil
+			},
+		},
+		&tgsm.State[UserProfile, MockUpdate]{
+			Name:      "ask_age",
+			PromptKey: "age",
+			Handle:    func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+		},
+	))
+
+	// Without a provider keyed prompts cannot be sent
+	_, err := sm.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+	assert.ErrorIs(t, err, tgsm.ErrNoPrompt)
+
+	var sent []string
+	require.NoError(t, sm.SetPromptProvider(prompts))
+	require.NoError(t, sm.SetResponder(func(u MockUpdate, reply any) error {
+		sent = append(sent, reply.(string))
+		return nil
+	}))
+	require.NoError(t, sm.SetNotifier(func(chatID int64, msg any) error {
+		sent = append(sent, msg.(string))
+		return nil
+	}))
+	require.NoError(t, sm.SetProfileResolver(tgsm.ProfileResolverFunc(func(id int64) (tgsm.Profile, error) {
+		return tgsm.Profile{ID: id, LanguageCode: map[int64]string{2: "de"}[id]}, nil
+	}), time.Hour))
+
+	for _, chatID := range []int64{1, 2} {
+		for _, text := range []string{"/start", "Anna"} {
+			_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: text})
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, sm.Reprompt(2))
+	assert.Equal(t, []string{
+		"What is your name?",
+		"How old are you, Anna?",
+		"What is your name?",
+		"Wie alt bist du, Anna?",
+		"Wie alt bist du, Anna?",
+	}, sent)
+	assert.Equal(t, "age", sm.States()[0].PromptKey)
+}
+
+func TestStateManagerLocalizer(t *testing.T) {
+	localizer := tgsm.NewMapLocalizer("en")
+	require.NoError(t, localizer.Add("en", map[string]string{
+		"age":         "How old are you, {{.Data.Name}}?",
+		"age.invalid": "Please send a number.",
+		"age.range":   "Nobody is {{.}}.",
+	}))
+	require.NoError(t, localizer.Add("de", map[string]string{
+		"age":         "Wie alt bist du, {{.Data.Name}}?",
+		"age.invalid": "Bitte sende eine Zahl.",
+	}))
+
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("ask_name")
+	require.NoError(t, sm.Add(createNameState(), &tgsm.State[UserProfile, MockUpdate]{
+		Name:       "ask_age",
+		PromptKey:  "age",
+		InvalidKey: "age.invalid",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+			age, err := strconv.Atoi(u.Text)
+			if err != nil {
+				return "", tgsm.ErrValidation
+			}
+			if age > 150 {
+				return "", &tgsm.ValidationError{Key: "age.range", Data: age}
+			}
+			data.Age = age
+			return "", nil
+		},
+	}))
+	var sent []string
+	require.NoError(t, sm.SetResponder(func(u MockUpdate, reply any) error {
+		sent = append(sent, reply.(string))
+		return nil
+	}))
+	require.NoError(t, sm.SetLocalizer(localizer, func(u MockUpdate) string {
+		return map[int64]string{2: "de"}[u.ChatID]
+	}))
+
+	for _, chatID := range []int64{1, 2} {
+		for _, text := range []string{"/start", "Anna", "old", "200"} {
+			_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: text})
+			require.NoError(t, err)
+		}
+	}
+	assert.Equal(t, []string{
+		"How old are you, Anna?", "Please send a number.", "Nobody is 200.",
+		"Wie alt bist du, Anna?", "Bitte sende eine Zahl.", "Nobody is 200.",
+	}, sent)
+
+	require.NoError(t, sm.SetLanguage(1, "de"))
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "de", state.Language)
+	assert.Equal(t, "ask_age", state.CurrentState)
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "x"})
+	require.NoError(t, err)
+	assert.Equal(t, "Bitte sende eine Zahl.", sent[len(sent)-1])
+}
+
+func TestStateManagerMeta(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	sm.SetActionFunc(func(u MockUpdate) (tgsm.Action, bool) { return tgsm.ActionCancel, u.Text == "/cancel" })
+
+	require.NoError(t, sm.SetMeta(1, "bucket", "b"))
+	for _, text := range []string{"/start", "John", "/cancel"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: text})
+		require.NoError(t, err)
+	}
+	bucket, ok, err := sm.Meta(1, "bucket")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "b", bucket)
+	_, ok, err = sm.Meta(1, "campaign")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// States read from memory do not share their metadata with the storage
+	state, _, err := storage.Get(1)
+	require.NoError(t, err)
+	state.SetMeta("bucket", "a")
+	bucket, _, err = sm.Meta(1, "bucket")
+	require.NoError(t, err)
+	assert.Equal(t, "b", bucket)
+
+	require.NoError(t, sm.SetMeta(1, "campaign", "spring"))
+	session, _, err := sm.Session(1)
+	require.NoError(t, err)
+	assert.Nil(t, session.Meta, "sessions expose no metadata unless selected")
+	require.NoError(t, sm.SetSessionFields(nil, "bucket"))
+	session, _, err = sm.Session(1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"bucket": "b"}, session.Meta)
+}
+
+func TestStateManagerValidate(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	assert.NoError(t, sm.Validate())
+
+	sm = tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	assert.ErrorIs(t, sm.Validate(), tgsm.ErrNoInitialState)
+
+	sm.SetInitialState("start")
+	notes := &tgsm.State[UserProfile, MockUpdate]{Name: "ask_notes", Optional: true, Owner: "growth"}
+	breaker := &tgsm.Breaker{Threshold: 3, OpenFor: time.Minute}
+	require.NoError(t, sm.Add(
+		&tgsm.State[UserProfile, MockUpdate]{
+			Name:        "ask_name",
+			Transitions: []tgsm.Transition[UserProfile, MockUpdate]{{To: "ask_age"}, {To: tgsm.End(tgsm.OutcomeRejected)}},
+			SkipTo:      "ask_country",
+			Breaker:     &tgsm.Breaker{Threshold: 3, OpenFor: time.Minute, Fallback: "support"},
+		},
+		&tgsm.State[UserProfile, MockUpdate]{Name: "ask_age", SkipTo: tgsm.NopState, Breaker: breaker},
+		notes,
+	))
+	err := sm.Validate()
+	assert.ErrorIs(t, err, tgsm.ErrUnknownState)
+	assert.ErrorIs(t, err, tgsm.ErrNoSkipTo)
+	assert.ErrorIs(t, err, tgsm.ErrNoFallback)
+	assert.Equal(t, "unknown state: start (initial state)\n"+
+		"breaker without a fallback state: ask_age\n"+
+		"unknown state: ask_country (SkipTo of ask_name)\n"+
+		"unknown state: support (breaker fallback of ask_name)\n"+
+		"optional state without SkipTo: ask_notes, owned by growth", err.Error())
+
+	// Handle refuses to run until the configuration is fixed
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "hi"})
+	assert.ErrorIs(t, err, tgsm.ErrUnknownState)
+	sm.SetInitialState("ask_name")
+	require.NoError(t, sm.Add(
+		&tgsm.State[UserProfile, MockUpdate]{Name: "ask_country"},
+		&tgsm.State[UserProfile, MockUpdate]{Name: "support"},
+	))
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "hi"})
+	assert.ErrorIs(t, err, tgsm.ErrNoSkipTo)
+	notes.SkipTo = tgsm.NopState
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "hi"})
+	assert.ErrorIs(t, err, tgsm.ErrNoFallback)
+	breaker.Fallback = "support"
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "hi"})
+	assert.NoError(t, err)
+}
+
+func TestStateManagerHandleResult(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+
+	var results []tgsm.Result
+	for _, text := range []string{"/start", "John", "abc", "30", "Japan"} {
+		result, err := sm.HandleResult(MockUpdate{ChatID: 1, Text: text})
+		require.NoError(t, err)
+		results = append(results, result)
+	}
+	assert.Equal(t, []tgsm.Result{
+		{Handled: true, To: "ask_name"},
+		{Handled: true, From: "ask_name", To: "ask_age"},
+		{Handled: true, From: "ask_age", To: "ask_age"},
+		{Handled: true, From: "ask_age", To: "ask_country"},
+		{Handled: true, From: "ask_country", Finished: true, Outcome: tgsm.OutcomeCompleted},
+	}, results)
+}
+
+func TestStateManagerHandleContext(t *testing.T) {
+	type traceKey struct{}
+	var traces []any
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("ask_name")
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name: "ask_name",
+		PromptWith: func(ctx tgsm.PromptContext[MockUpdate], data *UserProfile) error {
+			traces = append(traces, ctx.Context.Value(traceKey{}))
+			return nil
+		},
+		HandleWith: func(ctx context.Context, u MockUpdate, data *UserProfile) (string, error) {
+			traces = append(traces, ctx.Value(traceKey{}))
+			data.Name = u.Text
+			return "", nil
+		},
+	}))
+
+	ctx := context.WithValue(context.Background(), traceKey{}, "trace-1")
+	_, err := sm.HandleContext(ctx, MockUpdate{ChatID: 1, Text: "/start"})
+	require.NoError(t, err)
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "John"})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"trace-1", nil}, traces)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = sm.HandleContext(cancelled, MockUpdate{ChatID: 2, Text: "/start"})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// readOnlyStorage fails every write.
+type readOnlyStorage struct {
+	tgsm.StateStorage[UserProfile]
+}
+
+func (s readOnlyStorage) Set(id int64, state tgsm.UserState[UserProfile]) error {
+	return assert.AnError
+}
+
+func TestStateError(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	failing := errors.New("backend down")
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:   "failing",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "", failing },
+	}))
+	require.NoError(t, sm.SetState(1, "failing"))
+	_, err := sm.Handle(MockUpdate{ChatID: 1, Text: "x"})
+	assert.ErrorIs(t, err, failing)
+	var se *tgsm.StateError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, tgsm.StateError{Key: 1, State: "failing", Phase: tgsm.PhaseHandle, Err: failing}, *se)
+	assert.Equal(t, `handle state "failing" of user 1: backend down`, err.Error())
+
+	sm = setupStateManager(t, readOnlyStorage{storage})
+	_, err = sm.Handle(MockUpdate{ChatID: 2, Text: "/start"})
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, tgsm.PhasePersist, se.Phase)
+	assert.Equal(t, "ask_name", se.State)
+}
+
+func TestStateManagerSetStateResetsState(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	for _, text := range []string{"/start", "John", "abc"} {
+		_, err := sm.Handle(MockUpdate{ChatID: 1, Text: text})
+		require.NoError(t, err)
+	}
+	state, _, err := storage.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, state.Failures)
+
+	require.NoError(t, sm.SetState(1, "ask_name"))
+	state, _, err = storage.Get(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_name", state.CurrentState)
+	assert.Zero(t, state.Failures, "failures are kept per state")
+	assert.False(t, state.PromptSent)
+	assert.Equal(t, "John", state.Data.Name)
+}
+
+func TestStateManagerDeleteSession(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	require.NoError(t, sm.SetState(1, "ask_age"))
+	require.NoError(t, sm.DeleteSession(1))
+	_, exists, err := storage.Get(1)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Hides Delete of the in-memory storage
+	sm = setupStateManager(t, struct{ tgsm.StateStorage[UserProfile] }{storage})
+	assert.ErrorIs(t, sm.DeleteSession(1), tgsm.ErrNotDeletable)
+}
+
+func TestStateManagerInitialStateFunc(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	require.NoError(t, sm.AddFlow("survey", "rate", &tgsm.State[UserProfile, MockUpdate]{
+		Name:   "rate",
+		Prompt: func(u MockUpdate, data *UserProfile) error { return nil },
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+	}))
+	require.NoError(t, sm.SetInitialStateFunc(func(u MockUpdate) (string, UserProfile, error) {
+		switch u.Text {
+		case "/start referral":
+			return "ask_age", UserProfile{Name: "Referred"}, nil
+		case "/start survey":
+			return "survey", UserProfile{}, nil
+		case "/start bogus":
+			return "bogus", UserProfile{}, nil
+		}
+		return "", UserProfile{}, nil
+	}))
+
+	for chatID, text := range map[int64]string{1: "/start referral", 2: "/start survey", 3: "/start"} {
+		_, err := sm.Handle(MockUpdate{ChatID: chatID, Text: text})
+		require.NoError(t, err)
+	}
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_age", state.CurrentState)
+	assert.Equal(t, "Referred", state.Data.Name)
+	state, _, err = sm.Current(2)
+	require.NoError(t, err)
+	assert.Equal(t, "survey", state.Flow)
+	assert.Equal(t, "rate", state.CurrentState)
+	state, _, err = sm.Current(3)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_name", state.CurrentState)
+
+	_, err = sm.Handle(MockUpdate{ChatID: 4, Text: "/start bogus"})
+	assert.ErrorIs(t, err, tgsm.ErrUnknownState)
+
+	// Users with only metadata start on their first update
+	require.NoError(t, sm.SetMeta(5, "campaign", "spring"))
+	_, err = sm.Handle(MockUpdate{ChatID: 5, Text: "/start referral"})
+	require.NoError(t, err)
+	state, _, err = sm.Current(5)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_age", state.CurrentState)
+	assert.Equal(t, "spring", state.Meta["campaign"])
+}
+
+func TestStateManagerDeepLinks(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	require.NoError(t, sm.SetSourceFunc(func(u MockUpdate) tgsm.Source {
+		if payload, ok := strings.CutPrefix(u.Text, "/start "); ok {
+			return tgsm.Source{Kind: tgsm.SourceDeepLink, Detail: payload}
+		}
+		return tgsm.Source{}
+	}))
+	require.NoError(t, sm.AddDeepLinks(
+		tgsm.DeepLink[UserProfile]{
+			Pattern: "ref_{name}_{age}",
+			State:   "ask_country",
+			Fill: func(params map[string]string, data *UserProfile) error {
+				data.Name = params["name"]
+				var err error
+				data.Age, err = strconv.Atoi(params["age"])
+				return err
+			},
+		},
+		tgsm.DeepLink[UserProfile]{Pattern: "age", State: "ask_age"},
+	))
+	assert.ErrorIs(t, sm.AddDeepLinks(tgsm.DeepLink[UserProfile]{Pattern: "x", State: "missing"}), tgsm.ErrUnknownState)
+	assert.ErrorIs(t, sm.AddDeepLinks(tgsm.DeepLink[UserProfile]{Pattern: "", State: "ask_age"}), tgsm.ErrInvalidPattern)
+
+	_, err := sm.Handle(MockUpdate{ChatID: 1, Text: "/start ref_Anna_30"})
+	require.NoError(t, err)
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_country", state.CurrentState)
+	assert.Equal(t, UserProfile{Name: "Anna", Age: 30}, state.Data)
+	assert.Equal(t, tgsm.Source{Kind: tgsm.SourceDeepLink, Detail: "ref_Anna_30"}, state.Source)
+
+	// Links take precedence over the state a user is in
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "/start age"})
+	require.NoError(t, err)
+	state, _, err = sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_age", state.CurrentState)
+	assert.Empty(t, state.Data.Name)
+
+	// Payloads matching no link start users as usual
+	_, err = sm.Handle(MockUpdate{ChatID: 2, Text: "/start ref_Anna"})
+	require.NoError(t, err)
+	state, _, err = sm.Current(2)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_name", state.CurrentState)
+}
+
+func TestStateManagerChatPolicy(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	require.NoError(t, sm.AddFlow("group_setup", "pick_topic", &tgsm.State[UserProfile, MockUpdate]{
+		Name:   "pick_topic",
+		Prompt: func(u MockUpdate, data *UserProfile) error { return nil },
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+	}))
+	require.NoError(t, sm.SetChatTypeFunc(func(u MockUpdate) tgsm.ChatType {
+		switch {
+		case u.ChatID > 0:
+			return tgsm.ChatPrivate
+		case u.ChatID > -1000:
+			return tgsm.ChatGroup
+		}
+		return tgsm.ChatChannel
+	}))
+	assert.ErrorIs(t, sm.SetChatPolicy(tgsm.ChatGroup, tgsm.ChatPolicy{Flow: "missing"}), tgsm.ErrUnknownFlow)
+	require.NoError(t, sm.SetChatPolicy(tgsm.ChatGroup, tgsm.ChatPolicy{Flow: "group_setup"}))
+	require.NoError(t, sm.SetChatPolicy(tgsm.ChatChannel, tgsm.ChatPolicy{Ignore: true}))
+
+	for _, chatID := range []int64{1, -5} {
+		handled, err := sm.Handle(MockUpdate{ChatID: chatID, Text: "/start"})
+		require.NoError(t, err)
+		assert.True(t, handled)
+	}
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ask_name", state.CurrentState)
+	state, _, err = sm.Current(-5)
+	require.NoError(t, err)
+	assert.Equal(t, "group_setup", state.Flow)
+	assert.Equal(t, "pick_topic", state.CurrentState)
+
+	handled, err := sm.Handle(MockUpdate{ChatID: -1001, Text: "/start"})
+	require.NoError(t, err)
+	assert.False(t, handled)
+	_, exists, err := sm.Current(-1001)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestStateManagerSchema(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	require.NoError(t, sm.AddFlow("feedback", "rate", &tgsm.State[UserProfile, MockUpdate]{Name: "rate"}))
+
+	var buf bytes.Buffer
+	require.NoError(t, sm.ExportSchema(&buf))
+	schema, err := tgsm.ImportSchema(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, sm.Schema(), schema)
+	assert.Equal(t, "ask_name", schema.InitialState)
+	assert.True(t, schema.HasState("ask_country"))
+
+	require.NoError(t, storage.Set(1, tgsm.UserState[UserProfile]{CurrentState: "ask_age"}))
+	require.NoError(t, storage.Set(2, tgsm.UserState[UserProfile]{CurrentState: "ask_country"}))
+	require.NoError(t, storage.Set(3, tgsm.UserState[UserProfile]{CurrentState: "rate", Flow: "feedback"}))
+	require.NoError(t, storage.Set(4, tgsm.UserState[UserProfile]{CurrentState: "ask_age", Finished: true}))
+
+	compat, err := sm.CheckSchema(context.Background(), schema)
+	require.NoError(t, err)
+	assert.True(t, compat.Compatible())
+	assert.Equal(t, 3, compat.Checked)
+
+	// The next release drops ask_age and the feedback flow
+	next := tgsm.Schema{InitialState: "ask_name", States: []tgsm.StateInfo{{Name: "ask_name"}, {Name: "ask_country"}, {Name: "ask_city"}}}
+	assert.Equal(t, tgsm.SchemaDiff{
+		AddedStates:   []string{"ask_city"},
+		RemovedStates: []string{"ask_age", "rate"},
+		RemovedFlows:  []string{"feedback"},
+	}, schema.Diff(next))
+	compat, err = sm.CheckSchema(context.Background(), next)
+	require.NoError(t, err)
+	assert.False(t, compat.Compatible())
+	assert.Equal(t, map[string]int{"ask_age": 1, "rate": 1}, compat.OrphanedStates)
+	assert.Equal(t, map[string]int{"feedback": 1}, compat.OrphanedFlows)
+}
+
+func TestStateManagerOutbox(t *testing.T) {
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("ask_name")
+	clock := tgsmtest.NewFakeClock(time.Now())
+	require.NoError(t, sm.SetClock(clock.Now))
+	_, err := sm.DeliverOutbox(context.Background())
+	assert.ErrorIs(t, err, tgsm.ErrNoOutbox)
+	require.NoError(t, sm.SetOutbox(tgsm.Outbox{Grace: time.Minute, MaxAttempts: 2}))
+
+	var sent []string
+	down := true
+	name := createNameState()
+	name.Prompt = nil
+	name.PromptWith = func(pc tgsm.PromptContext[MockUpdate], data *UserProfile) error {
+		if down {
+			return errors.New("bot api unavailable")
+		}
+		sent = append(sent, fmt.Sprintf("%d %s %s", pc.Key, pc.State, pc.Reason))
+		return nil
+	}
+	require.NoError(t, sm.Add(name, createAgeState(), createCountryState()))
+
+	_, err = sm.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+	assert.Error(t, err)
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.False(t, state.PromptSent)
+	assert.Equal(t, "ask_name", state.Outbox.State)
+	assert.Equal(t, tgsm.PromptPending, state.Outbox.Reason)
+
+	// Prompts within the grace period are left to the send in progress
+	delivered, err := sm.DeliverOutbox(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, delivered)
+
+	down = false
+	clock.Advance(time.Minute)
+	delivered, err = sm.DeliverOutbox(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, []string{"1 ask_name pending"}, sent)
+	state, _, err = sm.Current(1)
+	require.NoError(t, err)
+	assert.True(t, state.PromptSent)
+	assert.Equal(t, tgsm.OutboxPrompt{}, state.Outbox)
+
+	// Delivered prompts leave nothing behind
+	_, err = sm.Handle(MockUpdate{ChatID: 2, Text: "/start"})
+	require.NoError(t, err)
+	state, _, err = sm.Current(2)
+	require.NoError(t, err)
+	assert.True(t, state.PromptSent)
+	assert.Equal(t, tgsm.OutboxPrompt{}, state.Outbox)
+
+	// The relay gives up after MaxAttempts failed deliveries
+	down = true
+	var errs []error
+	require.NoError(t, sm.OnEvent(func(event tgsm.Event) {
+		if event.Kind == tgsm.EventError {
+			errs = append(errs, event.Err)
+		}
+	}))
+	_, err = sm.Handle(MockUpdate{ChatID: 3, Text: "/start"})
+	assert.Error(t, err)
+	clock.Advance(time.Minute)
+	for range 3 {
+		_, err = sm.DeliverOutbox(context.Background())
+		require.NoError(t, err)
+	}
+	require.Len(t, errs, 4)
+	assert.ErrorIs(t, errs[3], tgsm.ErrPromptUndelivered)
+	state, _, err = sm.Current(3)
+	require.NoError(t, err)
+	assert.Equal(t, tgsm.OutboxPrompt{}, state.Outbox)
+}
+
+func TestStateManagerPromptRetry(t *testing.T) {
+	sm := tgsm.NewStateManager[UserProfile, MockUpdate](tgsm.NewInMemoryStorage[UserProfile](), func(u MockUpdate) int64 { return u.ChatID })
+	sm.SetInitialState("ask_name")
+	require.NoError(t, sm.SetLocker(tgsm.NewLocalLocker(), time.Second))
+	require.NoError(t, sm.SetPromptRetry(tgsm.PromptRetry{Policy: tgsm.RetryWithBackoff, Attempts: 3, BaseDelay: time.Millisecond}))
+
+	var mu sync.Mutex
+	failures := map[int64]int{1: 2, 2: 1}
+	var sent []int64
+	name := createNameState()
+	name.Prompt = func(u MockUpdate, data *UserProfile) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures[u.ChatID] > 0 {
+			failures[u.ChatID]--
+			return errors.New("too many requests")
+		}
+		sent = append(sent, u.ChatID)
+		return nil
+	}
+	require.NoError(t, sm.Add(name, createAgeState(), createCountryState()))
+
+	_, err := sm.Handle(MockUpdate{ChatID: 1, Text: "/start"})
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		state, _, err := sm.Current(1)
+		return err == nil && state.PromptSent
+	}, time.Second, time.Millisecond, "the prompt is retried in the background")
+
+	// Prompts queued with a dispatcher are marked pending again on failure
+	dispatcher := tgsm.NewPromptDispatcher(1, 1, nil)
+	require.NoError(t, sm.SetPromptDispatcher(dispatcher))
+	require.NoError(t, sm.SetPromptRetry(tgsm.PromptRetry{}))
+	_, err = sm.Handle(MockUpdate{ChatID: 2, Text: "/start"})
+	require.NoError(t, err)
+	dispatcher.Close()
+	state, _, err := sm.Current(2)
+	require.NoError(t, err)
+	assert.False(t, state.PromptSent, "the next update sends the prompt rather than answering it")
+
+	require.NoError(t, sm.SetPromptDispatcher(nil))
+	_, err = sm.Handle(MockUpdate{ChatID: 2, Text: "John"})
+	require.NoError(t, err)
+	tgsmtest.NewFlowTester(t, sm).AssertState(2, "ask_name")
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []int64{1, 2}, sent)
+}
+
+func TestStateManagerHandleReply(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	var replies []any
+	require.NoError(t, sm.SetResponder(func(u MockUpdate, reply any) error {
+		replies = append(replies, reply)
+		return nil
+	}))
+	age := &tgsm.State[UserProfile, MockUpdate]{
+		Name: "ask_age",
+		HandleReply: func(u MockUpdate, data *UserProfile) (tgsm.Response, error) {
+			n, err := strconv.Atoi(u.Text)
+			if err != nil {
+				return tgsm.Response{Reply: "Please send a number"}, tgsm.ErrValidation
+			}
+			data.Age = n
+			return tgsm.Response{Next: "ask_country", Reply: fmt.Sprintf("Noted, %d", n)}, nil
+		},
+	}
+
+	// The handler is pure and testable without a manager
+	var data UserProfile
+	resp, err := age.HandleReply(MockUpdate{Text: "30"}, &data)
+	require.NoError(t, err)
+	assert.Equal(t, tgsm.Response{Next: "ask_country", Reply: "Noted, 30"}, resp)
+
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{Name: "intro", HandleReply: age.HandleReply}))
+	require.NoError(t, sm.SetState(1, "intro"))
+	tester := tgsmtest.NewFlowTester(t, sm)
+	tester.Send(MockUpdate{ChatID: 1, Text: "thirty"})
+	tester.AssertState(1, "intro")
+	tester.Send(MockUpdate{ChatID: 1, Text: "30"})
+	tester.AssertState(1, "ask_country")
+	assert.Equal(t, []any{"Please send a number", "Noted, 30"}, replies)
+}
+
+func TestStateManagerMiddleware(t *testing.T) {
+	sm := setupStateManager(t, tgsm.NewInMemoryStorage[UserProfile]())
+	var log []string
+	logging := func(next tgsm.HandlerFunc[UserProfile, MockUpdate]) tgsm.HandlerFunc[UserProfile, MockUpdate] {
+		return func(call tgsm.Call[UserProfile, MockUpdate]) (tgsm.Response, error) {
+			resp, err := next(call)
+			log = append(log, fmt.Sprintf("%d %s -> %s", call.Key, call.State, resp.Next))
+			return resp, err
+		}
+	}
+	adultsOnly := func(next tgsm.HandlerFunc[UserProfile, MockUpdate]) tgsm.HandlerFunc[UserProfile, MockUpdate] {
+		return func(call tgsm.Call[UserProfile, MockUpdate]) (tgsm.Response, error) {
+			if call.Key == 2 {
+				return tgsm.Response{}, tgsm.ErrValidation
+			}
+			return next(call)
+		}
+	}
+	require.NoError(t, sm.Use(logging))
+	age := createAgeState()
+	age.Name = "ask_age_checked"
+	age.Middleware = []tgsm.Middleware[UserProfile, MockUpdate]{adultsOnly}
+	require.NoError(t, sm.Add(age))
+
+	tester := tgsmtest.NewFlowTester(t, sm)
+	for _, key := range []int64{1, 2} {
+		require.NoError(t, sm.SetState(key, "ask_age_checked", tgsm.WithPrompt(MockUpdate{ChatID: key})))
+		tester.Send(MockUpdate{ChatID: key, Text: "30"})
+	}
+	tester.AssertState(1, "ask_country")
+	tester.AssertState(2, "ask_age_checked")
+	tester.Send(MockUpdate{ChatID: 1, Text: "Norway"})
+	assert.Equal(t, []string{"1 ask_age_checked -> ask_country", "2 ask_age_checked -> ", "1 ask_country -> "}, log)
+}
+
+func TestStateManagerGuard(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[UserProfile]()
+	sm := setupStateManager(t, storage)
+	var replies []any
+	require.NoError(t, sm.SetResponder(func(u MockUpdate, reply any) error {
+		replies = append(replies, reply)
+		return nil
+	}))
+	var denials []string
+	require.NoError(t, sm.SetOnDenied(func(u MockUpdate, userState tgsm.UserState[UserProfile], state string, err error) {
+		assert.ErrorIs(t, err, tgsm.ErrDenied)
+		denials = append(denials, fmt.Sprintf("%d %s -> %s", u.ChatID, userState.CurrentState, state))
+	}))
+	verified := map[int64]bool{1: true}
+	errVerification := errors.New("verification service down")
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name: "menu",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) {
+			data.Name = u.Text
+			return "withdraw_amount", nil
+		},
+	}))
+	require.NoError(t, sm.Add(&tgsm.State[UserProfile, MockUpdate]{
+		Name:   "withdraw_amount",
+		Handle: func(u MockUpdate, data *UserProfile) (string, error) { return "", nil },
+		Guard: func(u MockUpdate, data *UserProfile) error {
+			if u.ChatID == 3 {
+				return errVerification
+			}
+			if !verified[u.ChatID] {
+				return tgsm.DenyEntry("Only verified users may withdraw")
+			}
+			return nil
+		},
+	}))
+
+	tester := tgsmtest.NewFlowTester(t, sm)
+	for _, key := range []int64{1, 2} {
+		require.NoError(t, sm.SetState(key, "menu"))
+		tester.Send(MockUpdate{ChatID: key, Text: "withdraw"})
+	}
+	tester.AssertState(1, "withdraw_amount")
+	tester.AssertState(2, "menu")
+	userState, _, err := storage.Get(2)
+	require.NoError(t, err)
+	assert.Empty(t, userState.Data.Name, "a denied update must not persist its changes")
+	assert.Equal(t, []any{"Only verified users may withdraw"}, replies)
+	assert.Equal(t, []string{"2 menu -> withdraw_amount"}, denials)
+
+	// Guard errors other than denials fail the update
+	require.NoError(t, sm.SetState(3, "menu"))
+	_, err = sm.Handle(MockUpdate{ChatID: 3, Text: "withdraw"})
+	assert.ErrorIs(t, err, errVerification)
+	assert.NotErrorIs(t, err, tgsm.ErrDenied)
+	tester.AssertState(3, "menu")
+	assert.Len(t, denials, 1)
+}
@@ -0,0 +1,43 @@
+package tgstatemanager
+
+import "fmt"
+
+// Phase names the step of handling an update that failed.
+type Phase string
+
+const (
+	PhaseLoad    Phase = "load"    // Reading the user state from storage
+	PhasePrompt  Phase = "prompt"  // Sending the prompt of a state
+	PhaseHandle  Phase = "handle"  // Running the Handle of a state
+	PhasePersist Phase = "persist" // Writing the user state to storage
+)
+
+// StateError wraps the errors of prompts, handlers and storages with where
+// they happened, so error reporters can group failures by state. Use
+// errors.As to read it; errors.Is still matches the wrapped error.
+type StateError struct {
+	Key   int64
+	State string // State being prompted, handled or persisted, empty when unknown
+	Phase Phase
+	Err   error
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s state %q of user %d: %v", e.Phase, e.State, e.Key, e.Err)
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// stateError wraps err in a StateError, leaving nil and already wrapped
+// errors alone.
+func stateError(err error, key int64, state string, phase Phase) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*StateError); ok {
+		return err
+	}
+	return &StateError{Key: key, State: state, Phase: phase, Err: err}
+}
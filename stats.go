@@ -0,0 +1,45 @@
+package tgstatemanager
+
+import "context"
+
+// Stats counts the sessions held by a storage, showing where users drop off
+// a flow: many sessions left in one state point at a confusing question.
+type Stats struct {
+	Total    int             // Stored sessions, finished ones included
+	Active   int             // Sessions in a state, not finished
+	States   map[string]int  // Active sessions per current state
+	Flows    map[string]int  // Active sessions per flow, "" for the default one
+	Outcomes map[Outcome]int // Finished sessions per outcome
+}
+
+// CountSessions walks storage once, counting its sessions.
+func CountSessions[S any](ctx context.Context, storage IterableStorage[S]) (Stats, error) {
+	stats := Stats{
+		States:   make(map[string]int),
+		Flows:    make(map[string]int),
+		Outcomes: make(map[Outcome]int),
+	}
+	err := storage.ForEach(ctx, func(_ int64, userState UserState[S]) error {
+		stats.Total++
+		switch {
+		case userState.Finished:
+			stats.Outcomes[userState.Outcome]++
+		case userState.CurrentState != "":
+			stats.Active++
+			stats.States[userState.CurrentState]++
+			stats.Flows[userState.Flow]++
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// Stats counts the stored sessions, as by CountSessions. It requires the
+// storage to implement IterableStorage.
+func (m *StateManager[S, U]) Stats(ctx context.Context) (Stats, error) {
+	storage, ok := m.storage.(IterableStorage[S])
+	if !ok {
+		return Stats{}, ErrNotIterable
+	}
+	return CountSessions(ctx, storage)
+}
@@ -1,10 +1,37 @@
 package tgstatemanager
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotDeletable is returned by features removing stored states when the
+// storage does not implement Deleter.
+var ErrNotDeletable = errors.New("storage cannot delete states")
+
 // UserState holds the current state name and data.
 type UserState[S any] struct {
-	CurrentState string
-	Data         S
-	PromptSent   bool // Tracks if prompt has been sent for the current state
+	CurrentState   string
+	Flow           string `json:",omitempty"` // Named flow the user is in, empty for the default flow
+	Data           S
+	Source         Source            `json:",omitzero"`  // How the session was started
+	SchemaVersion  int               `json:",omitempty"` // Version of the serialized Data, see Migrations
+	PromptSent     bool              // Tracks if prompt has been sent for the current state
+	PromptParts    int               `json:",omitempty"` // Parts of a multi-part prompt delivered before sending it failed
+	Page           int               `json:",omitempty"` // Page of the current state's prompt the user is looking at, see Page
+	Finished       bool              `json:",omitempty"` // Set once the user has completed the flow
+	Outcome        Outcome           `json:",omitempty"` // How the flow ended, once Finished
+	Failures       int               `json:",omitempty"` // Consecutive validation failures in the current state
+	History        []string          `json:",omitempty"` // Previously visited states, most recent last
+	RestartPending bool              `json:",omitempty"` // The user asked to restart and has to confirm it
+	LastUpdateID   int64             `json:",omitempty"` // ID of the last update handled, see SetUpdateIDFunc
+	Language       string            `json:",omitempty"` // Language code of the user, see SetLocalizer
+	Meta           map[string]string `json:",omitempty"` // Cross-cutting attributes kept apart from Data, see SetMeta
+	Outbox         OutboxPrompt      `json:",omitzero"`  // Prompt not delivered yet, see SetOutbox
+	CreatedAt      time.Time         `json:",omitzero"`  // When the state was first persisted
+	UpdatedAt      time.Time         `json:",omitzero"`  // When the state was last persisted
+
+	entering string // Initial state of a new user, whose entry the first save emits
 }
 
 // StateStorage defines the interface for storing user states.
@@ -12,3 +39,35 @@ type StateStorage[S any] interface {
 	Get(id int64) (UserState[S], bool, error)
 	Set(id int64, state UserState[S]) error
 }
+
+// Enter moves the user state to the named state, resetting what is kept per
+// state: the prompt progress, the page, the validation failures and the end
+// of the flow. The data, history and session attributes are kept. Callers
+// ending the flow set Finished and Outcome afterwards.
+func (s *UserState[S]) Enter(state string) {
+	s.CurrentState = state
+	s.PromptSent = false
+	s.PromptParts = 0
+	s.Page = 0
+	s.Failures = 0
+	s.Finished = false
+	s.Outcome = ""
+}
+
+// Deleter is implemented by storages able to remove a user state.
+type Deleter[S any] interface {
+	StateStorage[S]
+	// Delete removes the state of id. Removing a missing state is not an
+	// error.
+	Delete(id int64) error
+}
+
+// deleteState removes the state of id from storage, failing with
+// ErrNotDeletable when it does not implement Deleter.
+func deleteState[S any](storage StateStorage[S], id int64) error {
+	deleter, ok := storage.(Deleter[S])
+	if !ok {
+		return ErrNotDeletable
+	}
+	return deleter.Delete(id)
+}
@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -15,6 +19,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/tgsmtest"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 type TestData struct {
@@ -81,12 +88,22 @@ func createStorageFactories(cfg *testStorageConfig) map[string]func() tgsm.State
 		"InMemory": func() tgsm.StateStorage[TestData] {
 			return tgsm.NewInMemoryStorage[TestData]()
 		},
+		"Cached": func() tgsm.StateStorage[TestData] {
+			return tgsm.NewCachedStorage(tgsm.NewInMemoryStorage[TestData](), 16, time.Minute)
+		},
 	}
 
 	if cfg != nil && cfg.client != nil {
 		factories["Redis"] = func() tgsm.StateStorage[TestData] {
 			return tgsm.NewRedisStorage[TestData](cfg.client, cfg.testPrefix)
 		}
+		factories["RedisHashTagged"] = func() tgsm.StateStorage[TestData] {
+			storage := tgsm.NewRedisStorage[TestData](cfg.client, cfg.testPrefix)
+			storage.SetKeyFormatter(func(prefix string, id int64) string {
+				return fmt.Sprintf("%s:{%d}", prefix, id) // Kept under the prefix for cleanup
+			})
+			return storage
+		}
 	}
 
 	return factories
@@ -104,6 +121,7 @@ func TestStorageImplementations(t *testing.T) {
 		{"Basic operations", testStorageOperations},
 		{"Concurrent access", testConcurrentAccess},
 		{"Edge cases", testEdgeCases},
+		{"Delete", testDelete},
 	}
 
 	for implName, factory := range factories {
@@ -115,23 +133,58 @@ func TestStorageImplementations(t *testing.T) {
 	}
 }
 
+func TestMongoStorage(t *testing.T) {
+	mongoURL := os.Getenv("MONGO_URL")
+	if mongoURL == "" {
+		mongoURL = "mongodb://localhost:27017"
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(mongoURL).SetServerSelectionTimeout(2 * time.Second))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Skipf("Skipping MongoDB tests: %v", err)
+	}
+
+	database := "test-storage-" + uuid.New().String()
+	defer func() {
+		require.NoError(t, client.Database(database).Drop(context.Background()))
+		require.NoError(t, client.Disconnect(context.Background()))
+	}()
+
+	storage := tgsm.NewMongoStorage[TestData](client, database, "states")
+	require.NoError(t, storage.EnsureIndexes(ctx))
+	t.Run("Basic operations", func(t *testing.T) { testStorageOperations(t, storage) })
+	t.Run("Concurrent access", func(t *testing.T) { testConcurrentAccess(t, storage) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, storage) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, storage) })
+
+	t.Run("TTL", func(t *testing.T) {
+		storage.SetTTL(time.Millisecond, 0)
+		defer storage.SetTTL(0, 0)
+		require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{CurrentState: "initial"}))
+		time.Sleep(10 * time.Millisecond)
+		_, exists, err := storage.Get(1)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
+
 func FuzzStorageOperations(f *testing.F) {
 	storage := tgsm.NewInMemoryStorage[TestData]()
 
 	// Add seed corpus
-	f.Add(int64(1), "test", 42, true)
-	f.Add(int64(-1), "", -42, false)
-	f.Add(int64(0), "long_string_test", 0, true)
-
-	f.Fuzz(func(t *testing.T, userID int64, name string, value int, promptSent bool) {
-		state := tgsm.UserState[TestData]{
-			CurrentState: fmt.Sprintf("state_%s", strings.ReplaceAll(name, "/", "_")), // Sanitize state name
-			Data: TestData{
-				Name:  name,
-				Value: value,
-			},
-			PromptSent: promptSent,
-		}
+	f.Add(int64(1), "test", uint64(42))
+	f.Add(int64(-1), "", uint64(0))
+	f.Add(int64(0), "long_string_test", uint64(7))
+
+	f.Fuzz(func(t *testing.T, userID int64, name string, seed uint64) {
+		gen, err := tgsmtest.NewGenerator[TestData](seed)
+		require.NoError(t, err)
+		state := gen.UserState()
+		state.CurrentState = fmt.Sprintf("state_%s", strings.ReplaceAll(name, "/", "_")) // Sanitize state name
+		state.Data.Name = name
 
 		// Test Set operation
 		if err := storage.Set(userID, state); err != nil {
@@ -188,6 +241,17 @@ func testStorageOperations(t *testing.T, storage tgsm.StateStorage[TestData]) {
 				assert.Equal(t, expected, actual)
 			},
 		},
+		{
+			name:   "State with metadata",
+			userID: rand.Int63(),
+			state: tgsm.UserState[TestData]{
+				CurrentState: "initial",
+				Meta:         map[string]string{"bucket": "b", "campaign": "spring"},
+			},
+			validate: func(t *testing.T, expected, actual tgsm.UserState[TestData]) {
+				assert.Equal(t, expected.Meta, actual.Meta)
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -201,10 +265,26 @@ func testStorageOperations(t *testing.T, storage tgsm.StateStorage[TestData]) {
 	}
 }
 
+func testDelete(t *testing.T, s tgsm.StateStorage[TestData]) {
+	storage, ok := s.(tgsm.Deleter[TestData])
+	require.True(t, ok, "storage does not implement Deleter")
+	userID := rand.Int63()
+	require.NoError(t, storage.Set(userID, tgsm.UserState[TestData]{CurrentState: "initial"}))
+	require.NoError(t, storage.Delete(userID))
+
+	_, exists, err := storage.Get(userID)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Deleting a missing state is not an error
+	require.NoError(t, storage.Delete(userID))
+}
+
 func testConcurrentAccess(t *testing.T, storage tgsm.StateStorage[TestData]) {
 	const numGoroutines = 50
 	const numOperations = 20
 
+	generator := newGenerator(t)
 	var wg sync.WaitGroup
 	errors := make(chan error, numGoroutines*numOperations)
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -220,7 +300,7 @@ func testConcurrentAccess(t *testing.T, storage tgsm.StateStorage[TestData]) {
 					errors <- ctx.Err()
 					return
 				default:
-					if err := performRandomOperation(storage, workerID, j); err != nil {
+					if err := performRandomOperation(storage, generator, workerID, j); err != nil {
 						errors <- err
 					}
 				}
@@ -237,6 +317,7 @@ func testConcurrentAccess(t *testing.T, storage tgsm.StateStorage[TestData]) {
 }
 
 func testEdgeCases(t *testing.T, storage tgsm.StateStorage[TestData]) {
+	generator := newGenerator(t)
 	testCases := []struct {
 		name     string
 		userID   int64
@@ -246,7 +327,7 @@ func testEdgeCases(t *testing.T, storage tgsm.StateStorage[TestData]) {
 		{
 			name:   "Zero UserID",
 			userID: 0,
-			state:  generateRandomState(),
+			state:  generator.UserState(),
 			validate: func(t *testing.T, s tgsm.StateStorage[TestData], id int64) {
 				retrieved, exists, err := s.Get(id)
 				assert.NoError(t, err)
@@ -275,9 +356,9 @@ func testEdgeCases(t *testing.T, storage tgsm.StateStorage[TestData]) {
 	}
 }
 
-func performRandomOperation(storage tgsm.StateStorage[TestData], workerID, opID int) error {
+func performRandomOperation(storage tgsm.StateStorage[TestData], generator *tgsmtest.Generator[TestData], workerID, opID int) error {
 	userID := rand.Int63()
-	state := generateRandomState()
+	state := generator.UserState()
 	state.Data.Name = fmt.Sprintf("Worker_%d_Op_%d", workerID, opID)
 
 	if err := storage.Set(userID, state); err != nil {
@@ -296,13 +377,761 @@ func performRandomOperation(storage tgsm.StateStorage[TestData], workerID, opID
 	return nil
 }
 
-func generateRandomState() tgsm.UserState[TestData] {
-	return tgsm.UserState[TestData]{
-		CurrentState: fmt.Sprintf("state_%s", uuid.New().String()),
-		Data: TestData{
-			Name:  fmt.Sprintf("User_%s", uuid.New().String()),
-			Value: rand.Intn(1000),
+// newGenerator creates the generator of the random states of a storage test,
+// logging its seed so failures can be reproduced.
+func newGenerator(t *testing.T) *tgsmtest.Generator[TestData] {
+	t.Helper()
+	seed := rand.Uint64()
+	generator, err := tgsmtest.NewGenerator[TestData](seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("generator seed: %d", seed)
+	return generator
+}
+
+func TestInMemoryStorageDelete(t *testing.T) {
+	testDelete(t, tgsm.NewInMemoryStorage[TestData]())
+}
+
+func TestInMemoryStorageBatch(t *testing.T) {
+	testBatch(t, tgsm.NewInMemoryStorage[TestData]())
+}
+
+func testBatch(t *testing.T, storage tgsm.BatchStorage[TestData]) {
+	first, second := rand.Int63(), rand.Int63()
+	require.NoError(t, storage.SetMany(map[int64]tgsm.UserState[TestData]{
+		first:  {CurrentState: "first"},
+		second: {CurrentState: "second"},
+	}))
+
+	states, err := storage.GetMany([]int64{first, second, rand.Int63()})
+	require.NoError(t, err)
+	require.Len(t, states, 2)
+	assert.Equal(t, "first", states[first].CurrentState)
+	assert.Equal(t, "second", states[second].CurrentState)
+}
+
+func TestInMemoryStorageTTL(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[TestData]()
+	storage.SetTTL(20*time.Millisecond, 20*time.Millisecond)
+
+	var mu sync.Mutex
+	var expired []int64
+	storage.SetOnExpire(func(id int64, _ tgsm.UserState[TestData]) {
+		mu.Lock()
+		defer mu.Unlock()
+		expired = append(expired, id)
+	})
+
+	for id := range int64(10) {
+		require.NoError(t, storage.Set(id, tgsm.UserState[TestData]{CurrentState: "active"}))
+	}
+	_, exists, err := storage.Get(3)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	storage.StartSweeper(ctx, 5*time.Millisecond, 3)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(expired) == 10
+	}, time.Second, 5*time.Millisecond)
+
+	_, exists, err = storage.Get(3)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestInMemoryStorageCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		policy  tgsm.EvictionPolicy
+		evicted []int64
+	}{
+		{tgsm.EvictLRU, []int64{2, 1}},
+		{tgsm.EvictOldest, []int64{1, 2}},
+	} {
+		storage := tgsm.NewInMemoryStorage[TestData]()
+		storage.SetCapacity(3, tc.policy)
+		var evicted []int64
+		storage.SetOnEvict(func(id int64, _ tgsm.UserState[TestData]) {
+			evicted = append(evicted, id)
+		})
+
+		for id := int64(1); id <= 3; id++ {
+			require.NoError(t, storage.Set(id, tgsm.UserState[TestData]{}))
+		}
+		_, _, err := storage.Get(1) // Keeps 1 under LRU only
+		require.NoError(t, err)
+		require.NoError(t, storage.Set(3, tgsm.UserState[TestData]{CurrentState: "updated"}))
+		require.NoError(t, storage.Set(4, tgsm.UserState[TestData]{}))
+		require.NoError(t, storage.Delete(4))
+		require.NoError(t, storage.Set(5, tgsm.UserState[TestData]{}))
+		require.NoError(t, storage.Set(6, tgsm.UserState[TestData]{}))
+
+		assert.Equal(t, tc.evicted, evicted, "policy %d", tc.policy)
+		for _, id := range evicted {
+			_, exists, err := storage.Get(id)
+			require.NoError(t, err)
+			assert.False(t, exists)
+		}
+	}
+}
+
+func TestInMemoryStorageSnapshot(t *testing.T) {
+	path := t.TempDir() + "/states.jsonl"
+	storage := tgsm.NewInMemoryStorage[TestData]()
+	require.NoError(t, storage.LoadSnapshot(path), "a missing snapshot is empty")
+	require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{CurrentState: "kept", Data: TestData{Name: "x"}}))
+	require.NoError(t, storage.Set(2, tgsm.UserState[TestData]{CurrentState: "gone"}))
+	require.NoError(t, storage.Delete(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	storage.StartSnapshots(ctx, path, 5*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+
+	restored := tgsm.NewInMemoryStorage[TestData]()
+	require.NoError(t, restored.LoadSnapshot(path))
+	state, ok, err := restored.Get(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "kept", state.CurrentState)
+	assert.Equal(t, "x", state.Data.Name)
+	_, ok, _ = restored.Get(2)
+	assert.False(t, ok)
+
+	require.NoError(t, restored.Set(3, tgsm.UserState[TestData]{}))
+	require.NoError(t, restored.SaveSnapshot(path))
+	reloaded := tgsm.NewInMemoryStorage[TestData]()
+	require.NoError(t, reloaded.LoadSnapshot(path))
+	stats, err := tgsm.CountSessions[TestData](context.Background(), reloaded)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Total)
+}
+
+func TestNewRandomIsDeterministic(t *testing.T) {
+	a, b := tgsm.NewRandom(42), tgsm.NewRandom(42)
+	for range 10 {
+		assert.Equal(t, a.Int64N(1000), b.Int64N(1000))
+	}
+}
+
+// countingStorage counts the reads reaching a storage.
+type countingStorage struct {
+	tgsm.Deleter[TestData]
+	gets int
+}
+
+func (s *countingStorage) Get(id int64) (tgsm.UserState[TestData], bool, error) {
+	s.gets++
+	return s.Deleter.Get(id)
+}
+
+func TestCachedStorage(t *testing.T) {
+	backend := &countingStorage{Deleter: tgsm.NewInMemoryStorage[TestData]()}
+	storage := tgsm.NewCachedStorage[TestData](backend, 2, time.Minute)
+
+	for id := range int64(3) {
+		require.NoError(t, storage.Set(id, tgsm.UserState[TestData]{CurrentState: strconv.FormatInt(id, 10)}))
+	}
+	for _, id := range []int64{1, 2, 1, 2} {
+		state, exists, err := storage.Get(id)
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, strconv.FormatInt(id, 10), state.CurrentState)
+	}
+	assert.Zero(t, backend.gets, "warm users are served from the cache")
+
+	_, exists, err := storage.Get(0)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 1, backend.gets, "evicted users are read from the backend")
+
+	require.NoError(t, storage.Delete(0))
+	_, exists, err = storage.Get(0)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+// stallingStorage returns the state its Get read only once released.
+type stallingStorage struct {
+	tgsm.StateStorage[TestData]
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s *stallingStorage) Get(id int64) (tgsm.UserState[TestData], bool, error) {
+	state, exists, err := s.StateStorage.Get(id)
+	close(s.read)
+	<-s.release
+	return state, exists, err
+}
+
+func TestCachedStorageColdReadRace(t *testing.T) {
+	backend := &stallingStorage{
+		StateStorage: tgsm.NewInMemoryStorage[TestData](),
+		read:         make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	require.NoError(t, backend.StateStorage.Set(1, tgsm.UserState[TestData]{CurrentState: "old"}))
+	storage := tgsm.NewCachedStorage[TestData](backend, 10, time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		state, _, err := storage.Get(1)
+		assert.NoError(t, err)
+		assert.Equal(t, "old", state.CurrentState)
+	}()
+	<-backend.read
+	require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{CurrentState: "new"}))
+	close(backend.release)
+	<-done
+
+	state, _, err := storage.Get(1)
+	require.NoError(t, err)
+	assert.Equal(t, "new", state.CurrentState, "a read that raced a write must not cache the stale state")
+}
+
+// unhealthyStorage fails every health check.
+type unhealthyStorage struct {
+	tgsm.StateStorage[TestData]
+}
+
+func (unhealthyStorage) Ping(ctx context.Context) error {
+	return assert.AnError
+}
+
+func TestStateManagerHealth(t *testing.T) {
+	keyFunc := func(id int64) int64 { return id }
+
+	sm := tgsm.NewStateManager(tgsm.NewInMemoryStorage[TestData](), keyFunc)
+	assert.NoError(t, sm.Health(context.Background()))
+
+	cached := tgsm.NewCachedStorage[TestData](unhealthyStorage{tgsm.NewInMemoryStorage[TestData]()}, 1, 0)
+	sm = tgsm.NewStateManager[TestData](cached, keyFunc)
+	assert.ErrorIs(t, sm.Health(context.Background()), assert.AnError)
+}
+
+// flakyStorage fails the first failures operations with err.
+type flakyStorage struct {
+	tgsm.StateStorage[TestData]
+	failures int
+	err      error
+	calls    int
+}
+
+func (s *flakyStorage) Set(id int64, state tgsm.UserState[TestData]) error {
+	s.calls++
+	if s.calls <= s.failures {
+		return s.err
+	}
+	return s.StateStorage.Set(id, state)
+}
+
+func TestRetryingStorage(t *testing.T) {
+	backend := &flakyStorage{StateStorage: tgsm.NewInMemoryStorage[TestData](), failures: 2, err: syscall.ECONNRESET}
+	storage := tgsm.NewRetryingStorage[TestData](backend, 3, time.Millisecond)
+	require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{CurrentState: "initial"}))
+	assert.Equal(t, 3, backend.calls)
+
+	backend = &flakyStorage{StateStorage: tgsm.NewInMemoryStorage[TestData](), failures: 5, err: syscall.ECONNRESET}
+	storage = tgsm.NewRetryingStorage[TestData](backend, 3, time.Millisecond)
+	assert.ErrorIs(t, storage.Set(1, tgsm.UserState[TestData]{}), syscall.ECONNRESET)
+	assert.Equal(t, 3, backend.calls)
+
+	backend = &flakyStorage{StateStorage: tgsm.NewInMemoryStorage[TestData](), failures: 1, err: assert.AnError}
+	storage = tgsm.NewRetryingStorage[TestData](backend, 3, time.Millisecond)
+	assert.ErrorIs(t, storage.Set(1, tgsm.UserState[TestData]{}), assert.AnError, "permanent errors are not retried")
+	assert.Equal(t, 1, backend.calls)
+}
+
+// switchableStorage fails every operation while down.
+type switchableStorage struct {
+	tgsm.StateStorage[TestData]
+	down bool
+	ttls map[int64]time.Duration // TTLs written with SetWithTTL
+}
+
+func (s *switchableStorage) Get(id int64) (tgsm.UserState[TestData], bool, error) {
+	if s.down {
+		return tgsm.UserState[TestData]{}, false, syscall.ECONNREFUSED
+	}
+	return s.StateStorage.Get(id)
+}
+
+func (s *switchableStorage) Set(id int64, state tgsm.UserState[TestData]) error {
+	if s.down {
+		return syscall.ECONNREFUSED
+	}
+	return s.StateStorage.Set(id, state)
+}
+
+func (s *switchableStorage) SetWithTTL(id int64, state tgsm.UserState[TestData], ttl time.Duration) error {
+	if s.down {
+		return syscall.ECONNREFUSED
+	}
+	if s.ttls == nil {
+		s.ttls = make(map[int64]time.Duration)
+	}
+	s.ttls[id] = ttl
+	return s.StateStorage.Set(id, state)
+}
+
+func TestFallbackStorage(t *testing.T) {
+	backend := &switchableStorage{StateStorage: tgsm.NewInMemoryStorage[TestData]()}
+	storage := tgsm.NewFallbackStorage[TestData](backend, 2, 20*time.Millisecond)
+
+	backend.down = true
+	assert.ErrorIs(t, storage.Set(1, tgsm.UserState[TestData]{CurrentState: "first"}), syscall.ECONNREFUSED,
+		"failures below the threshold are returned")
+	require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{CurrentState: "second"}))
+	assert.True(t, storage.Degraded())
+
+	state, exists, err := storage.Get(1)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "second", state.CurrentState)
+
+	backend.down = false
+	time.Sleep(30 * time.Millisecond)
+	state, exists, err = storage.Get(1)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "second", state.CurrentState)
+	assert.False(t, storage.Degraded())
+
+	state, _, err = backend.StateStorage.Get(1)
+	require.NoError(t, err)
+	assert.Equal(t, "second", state.CurrentState, "writes made while degraded are replayed")
+
+	// Another instance updates the state during the outage
+	now := time.Now()
+	backend.down = true
+	require.Error(t, storage.Set(2, tgsm.UserState[TestData]{CurrentState: "stale", UpdatedAt: now}))
+	require.NoError(t, storage.Set(2, tgsm.UserState[TestData]{CurrentState: "stale", UpdatedAt: now}))
+	require.True(t, storage.Degraded())
+	require.NoError(t, backend.StateStorage.Set(2, tgsm.UserState[TestData]{CurrentState: "newer", UpdatedAt: now.Add(time.Second)}))
+	backend.down = false
+	time.Sleep(30 * time.Millisecond)
+	state, _, err = storage.Get(2)
+	require.NoError(t, err)
+	assert.Equal(t, "newer", state.CurrentState, "replays do not overwrite newer states")
+
+	// States written before the outage are not reported missing, and states
+	// started over blindly do not replace them
+	require.NoError(t, backend.StateStorage.Set(3, tgsm.UserState[TestData]{CurrentState: "b", Data: TestData{Name: "alice"}}))
+	backend.down = true
+	require.Error(t, storage.Set(4, tgsm.UserState[TestData]{}))
+	require.NoError(t, storage.Set(4, tgsm.UserState[TestData]{CurrentState: "a"}))
+	require.True(t, storage.Degraded())
+	_, _, err = storage.Get(3)
+	assert.ErrorIs(t, err, tgsm.ErrStateUnavailable)
+	_, err = storage.GetMany([]int64{3, 4})
+	assert.ErrorIs(t, err, tgsm.ErrStateUnavailable)
+	require.NoError(t, storage.Set(3, tgsm.UserState[TestData]{CurrentState: "a", UpdatedAt: time.Now().Add(time.Hour)}))
+	state, exists, err = storage.Get(3)
+	require.NoError(t, err)
+	require.True(t, exists)
+	backend.down = false
+	time.Sleep(30 * time.Millisecond)
+	state, _, err = storage.Get(3)
+	require.NoError(t, err)
+	assert.Equal(t, "b", state.CurrentState, "states written blindly while degraded do not replace the backend copy")
+	assert.Equal(t, "alice", state.Data.Name)
+
+	// Replays keep what is left of the TTL of the states
+	backend.down = true
+	require.Error(t, storage.SetWithTTL(5, tgsm.UserState[TestData]{}, time.Hour))
+	require.NoError(t, storage.SetWithTTL(5, tgsm.UserState[TestData]{CurrentState: "otp"}, time.Hour))
+	require.True(t, storage.Degraded())
+	backend.down = false
+	time.Sleep(30 * time.Millisecond)
+	state, _, err = storage.Get(5)
+	require.NoError(t, err)
+	assert.Equal(t, "otp", state.CurrentState)
+	assert.InDelta(t, time.Hour, backend.ttls[5], float64(time.Second))
+	assert.Less(t, backend.ttls[5], time.Hour)
+}
+
+func TestFileStorage(t *testing.T) {
+	path := t.TempDir() + "/states.log"
+	storage, err := tgsm.NewFileStorage[TestData](path, nil)
+	require.NoError(t, err)
+	testStorageOperations(t, storage)
+	testDelete(t, storage)
+
+	require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{CurrentState: "old"}))
+	require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{CurrentState: "kept", Data: TestData{Name: "x"}}))
+	require.NoError(t, storage.Set(2, tgsm.UserState[TestData]{CurrentState: "gone"}))
+	require.NoError(t, storage.Delete(2))
+	require.NoError(t, storage.Close())
+
+	// Torn write at the end of the log
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":3,"state":{"Curr`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	storage, err = tgsm.NewFileStorage[TestData](path, nil)
+	require.NoError(t, err)
+	state, ok, err := storage.Get(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "kept", state.CurrentState)
+	assert.Equal(t, "x", state.Data.Name)
+	_, ok, _ = storage.Get(2)
+	assert.False(t, ok)
+	_, ok, _ = storage.Get(3)
+	assert.False(t, ok)
+
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, storage.Compact())
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size())
+
+	require.NoError(t, storage.Set(4, tgsm.UserState[TestData]{CurrentState: "after"}))
+	require.NoError(t, storage.Close())
+
+	storage, err = tgsm.NewFileStorage[TestData](path, nil)
+	require.NoError(t, err)
+	defer storage.Close()
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		_, err = tgsm.NewFileStorage[TestData](path, nil)
+		assert.ErrorIs(t, err, tgsm.ErrFileLocked, "a single storage has the log open")
+	}
+	for _, id := range []int64{1, 4} {
+		_, ok, err := storage.Get(id)
+		require.NoError(t, err)
+		assert.True(t, ok, "id %d", id)
+	}
+}
+
+func TestFileStorageTornRecordInMiddle(t *testing.T) {
+	path := t.TempDir() + "/states.log"
+	log := `{"id":1,"state":{"CurrentState":"first"}}` + "\n" +
+		`{"id":2,"state":{"Curr` + `{"id":3,"state":{"CurrentState":"glued"}}` + "\n" +
+		`{"id":1,"state":{"CurrentState":"last"}}` + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(log), 0o600))
+
+	storage, err := tgsm.NewFileStorage[TestData](path, nil)
+	require.NoError(t, err, "a torn record in the middle of the log must not keep it from opening")
+	defer storage.Close()
+	state, ok, err := storage.Get(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "last", state.CurrentState)
+	_, ok, _ = storage.Get(2)
+	assert.False(t, ok, "the torn record is dropped")
+	state, ok, _ = storage.Get(3)
+	require.True(t, ok, "the record appended to the torn one is kept")
+	assert.Equal(t, "glued", state.CurrentState)
+}
+
+func TestFileStorageNilMigrations(t *testing.T) {
+	var migrations *tgsm.Migrations[TestData]
+	storage, err := tgsm.NewFileStorage[TestData](t.TempDir()+"/states.log", migrations)
+	require.NoError(t, err)
+	defer storage.Close()
+	testStorageOperations(t, storage)
+}
+
+func TestQuotaStorage(t *testing.T) {
+	backend := tgsm.NewInMemoryStorage[TestData]()
+	require.NoError(t, backend.Set(1, tgsm.UserState[TestData]{Flow: "shop"}))
+
+	clock := tgsmtest.NewFakeClock(time.Now())
+	storage := tgsm.NewQuotaStorage[TestData](backend,
+		tgsm.Quota{Namespace: "shop", MaxSessions: 2},
+		tgsm.Quota{Namespace: "spam", OpsPerSecond: 1, Burst: 2},
+	)
+	storage.SetClock(clock.Now)
+	require.NoError(t, storage.Load(context.Background()))
+	assert.Equal(t, 1, storage.Usage("shop"))
+
+	require.NoError(t, storage.Set(2, tgsm.UserState[TestData]{Flow: "shop"}))
+	require.NoError(t, storage.Set(2, tgsm.UserState[TestData]{Flow: "shop", CurrentState: "next"}))
+	err := storage.Set(3, tgsm.UserState[TestData]{Flow: "shop"})
+	assert.ErrorIs(t, err, tgsm.ErrQuotaExceeded)
+	var quotaErr *tgsm.QuotaError
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, tgsm.QuotaSessions, quotaErr.Limit)
+	_, exists, err := backend.Get(3)
+	require.NoError(t, err)
+	assert.False(t, exists, "refused writes never reach the backend")
+
+	// Finishing a session makes room for another one
+	require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{Flow: "shop", Finished: true}))
+	require.NoError(t, storage.Set(3, tgsm.UserState[TestData]{Flow: "shop"}))
+	require.NoError(t, storage.Delete(3))
+	assert.Equal(t, 1, storage.Usage("shop"))
+
+	// Other namespaces are not affected by the rate quota of spam
+	require.NoError(t, storage.Set(10, tgsm.UserState[TestData]{Flow: "spam"}))
+	_, _, err = storage.Get(10)
+	require.NoError(t, err)
+	_, _, err = storage.Get(10)
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, tgsm.QuotaRate, quotaErr.Limit)
+	_, _, err = storage.Get(1)
+	require.NoError(t, err)
+
+	clock.Advance(time.Second)
+	_, _, err = storage.Get(10)
+	require.NoError(t, err)
+}
+
+// gatedStorage holds every write to the storage it wraps until released.
+type gatedStorage struct {
+	tgsm.StateStorage[TestData]
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *gatedStorage) Set(id int64, state tgsm.UserState[TestData]) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.StateStorage.Set(id, state)
+}
+
+func TestQuotaStorageReservesSessions(t *testing.T) {
+	gated := &gatedStorage{StateStorage: tgsm.NewInMemoryStorage[TestData](), entered: make(chan struct{}), release: make(chan struct{})}
+	storage := tgsm.NewQuotaStorage[TestData](gated, tgsm.Quota{Namespace: "shop", MaxSessions: 1})
+
+	done := make(chan error)
+	go func() { done <- storage.Set(1, tgsm.UserState[TestData]{Flow: "shop"}) }()
+	<-gated.entered
+	assert.ErrorIs(t, storage.Set(2, tgsm.UserState[TestData]{Flow: "shop"}), tgsm.ErrQuotaExceeded, "writes in flight hold their place")
+	close(gated.release)
+	require.NoError(t, <-done)
+	assert.Equal(t, 1, storage.Usage("shop"))
+
+	// Failed writes give their place back
+	flaky := &flakyStorage{StateStorage: tgsm.NewInMemoryStorage[TestData](), failures: 2, err: syscall.ECONNRESET}
+	storage = tgsm.NewQuotaStorage[TestData](flaky, tgsm.Quota{Namespace: "shop", MaxSessions: 1})
+	assert.ErrorIs(t, storage.Set(1, tgsm.UserState[TestData]{Flow: "shop"}), syscall.ECONNRESET)
+	assert.Zero(t, storage.Usage("shop"))
+	assert.ErrorIs(t, storage.SetMany(map[int64]tgsm.UserState[TestData]{1: {Flow: "shop"}}), syscall.ECONNRESET)
+	assert.Zero(t, storage.Usage("shop"))
+	require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{Flow: "shop"}))
+	assert.Equal(t, 1, storage.Usage("shop"))
+	assert.ErrorIs(t, storage.SetMany(map[int64]tgsm.UserState[TestData]{
+		2: {Flow: "other"},
+		3: {Flow: "shop"},
+		4: {Flow: "shop"},
+	}), tgsm.ErrQuotaExceeded)
+	assert.Equal(t, 1, storage.Usage("shop"), "refused batches keep the sessions counted")
+}
+
+func TestExportImport(t *testing.T) {
+	generator := newGenerator(t)
+	source := tgsm.NewInMemoryStorage[TestData]()
+	for id := int64(1); id <= 3; id++ {
+		require.NoError(t, source.Set(id, generator.UserState()))
+	}
+	var buf strings.Builder
+	require.NoError(t, tgsm.Export[TestData](context.Background(), source, &buf))
+	assert.Equal(t, 3, strings.Count(buf.String(), "\n"))
+
+	target := tgsm.NewInMemoryStorage[TestData]()
+	n, err := tgsm.Import[TestData](target, strings.NewReader(buf.String()))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	for id := int64(1); id <= 3; id++ {
+		want, _, _ := source.Get(id)
+		got, ok, err := target.Get(id)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, want.CurrentState, got.CurrentState)
+		assert.Equal(t, want.Data, got.Data)
+	}
+
+	n, err = tgsm.Import[TestData](target, strings.NewReader(`{"Key":4,"State":{}}`+"\n{\n"))
+	assert.ErrorContains(t, err, "line 2")
+	assert.Equal(t, 1, n)
+
+	sm := tgsm.NewStateManager[TestData, MockUpdate](target, func(u MockUpdate) int64 { return u.ChatID })
+	buf.Reset()
+	require.NoError(t, sm.Export(context.Background(), &buf))
+	assert.Equal(t, 4, strings.Count(buf.String(), "\n"))
+
+	sm = tgsm.NewStateManager[TestData, MockUpdate](tgsm.NewCachedStorage[TestData](target, 10, time.Minute), func(u MockUpdate) int64 { return u.ChatID })
+	buf.Reset()
+	require.NoError(t, sm.Export(context.Background(), &buf), "decorators walk their backend")
+	assert.Equal(t, 4, strings.Count(buf.String(), "\n"))
+
+	opaque := struct{ tgsm.StateStorage[TestData] }{target}
+	sm = tgsm.NewStateManager[TestData, MockUpdate](opaque, func(u MockUpdate) int64 { return u.ChatID })
+	assert.ErrorIs(t, sm.Export(context.Background(), &buf), tgsm.ErrNotIterable)
+}
+
+func TestInMemoryStorageForEach(t *testing.T) {
+	storage := tgsm.NewInMemoryStorage[TestData]()
+	for id := int64(1); id <= 3; id++ {
+		require.NoError(t, storage.Set(id, tgsm.UserState[TestData]{CurrentState: strconv.FormatInt(id, 10)}))
+	}
+
+	seen := map[int64]string{}
+	require.NoError(t, storage.ForEach(context.Background(), func(id int64, state tgsm.UserState[TestData]) error {
+		seen[id] = state.CurrentState
+		return storage.Delete(id) // Allowed while walking
+	}))
+	assert.Equal(t, map[int64]string{1: "1", 2: "2", 3: "3"}, seen)
+
+	require.NoError(t, storage.Set(1, tgsm.UserState[TestData]{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := storage.ForEach(ctx, func(int64, tgsm.UserState[TestData]) error {
+		t.Fatal("walked after ctx was done")
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestShardedStorage(t *testing.T) {
+	storage := tgsm.NewShardedInMemoryStorage[TestData](8)
+	testStorageOperations(t, storage)
+	testDelete(t, storage)
+	testBatch(t, storage)
+
+	// Batch operations fall back to single ones on shards without them
+	testBatch(t, tgsm.NewShardedStorage(4, func() tgsm.StateStorage[TestData] {
+		return struct{ tgsm.StateStorage[TestData] }{tgsm.NewInMemoryStorage[TestData]()}
+	}))
+
+	var shards []*tgsm.InMemoryStorage[TestData]
+	storage = tgsm.NewShardedStorage(4, func() tgsm.StateStorage[TestData] {
+		shard := tgsm.NewInMemoryStorage[TestData]()
+		shards = append(shards, shard)
+		return shard
+	})
+	for id := range int64(100) {
+		require.NoError(t, storage.Set(id, tgsm.UserState[TestData]{}))
+	}
+	for _, shard := range shards {
+		stats, err := tgsm.CountSessions[TestData](context.Background(), shard)
+		require.NoError(t, err)
+		assert.InDelta(t, 25, stats.Total, 10, "sequential IDs are spread over the shards")
+	}
+	stats, err := tgsm.CountSessions[TestData](context.Background(), storage)
+	require.NoError(t, err)
+	assert.Equal(t, 100, stats.Total)
+}
+
+func TestStorageDecoratorsForward(t *testing.T) {
+	for name, wrap := range map[string]func(tgsm.StateStorage[TestData]) tgsm.StateStorage[TestData]{
+		"cached": func(s tgsm.StateStorage[TestData]) tgsm.StateStorage[TestData] {
+			return tgsm.NewCachedStorage(s, 10, 0)
 		},
-		PromptSent: rand.Float32() < 0.5,
+		"retrying": func(s tgsm.StateStorage[TestData]) tgsm.StateStorage[TestData] {
+			return tgsm.NewRetryingStorage(s, 3, 0)
+		},
+		"fallback": func(s tgsm.StateStorage[TestData]) tgsm.StateStorage[TestData] {
+			return tgsm.NewFallbackStorage(s, 3, time.Second)
+		},
+		"quota": func(s tgsm.StateStorage[TestData]) tgsm.StateStorage[TestData] { return tgsm.NewQuotaStorage(s) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			storage := wrap(tgsm.NewInMemoryStorage[TestData]())
+			testBatch(t, storage.(tgsm.BatchStorage[TestData]))
+			for id := range int64(5) {
+				require.NoError(t, storage.Set(id, tgsm.UserState[TestData]{CurrentState: "initial"}))
+			}
+			stats, err := tgsm.CountSessions(context.Background(), storage.(tgsm.IterableStorage[TestData]))
+			require.NoError(t, err)
+			assert.Equal(t, 7, stats.Total, "iteration reaches the backend")
+
+			// Backends that cannot iterate still cannot
+			opaque := wrap(struct{ tgsm.StateStorage[TestData] }{tgsm.NewInMemoryStorage[TestData]()})
+			_, err = tgsm.CountSessions(context.Background(), opaque.(tgsm.IterableStorage[TestData]))
+			assert.ErrorIs(t, err, tgsm.ErrNotIterable)
+			testBatch(t, opaque.(tgsm.BatchStorage[TestData]))
+		})
+	}
+}
+
+func BenchmarkInMemoryStorage(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		storage tgsm.StateStorage[TestData]
+	}{
+		{"single", tgsm.NewInMemoryStorage[TestData]()},
+		{"sharded", tgsm.NewShardedInMemoryStorage[TestData](256)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				id := next.Add(1) * 7919 // Each goroutine walks its own chats
+				for pb.Next() {
+					id = (id + 1) % 50_000
+					state, _, err := bc.storage.Get(id)
+					if err == nil {
+						err = bc.storage.Set(id, state)
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
 	}
 }
+
+func TestRedisStorageForEachKeyFormatter(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:0"})
+	defer client.Close()
+	storage := tgsm.NewRedisStorage[TestData](client, "test")
+	storage.SetKeyFormatter(func(prefix string, id int64) string {
+		return fmt.Sprintf("%s:{%d}", prefix, id)
+	})
+	err := storage.ForEach(context.Background(), func(id int64, state tgsm.UserState[TestData]) error { return nil })
+	assert.ErrorIs(t, err, tgsm.ErrNotIterable)
+}
+
+func TestRedisLocker(t *testing.T) {
+	cfg := setupTestEnv(t)
+	defer cleanupTestEnv(t, cfg)
+
+	locker := tgsm.NewRedisLocker(cfg.client, cfg.testPrefix, time.Minute)
+	locker.SetRandom(tgsm.NewRandom(1))
+	unlock, err := locker.Lock(context.Background(), 1)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = locker.Lock(ctx, 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.NoError(t, unlock())
+	unlock, err = locker.Lock(context.Background(), 1)
+	require.NoError(t, err)
+	require.NoError(t, unlock())
+}
+
+func TestRedisAuditStorage(t *testing.T) {
+	cfg := setupTestEnv(t)
+	defer cleanupTestEnv(t, cfg)
+
+	audit := tgsm.NewRedisAuditStorage(cfg.client, cfg.testPrefix)
+	at := time.Now().Truncate(time.Millisecond)
+	require.NoError(t, audit.Append(tgsm.AuditEntry{Key: 1, From: "ask_name", To: "ask_age", Update: "John", Time: at}))
+	require.NoError(t, audit.Append(tgsm.AuditEntry{Key: 1, From: "ask_age", Outcome: tgsm.OutcomeCompleted, Time: at}))
+
+	entries, err := audit.Entries(context.Background(), 1)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "John", entries[0].Update)
+	assert.True(t, at.Equal(entries[0].Time))
+	assert.Equal(t, tgsm.OutcomeCompleted, entries[1].Outcome)
+}
@@ -0,0 +1,91 @@
+package tgstatemanager
+
+import (
+	"strings"
+	"text/template"
+)
+
+// Renderer formats the final state of a flow into a summary message.
+type Renderer[S any] interface {
+	Render(userState UserState[S]) (string, error)
+}
+
+// RendererFunc adapts a function to the Renderer interface.
+type RendererFunc[S any] func(userState UserState[S]) (string, error)
+
+// Render calls f(userState).
+func (f RendererFunc[S]) Render(userState UserState[S]) (string, error) {
+	return f(userState)
+}
+
+// TemplateRenderer renders summaries with a text/template executed against
+// the UserState, so fields are reachable as {{.Data.Name}}.
+type TemplateRenderer[S any] struct {
+	tmpl *template.Template
+}
+
+// NewTemplateRenderer parses text into a TemplateRenderer.
+func NewTemplateRenderer[S any](text string) (*TemplateRenderer[S], error) {
+	tmpl, err := template.New("summary").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateRenderer[S]{tmpl: tmpl}, nil
+}
+
+// Render executes the template against the user state.
+func (r *TemplateRenderer[S]) Render(userState UserState[S]) (string, error) {
+	var b strings.Builder
+	if err := r.tmpl.Execute(&b, userState); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// completionSummary configures the summary sent when a flow finishes.
+type completionSummary[S any] struct {
+	renderer   Renderer[S]
+	toUser     bool
+	adminChats []int64
+}
+
+// SetCompletionSummary makes the manager render a summary of the collected
+// data whenever a user completes a flow, that is finishes it with
+// OutcomeCompleted. The summary is replied to the user
+// through the responder when toUser is set, and sent to every admin chat
+// through the notifier.
+func (m *StateManager[S, U]) SetCompletionSummary(renderer Renderer[S], toUser bool, adminChats ...int64) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.summary = &completionSummary[S]{
+		renderer:   renderer,
+		toUser:     toUser,
+		adminChats: adminChats,
+	}
+	return nil
+}
+
+// sendSummary renders and delivers the completion summary, if configured.
+func (m *StateManager[S, U]) sendSummary(update U, userState UserState[S]) error {
+	if m.summary == nil {
+		return nil
+	}
+
+	text, err := m.summary.renderer.Render(userState)
+	if err != nil {
+		return err
+	}
+
+	if m.summary.toUser {
+		if err := m.reply(update, text); err != nil {
+			return err
+		}
+	}
+	for _, chatID := range m.summary.adminChats {
+		if err := m.notify(chatID, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
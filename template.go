@@ -0,0 +1,131 @@
+package tgstatemanager
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// PromptProvider supplies the templates of the messages states reference by
+// PromptKey, so copy lives outside the Go code and is shared across states.
+type PromptProvider interface {
+	// Template returns the template of the message key in locale, falling
+	// back to another locale as the provider sees fit.
+	Template(key, locale string) (*template.Template, error)
+}
+
+// PromptData is what the template of a keyed prompt is executed against, so
+// collected fields are reachable as {{.Data.Name}}.
+type PromptData[S any] struct {
+	Key    int64
+	State  string
+	Locale string // Language of the user, empty when unknown
+	Page   int
+	Data   S
+}
+
+// SetPromptProvider sets the provider rendering the prompts of states with a
+// PromptKey. Rendered prompts answer the update through the responder, or are
+// sent through the notifier when there is no update, as on Reprompt. The
+// locale is the language of the user, see SetLocalizer, or else the language
+// code of their profile when a ProfileResolver is set.
+func (m *StateManager[S, U]) SetPromptProvider(provider PromptProvider) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.promptProvider = provider
+	return nil
+}
+
+// canRender reports whether the keyed prompt of a state can be delivered in
+// the given context.
+func (m *StateManager[S, U]) canRender(pc PromptContext[U]) bool {
+	if m.promptProvider == nil && m.localizer == nil {
+		return false
+	}
+	return pc.Update != nil && m.responder != nil || m.notifier != nil
+}
+
+// render renders a keyed prompt through the prompt provider, or else the
+// localizer, and delivers the message.
+func (m *StateManager[S, U]) render(pc PromptContext[U], key string, data *S) error {
+	promptData := PromptData[S]{Key: pc.Key, State: pc.State, Locale: pc.Language, Page: pc.Page, Data: *data}
+	var text string
+	if m.promptProvider != nil {
+		tmpl, err := m.promptProvider.Template(key, pc.Language)
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, promptData); err != nil {
+			return err
+		}
+		text = b.String()
+	} else {
+		var err error
+		if text, err = m.localizer.Localize(pc.Language, key, promptData); err != nil {
+			return err
+		}
+	}
+	if pc.Update != nil && m.responder != nil {
+		return m.responder(*pc.Update, text)
+	}
+	return m.notify(pc.Key, text)
+}
+
+// TemplatePrompts is a PromptProvider holding text/template messages per
+// locale, falling back to a default locale for messages missing from the
+// user's one. It is safe for concurrent use.
+type TemplatePrompts struct {
+	fallback string
+
+	mu        sync.RWMutex
+	templates map[string]map[string]*template.Template // By locale, then key
+}
+
+// NewTemplatePrompts creates a provider falling back to the messages of the
+// fallback locale.
+func NewTemplatePrompts(fallback string) *TemplatePrompts {
+	return &TemplatePrompts{
+		fallback:  fallback,
+		templates: make(map[string]map[string]*template.Template),
+	}
+}
+
+// Add parses text into the message key of locale, replacing any message
+// already there.
+func (p *TemplatePrompts) Add(locale, key, text string) error {
+	tmpl, err := template.New(key).Parse(text)
+	if err != nil {
+		return err
+	}
+	p.store(locale, map[string]*template.Template{key: tmpl})
+	return nil
+}
+
+// store adds templates to the messages of locale, replacing those with the
+// same keys.
+func (p *TemplatePrompts) store(locale string, templates map[string]*template.Template) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.templates[locale] == nil {
+		p.templates[locale] = make(map[string]*template.Template)
+	}
+	maps.Copy(p.templates[locale], templates)
+}
+
+// Template returns the message key of locale, or of the fallback locale when
+// locale lacks it.
+func (p *TemplatePrompts) Template(key, locale string) (*template.Template, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if tmpl, ok := p.templates[locale][key]; ok {
+		return tmpl, nil
+	}
+	if tmpl, ok := p.templates[p.fallback][key]; ok {
+		return tmpl, nil
+	}
+	return nil, fmt.Errorf("no prompt template %q", key)
+}
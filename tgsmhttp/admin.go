@@ -0,0 +1,185 @@
+package tgsmhttp
+
+import (
+	"cmp"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// defaultListLimit is the number of sessions GET /sessions lists without a
+// limit parameter.
+const defaultListLimit = 100
+
+// AdminHandler serves the inspection API support staff use to debug stuck
+// users:
+//
+//   - GET /sessions lists the active sessions as snapshots, most recently
+//     updated first. The state and flow parameters narrow the list, limit caps
+//     it (100 by default) and all=1 includes finished sessions.
+//   - GET /sessions/{key} returns the user's full state, data included.
+//   - POST /sessions/{key}/state forces the user to the state named in a
+//     {"state": "..."} body. With "prompt": true its prompt is sent right away.
+//   - DELETE /sessions/{key} deletes the user's session.
+//   - GET /states describes the registered states, with their description,
+//     owner and tags. The owner and tag parameters narrow the list.
+//
+// Listing requires the manager's storage to implement tgsm.IterableStorage and
+// answers 501 otherwise. Forced transitions are recorded with the
+// tgsm.SourceAdmin source.
+func AdminHandler[S, U any](m *tgsm.StateManager[S, U]) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit := defaultListLimit
+		if s := query.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		state, flow, all := query.Get("state"), query.Get("flow"), query.Get("all") == "1"
+
+		sessions := &latest{limit: limit}
+		err := m.Sessions(r.Context(), func(session tgsm.Session) error {
+			switch {
+			case !all && (session.Finished || session.State == ""):
+			case state != "" && session.State != state:
+			case flow != "" && session.Flow != flow:
+			default:
+				sessions.add(session)
+			}
+			return nil
+		})
+		if errors.Is(err, tgsm.ErrNotIterable) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, sessions.list())
+	})
+	mux.HandleFunc("GET /sessions/{key}", func(w http.ResponseWriter, r *http.Request) {
+		key, ok := pathKey(w, r)
+		if !ok {
+			return
+		}
+		userState, exists, err := m.Current(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "no session", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, userState)
+	})
+	mux.HandleFunc("POST /sessions/{key}/state", func(w http.ResponseWriter, r *http.Request) {
+		key, ok := pathKey(w, r)
+		if !ok {
+			return
+		}
+		var body struct {
+			State  string
+			Prompt bool
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.State == "" {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		opts := []tgsm.SetStateOption[U]{tgsm.WithSource[U](tgsm.Source{Kind: tgsm.SourceAdmin})}
+		if body.Prompt {
+			opts = append(opts, tgsm.WithPromptNow[U]())
+		}
+		err := m.SetState(key, body.State, opts...)
+		if errors.Is(err, tgsm.ErrUnknownState) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /states", func(w http.ResponseWriter, r *http.Request) {
+		owner, tag := r.URL.Query().Get("owner"), r.URL.Query().Get("tag")
+		states := []tgsm.StateInfo{}
+		for _, state := range m.States() {
+			if owner != "" && state.Owner != owner || tag != "" && !slices.Contains(state.Tags, tag) {
+				continue
+			}
+			states = append(states, state)
+		}
+		writeJSON(w, http.StatusOK, states)
+	})
+	mux.HandleFunc("DELETE /sessions/{key}", func(w http.ResponseWriter, r *http.Request) {
+		key, ok := pathKey(w, r)
+		if !ok {
+			return
+		}
+		if err := m.DeleteSession(key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// latest keeps the limit sessions listed first, most recently updated first,
+// in a heap whose root is the one listed last, so listing holds no more than
+// limit sessions however many are stored.
+type latest struct {
+	sessions []tgsm.Session
+	limit    int
+}
+
+// add keeps session if it is among the limit listed first so far.
+func (l *latest) add(session tgsm.Session) {
+	switch {
+	case len(l.sessions) < l.limit:
+		heap.Push(l, session)
+	case listedBefore(session, l.sessions[0]) < 0:
+		l.sessions[0] = session
+		heap.Fix(l, 0)
+	}
+}
+
+// list returns the sessions kept, in listing order.
+func (l *latest) list() []tgsm.Session {
+	sessions := append([]tgsm.Session{}, l.sessions...)
+	slices.SortFunc(sessions, listedBefore)
+	return sessions
+}
+
+// listedBefore orders sessions most recently updated first, by key when
+// updated at the same time.
+func listedBefore(a, b tgsm.Session) int {
+	if c := b.UpdatedAt.Compare(a.UpdatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Key, b.Key)
+}
+
+func (l *latest) Len() int           { return len(l.sessions) }
+func (l *latest) Less(i, j int) bool { return listedBefore(l.sessions[i], l.sessions[j]) > 0 }
+func (l *latest) Swap(i, j int)      { l.sessions[i], l.sessions[j] = l.sessions[j], l.sessions[i] }
+func (l *latest) Push(x any)         { l.sessions = append(l.sessions, x.(tgsm.Session)) }
+
+func (l *latest) Pop() any {
+	n := len(l.sessions)
+	session := l.sessions[n-1]
+	l.sessions = l.sessions[:n-1]
+	return session
+}
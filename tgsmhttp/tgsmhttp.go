@@ -0,0 +1,55 @@
+// Package tgsmhttp exposes tg-state-manager over HTTP for other services and
+// support staff, and posts finished flows to webhooks. Handlers do not
+// authenticate requests; wrap them with the middleware of package httpauth or
+// your own.
+package tgsmhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// SessionHandler serves read-only session snapshots as JSON at GET /{key},
+// answering 404 for users without a session. Mount it under a prefix with
+// http.StripPrefix.
+func SessionHandler(reader tgsm.SessionReader) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{key}", func(w http.ResponseWriter, r *http.Request) {
+		key, ok := pathKey(w, r)
+		if !ok {
+			return
+		}
+		session, exists, err := reader.Session(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "no session", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, session)
+	})
+	return mux
+}
+
+// pathKey parses the user key of the request path, answering 400 when it is
+// not a number.
+func pathKey(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	key, err := strconv.ParseInt(r.PathValue("key"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return 0, false
+	}
+	return key, true
+}
+
+// writeJSON answers with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
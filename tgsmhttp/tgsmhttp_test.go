@@ -0,0 +1,238 @@
+package tgsmhttp_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/httpauth"
+	"github.com/sudosz/tg-state-manager/tgsmhttp"
+	"github.com/sudosz/tg-state-manager/tgsmtest"
+)
+
+type (
+	update struct {
+		ChatID int64
+		Text   string
+	}
+
+	account struct {
+		Email    string
+		Password string
+	}
+)
+
+func newManager(t *testing.T) *tgsm.StateManager[account, update] {
+	sm := tgsm.NewStateManager[account, update](tgsm.NewInMemoryStorage[account](), func(u update) int64 { return u.ChatID })
+	sm.SetInitialState("email")
+	require.NoError(t, sm.Add(
+		&tgsm.State[account, update]{
+			Name: "email",
+			Handle: func(u update, data *account) (string, error) {
+				data.Email = u.Text
+				return "password", nil
+			},
+		},
+		&tgsm.State[account, update]{
+			Name:        "password",
+			Description: "Asks for the account password",
+			Owner:       "identity",
+			Tags:        []string{"credentials"},
+			Handle: func(u update, data *account) (string, error) {
+				data.Password = u.Text
+				return "", nil
+			},
+		},
+	))
+	return sm
+}
+
+func TestAdminHandlerListsLatest(t *testing.T) {
+	sm := newManager(t)
+	clock := tgsmtest.NewFakeClock(time.Now())
+	require.NoError(t, sm.SetClock(clock.Now))
+	for _, chatID := range []int64{4, 1, 5, 3, 2} {
+		clock.Advance(time.Second)
+		_, err := sm.Handle(update{ChatID: chatID, Text: "a@example.com"})
+		require.NoError(t, err)
+	}
+
+	rec := httptest.NewRecorder()
+	tgsmhttp.AdminHandler(sm).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions?limit=3", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var sessions []tgsm.Session
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sessions))
+	var keys []int64
+	for _, session := range sessions {
+		keys = append(keys, session.Key)
+	}
+	assert.Equal(t, []int64{2, 3, 5}, keys)
+}
+
+func TestSessionHandler(t *testing.T) {
+	sm := newManager(t)
+	require.NoError(t, sm.SetSessionFields(func(data account) map[string]any {
+		return map[string]any{"email": data.Email}
+	}))
+	_, err := sm.Handle(update{ChatID: 7, Text: "a@example.com"})
+	require.NoError(t, err)
+
+	handler := http.StripPrefix("/sessions", tgsmhttp.SessionHandler(sm))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions/7", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var session tgsm.Session
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&session))
+	assert.Equal(t, int64(7), session.Key)
+	assert.Equal(t, "password", session.State)
+	assert.Equal(t, map[string]any{"email": "a@example.com"}, session.Fields)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions/8", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions/abc", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/sessions/7", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAdminHandler(t *testing.T) {
+	sm := newManager(t)
+	for _, chatID := range []int64{1, 2, 3} {
+		_, err := sm.Handle(update{ChatID: chatID, Text: "a@example.com"})
+		require.NoError(t, err)
+	}
+	_, err := sm.Handle(update{ChatID: 3, Text: "secret"}) // Finished
+	require.NoError(t, err)
+
+	handler := tgsmhttp.AdminHandler(sm)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "/sessions", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var sessions []tgsm.Session
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sessions))
+	assert.Len(t, sessions, 2)
+
+	rec = serve(http.MethodGet, "/sessions?all=1&limit=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sessions))
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/sessions?limit=x", "").Code)
+
+	rec = serve(http.MethodGet, "/sessions/1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var userState tgsm.UserState[account]
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&userState))
+	assert.Equal(t, "password", userState.CurrentState)
+	assert.Equal(t, "a@example.com", userState.Data.Email)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/sessions/9", "").Code)
+
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodPost, "/sessions/1/state", `{"state": "email"}`).Code)
+	current, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.Equal(t, "email", current.CurrentState)
+	assert.Equal(t, tgsm.SourceAdmin, current.Source.Kind)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/sessions/1/state", `{"state": "missing"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/sessions/1/state", `{`).Code)
+
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/sessions/2", "").Code)
+	_, exists, err := sm.Current(2)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	rec = serve(http.MethodGet, "/states", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var states []tgsm.StateInfo
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&states))
+	require.Len(t, states, 2)
+	assert.Equal(t, "Asks for the account password", states[1].Description)
+	assert.Equal(t, "identity", states[1].Owner)
+	assert.Equal(t, []string{"credentials"}, states[1].Tags)
+	rec = serve(http.MethodGet, "/states?owner=identity&tag=credentials", "")
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&states))
+	require.Len(t, states, 1)
+	assert.Equal(t, "password", states[0].Name)
+	rec = serve(http.MethodGet, "/states?tag=billing", "")
+	assert.JSONEq(t, "[]", rec.Body.String())
+}
+
+func TestWebhook(t *testing.T) {
+	keyring := httpauth.NewKeyring([]byte("secret"))
+	received := make(chan tgsmhttp.Completion[account], 1)
+	var calls atomic.Int32
+	server := httptest.NewServer(keyring.RequireSignature(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		var completion tgsmhttp.Completion[account]
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&completion))
+		received <- completion
+	})))
+	defer server.Close()
+
+	sm := newManager(t)
+	require.NoError(t, sm.SetOnFinish(tgsmhttp.OnFinish(sm, tgsmhttp.Webhook{
+		URL:     server.URL,
+		Sign:    keyring.SignRequest,
+		Backoff: time.Millisecond,
+		OnError: func(err error) { t.Error(err) },
+	})))
+	for _, text := range []string{"a@example.com", "hunter2"} {
+		_, err := sm.Handle(update{ChatID: 7, Text: text})
+		require.NoError(t, err)
+	}
+
+	select {
+	case completion := <-received:
+		assert.Equal(t, int64(7), completion.Key)
+		assert.Equal(t, tgsm.OutcomeCompleted, completion.Outcome)
+		assert.Equal(t, account{Email: "a@example.com", Password: "hunter2"}, completion.Data)
+	case <-time.After(time.Second):
+		t.Fatal("webhook not delivered")
+	}
+	assert.Equal(t, int32(2), calls.Load(), "the failed attempt is retried")
+}
+
+func TestVisualizerHandler(t *testing.T) {
+	sm := newManager(t)
+	for _, chatID := range []int64{1, 2} {
+		_, err := sm.Handle(update{ChatID: chatID, Text: "a@example.com"})
+		require.NoError(t, err)
+	}
+
+	handler := tgsmhttp.VisualizerHandler(sm)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<svg")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/graph", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var graph tgsmhttp.Graph
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&graph))
+	assert.True(t, graph.Counted)
+	assert.Equal(t, 2, graph.Active)
+	require.Len(t, graph.States, 2)
+	assert.Equal(t, "email", graph.States[0].Name)
+	assert.True(t, graph.States[0].Initial)
+	assert.Equal(t, 2, graph.States[1].Users)
+}
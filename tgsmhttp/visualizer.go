@@ -0,0 +1,65 @@
+package tgsmhttp
+
+import (
+	_ "embed"
+	"errors"
+	"net/http"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+//go:embed visualizer.html
+var visualizerPage []byte
+
+// Graph is the state graph served by VisualizerHandler.
+type Graph struct {
+	States  []GraphState
+	Active  int  // Active sessions
+	Counted bool // Users were counted; false when the storage is not iterable
+}
+
+// GraphState is a registered state with the number of users currently in it.
+type GraphState struct {
+	tgsm.StateInfo
+	Users int
+}
+
+// VisualizerHandler serves a page rendering the state graph of the manager,
+// refreshed every few seconds with the number of users currently in each
+// state:
+//
+//   - GET / serves the page.
+//   - GET /graph returns the graph as JSON.
+//
+// Edges are drawn from guarded transitions and SkipTo; next states returned
+// by Handle are only known at runtime and are not drawn. Counting users walks
+// the whole storage, as by StateManager.Stats, so keep the page closed when
+// idle on large storages. Storages not implementing tgsm.IterableStorage
+// render the graph without counts. Mount the handler under a prefix ending
+// with a slash, such as http.StripPrefix("/flows", ...) at "/flows/".
+func VisualizerHandler[S, U any](m *tgsm.StateManager[S, U]) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(visualizerPage)
+	})
+	mux.HandleFunc("GET /graph", func(w http.ResponseWriter, r *http.Request) {
+		var graph Graph
+		stats, err := m.Stats(r.Context())
+		switch {
+		case errors.Is(err, tgsm.ErrNotIterable):
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		default:
+			graph.Active, graph.Counted = stats.Active, true
+		}
+		graph.States = []GraphState{}
+		for _, info := range m.States() {
+			graph.States = append(graph.States, GraphState{StateInfo: info, Users: stats.States[info.Name]})
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, graph)
+	})
+	return mux
+}
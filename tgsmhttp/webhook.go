@@ -0,0 +1,117 @@
+package tgsmhttp
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// Webhook posts the data of finished flows to an external system, such as a
+// CRM receiving completed registrations.
+type Webhook struct {
+	URL      string
+	Client   *http.Client                             // Optional: A client with a 10s timeout by default
+	Sign     func(r *http.Request, body []byte) error // Optional: Signs requests, e.g. the SignRequest method of an httpauth.Keyring
+	Attempts int                                      // Deliveries tried before giving up, 3 by default
+	Backoff  time.Duration                            // Wait before the first retry, doubled for each further one, 1s by default
+	Outcomes []tgsm.Outcome                           // Posted outcomes, only tgsm.OutcomeCompleted when empty
+	OnError  func(err error)                          // Optional: Receives failed deliveries
+}
+
+// Completion is the JSON body a Webhook posts.
+type Completion[S any] struct {
+	Key       int64
+	Flow      string `json:",omitempty"`
+	Outcome   tgsm.Outcome
+	Source    tgsm.Source `json:",omitzero"`
+	Data      S
+	CreatedAt time.Time `json:",omitzero"`
+	UpdatedAt time.Time `json:",omitzero"`
+}
+
+// OnFinish returns a hook for StateManager.SetOnFinish posting the finished
+// flows of the manager's users to the webhook. Deliveries run in the
+// background, so a slow endpoint never holds up update handling; those still
+// in flight when the process exits are lost. Network errors, 429 and 5xx
+// answers are retried, other answers are final.
+func OnFinish[S, U any](m *tgsm.StateManager[S, U], hook Webhook) func(update U, userState tgsm.UserState[S]) error {
+	if hook.Client == nil {
+		hook.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	outcomes := hook.Outcomes
+	if len(outcomes) == 0 {
+		outcomes = []tgsm.Outcome{tgsm.OutcomeCompleted}
+	}
+	return func(update U, userState tgsm.UserState[S]) error {
+		if !slices.Contains(outcomes, userState.Outcome) {
+			return nil
+		}
+		key, _ := m.Key(update)
+		body, err := json.Marshal(Completion[S]{
+			Key:       key,
+			Flow:      userState.Flow,
+			Outcome:   userState.Outcome,
+			Source:    userState.Source,
+			Data:      userState.Data,
+			CreatedAt: userState.CreatedAt,
+			UpdatedAt: userState.UpdatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := hook.deliver(body); err != nil && hook.OnError != nil {
+				hook.OnError(err)
+			}
+		}()
+		return nil
+	}
+}
+
+// deliver posts body, retrying failed attempts.
+func (h Webhook) deliver(body []byte) error {
+	attempts := cmp.Or(h.Attempts, 3)
+	backoff := cmp.Or(h.Backoff, time.Second)
+	var err error
+	for attempt := range attempts {
+		if attempt > 0 {
+			time.Sleep(backoff << (attempt - 1))
+		}
+		var retry bool
+		if retry, err = h.post(body); !retry {
+			return err
+		}
+	}
+	return fmt.Errorf("webhook failed after %d attempts: %w", attempts, err)
+}
+
+// post makes a single delivery attempt, reporting whether a failure is worth
+// retrying.
+func (h Webhook) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Sign != nil {
+		if err := h.Sign(req, body); err != nil {
+			return false, err
+		}
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook answered %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
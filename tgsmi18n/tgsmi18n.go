@@ -0,0 +1,56 @@
+// Package tgsmi18n localizes the prompts and messages of a state manager with
+// the message bundles of go-i18n, kept in a package of its own so the
+// dependency is only pulled in by bots using it.
+package tgsmi18n
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	tgsm "github.com/sudosz/tg-state-manager"
+	xlanguage "golang.org/x/text/language"
+)
+
+// Localizer is a tgsm.Localizer rendering the messages of a go-i18n bundle.
+// Messages missing from the language of a user fall back to the default
+// language of the bundle. It is safe for concurrent use.
+type Localizer struct {
+	bundle     *i18n.Bundle
+	localizers sync.Map // Of *i18n.Localizer by language
+}
+
+var _ tgsm.Localizer = (*Localizer)(nil)
+
+// New creates a localizer rendering the messages of bundle.
+func New(bundle *i18n.Bundle) *Localizer {
+	return &Localizer{bundle: bundle}
+}
+
+// Localize renders the message key in language with data as its template
+// data. An empty language renders the default language of the bundle.
+func (l *Localizer) Localize(language, key string, data any) (string, error) {
+	text, tag, err := l.localizer(language).LocalizeWithTag(&i18n.LocalizeConfig{
+		MessageID:    key,
+		TemplateData: data,
+	})
+	var notFound *i18n.MessageNotFoundErr
+	if errors.As(err, &notFound) && tag != xlanguage.Und {
+		return text, nil // Rendered in the default language
+	}
+	return text, err
+}
+
+// localizer returns the go-i18n localizer of language, creating it on first
+// use.
+func (l *Localizer) localizer(language string) *i18n.Localizer {
+	if localizer, ok := l.localizers.Load(language); ok {
+		return localizer.(*i18n.Localizer)
+	}
+	var languages []string
+	if language != "" {
+		languages = append(languages, language)
+	}
+	localizer, _ := l.localizers.LoadOrStore(language, i18n.NewLocalizer(l.bundle, languages...))
+	return localizer.(*i18n.Localizer)
+}
@@ -0,0 +1,82 @@
+package tgsmi18n_test
+
+import (
+	"testing"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/tgsmi18n"
+	"golang.org/x/text/language"
+)
+
+type (
+	update struct {
+		ChatID int64
+		Text   string
+	}
+
+	profile struct {
+		Name string
+	}
+)
+
+func TestLocalizer(t *testing.T) {
+	bundle := i18n.NewBundle(language.English)
+	require.NoError(t, bundle.AddMessages(language.English,
+		&i18n.Message{ID: "name", Other: "What is your name?"},
+		&i18n.Message{ID: "greeting", Other: "Hello, {{.Data.Name}}!"},
+		&i18n.Message{ID: "name.invalid", Other: "Please send your name."},
+	))
+	require.NoError(t, bundle.AddMessages(language.German,
+		&i18n.Message{ID: "name", Other: "Wie heißt du?"},
+		&i18n.Message{ID: "greeting", Other: "Hallo, {{.Data.Name}}!"},
+	))
+	localizer := tgsmi18n.New(bundle)
+
+	text, err := localizer.Localize("de", "name", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Wie heißt du?", text)
+	text, err = localizer.Localize("de", "name.invalid", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Please send your name.", text, "missing messages fall back to the default language")
+	text, err = localizer.Localize("", "name", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "What is your name?", text)
+	_, err = localizer.Localize("en", "missing", nil)
+	assert.Error(t, err)
+
+	sm := tgsm.NewStateManager[profile, update](tgsm.NewInMemoryStorage[profile](), func(u update) int64 { return u.ChatID })
+	require.NoError(t, sm.Add(
+		&tgsm.State[profile, update]{
+			Name:       "name",
+			PromptKey:  "name",
+			InvalidKey: "name.invalid",
+			Handle: func(u update, data *profile) (string, error) {
+				if u.Text == "" {
+					return "", tgsm.ErrValidation
+				}
+				data.Name = u.Text
+				return "greeting", nil
+			},
+		},
+		&tgsm.State[profile, update]{
+			Name:      "greeting",
+			PromptKey: "greeting",
+			Handle:    func(u update, data *profile) (string, error) { return "", nil },
+		},
+	))
+	require.NoError(t, sm.SetInitialState("name"))
+	var sent []string
+	require.NoError(t, sm.SetResponder(func(u update, reply any) error {
+		sent = append(sent, reply.(string))
+		return nil
+	}))
+	require.NoError(t, sm.SetLocalizer(localizer, func(u update) string { return "de" }))
+	for _, text := range []string{"/start", "", "Anna"} {
+		_, err := sm.Handle(update{ChatID: 1, Text: text})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"Wie heißt du?", "Please send your name.", "Hallo, Anna!"}, sent)
+}
@@ -0,0 +1,131 @@
+// Package tgsmqueue feeds updates consumed from a message queue, such as NATS
+// or Kafka, into a state manager. Updates of a user are handled one at a time
+// in the order they were received, while those of different users are handled
+// concurrently.
+//
+// Ordering holds within a process. When several bot workers consume the same
+// queue, route the updates of a user to the same worker, such as by using the
+// chat ID as the Kafka partition key or in the NATS subject of a queue group.
+package tgsmqueue
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"sync"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// Message is a message consumed from a queue.
+type Message struct {
+	Data []byte       // The encoded update
+	Ack  func() error // Optional: Acknowledges the message once it is handled
+}
+
+// Consumer receives messages from a queue. Wrap the subscription of a queue
+// client in one to feed its messages to Run.
+type Consumer interface {
+	// Receive blocks until the next message arrives or ctx is done.
+	Receive(ctx context.Context) (Message, error)
+}
+
+// ConsumerFunc adapts a function to the Consumer interface.
+type ConsumerFunc func(ctx context.Context) (Message, error)
+
+// Receive calls f.
+func (f ConsumerFunc) Receive(ctx context.Context) (Message, error) {
+	return f(ctx)
+}
+
+// Options configures Run.
+type Options[U any] struct {
+	Decode    func(data []byte) (U, error) // Optional: Decodes updates, JSON by default
+	Workers   int                          // Number of users handled concurrently, 16 by default
+	QueueSize int                          // Updates queued per worker before Run waits, 64 by default
+	OnError   func(msg Message, err error) // Optional: Receives failures to decode, handle or acknowledge
+}
+
+// Run receives messages from consumer and handles their updates with m until
+// ctx is done, then waits for the received updates to be handled and returns
+// nil. A failure to receive stops it the same way and is returned. Messages
+// received as ctx is done are left unacknowledged for the queue to redeliver.
+//
+// Messages are acknowledged once handled, even when handling failed: the
+// failure is passed to OnError rather than retried, as handling an update
+// twice could record an answer twice. Updates the key function rejects are
+// handled by a single worker.
+func Run[S, U any](ctx context.Context, consumer Consumer, m *tgsm.StateManager[S, U], opts Options[U]) error {
+	decode := opts.Decode
+	if decode == nil {
+		decode = func(data []byte) (U, error) {
+			var update U
+			err := json.Unmarshal(data, &update)
+			return update, err
+		}
+	}
+	fail := func(msg Message, err error) {
+		if opts.OnError != nil {
+			opts.OnError(msg, err)
+		}
+	}
+
+	type task struct {
+		msg    Message
+		update U
+	}
+	queues := make([]chan task, cmp.Or(opts.Workers, 16))
+	queueSize := cmp.Or(opts.QueueSize, 64)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan task, queueSize)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queues[i] {
+				if _, err := m.HandleContext(context.WithoutCancel(ctx), t.update); err != nil {
+					fail(t.msg, err)
+				}
+				ack(t.msg, fail)
+			}
+		}()
+	}
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		msg, err := consumer.Receive(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		update, err := decode(msg.Data)
+		if err != nil {
+			fail(msg, err)
+			ack(msg, fail)
+			continue
+		}
+		key, _ := m.Key(update)
+		select {
+		case queues[uint64(key)%uint64(len(queues))] <- task{msg: msg, update: update}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// ack acknowledges msg, reporting a failure to fail.
+func ack(msg Message, fail func(msg Message, err error)) {
+	if msg.Ack == nil {
+		return
+	}
+	if err := msg.Ack(); err != nil {
+		fail(msg, err)
+	}
+}
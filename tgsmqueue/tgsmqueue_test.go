@@ -0,0 +1,95 @@
+package tgsmqueue_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/tgsmqueue"
+)
+
+type (
+	update struct {
+		ChatID int64
+		Text   string
+	}
+
+	transcript struct {
+		Texts []string
+	}
+)
+
+func TestRun(t *testing.T) {
+	sm := tgsm.NewStateManager[transcript, update](tgsm.NewInMemoryStorage[transcript](), func(u update) int64 { return u.ChatID })
+	sm.SetInitialState("echo")
+	require.NoError(t, sm.Add(&tgsm.State[transcript, update]{
+		Name: "echo",
+		Handle: func(u update, data *transcript) (string, error) {
+			if u.Text == "fail" {
+				return "", errors.New("handler failed")
+			}
+			time.Sleep(time.Duration(u.ChatID) * 100 * time.Microsecond) // Users progress at different paces
+			data.Texts = append(data.Texts, u.Text)
+			return tgsm.NopState, nil
+		},
+	}))
+
+	messages := make(chan tgsmqueue.Message, 100)
+	var acked atomic.Int32
+	push := func(data string) {
+		messages <- tgsmqueue.Message{Data: []byte(data), Ack: func() error {
+			acked.Add(1)
+			return nil
+		}}
+	}
+	for i := range 10 {
+		for chatID := int64(1); chatID <= 3; chatID++ {
+			data, err := json.Marshal(update{ChatID: chatID, Text: fmt.Sprint(i)})
+			require.NoError(t, err)
+			push(string(data))
+		}
+	}
+	push(`{"ChatID": 1, "Text": "fail"}`)
+	push(`not json`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := tgsmqueue.ConsumerFunc(func(ctx context.Context) (tgsmqueue.Message, error) {
+		select {
+		case msg := <-messages:
+			return msg, nil
+		case <-ctx.Done():
+			return tgsmqueue.Message{}, ctx.Err()
+		}
+	})
+	var failures atomic.Int32
+	done := make(chan error)
+	go func() {
+		done <- tgsmqueue.Run(ctx, consumer, sm, tgsmqueue.Options[update]{
+			Workers: 4,
+			OnError: func(msg tgsmqueue.Message, err error) { failures.Add(1) },
+		})
+	}()
+
+	require.Eventually(t, func() bool { return acked.Load() == 32 }, time.Second, time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	assert.Equal(t, int32(2), failures.Load())
+
+	for chatID := int64(1); chatID <= 3; chatID++ {
+		state, _, err := sm.Current(chatID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, state.Data.Texts, "chat %d", chatID)
+	}
+
+	failing := tgsmqueue.ConsumerFunc(func(context.Context) (tgsmqueue.Message, error) {
+		return tgsmqueue.Message{}, errors.New("connection lost")
+	})
+	assert.EqualError(t, tgsmqueue.Run(context.Background(), failing, sm, tgsmqueue.Options[update]{}), "connection lost")
+}
@@ -0,0 +1,89 @@
+package tgsmtele
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/updates"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Choice is an option offered by a choice state.
+type Choice = updates.Choice
+
+// ChoiceState creates a state asking the user to pick one of choices from an
+// inline keyboard sent with prompt, as updates.ChoiceState does, with the
+// prompt sent by Prompt so it may be any message telebot can send.
+func (a *Adapter[S]) ChoiceState(name string, prompt any, choices []Choice, next string, set func(state *S, value string)) *tgsm.State[S, tele.Update] {
+	state := updates.ChoiceState(a, name, "", choices, next, set)
+	state.PromptWith = a.Prompt(state, prompt, inlineMarkup(updates.ChoiceButtons(name, choices)))
+	return state
+}
+
+// Paging labels the buttons turning the pages of a paginated choice state.
+type Paging struct {
+	PerPage int    // Choices shown on a page
+	Prev    string // Label of the button showing the previous page, "«" by default
+	Next    string // Label of the button showing the next page, "»" by default
+}
+
+// PaginatedChoiceState creates a choice state for long lists of choices,
+// showing paging.PerPage of them at a time with buttons turning the pages.
+// Turning a page edits the prompt in place and records the page in the
+// user's state, so the prompt shows the same page when it is sent again.
+// Selecting a choice, by button or by typing its label, works as for
+// ChoiceState.
+func (a *Adapter[S]) PaginatedChoiceState(name string, prompt any, choices []Choice, paging Paging, next string, set func(state *S, value string)) *tgsm.State[S, tele.Update] {
+	perPage := max(paging.PerPage, 1)
+	pages := max((len(choices)+perPage-1)/perPage, 1)
+	prev, nextLabel := cmp.Or(paging.Prev, "«"), cmp.Or(paging.Next, "»")
+	buttons := updates.ChoiceButtons(name, choices)
+
+	state := updates.ChoiceState(a, name, "", choices, next, set)
+	state.PromptWith = func(pc tgsm.PromptContext[tele.Update], data *S) error {
+		page := min(max(pc.Page, 0), pages-1)
+		shown := buttons[page*perPage : min((page+1)*perPage, len(buttons))]
+		var turn []updates.Button
+		if page > 0 {
+			turn = append(turn, updates.Button{Text: prev, Data: pageData(name, page-1)})
+		}
+		if page < pages-1 {
+			turn = append(turn, updates.Button{Text: nextLabel, Data: pageData(name, page+1)})
+		}
+		if len(turn) > 0 {
+			shown = append(shown[:len(shown):len(shown)], turn)
+		}
+		markup := inlineMarkup(shown)
+
+		if pc.Reason == tgsm.PromptPaged && pc.Update != nil && pc.Update.Callback != nil && pc.Update.Callback.Message != nil {
+			opts := withNavigation([]any{markup}, navigationRow(a.manager.Navigation(), state))
+			_, err := a.with(pc.Context).sender.Edit(pc.Update.Callback.Message, prompt, append(opts, sendOptions(state.SendOptions)...)...)
+			return err
+		}
+		return a.Prompt(state, prompt, markup)(pc, data)
+	}
+	choose := state.Handle
+	state.Handle = func(u tele.Update, data *S) (string, error) {
+		if u.Callback != nil {
+			if index, ok := strings.CutPrefix(u.Callback.Data, actionPrefix+"page:"+name+":"); ok {
+				if err := a.Answer(u); err != nil {
+					return "", err
+				}
+				if page, err := strconv.Atoi(index); err == nil && page >= 0 && page < pages {
+					return tgsm.Page(page), nil
+				}
+				return "", tgsm.ErrValidation
+			}
+		}
+		return choose(u, data)
+	}
+	return state
+}
+
+// pageData builds the callback data of the button turning a paginated choice
+// state to the given page.
+func pageData(state string, page int) string {
+	return actionPrefix + "page:" + state + ":" + strconv.Itoa(page)
+}
@@ -0,0 +1,86 @@
+package tgsmtele
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	tele "gopkg.in/telebot.v4"
+)
+
+// ErrFormTag is returned when a form struct carries an invalid tgsm tag. It
+// is tgsm.ErrFormTag, which the parsing of tags returns.
+var ErrFormTag = tgsm.ErrFormTag
+
+// Form creates the states asking for every field of S carrying a tgsm tag, in
+// field order, and ending in next. A tag is a comma-separated list of options:
+//
+//	name=age          state name, the field name by default
+//	prompt=Your age   prompt text
+//	invalid=Oops      reply to rejected answers, generated by default
+//	min=10,max=60     bounds of numbers or of the length of strings
+//	layout=02.01.2006 time.Parse layout of time.Time fields
+//	options=Free|Pro  allowed answers of string fields, offered on a keyboard
+//	pattern=^\w+$     regexp string answers must match, always the last option
+//
+// A comma not followed by an option name is part of the value, so prompts may
+// contain commas. Supported field types are strings, integers and time.Time.
+// Going Back to a question clears the answer it collected.
+func (a *Adapter[S]) Form(next string) ([]*tgsm.State[S, tele.Update], error) {
+	fields, err := tgsm.FormFields[S]()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]*tgsm.State[S, tele.Update], len(fields))
+	for i, field := range fields {
+		in := Input{Name: field.Name, Prompt: field.Prompt, Invalid: field.Invalid, Next: next}
+		if i+1 < len(fields) {
+			in.Next = fields[i+1].Name
+		}
+		states[i] = a.formState(in, field)
+		states[i].Rollback = func(data *S) {
+			v := reflect.ValueOf(data).Elem().Field(field.Index)
+			v.Set(reflect.Zero(v.Type()))
+		}
+	}
+	return states, nil
+}
+
+// formState creates the state asking for a form field.
+func (a *Adapter[S]) formState(in Input, field tgsm.FormField) *tgsm.State[S, tele.Update] {
+	t := field.Type
+	set := func(data *S, value reflect.Value) {
+		reflect.ValueOf(data).Elem().Field(field.Index).Set(value.Convert(t))
+	}
+
+	if t == reflect.TypeFor[time.Time]() {
+		return inputState(a, in, nil, func(text string) (reflect.Value, bool) {
+			v, err := time.Parse(field.Layout, strings.TrimSpace(text))
+			return reflect.ValueOf(v), err == nil
+		}, set)
+	}
+
+	if t.Kind() == reflect.String {
+		if len(field.Options) > 0 {
+			return a.EnumState(in, field.Options, func(data *S, value string) {
+				set(data, reflect.ValueOf(value))
+			})
+		}
+		return inputState(a, in, nil, func(text string) (reflect.Value, bool) {
+			text = strings.TrimSpace(text)
+			n := int64(utf8.RuneCountInString(text))
+			ok := text != "" && field.InRange(n) && (field.Pattern == nil || field.Pattern.MatchString(text))
+			return reflect.ValueOf(text), ok
+		}, set)
+	}
+
+	// Integers, checked by tgsm.FormFields
+	return inputState(a, in, nil, func(text string) (reflect.Value, bool) {
+		n, err := strconv.ParseInt(strings.TrimSpace(text), 10, t.Bits())
+		return reflect.ValueOf(n), err == nil && field.InRange(n)
+	}, set)
+}
@@ -0,0 +1,92 @@
+package tgsmtele
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/updates"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Input describes a question asked by a prebuilt input state.
+type Input struct {
+	Name    string // State name
+	Prompt  any    // Sent when entering the state
+	Invalid any    // Optional: Sent when an answer is rejected
+	Next    string // State entered after a valid answer
+}
+
+// TextState creates a state accepting any non-blank text message.
+func (a *Adapter[S]) TextState(in Input, set func(state *S, value string)) *tgsm.State[S, tele.Update] {
+	return inputState(a, in, nil, func(text string) (string, bool) {
+		return text, strings.TrimSpace(text) != ""
+	}, set)
+}
+
+// IntState creates a state accepting a whole number between min and max
+// inclusive.
+func (a *Adapter[S]) IntState(in Input, min, max int, set func(state *S, value int)) *tgsm.State[S, tele.Update] {
+	return inputState(a, in, nil, func(text string) (int, bool) {
+		n, err := strconv.Atoi(strings.TrimSpace(text))
+		return n, err == nil && n >= min && n <= max
+	}, set)
+}
+
+// DateState creates a state accepting a date or time in the given layout, as
+// understood by time.Parse.
+func (a *Adapter[S]) DateState(in Input, layout string, set func(state *S, value time.Time)) *tgsm.State[S, tele.Update] {
+	return inputState(a, in, nil, func(text string) (time.Time, bool) {
+		t, err := time.Parse(layout, strings.TrimSpace(text))
+		return t, err == nil
+	}, set)
+}
+
+// RegexState creates a state accepting text matched by pattern.
+func (a *Adapter[S]) RegexState(in Input, pattern *regexp.Regexp, set func(state *S, value string)) *tgsm.State[S, tele.Update] {
+	return inputState(a, in, nil, func(text string) (string, bool) {
+		return text, pattern.MatchString(text)
+	}, set)
+}
+
+// EnumState creates a state accepting one of options, offered on a one-time
+// reply keyboard. Typed answers are matched case-insensitively and the option
+// as spelled in options is passed to set.
+func (a *Adapter[S]) EnumState(in Input, options []string, set func(state *S, value string)) *tgsm.State[S, tele.Update] {
+	keyboard := make([][]tele.ReplyButton, len(options))
+	for i, option := range options {
+		keyboard[i] = []tele.ReplyButton{{Text: option}}
+	}
+	markup := &tele.ReplyMarkup{ReplyKeyboard: keyboard, ResizeKeyboard: true, OneTimeKeyboard: true}
+
+	return inputState(a, in, []any{markup}, func(text string) (string, bool) {
+		for _, option := range options {
+			if strings.EqualFold(strings.TrimSpace(text), option) {
+				return option, true
+			}
+		}
+		return "", false
+	}, set)
+}
+
+// inputState creates a state parsing the text of the user's answer with
+// parse, as updates.InputState does, with the prompt sent by Prompt with opts
+// and the Invalid message of in, if any, sent when an answer is rejected.
+func inputState[S, T any](a *Adapter[S], in Input, opts []any, parse func(text string) (T, bool), set func(state *S, value T)) *tgsm.State[S, tele.Update] {
+	state := updates.InputState(a, updates.Input{Name: in.Name, Next: in.Next}, parse, set)
+	state.PromptWith = a.Prompt(state, in.Prompt, opts...)
+	answer := state.Handle
+	state.Handle = func(u tele.Update, data *S) (string, error) {
+		next, err := answer(u, data)
+		if errors.Is(err, tgsm.ErrValidation) && in.Invalid != nil {
+			if err := a.send(u, in.Invalid); err != nil {
+				return "", err
+			}
+		}
+		return next, err
+	}
+	return state
+}
@@ -0,0 +1,27 @@
+package tgsmtele
+
+import (
+	"slices"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Commands returns an interceptor letting bot commands sent mid-flow escape
+// the current state. The listed cancel commands also clear the user's state;
+// every other command is bypassed to the bot's handlers.
+func Commands(cancel ...string) tgsm.Interceptor[tele.Update] {
+	return func(u tele.Update) tgsm.Interception {
+		if u.Message == nil {
+			return tgsm.InterceptContinue
+		}
+		switch cmd := Command(u.Message.Text); {
+		case cmd == "":
+			return tgsm.InterceptContinue
+		case slices.Contains(cancel, cmd):
+			return tgsm.InterceptCancel
+		default:
+			return tgsm.InterceptBypass
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package tgsmtele
+
+import (
+	"errors"
+	"strings"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	tele "gopkg.in/telebot.v4"
+)
+
+// File describes a file received by a media state.
+type File struct {
+	ID       string // File ID to send or download the file with
+	UniqueID string // Stable ID of the file, the same for every bot
+	Size     int64  // Size in bytes, zero when unknown
+	MIME     string // MIME type, image/jpeg for photos
+	Name     string // Original file name of documents
+}
+
+// FileCheck reports whether a received file is acceptable.
+type FileCheck func(f File) bool
+
+// MaxSize returns a check rejecting files larger than n bytes.
+func MaxSize(n int64) FileCheck {
+	return func(f File) bool { return f.Size <= n }
+}
+
+// MIMETypes returns a check accepting files of the given MIME types. A type
+// ending in "/*", such as "image/*", accepts any subtype.
+func MIMETypes(types ...string) FileCheck {
+	return func(f File) bool {
+		for _, t := range types {
+			if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(f.MIME, prefix) || f.MIME == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PhotoState creates a state accepting a photo, such as an avatar, passing
+// its largest size to set. Photos failing any of checks are rejected as
+// invalid; other kinds of input get the Invalid message of in and leave the
+// validation failures untouched.
+func (a *Adapter[S]) PhotoState(in Input, set func(state *S, photo File), checks ...FileCheck) *tgsm.State[S, tele.Update] {
+	return mediaState(a, in, KindPhoto, func(msg *tele.Message) File {
+		return photoFile(msg.Photo)
+	}, checks, set)
+}
+
+// DocumentState creates a state accepting a file sent as a document, such as
+// a CV, passing it to set. Documents failing any of checks are rejected as
+// invalid; other kinds of input get the Invalid message of in and leave the
+// validation failures untouched.
+func (a *Adapter[S]) DocumentState(in Input, set func(state *S, document File), checks ...FileCheck) *tgsm.State[S, tele.Update] {
+	return mediaState(a, in, KindDocument, func(msg *tele.Message) File {
+		doc := msg.Document
+		return File{ID: doc.FileID, UniqueID: doc.UniqueID, Size: doc.FileSize, MIME: doc.MIME, Name: doc.FileName}
+	}, checks, set)
+}
+
+// PhotosState creates a state collecting several photos, such as the pictures
+// of a listing, into the slice returned by entries. The prompt offers a
+// button labelled done, which finishes the collection once at least min
+// photos were received, as does typing the label or /done; max photos finish
+// it on their own unless max is zero. Other input and photos failing any of
+// checks are rejected with the Invalid message of in.
+func (a *Adapter[S]) PhotosState(in Input, done string, min, max int, entries func(state *S) *[]File, checks ...FileCheck) *tgsm.State[S, tele.Update] {
+	markup := &tele.ReplyMarkup{ReplyKeyboard: [][]tele.ReplyButton{{{Text: done}}}, ResizeKeyboard: true}
+	state := tgsm.CollectState(tgsm.Collect[S, tele.Update, File]{
+		Name:    in.Name,
+		Entries: entries,
+		Done: func(u tele.Update) bool {
+			if u.Message == nil || u.Message.Photo != nil {
+				return false
+			}
+			text := strings.TrimSpace(u.Message.Text)
+			return strings.EqualFold(text, done) || Command(text) == "/done"
+		},
+		Parse: func(u tele.Update) (File, error) {
+			if KindOf(u) != KindPhoto {
+				return File{}, tgsm.ErrValidation
+			}
+			f := photoFile(u.Message.Photo)
+			for _, check := range checks {
+				if !check(f) {
+					return File{}, tgsm.ErrValidation
+				}
+			}
+			return f, nil
+		},
+		Min:  min,
+		Max:  max,
+		Next: in.Next,
+	})
+	state.PromptWith = a.Prompt(state, in.Prompt, markup)
+
+	collect := state.Handle
+	state.Handle = func(u tele.Update, data *S) (string, error) {
+		next, err := collect(u, data)
+		if errors.Is(err, tgsm.ErrValidation) && in.Invalid != nil {
+			if err := a.send(u, in.Invalid); err != nil {
+				return "", err
+			}
+		}
+		return next, err
+	}
+	return state
+}
+
+// photoFile describes a received photo.
+func photoFile(photo *tele.Photo) File {
+	return File{ID: photo.FileID, UniqueID: photo.UniqueID, Size: photo.FileSize, MIME: "image/jpeg"}
+}
+
+// mediaState creates a state accepting messages of the given kind, reading
+// the file they carry with file.
+func mediaState[S any](a *Adapter[S], in Input, kind Kind, file func(msg *tele.Message) File, checks []FileCheck, set func(state *S, f File)) *tgsm.State[S, tele.Update] {
+	state := &tgsm.State[S, tele.Update]{
+		Name:       in.Name,
+		Filter:     Accept(kind),
+		WrongInput: in.Invalid,
+	}
+	state.PromptWith = a.Prompt(state, in.Prompt)
+	state.Handle = func(u tele.Update, data *S) (string, error) {
+		f := file(u.Message)
+		for _, check := range checks {
+			if check(f) {
+				continue
+			}
+			if in.Invalid != nil {
+				if err := a.send(u, in.Invalid); err != nil {
+					return "", err
+				}
+			}
+			return "", tgsm.ErrValidation
+		}
+		set(data, f)
+		return in.Next, nil
+	}
+	return state
+}
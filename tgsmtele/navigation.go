@@ -0,0 +1,79 @@
+package tgsmtele
+
+import (
+	"strings"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	tele "gopkg.in/telebot.v4"
+)
+
+// actionPrefix prefixes the callback data of navigation buttons.
+const actionPrefix = "tgsm:"
+
+// Action extracts the navigation action carried by an update: a press of a
+// navigation button or one of the /skip and /cancel commands.
+func Action(u tele.Update) (tgsm.Action, bool) {
+	if u.Message != nil {
+		switch Command(u.Message.Text) {
+		case "/skip":
+			return tgsm.ActionSkip, true
+		case "/cancel":
+			return tgsm.ActionCancel, true
+		}
+	}
+	if u.Callback == nil {
+		return "", false
+	}
+	action, ok := strings.CutPrefix(u.Callback.Data, actionPrefix)
+	if !ok {
+		return "", false
+	}
+	switch a := tgsm.Action(action); a {
+	case tgsm.ActionBack, tgsm.ActionCancel, tgsm.ActionSkip:
+		return a, true
+	}
+	return "", false
+}
+
+// navigationRow builds the navigation buttons shown under the state's prompt.
+func navigationRow[S any](nav tgsm.Navigation, state *tgsm.State[S, tele.Update]) []tele.InlineButton {
+	var row []tele.InlineButton
+	add := func(label string, action tgsm.Action) {
+		if label != "" {
+			row = append(row, tele.InlineButton{Text: label, Data: actionPrefix + string(action)})
+		}
+	}
+	add(nav.Back, tgsm.ActionBack)
+	if state.Skippable() {
+		add(nav.Skip, tgsm.ActionSkip)
+	}
+	add(nav.Cancel, tgsm.ActionCancel)
+	return row
+}
+
+// withNavigation returns opts with the navigation row appended to the inline
+// keyboard, creating one when opts carry no markup. Prompts using a reply
+// keyboard are left untouched since both keyboards cannot be combined.
+func withNavigation(opts []any, row []tele.InlineButton) []any {
+	if len(row) == 0 {
+		return opts
+	}
+
+	out := make([]any, 0, len(opts)+1)
+	attached := false
+	for _, opt := range opts {
+		if markup, ok := opt.(*tele.ReplyMarkup); ok && markup != nil && !attached {
+			if len(markup.ReplyKeyboard) > 0 {
+				return opts
+			}
+			cp := *markup
+			cp.InlineKeyboard = append(append([][]tele.InlineButton(nil), markup.InlineKeyboard...), row)
+			opt, attached = &cp, true
+		}
+		out = append(out, opt)
+	}
+	if !attached {
+		out = append(out, &tele.ReplyMarkup{InlineKeyboard: [][]tele.InlineButton{row}})
+	}
+	return out
+}
@@ -0,0 +1,49 @@
+package tgsmtele
+
+import (
+	tgsm "github.com/sudosz/tg-state-manager"
+	tele "gopkg.in/telebot.v4"
+)
+
+// ChatProfiles returns a resolver looking profiles up with getChat. Chats do
+// not carry the language code and premium flag, those are only known for
+// users the adapter has seen in updates.
+func ChatProfiles(bot tele.API) tgsm.ProfileResolver {
+	return tgsm.ProfileResolverFunc(func(id int64) (tgsm.Profile, error) {
+		chat, err := bot.ChatByID(id)
+		if err != nil {
+			return tgsm.Profile{}, err
+		}
+		return tgsm.Profile{
+			ID:        chat.ID,
+			Username:  chat.Username,
+			FirstName: chat.FirstName,
+			LastName:  chat.LastName,
+		}, nil
+	})
+}
+
+// Sender returns the user who sent the update, or nil when it has none.
+func Sender(u tele.Update) *tele.User {
+	switch {
+	case u.Message != nil:
+		return u.Message.Sender
+	case u.EditedMessage != nil:
+		return u.EditedMessage.Sender
+	case u.Callback != nil:
+		return u.Callback.Sender
+	}
+	return nil
+}
+
+// profileOf converts a telebot user into a profile.
+func profileOf(user *tele.User) tgsm.Profile {
+	return tgsm.Profile{
+		ID:           user.ID,
+		Username:     user.Username,
+		FirstName:    user.FirstName,
+		LastName:     user.LastName,
+		LanguageCode: user.LanguageCode,
+		Premium:      user.IsPremium,
+	}
+}
@@ -0,0 +1,97 @@
+package tgsmtele
+
+import (
+	"errors"
+	"time"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Prompt returns a PromptWith func that sends what to the chat of the update
+// triggering the prompt, or through the adapter's notifier to the chat of the
+// user's key, as mapped by SetChatFunc, when the prompt is sent without an
+// update, as by Reprompt. The state's SendOptions
+// are applied on top of opts and the manager's navigation row is attached to
+// the keyboard when the prompt is sent, so both may be changed after the state
+// has been built.
+func (a *Adapter[S]) Prompt(state *tgsm.State[S, tele.Update], what any, opts ...any) func(tgsm.PromptContext[tele.Update], *S) error {
+	return a.prompt(state, Part{What: what, Opts: opts}, true)
+}
+
+// Part is a message of a multi-part prompt.
+type Part struct {
+	What any   // Message to send, as accepted by telebot's Send
+	Opts []any // Send options of the message
+}
+
+// PromptParts returns a PromptWith func sending parts as separate messages,
+// such as an intro text, an example image and the question itself, as
+// Prompt sends a single one. The navigation row is attached to the last part
+// only. A failing part leaves the prompt pending and the next attempt sends
+// the remaining parts, as described by tgsm.PromptParts.
+func (a *Adapter[S]) PromptParts(state *tgsm.State[S, tele.Update], parts ...Part) func(tgsm.PromptContext[tele.Update], *S) error {
+	sends := make([]func(tgsm.PromptContext[tele.Update], *S) error, len(parts))
+	for i, part := range parts {
+		sends[i] = a.prompt(state, part, i == len(parts)-1)
+	}
+	return tgsm.PromptParts(sends...)
+}
+
+// prompt returns a PromptWith func sending part, with the navigation row
+// attached when navigation is set.
+func (a *Adapter[S]) prompt(state *tgsm.State[S, tele.Update], part Part, navigation bool) func(tgsm.PromptContext[tele.Update], *S) error {
+	what := part.What
+	return func(pc tgsm.PromptContext[tele.Update], _ *S) error {
+		opts := part.Opts
+		if navigation {
+			opts = withNavigation(opts, navigationRow(a.manager.Navigation(), state))
+		}
+		opts = append(opts[:len(opts):len(opts)], sendOptions(state.SendOptions)...)
+		a := a.with(pc.Context)
+		if pc.Update == nil {
+			return a.notifyWith(pc.Key, what, opts...)
+		}
+		return a.send(*pc.Update, what, opts...)
+	}
+}
+
+// send sends what to the chat the update belongs to.
+func (a *Adapter[S]) send(u tele.Update, what any, opts ...any) error {
+	chat := Chat(u)
+	if chat == nil {
+		return ErrNoChat
+	}
+	_, err := a.sender.Send(chat, what, opts...)
+	return err
+}
+
+// RetryAfter returns the delay Telegram asks for before sending again when
+// err is a flood error or a FloodWaitError, and zero otherwise. It is
+// suitable as the RetryAfter of a tgsm.PromptRetry.
+func RetryAfter(err error) time.Duration {
+	var flood tele.FloodError
+	if errors.As(err, &flood) {
+		return time.Duration(flood.RetryAfter) * time.Second
+	}
+	var wait *FloodWaitError
+	if errors.As(err, &wait) {
+		return wait.RetryAfter
+	}
+	return 0
+}
+
+// sendOptions converts state send options into telebot send options.
+func sendOptions(o tgsm.SendOptions) []any {
+	var opts []any
+	if o.Silent {
+		opts = append(opts, tele.Silent)
+	}
+	if o.ProtectContent {
+		opts = append(opts, tele.Protected)
+	}
+	if o.ParseMode != "" {
+		opts = append(opts, tele.ParseMode(o.ParseMode))
+	}
+	return opts
+}
@@ -0,0 +1,195 @@
+package tgsmtele
+
+import (
+	"slices"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Sanitize returns a copy of the update stripped of personal data: names,
+// usernames, bios, contacts and locations, down to the messages replied to,
+// forwarded or pinned and the members of membership updates. IDs and texts
+// are kept, so the update can still be replayed against a state manager. It
+// is suitable as the sanitize function of a replay.Recorder.
+func Sanitize(u tele.Update) tele.Update {
+	u.Message = sanitizeMessage(u.Message)
+	u.EditedMessage = sanitizeMessage(u.EditedMessage)
+	if u.Callback != nil {
+		cb := *u.Callback
+		cb.Sender = sanitizeUser(cb.Sender)
+		cb.Message = sanitizeMessage(cb.Message)
+		u.Callback = &cb
+	}
+	u.ChatMember = sanitizeMemberUpdate(u.ChatMember)
+	u.MyChatMember = sanitizeMemberUpdate(u.MyChatMember)
+	if u.ChatJoinRequest != nil {
+		req := *u.ChatJoinRequest
+		req.Sender = sanitizeUser(req.Sender)
+		req.Chat = sanitizeChat(req.Chat)
+		req.Bio = ""
+		req.InviteLink = sanitizeInviteLink(req.InviteLink)
+		u.ChatJoinRequest = &req
+	}
+	return u
+}
+
+// SanitizeSensitive is Sanitize also replacing the text and caption of the
+// answers to Sensitive states with tgsm.Redacted. It reads the user's current
+// state, so it must be called before the update is handled.
+func (a *Adapter[S]) SanitizeSensitive(u tele.Update) tele.Update {
+	u = Sanitize(u)
+	key, ok := a.manager.Key(u)
+	if !ok {
+		return u
+	}
+	userState, exists, err := a.manager.Current(key)
+	if err != nil || !exists || userState.CurrentState == "" {
+		return u
+	}
+	for _, info := range a.manager.States() {
+		if info.Name == userState.CurrentState && info.Sensitive {
+			redactMessage(u.Message)
+			redactMessage(u.EditedMessage)
+			break
+		}
+	}
+	return u
+}
+
+// redactMessage replaces the text and caption of a sanitized message.
+func redactMessage(m *tele.Message) {
+	if m == nil {
+		return
+	}
+	if m.Text != "" {
+		m.Text, m.Entities = tgsm.Redacted, nil
+	}
+	if m.Caption != "" {
+		m.Caption, m.CaptionEntities = tgsm.Redacted, nil
+	}
+}
+
+// sanitizeMessage returns a copy of the message stripped of personal data.
+func sanitizeMessage(m *tele.Message) *tele.Message {
+	if m == nil {
+		return nil
+	}
+	msg := *m
+	msg.Sender = sanitizeUser(msg.Sender)
+	msg.SenderChat = sanitizeChat(msg.SenderChat)
+	msg.OriginalSender = sanitizeUser(msg.OriginalSender)
+	msg.OriginalChat = sanitizeChat(msg.OriginalChat)
+	msg.OriginalSenderName = ""
+	msg.OriginalSignature = ""
+	msg.Origin = sanitizeOrigin(msg.Origin)
+	msg.Via = sanitizeUser(msg.Via)
+	msg.ReplyTo = sanitizeMessage(msg.ReplyTo)
+	msg.PinnedMessage = sanitizeMessage(msg.PinnedMessage)
+	if msg.ExternalReply != nil {
+		reply := *msg.ExternalReply
+		reply.Origin = sanitizeOrigin(reply.Origin)
+		reply.Chat = sanitizeChat(reply.Chat)
+		reply.Contact = nil
+		reply.Location = nil
+		reply.Venue = nil
+		msg.ExternalReply = &reply
+	}
+	msg.UserJoined = sanitizeUser(msg.UserJoined)
+	msg.UserLeft = sanitizeUser(msg.UserLeft)
+	if msg.UsersJoined != nil {
+		joined := make([]tele.User, len(msg.UsersJoined))
+		for i := range msg.UsersJoined {
+			joined[i] = *sanitizeUser(&msg.UsersJoined[i])
+		}
+		msg.UsersJoined = joined
+	}
+	msg.Entities = sanitizeEntities(msg.Entities)
+	msg.CaptionEntities = sanitizeEntities(msg.CaptionEntities)
+	msg.Contact = nil
+	msg.Location = nil
+	msg.Venue = nil
+	msg.Chat = sanitizeChat(msg.Chat)
+	return &msg
+}
+
+// sanitizeOrigin returns a copy of the origin of a forwarded message stripped
+// of personal data.
+func sanitizeOrigin(o *tele.MessageOrigin) *tele.MessageOrigin {
+	if o == nil {
+		return nil
+	}
+	origin := *o
+	origin.Sender = sanitizeUser(origin.Sender)
+	origin.SenderUsername = ""
+	origin.SenderChat = sanitizeChat(origin.SenderChat)
+	origin.Chat = sanitizeChat(origin.Chat)
+	origin.Signature = ""
+	return &origin
+}
+
+// sanitizeEntities returns a copy of the entities with the users mentioned
+// by text mentions sanitized.
+func sanitizeEntities(entities tele.Entities) tele.Entities {
+	if entities == nil {
+		return nil
+	}
+	entities = slices.Clone(entities)
+	for i := range entities {
+		entities[i].User = sanitizeUser(entities[i].User)
+	}
+	return entities
+}
+
+// sanitizeMemberUpdate returns a copy of the membership update stripped of
+// personal data.
+func sanitizeMemberUpdate(u *tele.ChatMemberUpdate) *tele.ChatMemberUpdate {
+	if u == nil {
+		return nil
+	}
+	update := *u
+	update.Chat = sanitizeChat(update.Chat)
+	update.Sender = sanitizeUser(update.Sender)
+	update.OldChatMember = sanitizeMember(update.OldChatMember)
+	update.NewChatMember = sanitizeMember(update.NewChatMember)
+	update.InviteLink = sanitizeInviteLink(update.InviteLink)
+	return &update
+}
+
+// sanitizeMember returns a copy of the chat member stripped of personal data.
+func sanitizeMember(m *tele.ChatMember) *tele.ChatMember {
+	if m == nil {
+		return nil
+	}
+	member := *m
+	member.User = sanitizeUser(member.User)
+	member.Title = ""
+	return &member
+}
+
+// sanitizeInviteLink returns a copy of the invite link without its creator's
+// personal data.
+func sanitizeInviteLink(l *tele.ChatInviteLink) *tele.ChatInviteLink {
+	if l == nil {
+		return nil
+	}
+	link := *l
+	link.Creator = sanitizeUser(link.Creator)
+	return &link
+}
+
+// sanitizeChat returns a copy of the chat keeping only what identifies it.
+func sanitizeChat(c *tele.Chat) *tele.Chat {
+	if c == nil {
+		return nil
+	}
+	return &tele.Chat{ID: c.ID, Type: c.Type}
+}
+
+// sanitizeUser returns a copy of the user keeping only what identifies it.
+func sanitizeUser(u *tele.User) *tele.User {
+	if u == nil {
+		return nil
+	}
+	return &tele.User{ID: u.ID, IsBot: u.IsBot, LanguageCode: u.LanguageCode}
+}
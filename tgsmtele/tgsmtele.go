@@ -0,0 +1,166 @@
+// Package tgsmtele binds tg-state-manager to the telebot framework.
+package tgsmtele
+
+import (
+	"fmt"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/updates"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Adapter connects a StateManager to a telebot bot. It is the
+// updates.Adapter of telebot updates, so the prebuilt states of package
+// updates work with telebot as well; the adapter's own prebuilt states are
+// built on them.
+type Adapter[S any] struct {
+	bot     tele.API
+	sender  MessageSender
+	manager *tgsm.StateManager[S, tele.Update]
+	chat    func(key int64) tele.Recipient
+}
+
+// New creates an adapter for the manager and wires the telebot-specific hooks:
+// messages answering Sensitive states are deleted right after they are read,
+// presses of navigation buttons are mapped to navigation actions, message
+// texts, session sources, chat types and update IDs are exposed to the
+// manager, so redelivered updates are skipped, and its replies and notifications are sent
+// through the bot. It fails with tgsm.ErrFrozen when the manager is frozen.
+func New[S any](bot tele.API, manager *tgsm.StateManager[S, tele.Update]) (*Adapter[S], error) {
+	a := &Adapter[S]{
+		bot:     bot,
+		sender:  bot,
+		manager: manager,
+	}
+	for _, err := range []error{
+		manager.SetSensitiveInputHandler(a.deleteInput),
+		manager.SetActionFunc(Action),
+		manager.SetTextAccessor(UpdateText{}),
+		manager.SetSourceFunc(Source),
+		manager.SetChatTypeFunc(ChatType),
+		manager.SetUpdateIDFunc(UpdateID),
+		manager.SetResponder(a.reply),
+		manager.SetNotifier(a.notify),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Middleware returns telebot middleware feeding updates into the state manager.
+// Updates the manager handles are not passed to the next handler. Profiles of
+// update senders are cached with the manager along the way, for updates whose
+// key is the ID of their sender as in private chats.
+func (a *Adapter[S]) Middleware() tele.MiddlewareFunc {
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			u := c.Update()
+			if key, ok := a.manager.Key(u); ok {
+				if sender := Sender(u); sender != nil && sender.ID == key {
+					a.manager.CacheProfile(key, profileOf(sender))
+				}
+			}
+			handled, err := a.manager.Handle(u)
+			if err != nil {
+				return fmt.Errorf("state handling error: %w", err)
+			}
+			if _, ok := Action(u); ok && u.Callback != nil {
+				// Stop the loading indicator of the pressed button
+				if err := a.sender.Respond(u.Callback); err != nil {
+					return err
+				}
+			}
+			if handled {
+				return nil
+			}
+			return next(c)
+		}
+	}
+}
+
+// reply sends a reply of the manager to the update's chat.
+func (a *Adapter[S]) reply(u tele.Update, what any) error {
+	return a.send(u, what)
+}
+
+// SetChatFunc sets how the keys of the manager map to chats, for the messages
+// sent without an update: notifications and prompts sent by Reprompt, jobs or
+// the outbox relay. Keys are taken for chat IDs by default, as made by Key;
+// managers keyed otherwise, such as by user in group chats, must map them.
+// The manager must not be frozen yet.
+func (a *Adapter[S]) SetChatFunc(fn func(key int64) tele.Recipient) {
+	a.chat = fn
+}
+
+// notify sends a notification of the manager to the chat of the given key.
+func (a *Adapter[S]) notify(key int64, msg any) error {
+	return a.notifyWith(key, msg)
+}
+
+// notifyWith sends what to the chat of the given key.
+func (a *Adapter[S]) notifyWith(key int64, what any, opts ...any) error {
+	var to tele.Recipient = tele.ChatID(key)
+	if a.chat != nil {
+		to = a.chat(key)
+	}
+	_, err := a.sender.Send(to, what, opts...)
+	return err
+}
+
+// Text returns the text of the update's message.
+func (a *Adapter[S]) Text(u tele.Update) string {
+	return UpdateText{}.Text(u)
+}
+
+// ChatID returns the ID of the chat the update belongs to.
+func (a *Adapter[S]) ChatID(u tele.Update) (int64, bool) {
+	return Key(u)
+}
+
+// CallbackData returns the data of the pressed inline button.
+func (a *Adapter[S]) CallbackData(u tele.Update) (string, bool) {
+	if u.Callback == nil {
+		return "", false
+	}
+	return u.Callback.Data, true
+}
+
+// Send sends text to the chat through the adapter's sender, with buttons as
+// an inline keyboard.
+func (a *Adapter[S]) Send(chatID int64, text string, buttons [][]updates.Button) error {
+	var opts []any
+	if len(buttons) > 0 {
+		opts = append(opts, inlineMarkup(buttons))
+	}
+	_, err := a.sender.Send(tele.ChatID(chatID), text, opts...)
+	return err
+}
+
+// Answer answers the callback of a pressed button.
+func (a *Adapter[S]) Answer(u tele.Update) error {
+	if u.Callback == nil {
+		return nil
+	}
+	return a.sender.Respond(u.Callback)
+}
+
+// inlineMarkup returns the inline keyboard of buttons, by row.
+func inlineMarkup(buttons [][]updates.Button) *tele.ReplyMarkup {
+	keyboard := make([][]tele.InlineButton, len(buttons))
+	for i, row := range buttons {
+		for _, button := range row {
+			keyboard[i] = append(keyboard[i], tele.InlineButton{Text: button.Text, Data: button.Data})
+		}
+	}
+	return &tele.ReplyMarkup{InlineKeyboard: keyboard}
+}
+
+// deleteInput removes the user's message carried by the update.
+func (a *Adapter[S]) deleteInput(u tele.Update) error {
+	if u.Message == nil {
+		return nil
+	}
+	return a.bot.Delete(u.Message)
+}
@@ -0,0 +1,686 @@
+package tgsmtele_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/tgsmtele"
+	"github.com/sudosz/tg-state-manager/updates"
+	tele "gopkg.in/telebot.v4"
+)
+
+type (
+	// fakeBot records the calls made through the telebot API.
+	fakeBot struct {
+		tele.API
+		sent      []sentMessage
+		edited    []sentMessage
+		deleted   []tele.Editable
+		responded []*tele.Callback
+	}
+
+	sentMessage struct {
+		to   tele.Recipient
+		what any
+		opts []any
+	}
+
+	profile struct {
+		Name string
+		Age  int
+	}
+)
+
+func (b *fakeBot) Send(to tele.Recipient, what any, opts ...any) (*tele.Message, error) {
+	b.sent = append(b.sent, sentMessage{to: to, what: what, opts: opts})
+	return &tele.Message{}, nil
+}
+
+func (b *fakeBot) Edit(msg tele.Editable, what any, opts ...any) (*tele.Message, error) {
+	b.edited = append(b.edited, sentMessage{what: what, opts: opts})
+	return &tele.Message{}, nil
+}
+
+func (b *fakeBot) Delete(msg tele.Editable) error {
+	b.deleted = append(b.deleted, msg)
+	return nil
+}
+
+func (b *fakeBot) Respond(c *tele.Callback, resp ...*tele.CallbackResponse) error {
+	b.responded = append(b.responded, c)
+	return nil
+}
+
+func newAdapter(t *testing.T) (*fakeBot, *tgsm.StateManager[profile, tele.Update], *tgsmtele.Adapter[profile]) {
+	t.Helper()
+	bot := &fakeBot{}
+	sm := tgsm.NewStateManager[profile, tele.Update](tgsm.NewInMemoryStorage[profile](), func(u tele.Update) int64 {
+		return tgsmtele.ChatID(u)
+	})
+	adapter, err := tgsmtele.New(bot, sm)
+	require.NoError(t, err)
+	return bot, sm, adapter
+}
+
+func textUpdate(chatID int64, text string) tele.Update {
+	return tele.Update{Message: &tele.Message{ID: 1, Chat: &tele.Chat{ID: chatID}, Text: text}}
+}
+
+func promptContext(u tele.Update) tgsm.PromptContext[tele.Update] {
+	return tgsm.PromptContext[tele.Update]{Key: tgsmtele.ChatID(u), Update: &u}
+}
+
+func TestMiddlewareCachesSenderProfiles(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+	sm.SetInitialState("ask_name")
+	require.NoError(t, sm.Add(&tgsm.State[profile, tele.Update]{Name: "ask_name"}))
+	resolved := 0
+	require.NoError(t, sm.SetProfileResolver(tgsm.ProfileResolverFunc(func(id int64) (tgsm.Profile, error) {
+		resolved++
+		return tgsm.Profile{ID: id}, nil
+	}), time.Hour))
+	handler := adapter.Middleware()(func(tele.Context) error { return nil })
+
+	private := tele.Update{Message: &tele.Message{ID: 1, Chat: &tele.Chat{ID: 7}, Sender: &tele.User{ID: 7, Username: "anna"}}}
+	group := tele.Update{Message: &tele.Message{ID: 2, Chat: &tele.Chat{ID: -100}, Sender: &tele.User{ID: 8, Username: "bob"}}}
+	require.NoError(t, handler(tele.NewContext(bot, private)))
+	require.NoError(t, handler(tele.NewContext(bot, group)))
+
+	p, err := sm.Profile(7)
+	require.NoError(t, err)
+	assert.Equal(t, "anna", p.Username)
+	assert.Zero(t, resolved, "senders of private chats are cached under their key")
+	p, err = sm.Profile(-100)
+	require.NoError(t, err)
+	assert.Empty(t, p.Username, "a group member is not cached as the profile of the group")
+	assert.Equal(t, 1, resolved)
+}
+
+func TestPromptAppliesSendOptions(t *testing.T) {
+	bot, _, adapter := newAdapter(t)
+
+	state := &tgsm.State[profile, tele.Update]{
+		Name:        "ask_name",
+		SendOptions: tgsm.SendOptions{Silent: true, ParseMode: tele.ModeHTML},
+	}
+	state.PromptWith = adapter.Prompt(state, "<b>Name?</b>")
+
+	require.NoError(t, state.PromptWith(promptContext(textUpdate(7, "")), &profile{}))
+	require.Len(t, bot.sent, 1)
+	assert.Equal(t, int64(7), bot.sent[0].to.(*tele.Chat).ID)
+	assert.Equal(t, []any{tele.Silent, tele.ParseMode(tele.ModeHTML)}, bot.sent[0].opts)
+}
+
+func TestReprompt(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+	sm.SetInitialState("ask_name")
+	require.NoError(t, sm.Add(adapter.TextState(tgsmtele.Input{Name: "ask_name", Prompt: "Name?"}, func(data *profile, value string) {
+		data.Name = value
+	})))
+
+	assert.ErrorIs(t, sm.Reprompt(7), tgsm.ErrNoPrompt)
+
+	_, err := sm.Handle(textUpdate(7, "/start"))
+	require.NoError(t, err)
+	require.NoError(t, sm.Reprompt(7))
+	require.Len(t, bot.sent, 2)
+	assert.Equal(t, tele.ChatID(7), bot.sent[1].to)
+	assert.Equal(t, "Name?", bot.sent[1].what)
+
+	adapter.SetChatFunc(func(key int64) tele.Recipient { return tele.ChatID(-key) })
+	require.NoError(t, sm.Reprompt(7))
+	require.Len(t, bot.sent, 3)
+	assert.Equal(t, tele.ChatID(-7), bot.sent[2].to, "keys are mapped to chats")
+}
+
+func TestSensitiveInputIsDeleted(t *testing.T) {
+	bot, sm, _ := newAdapter(t)
+
+	sm.SetInitialState("ask_token")
+	require.NoError(t, sm.Add(&tgsm.State[profile, tele.Update]{
+		Name:      "ask_token",
+		Sensitive: true,
+		Handle: func(u tele.Update, data *profile) (string, error) {
+			data.Name = tgsm.HashSecret(u.Message.Text, nil)
+			return "", nil
+		},
+	}))
+
+	handled, err := sm.Handle(textUpdate(7, "secret"))
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Len(t, bot.deleted, 1)
+}
+
+func TestPromptAttachesNavigationRow(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+	sm.SetNavigation(tgsm.Navigation{Back: "Back", Cancel: "Cancel", Skip: "Skip"})
+
+	state := &tgsm.State[profile, tele.Update]{Name: "ask_name"}
+	state.PromptWith = adapter.Prompt(state, "Name?")
+
+	require.NoError(t, state.PromptWith(promptContext(textUpdate(7, "")), &profile{}))
+	markup := bot.sent[0].opts[0].(*tele.ReplyMarkup)
+	require.Len(t, markup.InlineKeyboard, 1)
+	assert.Equal(t, []string{"Back", "Cancel"}, buttonTexts(markup.InlineKeyboard[0]))
+
+	state.SkipTo = "ask_age"
+	keyboard := &tele.ReplyMarkup{InlineKeyboard: [][]tele.InlineButton{{{Text: "Alice", Data: "alice"}}}}
+	state.PromptWith = adapter.Prompt(state, "Name?", keyboard)
+
+	require.NoError(t, state.PromptWith(promptContext(textUpdate(7, "")), &profile{}))
+	markup = bot.sent[1].opts[0].(*tele.ReplyMarkup)
+	require.Len(t, markup.InlineKeyboard, 2)
+	assert.Equal(t, []string{"Back", "Skip", "Cancel"}, buttonTexts(markup.InlineKeyboard[1]))
+	assert.Len(t, keyboard.InlineKeyboard, 1, "caller's markup must not be modified")
+
+	action, ok := tgsmtele.Action(tele.Update{Callback: &tele.Callback{Data: markup.InlineKeyboard[1][1].Data}})
+	assert.True(t, ok)
+	assert.Equal(t, tgsm.ActionSkip, action)
+}
+
+func TestPromptParts(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+	sm.SetNavigation(tgsm.Navigation{Back: "Back", Cancel: "Cancel"})
+
+	state := &tgsm.State[profile, tele.Update]{Name: "ask_photo", SendOptions: tgsm.SendOptions{Silent: true}}
+	state.PromptWith = adapter.PromptParts(state,
+		tgsmtele.Part{What: "Please send a selfie, like this one:"},
+		tgsmtele.Part{What: &tele.Photo{Caption: "Example"}},
+	)
+
+	require.NoError(t, state.PromptWith(promptContext(textUpdate(7, "")), &profile{}))
+	require.Len(t, bot.sent, 2)
+	assert.Equal(t, []any{tele.Silent}, bot.sent[0].opts)
+	markup := bot.sent[1].opts[0].(*tele.ReplyMarkup)
+	assert.Equal(t, []string{"Back", "Cancel"}, buttonTexts(markup.InlineKeyboard[0]))
+
+	pc := promptContext(textUpdate(7, ""))
+	pc.Sent = 1
+	require.NoError(t, state.PromptWith(pc, &profile{}))
+	require.Len(t, bot.sent, 3)
+	assert.IsType(t, &tele.Photo{}, bot.sent[2].what)
+}
+
+func buttonTexts(row []tele.InlineButton) []string {
+	texts := make([]string, len(row))
+	for i, btn := range row {
+		texts[i] = btn.Text
+	}
+	return texts
+}
+
+func TestCommandsInterceptor(t *testing.T) {
+	intercept := tgsmtele.Commands("/cancel")
+
+	assert.Equal(t, tgsm.InterceptContinue, intercept(textUpdate(1, "John")))
+	assert.Equal(t, tgsm.InterceptBypass, intercept(textUpdate(1, "/profile")))
+	assert.Equal(t, tgsm.InterceptCancel, intercept(textUpdate(1, "/cancel@my_bot")))
+	assert.Equal(t, tgsm.InterceptContinue, intercept(tele.Update{Callback: &tele.Callback{Data: "x"}}))
+}
+
+func callbackUpdate(chatID int64, data string) tele.Update {
+	return tele.Update{Callback: &tele.Callback{
+		Message: &tele.Message{ID: 2, Chat: &tele.Chat{ID: chatID}},
+		Data:    data,
+	}}
+}
+
+func TestChoiceState(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+
+	sm.SetInitialState("plan")
+	require.NoError(t, sm.Add(adapter.ChoiceState("plan", "Pick a plan", []tgsmtele.Choice{
+		{Text: "Free"},
+		{Text: "Pro", Value: "pro"},
+	}, "", func(data *profile, value string) { data.Name = value })))
+
+	handled, err := sm.Handle(textUpdate(7, "/start"))
+	require.NoError(t, err)
+	assert.True(t, handled)
+
+	require.Len(t, bot.sent, 1)
+	markup := bot.sent[0].opts[0].(*tele.ReplyMarkup)
+	require.Len(t, markup.InlineKeyboard, 2)
+
+	handled, err = sm.Handle(callbackUpdate(7, "tgsm:choice:other:1"))
+	require.NoError(t, err)
+	assert.True(t, handled)
+
+	handled, err = sm.Handle(callbackUpdate(7, markup.InlineKeyboard[1][0].Data))
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Len(t, bot.responded, 2)
+
+	state, _, err := sm.Current(7)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+	assert.Equal(t, "pro", state.Data.Name)
+}
+
+func TestPaginatedChoiceState(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+	var country string
+
+	choices := make([]tgsmtele.Choice, 5)
+	for i := range choices {
+		choices[i] = tgsmtele.Choice{Text: string(rune('A' + i))}
+	}
+	sm.SetInitialState("country")
+	require.NoError(t, sm.Add(adapter.PaginatedChoiceState("country", "Country?", choices, tgsmtele.Paging{PerPage: 2}, "",
+		func(data *profile, value string) { country = value })))
+
+	_, err := sm.Handle(textUpdate(7, "/start"))
+	require.NoError(t, err)
+	keyboard := bot.sent[0].opts[0].(*tele.ReplyMarkup).InlineKeyboard
+	require.Len(t, keyboard, 3)
+	assert.Equal(t, []string{"»"}, buttonTexts(keyboard[2]))
+
+	// Turn to the last page
+	for range 2 {
+		keyboard = bot.sent[0].opts[0].(*tele.ReplyMarkup).InlineKeyboard
+		if n := len(bot.edited); n > 0 {
+			keyboard = bot.edited[n-1].opts[0].(*tele.ReplyMarkup).InlineKeyboard
+		}
+		turn := keyboard[len(keyboard)-1]
+		_, err = sm.Handle(callbackUpdate(7, turn[len(turn)-1].Data))
+		require.NoError(t, err)
+	}
+	require.Len(t, bot.sent, 1, "pages are edited in place")
+	require.Len(t, bot.edited, 2)
+	keyboard = bot.edited[1].opts[0].(*tele.ReplyMarkup).InlineKeyboard
+	require.Len(t, keyboard, 2)
+	assert.Equal(t, []string{"«"}, buttonTexts(keyboard[1]))
+	state, _, err := sm.Current(7)
+	require.NoError(t, err)
+	assert.Equal(t, 2, state.Page)
+
+	_, err = sm.Handle(callbackUpdate(7, keyboard[0][0].Data))
+	require.NoError(t, err)
+	assert.Equal(t, "E", country)
+	state, _, err = sm.Current(7)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+	assert.Zero(t, state.Page)
+}
+
+func TestUpdatesAdapter(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+	sender := &fakeBot{}
+	adapter.SetSender(sender)
+
+	var a updates.Adapter[tele.Update] = adapter
+	assert.Equal(t, "hello", a.Text(textUpdate(7, "hello")))
+	chatID, ok := a.ChatID(textUpdate(7, "hello"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), chatID)
+	data, ok := a.CallbackData(callbackUpdate(7, "tgsm:choice:size:0"))
+	assert.True(t, ok)
+	assert.Equal(t, "tgsm:choice:size:0", data)
+	_, ok = a.CallbackData(tele.Update{})
+	assert.False(t, ok)
+
+	sm.SetInitialState("size")
+	require.NoError(t, sm.Add(updates.ChoiceState(a, "size", "Size?", []updates.Choice{{Text: "S"}, {Text: "L"}}, "",
+		func(data *profile, value string) { data.Name = value })))
+	_, err := sm.Handle(textUpdate(7, "/start"))
+	require.NoError(t, err)
+	assert.Empty(t, bot.sent, "messages go through the adapter's sender")
+	require.Len(t, sender.sent, 1)
+	assert.Equal(t, "Size?", sender.sent[0].what)
+	keyboard := sender.sent[0].opts[0].(*tele.ReplyMarkup).InlineKeyboard
+	require.Len(t, keyboard, 2)
+
+	_, err = sm.Handle(callbackUpdate(7, keyboard[1][0].Data))
+	require.NoError(t, err)
+	assert.Empty(t, bot.responded)
+	assert.Len(t, sender.responded, 1)
+	state, _, err := sm.Current(7)
+	require.NoError(t, err)
+	assert.Equal(t, "L", state.Data.Name)
+}
+
+func TestInputStates(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+
+	sm.SetInitialState("age")
+	require.NoError(t, sm.Add(
+		adapter.IntState(tgsmtele.Input{Name: "age", Prompt: "Age?", Invalid: "Enter 10-60", Next: "plan"}, 10, 60,
+			func(data *profile, value int) { data.Age = value }),
+		adapter.EnumState(tgsmtele.Input{Name: "plan", Prompt: "Plan?", Next: ""}, []string{"Free", "Pro"},
+			func(data *profile, value string) { data.Name = value }),
+	))
+
+	for _, text := range []string{"/start", "abc", "70", " 42 "} {
+		_, err := sm.Handle(textUpdate(7, text))
+		require.NoError(t, err)
+	}
+	// Prompt, two rejections and the prompt of the next state
+	require.Len(t, bot.sent, 4)
+	assert.Equal(t, "Enter 10-60", bot.sent[1].what)
+	markup := bot.sent[3].opts[0].(*tele.ReplyMarkup)
+	assert.Len(t, markup.ReplyKeyboard, 2)
+
+	_, err := sm.Handle(textUpdate(7, "pro"))
+	require.NoError(t, err)
+
+	state, _, err := sm.Current(7)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+	assert.Equal(t, profile{Name: "Pro", Age: 42}, state.Data)
+}
+
+func TestMediaStates(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+
+	sm.SetInitialState("avatar")
+	require.NoError(t, sm.Add(
+		adapter.PhotoState(tgsmtele.Input{Name: "avatar", Prompt: "Avatar?", Invalid: "Send a photo", Next: "cv"},
+			func(data *profile, photo tgsmtele.File) { data.Name = photo.ID }),
+		adapter.DocumentState(tgsmtele.Input{Name: "cv", Prompt: "CV?", Invalid: "Send a PDF under 1 kB", Next: ""},
+			func(data *profile, doc tgsmtele.File) { data.Name += "," + doc.Name },
+			tgsmtele.MaxSize(1024), tgsmtele.MIMETypes("application/pdf")),
+	))
+
+	photo := textUpdate(7, "")
+	photo.Message.Photo = &tele.Photo{File: tele.File{FileID: "photo-1"}}
+	document := func(mime string, size int64) tele.Update {
+		u := textUpdate(7, "")
+		u.Message.Document = &tele.Document{File: tele.File{FileID: "doc", FileSize: size}, MIME: mime, FileName: "cv.pdf"}
+		return u
+	}
+
+	for _, u := range []tele.Update{textUpdate(7, "/start"), textUpdate(7, "hello"), photo, document("image/png", 10), document("application/pdf", 4096)} {
+		_, err := sm.Handle(u)
+		require.NoError(t, err)
+	}
+	// Prompt, wrong input, prompt of the next state and two rejections
+	require.Len(t, bot.sent, 5)
+	assert.Equal(t, "Send a photo", bot.sent[1].what)
+	assert.Equal(t, "Send a PDF under 1 kB", bot.sent[4].what)
+
+	_, err := sm.Handle(document("application/pdf", 512))
+	require.NoError(t, err)
+	state, _, err := sm.Current(7)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+	assert.Equal(t, "photo-1,cv.pdf", state.Data.Name)
+	assert.True(t, tgsmtele.MIMETypes("image/*")(tgsmtele.File{MIME: "image/png"}))
+}
+
+func TestPhotosState(t *testing.T) {
+	bot, sm, adapter := newAdapter(t)
+	var photos []tgsmtele.File
+
+	sm.SetInitialState("photos")
+	require.NoError(t, sm.Add(adapter.PhotosState(
+		tgsmtele.Input{Name: "photos", Prompt: "Send your photos", Invalid: "Send photos, then press Done"},
+		"Done", 1, 0, func(data *profile) *[]tgsmtele.File { return &photos },
+	)))
+
+	photo := func(id string) tele.Update {
+		u := textUpdate(7, "")
+		u.Message.Photo = &tele.Photo{File: tele.File{FileID: id}}
+		return u
+	}
+	for _, u := range []tele.Update{textUpdate(7, "/start"), textUpdate(7, "done"), photo("a"), textUpdate(7, "hi"), photo("b")} {
+		_, err := sm.Handle(u)
+		require.NoError(t, err)
+	}
+	// Prompt and two rejections
+	require.Len(t, bot.sent, 3)
+	markup := bot.sent[0].opts[0].(*tele.ReplyMarkup)
+	assert.Equal(t, "Done", markup.ReplyKeyboard[0][0].Text)
+	assert.Equal(t, "Send photos, then press Done", bot.sent[2].what)
+	require.Len(t, photos, 2)
+	assert.Equal(t, "b", photos[1].ID)
+
+	_, err := sm.Handle(textUpdate(7, "/done"))
+	require.NoError(t, err)
+	state, _, err := sm.Current(7)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+}
+
+func TestForm(t *testing.T) {
+	type signup struct {
+		Name  string `tgsm:"name=name,prompt=Hi, what is your name?,min=3,max=16"`
+		Age   int8   `tgsm:"prompt=Your age,min=10,max=60,invalid=Enter 10-60"`
+		Plan  string `tgsm:"options=Free|Pro"`
+		Code  string `tgsm:"pattern=^[a-z]{2,3}$"`
+		Notes string
+	}
+
+	bot := &fakeBot{}
+	sm := tgsm.NewStateManager[signup, tele.Update](tgsm.NewInMemoryStorage[signup](), tgsmtele.ChatID)
+	adapter, err := tgsmtele.New(bot, sm)
+	require.NoError(t, err)
+
+	states, err := adapter.Form("")
+	require.NoError(t, err)
+	require.Len(t, states, 4)
+	assert.Equal(t, []string{"name", "Age", "Plan", "Code"}, []string{states[0].Name, states[1].Name, states[2].Name, states[3].Name})
+	require.NoError(t, sm.Add(states...))
+	sm.SetInitialState(states[0].Name)
+
+	for _, text := range []string{"/start", "Al", "Alice", "9", "33", "gold", "pro", "abcd", "ab"} {
+		_, err := sm.Handle(textUpdate(7, text))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "Hi, what is your name?", bot.sent[0].what)
+	assert.Equal(t, "Invalid answer. Please use 3-16 characters.", bot.sent[1].what)
+	assert.Equal(t, "Enter 10-60", bot.sent[3].what)
+
+	state, _, err := sm.Current(7)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+	assert.Equal(t, signup{Name: "Alice", Age: 33, Plan: "Pro", Code: "ab"}, state.Data)
+}
+
+func TestFormRejectsInvalidTags(t *testing.T) {
+	type bad struct {
+		Flag bool `tgsm:"prompt=Sure?"`
+	}
+	sm := tgsm.NewStateManager[bad, tele.Update](tgsm.NewInMemoryStorage[bad](), tgsmtele.ChatID)
+	adapter, err := tgsmtele.New(&fakeBot{}, sm)
+	require.NoError(t, err)
+	_, err = adapter.Form("")
+	assert.ErrorIs(t, err, tgsmtele.ErrFormTag)
+}
+
+func TestNewFrozen(t *testing.T) {
+	sm := tgsm.NewStateManager[profile, tele.Update](tgsm.NewInMemoryStorage[profile](), tgsmtele.ChatID)
+	sm.Freeze()
+	_, err := tgsmtele.New(&fakeBot{}, sm)
+	assert.ErrorIs(t, err, tgsm.ErrFrozen)
+}
+
+func TestIsStart(t *testing.T) {
+	assert.True(t, tgsmtele.IsStart(textUpdate(1, "/start@my_bot payload")))
+	assert.False(t, tgsmtele.IsStart(textUpdate(1, "/started")))
+	assert.False(t, tgsmtele.IsStart(callbackUpdate(1, "/start")))
+}
+
+func TestKey(t *testing.T) {
+	key, ok := tgsmtele.Key(callbackUpdate(7, "choice"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), key)
+
+	_, ok = tgsmtele.Key(tele.Update{MyChatMember: &tele.ChatMemberUpdate{}})
+	assert.False(t, ok)
+
+	id, ok := tgsmtele.UpdateID(tele.Update{ID: 42})
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), id)
+	_, ok = tgsmtele.UpdateID(textUpdate(1, "hello"))
+	assert.False(t, ok)
+
+	u := textUpdate(1, "hallo")
+	u.Message.Sender = &tele.User{ID: 1, LanguageCode: "de"}
+	assert.Equal(t, "de", tgsmtele.Language(u))
+	assert.Empty(t, tgsmtele.Language(tele.Update{}))
+
+	group := textUpdate(-100, "hello")
+	group.Message.Chat.Type = tele.ChatSuperGroup
+	assert.Equal(t, tgsm.ChatSupergroup, tgsmtele.ChatType(group))
+	group.Message.Chat.Type = tele.ChatChannelPrivate
+	assert.Equal(t, tgsm.ChatChannel, tgsmtele.ChatType(group))
+	assert.Empty(t, tgsmtele.ChatType(tele.Update{}))
+}
+
+func TestAccept(t *testing.T) {
+	photo := textUpdate(1, "")
+	photo.Message.Photo = &tele.Photo{}
+	accept := tgsmtele.Accept(tgsmtele.KindPhoto, tgsmtele.KindCallback)
+	assert.True(t, accept(photo))
+	assert.True(t, accept(callbackUpdate(1, "choice")))
+	assert.False(t, accept(textUpdate(1, "hello")))
+	assert.Equal(t, tgsmtele.KindText, tgsmtele.KindOf(textUpdate(1, "hello")))
+	assert.Equal(t, tgsmtele.KindOther, tgsmtele.KindOf(tele.Update{}))
+}
+
+func TestSource(t *testing.T) {
+	assert.Equal(t, tgsm.Source{Kind: tgsm.SourceDeepLink, Detail: "promo"}, tgsmtele.Source(textUpdate(1, "/start promo")))
+	assert.Equal(t, tgsm.Source{Kind: tgsm.SourceCommand, Detail: "/start"}, tgsmtele.Source(textUpdate(1, "/start")))
+	assert.Equal(t, tgsm.Source{}, tgsmtele.Source(textUpdate(1, "hello")))
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 5*time.Second, tgsmtele.RetryAfter(&tgsm.StateError{Phase: tgsm.PhasePrompt, Err: tele.FloodError{RetryAfter: 5}}))
+	assert.Zero(t, tgsmtele.RetryAfter(errors.New("chat not found")))
+}
+
+// floodingSender fails its first sends with flood errors.
+type floodingSender struct {
+	tgsmtele.MessageSender
+	floods []int // Retry after of the flood errors to fail with, in seconds
+}
+
+func (s *floodingSender) Send(to tele.Recipient, what any, opts ...any) (*tele.Message, error) {
+	if len(s.floods) > 0 {
+		retryAfter := s.floods[0]
+		s.floods = s.floods[1:]
+		return nil, tele.FloodError{RetryAfter: retryAfter}
+	}
+	return s.MessageSender.Send(to, what, opts...)
+}
+
+func TestThrottledSender(t *testing.T) {
+	bot, _, adapter := newAdapter(t)
+	flooding := &floodingSender{MessageSender: bot, floods: []int{2}}
+	sender := tgsmtele.NewThrottledSender(flooding, 10*time.Second)
+	now := time.Now()
+	sender.SetClock(func() time.Time { return now }, func(ctx context.Context, d time.Duration) error {
+		now = now.Add(d)
+		return ctx.Err()
+	})
+	var floods []time.Duration
+	sender.OnFlood(func(to tele.Recipient, retryAfter time.Duration) { floods = append(floods, retryAfter) })
+	adapter.SetSender(sender)
+
+	state := &tgsm.State[profile, tele.Update]{Name: "ask_name"}
+	state.PromptWith = adapter.Prompt(state, "Name?")
+	require.NoError(t, state.PromptWith(promptContext(textUpdate(7, "")), &profile{}), "short waits are waited out")
+	require.Len(t, bot.sent, 1)
+
+	flooding.floods = []int{60}
+	err := state.PromptWith(promptContext(textUpdate(7, "")), &profile{})
+	var flood tele.FloodError
+	require.ErrorAs(t, err, &flood)
+	assert.Equal(t, time.Minute, tgsmtele.RetryAfter(err))
+
+	// Later sends to the chat hold off until the wait is over, other chats carry on
+	require.NoError(t, state.PromptWith(promptContext(textUpdate(8, "")), &profile{}))
+	require.Len(t, bot.sent, 2)
+	err = state.PromptWith(promptContext(textUpdate(7, "")), &profile{})
+	var wait *tgsmtele.FloodWaitError
+	require.ErrorAs(t, err, &wait)
+	assert.Equal(t, time.Minute, wait.RetryAfter)
+	now = now.Add(time.Minute)
+	require.NoError(t, state.PromptWith(promptContext(textUpdate(7, "")), &profile{}))
+	require.Len(t, bot.sent, 3)
+
+	assert.Equal(t, []time.Duration{2 * time.Second, time.Minute}, floods)
+	assert.Equal(t, tgsmtele.ThrottleStats{Throttled: 2, Retried: 1, GaveUp: 2, Waited: 2 * time.Second}, sender.Stats())
+
+	// Waits stop when the context of the prompt is done
+	flooding.floods = []int{2}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pc := promptContext(textUpdate(8, ""))
+	pc.Context = ctx
+	assert.ErrorIs(t, state.PromptWith(pc, &profile{}), context.Canceled)
+	require.Len(t, bot.sent, 3)
+}
+
+func TestThrottledSenderGlobalLimit(t *testing.T) {
+	bot, _, adapter := newAdapter(t)
+	flooding := &floodingSender{MessageSender: bot, floods: []int{60, 60}}
+	sender := tgsmtele.NewThrottledSender(flooding, time.Second)
+	sender.SetGlobalLimit(2)
+	adapter.SetSender(sender)
+
+	state := &tgsm.State[profile, tele.Update]{Name: "ask_name"}
+	state.PromptWith = adapter.Prompt(state, "Name?")
+	var flood tele.FloodError
+	require.ErrorAs(t, state.PromptWith(promptContext(textUpdate(7, "")), &profile{}), &flood)
+	require.ErrorAs(t, state.PromptWith(promptContext(textUpdate(8, "")), &profile{}), &flood)
+
+	// Two chats held off at once hold off every send
+	var wait *tgsmtele.FloodWaitError
+	require.ErrorAs(t, state.PromptWith(promptContext(textUpdate(9, "")), &profile{}), &wait)
+	assert.Empty(t, bot.sent)
+}
+
+func TestSanitize(t *testing.T) {
+	u := textUpdate(7, "hello")
+	u.Message.Sender = &tele.User{ID: 7, FirstName: "Alice", Username: "alice"}
+	u.Message.Contact = &tele.Contact{PhoneNumber: "+100"}
+
+	u.Message.OriginalSender = &tele.User{ID: 8, FirstName: "Bob"}
+	u.Message.OriginalSenderName = "Bob"
+	u.Message.ReplyTo = &tele.Message{Sender: &tele.User{ID: 9, Username: "carol"}, Contact: &tele.Contact{PhoneNumber: "+200"}}
+	u.Message.Entities = tele.Entities{{Type: tele.EntityTMention, User: &tele.User{ID: 10, FirstName: "Dave"}}}
+	u.ChatMember = &tele.ChatMemberUpdate{
+		Chat:          &tele.Chat{ID: -100, Title: "Secret club"},
+		Sender:        &tele.User{ID: 11, Username: "admin"},
+		NewChatMember: &tele.ChatMember{User: &tele.User{ID: 12, FirstName: "Eve"}},
+	}
+
+	clean := tgsmtele.Sanitize(u)
+	assert.Equal(t, &tele.User{ID: 7}, clean.Message.Sender)
+	assert.Nil(t, clean.Message.Contact)
+	assert.Equal(t, "hello", clean.Message.Text)
+	assert.Equal(t, &tele.User{ID: 8}, clean.Message.OriginalSender)
+	assert.Empty(t, clean.Message.OriginalSenderName)
+	assert.Equal(t, &tele.User{ID: 9}, clean.Message.ReplyTo.Sender, "replied messages are sanitized too")
+	assert.Nil(t, clean.Message.ReplyTo.Contact)
+	assert.Equal(t, &tele.User{ID: 10}, clean.Message.Entities[0].User)
+	assert.Equal(t, &tele.Chat{ID: -100}, clean.ChatMember.Chat)
+	assert.Equal(t, &tele.User{ID: 11}, clean.ChatMember.Sender)
+	assert.Equal(t, &tele.User{ID: 12}, clean.ChatMember.NewChatMember.User)
+	assert.Equal(t, "Alice", u.Message.Sender.FirstName, "the original update is untouched")
+	assert.Equal(t, "Dave", u.Message.Entities[0].User.FirstName)
+	assert.Equal(t, "Eve", u.ChatMember.NewChatMember.User.FirstName)
+}
+
+func TestSanitizeSensitive(t *testing.T) {
+	_, sm, adapter := newAdapter(t)
+	sm.SetInitialState("ask_name")
+	require.NoError(t, sm.Add(
+		&tgsm.State[profile, tele.Update]{Name: "ask_name"},
+		&tgsm.State[profile, tele.Update]{Name: "ask_password", Sensitive: true},
+	))
+	require.NoError(t, sm.SetState(7, "ask_password"))
+	require.NoError(t, sm.SetState(8, "ask_name"))
+
+	clean := adapter.SanitizeSensitive(textUpdate(7, "hunter2"))
+	assert.Equal(t, tgsm.Redacted, clean.Message.Text, "answers to Sensitive states are redacted")
+	clean = adapter.SanitizeSensitive(textUpdate(8, "Anna"))
+	assert.Equal(t, "Anna", clean.Message.Text)
+}
@@ -0,0 +1,305 @@
+package tgsmtele
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// maxFloodRetries is the number of times a ThrottledSender retries a send.
+const maxFloodRetries = 3
+
+// defaultGlobalLimit is the number of chats a ThrottledSender holds off at
+// once before holding off every send.
+const defaultGlobalLimit = 10
+
+// MessageSender sends the messages of an adapter: prompts, replies and
+// notifications, the edits turning the pages of paginated prompts and the
+// answers to button presses. A tele.API is a MessageSender.
+type MessageSender interface {
+	Send(to tele.Recipient, what any, opts ...any) (*tele.Message, error)
+	Edit(msg tele.Editable, what any, opts ...any) (*tele.Message, error)
+	Respond(c *tele.Callback, resp ...*tele.CallbackResponse) error
+}
+
+// ContextSender is implemented by senders that may wait before sending, such
+// as ThrottledSender, to stop waiting when a context is done. Prompts are sent
+// through the sender bound to the context of the update they answer.
+type ContextSender interface {
+	MessageSender
+	// WithContext returns the sender waiting no longer than ctx allows.
+	WithContext(ctx context.Context) MessageSender
+}
+
+// SetSender makes the adapter send messages through s instead of the bot,
+// such as a ThrottledSender wrapping it. The manager must not be frozen yet.
+func (a *Adapter[S]) SetSender(s MessageSender) {
+	a.sender = s
+}
+
+// with returns the adapter sending through its sender bound to ctx, when the
+// sender is a ContextSender, or a itself otherwise.
+func (a *Adapter[S]) with(ctx context.Context) *Adapter[S] {
+	sender, ok := a.sender.(ContextSender)
+	if !ok || ctx == nil {
+		return a
+	}
+	bound := *a
+	bound.sender = sender.WithContext(ctx)
+	return &bound
+}
+
+// FloodWaitError is returned by a ThrottledSender for sends held off by an
+// earlier flood error for longer than its maximum wait.
+type FloodWaitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *FloodWaitError) Error() string {
+	return fmt.Sprintf("throttled by Telegram, retry after %s", e.RetryAfter)
+}
+
+// ThrottleStats counts how a ThrottledSender dealt with flood errors.
+type ThrottleStats struct {
+	Throttled int64         // Sends failing with a flood error
+	Retried   int64         // Sends retried after waiting as asked
+	GaveUp    int64         // Sends failed because the wait asked for was too long
+	Waited    time.Duration // Total time spent waiting, by all sends
+}
+
+// ThrottledSender handles the flood errors, HTTP 429 responses with a
+// retry_after, of the sender it wraps. A send asked to wait no longer than
+// the maximum wait sleeps and is retried; longer waits fail with the flood
+// error, or a FloodWaitError for sends held off by an earlier one, for callers
+// such as a tgsm.PromptRetry with RetryAfter to reschedule.
+// Telegram mostly throttles sends to one chat, so after a flood error the
+// sends to that chat hold off until the wait is over while other chats carry
+// on. Flood errors not tied to a chat, or hitting more chats at once than the
+// global limit, are taken to throttle the whole bot and hold off every send.
+// Sends of the sender returned by WithContext stop waiting when the context
+// is done. A ThrottledSender is safe for concurrent use.
+type ThrottledSender struct {
+	next        MessageSender
+	maxWait     time.Duration
+	globalLimit int
+	sleep       func(ctx context.Context, d time.Duration) error
+	now         func() time.Time
+	onFlood     func(to tele.Recipient, retryAfter time.Duration)
+	mu          sync.Mutex
+	until       time.Time            // Every send holds off until then
+	held        map[string]time.Time // Sends to a recipient hold off until then
+
+	throttled, retried, gaveUp, waited atomic.Int64
+}
+
+// NewThrottledSender wraps next, waiting up to maxWait for every send
+// throttled by Telegram.
+func NewThrottledSender(next MessageSender, maxWait time.Duration) *ThrottledSender {
+	return &ThrottledSender{
+		next:        next,
+		maxWait:     maxWait,
+		globalLimit: defaultGlobalLimit,
+		sleep:       sleep,
+		now:         time.Now,
+		held:        make(map[string]time.Time),
+	}
+}
+
+// SetGlobalLimit sets the number of chats held off at once from which every
+// send holds off, 10 by default. Zero or less never holds off every send for
+// flood errors tied to a chat.
+func (s *ThrottledSender) SetGlobalLimit(n int) {
+	s.globalLimit = n
+}
+
+// SetClock sets the functions telling the time and sleeping, time.Now and a
+// timer stopped when the context is done by default.
+func (s *ThrottledSender) SetClock(now func() time.Time, sleep func(ctx context.Context, d time.Duration) error) {
+	s.now, s.sleep = now, sleep
+}
+
+// OnFlood sets a hook called with every flood error, such as to export
+// metrics or alert on sustained throttling.
+func (s *ThrottledSender) OnFlood(fn func(to tele.Recipient, retryAfter time.Duration)) {
+	s.onFlood = fn
+}
+
+// WithContext returns the sender waiting out flood errors like s, sharing its
+// wait, but no longer than ctx allows, failing with the context's error.
+func (s *ThrottledSender) WithContext(ctx context.Context) MessageSender {
+	return &boundSender{throttled: s, ctx: ctx}
+}
+
+// Send sends what to to through the wrapped sender, waiting out flood errors
+// asking for no more than the maximum wait, up to three times.
+func (s *ThrottledSender) Send(to tele.Recipient, what any, opts ...any) (*tele.Message, error) {
+	return s.send(context.Background(), to, what, opts...)
+}
+
+// Edit edits msg through the wrapped sender, waiting out flood errors like
+// Send.
+func (s *ThrottledSender) Edit(msg tele.Editable, what any, opts ...any) (*tele.Message, error) {
+	return s.edit(context.Background(), msg, what, opts...)
+}
+
+// Respond answers the callback through the wrapped sender, waiting out flood
+// errors like Send.
+func (s *ThrottledSender) Respond(c *tele.Callback, resp ...*tele.CallbackResponse) error {
+	return s.respond(context.Background(), c, resp...)
+}
+
+func (s *ThrottledSender) send(ctx context.Context, to tele.Recipient, what any, opts ...any) (*tele.Message, error) {
+	var msg *tele.Message
+	err := s.do(ctx, to, func() (err error) {
+		msg, err = s.next.Send(to, what, opts...)
+		return err
+	})
+	return msg, err
+}
+
+func (s *ThrottledSender) edit(ctx context.Context, msg tele.Editable, what any, opts ...any) (*tele.Message, error) {
+	_, chatID := msg.MessageSig()
+	var edited *tele.Message
+	err := s.do(ctx, tele.ChatID(chatID), func() (err error) {
+		edited, err = s.next.Edit(msg, what, opts...)
+		return err
+	})
+	return edited, err
+}
+
+func (s *ThrottledSender) respond(ctx context.Context, c *tele.Callback, resp ...*tele.CallbackResponse) error {
+	var to tele.Recipient
+	if c.Sender != nil {
+		to = c.Sender
+	}
+	return s.do(ctx, to, func() error {
+		return s.next.Respond(c, resp...)
+	})
+}
+
+// do runs call, a request to the chat to, waiting out flood errors asking
+// for no more than the maximum wait, up to three times.
+func (s *ThrottledSender) do(ctx context.Context, to tele.Recipient, call func() error) error {
+	for retry := 0; ; retry++ {
+		if err := s.wait(ctx, to); err != nil {
+			return err
+		}
+		err := call()
+		var flood tele.FloodError
+		if !errors.As(err, &flood) {
+			return err
+		}
+		retryAfter := time.Duration(flood.RetryAfter) * time.Second
+		s.throttled.Add(1)
+		if s.onFlood != nil {
+			s.onFlood(to, retryAfter)
+		}
+		s.holdOff(to, retryAfter)
+		if retryAfter > s.maxWait || retry == maxFloodRetries {
+			s.gaveUp.Add(1)
+			return err
+		}
+		s.retried.Add(1)
+	}
+}
+
+// holdOff makes sends to to wait for d from now, or every send when to is
+// nil or the global limit of chats held off is reached.
+func (s *ThrottledSender) holdOff(to tele.Recipient, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	until := now.Add(d)
+	if to == nil {
+		s.until = later(s.until, until)
+		return
+	}
+	for key, held := range s.held {
+		if !held.After(now) {
+			delete(s.held, key)
+		}
+	}
+	key := to.Recipient()
+	s.held[key] = later(s.held[key], until)
+	if s.globalLimit > 0 && len(s.held) >= s.globalLimit {
+		s.until = later(s.until, until)
+	}
+}
+
+// later returns the later of two times.
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// wait sleeps until sends to to may go out again, or until ctx is done. A
+// wait longer than the maximum fails with a FloodWaitError telling the
+// remaining time.
+func (s *ThrottledSender) wait(ctx context.Context, to tele.Recipient) error {
+	s.mu.Lock()
+	until := s.until
+	if to != nil {
+		until = later(until, s.held[to.Recipient()])
+	}
+	d := until.Sub(s.now())
+	s.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	if d > s.maxWait {
+		s.gaveUp.Add(1)
+		return &FloodWaitError{RetryAfter: d}
+	}
+	if err := s.sleep(ctx, d); err != nil {
+		return err
+	}
+	s.waited.Add(int64(d))
+	return nil
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// boundSender is a ThrottledSender bound to a context.
+type boundSender struct {
+	throttled *ThrottledSender
+	ctx       context.Context
+}
+
+func (b *boundSender) Send(to tele.Recipient, what any, opts ...any) (*tele.Message, error) {
+	return b.throttled.send(b.ctx, to, what, opts...)
+}
+
+func (b *boundSender) Edit(msg tele.Editable, what any, opts ...any) (*tele.Message, error) {
+	return b.throttled.edit(b.ctx, msg, what, opts...)
+}
+
+func (b *boundSender) Respond(c *tele.Callback, resp ...*tele.CallbackResponse) error {
+	return b.throttled.respond(b.ctx, c, resp...)
+}
+
+// Stats returns the throttling counters since the sender was created.
+func (s *ThrottledSender) Stats() ThrottleStats {
+	return ThrottleStats{
+		Throttled: s.throttled.Load(),
+		Retried:   s.retried.Load(),
+		GaveUp:    s.gaveUp.Load(),
+		Waited:    time.Duration(s.waited.Load()),
+	}
+}
@@ -0,0 +1,184 @@
+package tgsmtele
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+	tele "gopkg.in/telebot.v4"
+)
+
+// ErrNoChat is returned when an update does not belong to any chat.
+var ErrNoChat = errors.New("update has no chat")
+
+// Chat returns the chat the update belongs to, or nil when it carries none.
+func Chat(u tele.Update) *tele.Chat {
+	switch {
+	case u.Message != nil:
+		return u.Message.Chat
+	case u.EditedMessage != nil:
+		return u.EditedMessage.Chat
+	case u.Callback != nil && u.Callback.Message != nil:
+		return u.Callback.Message.Chat
+	case u.Callback != nil && u.Callback.Sender != nil:
+		return &tele.Chat{ID: u.Callback.Sender.ID}
+	}
+	return nil
+}
+
+// ChatID returns the ID of the chat the update belongs to, or zero when it
+// carries none. It is suitable as the key function of a StateManager.
+func ChatID(u tele.Update) int64 {
+	if chat := Chat(u); chat != nil {
+		return chat.ID
+	}
+	return 0
+}
+
+// Key returns the ID of the chat the update belongs to, and false when it
+// carries none, such as a my_chat_member update or an inline query. It is
+// suitable as the KeyFunc of a StateManager.
+func Key(u tele.Update) (int64, bool) {
+	if chat := Chat(u); chat != nil {
+		return chat.ID, true
+	}
+	return 0, false
+}
+
+// ChatType returns the type of the chat the update belongs to, counting
+// private channels as channels, or an empty string when it is unknown, such
+// as for presses of buttons under inline messages. It
+// is suitable as the chat type function of a StateManager.
+func ChatType(u tele.Update) tgsm.ChatType {
+	chat := Chat(u)
+	switch {
+	case chat == nil:
+		return ""
+	case chat.Type == tele.ChatChannelPrivate:
+		return tgsm.ChatChannel
+	}
+	return tgsm.ChatType(chat.Type)
+}
+
+// UpdateID returns the ID of the update, and false when it carries none. It
+// is suitable as the update ID function of a StateManager.
+func UpdateID(u tele.Update) (int64, bool) {
+	return int64(u.ID), u.ID != 0
+}
+
+// Language returns the language code of the user sending the update, or an
+// empty string when Telegram does not share it. It is suitable as the
+// language function of StateManager.SetLocalizer.
+func Language(u tele.Update) string {
+	switch {
+	case u.Message != nil && u.Message.Sender != nil:
+		return u.Message.Sender.LanguageCode
+	case u.EditedMessage != nil && u.EditedMessage.Sender != nil:
+		return u.EditedMessage.Sender.LanguageCode
+	case u.Callback != nil && u.Callback.Sender != nil:
+		return u.Callback.Sender.LanguageCode
+	}
+	return ""
+}
+
+// Command returns the bot command the text starts with, without the bot
+// username suffix, or an empty string when the text is not a command.
+func Command(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return ""
+	}
+	cmd, _, _ := strings.Cut(fields[0], "@")
+	return cmd
+}
+
+// IsStart reports whether the update is a /start command. It is suitable as
+// the IsStart function of a tgsm.Reentry.
+func IsStart(u tele.Update) bool {
+	return u.Message != nil && Command(u.Message.Text) == "/start"
+}
+
+// Source returns the source of a session started by the update: a deep link
+// when it is a /start command carrying a payload, a command for any other
+// command and the zero Source otherwise.
+func Source(u tele.Update) tgsm.Source {
+	if u.Message == nil {
+		return tgsm.Source{}
+	}
+	cmd := Command(u.Message.Text)
+	if cmd == "" {
+		return tgsm.Source{}
+	}
+	if fields := strings.Fields(u.Message.Text); cmd == "/start" && len(fields) > 1 {
+		return tgsm.Source{Kind: tgsm.SourceDeepLink, Detail: fields[1]}
+	}
+	return tgsm.Source{Kind: tgsm.SourceCommand, Detail: cmd}
+}
+
+// Kind is a kind of input a state may accept.
+type Kind int
+
+const (
+	KindOther    Kind = iota // Anything not listed below
+	KindText                 // A text message
+	KindPhoto                // A photo, with or without a caption
+	KindDocument             // A file sent as a document
+	KindContact              // A shared contact
+	KindLocation             // A shared location
+	KindCallback             // A press of an inline keyboard button
+)
+
+// KindOf returns the kind of input the update carries.
+func KindOf(u tele.Update) Kind {
+	if u.Callback != nil {
+		return KindCallback
+	}
+	msg := u.Message
+	switch {
+	case msg == nil:
+		return KindOther
+	case msg.Photo != nil:
+		return KindPhoto
+	case msg.Document != nil:
+		return KindDocument
+	case msg.Contact != nil:
+		return KindContact
+	case msg.Location != nil:
+		return KindLocation
+	case msg.Text != "":
+		return KindText
+	}
+	return KindOther
+}
+
+// Accept returns a Filter for states taking only the given kinds of input.
+func Accept(kinds ...Kind) func(u tele.Update) bool {
+	return func(u tele.Update) bool {
+		return slices.Contains(kinds, KindOf(u))
+	}
+}
+
+// UpdateText reads and rewrites the text of message updates, implementing
+// tgsm.TextAccessor for telebot updates.
+type UpdateText struct{}
+
+// Text returns the text of the update's message.
+func (UpdateText) Text(u tele.Update) string {
+	if u.Message == nil {
+		return ""
+	}
+	return u.Message.Text
+}
+
+// WithText returns a copy of the update whose message carries text. The
+// original message is left untouched.
+func (UpdateText) WithText(u tele.Update, text string) tele.Update {
+	if u.Message == nil {
+		return u
+	}
+	msg := *u.Message
+	msg.Text = text
+	u.Message = &msg
+	return u
+}
@@ -0,0 +1,151 @@
+package tgsmtest
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// Edge is a transition between two states. An empty To is the end of a flow.
+type Edge struct {
+	From string
+	To   string
+}
+
+// Coverage tracks which states and transitions were exercised by the flow
+// testers it is attached to. Transitions declared up front, as guarded
+// transitions and skip targets, are reported even when never taken; those
+// decided by Handle at runtime only once they are. A Coverage is safe for
+// concurrent use.
+type Coverage struct {
+	mu     sync.Mutex
+	states map[string]int
+	edges  map[Edge]int
+}
+
+// NewCoverage creates an empty coverage.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		states: make(map[string]int),
+		edges:  make(map[Edge]int),
+	}
+}
+
+// register adds the states of a manager and their declared transitions.
+func (c *Coverage) register(states []tgsm.StateInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, state := range states {
+		c.states[state.Name] += 0
+		for _, to := range state.Transitions {
+			c.edges[Edge{From: state.Name, To: to}] += 0
+		}
+		if state.SkipTo != "" {
+			c.edges[Edge{From: state.Name, To: state.SkipTo}] += 0
+		}
+	}
+}
+
+// record counts a transition event.
+func (c *Coverage) record(event tgsm.Event) {
+	if event.Kind != tgsm.EventTransition {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if event.From != "" {
+		c.states[event.From]++
+	}
+	if event.State != "" {
+		c.states[event.State]++
+	}
+	c.edges[Edge{From: event.From, To: event.State}]++
+}
+
+// Report summarizes the coverage collected so far.
+func (c *Coverage) Report() Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var r Report
+	for name, visits := range c.states {
+		r.States++
+		if visits > 0 {
+			r.CoveredStates++
+		} else {
+			r.UncoveredStates = append(r.UncoveredStates, name)
+		}
+	}
+	for edge, traversals := range c.edges {
+		r.Edges++
+		if traversals > 0 {
+			r.CoveredEdges++
+		} else {
+			r.UncoveredEdges = append(r.UncoveredEdges, edge)
+		}
+	}
+	slices.Sort(r.UncoveredStates)
+	slices.SortFunc(r.UncoveredEdges, func(a, b Edge) int {
+		return cmp.Or(strings.Compare(a.From, b.From), strings.Compare(a.To, b.To))
+	})
+	return r
+}
+
+// Require fails the test when less than minimum of the states, a fraction
+// between 0 and 1, were exercised. The report is logged either way.
+func (c *Coverage) Require(t testing.TB, minimum float64) {
+	t.Helper()
+	r := c.Report()
+	t.Log(r)
+	if r.StateCoverage() < minimum {
+		t.Errorf("state coverage %.1f%% is below %.1f%%", r.StateCoverage()*100, minimum*100)
+	}
+}
+
+// Report is a snapshot of a Coverage.
+type Report struct {
+	States          int
+	CoveredStates   int
+	Edges           int
+	CoveredEdges    int
+	UncoveredStates []string
+	UncoveredEdges  []Edge
+}
+
+// StateCoverage returns the fraction of states exercised.
+func (r Report) StateCoverage() float64 {
+	if r.States == 0 {
+		return 1
+	}
+	return float64(r.CoveredStates) / float64(r.States)
+}
+
+// EdgeCoverage returns the fraction of known transitions exercised.
+func (r Report) EdgeCoverage() float64 {
+	if r.Edges == 0 {
+		return 1
+	}
+	return float64(r.CoveredEdges) / float64(r.Edges)
+}
+
+// String formats the report for humans.
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "states: %d/%d (%.1f%%), transitions: %d/%d (%.1f%%)",
+		r.CoveredStates, r.States, r.StateCoverage()*100, r.CoveredEdges, r.Edges, r.EdgeCoverage()*100)
+	for _, name := range r.UncoveredStates {
+		fmt.Fprintf(&b, "\nuncovered state: %s", name)
+	}
+	for _, edge := range r.UncoveredEdges {
+		to := edge.To
+		if to == "" {
+			to = "<finish>"
+		}
+		fmt.Fprintf(&b, "\nuncovered transition: %s -> %s", edge.From, to)
+	}
+	return b.String()
+}
@@ -0,0 +1,328 @@
+package tgsmtest
+
+import (
+	"math/rand/v2"
+	"reflect"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// words are the building blocks of generated text.
+var words = []string{
+	"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi",
+	"berlin", "tehran", "lisbon", "osaka", "quito", "oslo", "lima", "cairo",
+	"red", "green", "blue", "quick", "lazy", "bright", "calm", "bold",
+}
+
+// Generator produces random values of S for fuzz, load and simulation
+// tests. Fields carrying tgsm form tags, as parsed by tgsm.FormFields, get
+// values their form states accept: numbers and text lengths within min and
+// max, one of the options, text matching the pattern and times representable
+// in the layout. Other exported fields get arbitrary values of their type. A
+// Generator is safe for concurrent use.
+type Generator[S any] struct {
+	mu     sync.Mutex
+	rand   *rand.Rand
+	fields map[int]tgsm.FormField
+}
+
+// NewGenerator creates a generator of S drawing from a source seeded with
+// seed, so runs with the same seed generate the same values. S must be a
+// struct with valid tgsm tags.
+func NewGenerator[S any](seed uint64) (*Generator[S], error) {
+	fields, err := tgsm.FormFields[S]()
+	if err != nil {
+		return nil, err
+	}
+	g := &Generator[S]{
+		rand:   rand.New(rand.NewPCG(seed, seed)),
+		fields: make(map[int]tgsm.FormField, len(fields)),
+	}
+	for _, field := range fields {
+		g.fields[field.Index] = field
+	}
+	return g, nil
+}
+
+// Data returns a random value of S.
+func (g *Generator[S]) Data() S {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var data S
+	v := reflect.ValueOf(&data).Elem()
+	for i := range v.NumField() {
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		if field, ok := g.fields[i]; ok {
+			g.formValue(v.Field(i), field)
+		} else {
+			g.value(v.Field(i), 0)
+		}
+	}
+	return data
+}
+
+// UserState returns a user state holding random data, in a random state.
+func (g *Generator[S]) UserState() tgsm.UserState[S] {
+	data := g.Data()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return tgsm.UserState[S]{
+		CurrentState: "state_" + g.word() + "_" + strconv.Itoa(g.rand.IntN(1000)),
+		Data:         data,
+		PromptSent:   g.rand.IntN(2) == 0,
+	}
+}
+
+// Text returns n bytes of random space-separated words, such as a free-text
+// answer of that size.
+func (g *Generator[S]) Text(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.words(int64(n))
+}
+
+// Answers returns the text answers a user would send to the states built by
+// tgsmtele's Form to fill in the values of data, in field order.
+func (g *Generator[S]) Answers(data S) []string {
+	v := reflect.ValueOf(data)
+	answers := make([]string, 0, len(g.fields))
+	for i := range v.NumField() {
+		field, ok := g.fields[i]
+		if !ok {
+			continue
+		}
+		switch value := v.Field(i); {
+		case value.Type() == timeType:
+			answers = append(answers, value.Interface().(time.Time).Format(field.Layout))
+		case value.Kind() == reflect.String:
+			answers = append(answers, value.String())
+		default:
+			answers = append(answers, strconv.FormatInt(value.Int(), 10))
+		}
+	}
+	return answers
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// formValue sets v to a random answer to the form field.
+func (g *Generator[S]) formValue(v reflect.Value, field tgsm.FormField) {
+	switch {
+	case v.Type() == timeType:
+		t := g.time()
+		parsed, err := time.Parse(field.Layout, t.Format(field.Layout))
+		if err == nil {
+			t = parsed
+		}
+		v.Set(reflect.ValueOf(t))
+	case v.Kind() == reflect.String && len(field.Options) > 0:
+		v.SetString(field.Options[g.rand.IntN(len(field.Options))])
+	case v.Kind() == reflect.String:
+		v.SetString(g.text(field))
+	default:
+		lo, hi := bounds(field, 0, 1000)
+		hi = max(hi, lo)
+		bits := v.Type().Bits()
+		lo = max(lo, -1<<(bits-1))
+		hi = min(hi, 1<<(bits-1)-1)
+		v.SetInt(lo + g.rand.Int64N(hi-lo+1))
+	}
+}
+
+// bounds returns the bounds of the field, spanning span when it is unbounded
+// on one side.
+func bounds(field tgsm.FormField, lo, span int64) (int64, int64) {
+	switch {
+	case field.Min != nil && field.Max != nil:
+		return *field.Min, *field.Max
+	case field.Min != nil:
+		return *field.Min, *field.Min + span
+	case field.Max != nil:
+		return min(lo, *field.Max), *field.Max
+	}
+	return lo, lo + span
+}
+
+// text returns random text of a length within the bounds of the field and
+// matching its pattern. Patterns that rarely produce a fitting string may
+// yield a string that does not fit.
+func (g *Generator[S]) text(field tgsm.FormField) string {
+	lo, hi := bounds(field, 1, 20)
+	lo = max(lo, 1)
+	hi = max(hi, lo)
+	if field.Pattern == nil {
+		return g.words(lo + g.rand.Int64N(hi-lo+1))
+	}
+
+	re, err := syntax.Parse(field.Pattern.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	var text string
+	for range 100 {
+		var b strings.Builder
+		g.pattern(&b, re)
+		text = b.String()
+		n := int64(utf8.RuneCountInString(text))
+		if text != "" && text == strings.TrimSpace(text) && n >= lo && n <= hi && field.Pattern.MatchString(text) {
+			break
+		}
+	}
+	return text
+}
+
+// words returns n runes of space-separated words.
+func (g *Generator[S]) words(n int64) string {
+	var b strings.Builder
+	for int64(b.Len()) < n {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(g.word())
+	}
+	text := []byte(b.String()[:n])
+	if text[n-1] == ' ' {
+		text[n-1] = 'a'
+	}
+	return string(text)
+}
+
+// word returns a random word.
+func (g *Generator[S]) word() string {
+	return words[g.rand.IntN(len(words))]
+}
+
+// pattern writes a random string matched by re to b.
+func (g *Generator[S]) pattern(b *strings.Builder, re *syntax.Regexp) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && g.rand.IntN(2) == 0 {
+				r = unicode.SimpleFold(r)
+			}
+			b.WriteRune(r)
+		}
+	case syntax.OpCharClass:
+		b.WriteRune(g.class(re.Rune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		b.WriteByte(byte('a' + g.rand.IntN(26)))
+	case syntax.OpCapture:
+		g.pattern(b, re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			g.pattern(b, sub)
+		}
+	case syntax.OpAlternate:
+		g.pattern(b, re.Sub[g.rand.IntN(len(re.Sub))])
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		lo, hi := 0, 3
+		switch re.Op {
+		case syntax.OpPlus:
+			lo, hi = 1, 4
+		case syntax.OpQuest:
+			hi = 1
+		case syntax.OpRepeat:
+			lo, hi = re.Min, re.Max
+			if hi < 0 {
+				hi = lo + 3
+			}
+		}
+		for range lo + g.rand.IntN(hi-lo+1) {
+			g.pattern(b, re.Sub[0])
+		}
+	}
+	// Anchors, word boundaries and empty matches write nothing
+}
+
+// class returns a random rune of a character class given as pairs of
+// inclusive range bounds, preferring printable ASCII.
+func (g *Generator[S]) class(ranges []rune) rune {
+	var printable []rune
+	for i := 0; i < len(ranges); i += 2 {
+		lo, hi := max(ranges[i], '!'), min(ranges[i+1], '~')
+		if lo <= hi {
+			printable = append(printable, lo, hi)
+		}
+	}
+	if len(printable) > 0 {
+		ranges = printable
+	}
+	if len(ranges) == 0 {
+		return 'a'
+	}
+	i := 2 * g.rand.IntN(len(ranges)/2)
+	return ranges[i] + g.rand.Int32N(ranges[i+1]-ranges[i]+1)
+}
+
+// time returns a random time between 1970 and 2040, in UTC.
+func (g *Generator[S]) time() time.Time {
+	return time.Unix(g.rand.Int64N(70*365*24*60*60), 0).UTC()
+}
+
+// value sets v to a random value of its type. Nesting is limited by depth.
+func (g *Generator[S]) value(v reflect.Value, depth int) {
+	if v.Type() == timeType {
+		v.Set(reflect.ValueOf(g.time()))
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(g.word())
+	case reflect.Bool:
+		v.SetBool(g.rand.IntN(2) == 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(g.rand.Int64N(100))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(g.rand.Uint64N(100))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(g.rand.IntN(10000)) / 100)
+	case reflect.Pointer:
+		if depth < 3 && g.rand.IntN(2) == 0 {
+			v.Set(reflect.New(v.Type().Elem()))
+			g.value(v.Elem(), depth+1)
+		}
+	case reflect.Slice:
+		if depth < 3 {
+			n := g.rand.IntN(4)
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+			for i := range n {
+				g.value(v.Index(i), depth+1)
+			}
+		}
+	case reflect.Array:
+		for i := range v.Len() {
+			g.value(v.Index(i), depth+1)
+		}
+	case reflect.Map:
+		if depth < 3 {
+			v.Set(reflect.MakeMap(v.Type()))
+			for range g.rand.IntN(4) {
+				key := reflect.New(v.Type().Key()).Elem()
+				elem := reflect.New(v.Type().Elem()).Elem()
+				g.value(key, depth+1)
+				g.value(elem, depth+1)
+				v.SetMapIndex(key, elem)
+			}
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				g.value(v.Field(i), depth+1)
+			}
+		}
+	}
+	// Channels, functions and interfaces are left zero
+}
@@ -0,0 +1,106 @@
+package tgsmtest
+
+import (
+	"sync"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// Simulator runs flows against scripted updates, without a bot or a real
+// storage, and records what happened along the way. Every run gets a fresh
+// manager backed by memory, so scripts never affect each other.
+type Simulator[S, U any] struct {
+	build func(storage tgsm.StateStorage[S]) (*tgsm.StateManager[S, U], error)
+}
+
+// NewSimulator creates a simulator building its managers with build, which
+// must use the storage it is given.
+func NewSimulator[S, U any](build func(storage tgsm.StateStorage[S]) (*tgsm.StateManager[S, U], error)) *Simulator[S, U] {
+	return &Simulator[S, U]{build: build}
+}
+
+// Step records the handling of a scripted update.
+type Step[S, U any] struct {
+	Update  U
+	Key     int64
+	From    string   // State of the user before the update
+	To      string   // State of the user after the update, empty once finished
+	Prompts []string // States whose prompt was sent while handling the update, in order
+	Handled bool
+	Data    S // Data of the user after the update
+	Err     error
+}
+
+// Transcript is the record of a simulated conversation.
+type Transcript[S, U any] struct {
+	Steps []Step[S, U]
+	Final map[int64]tgsm.UserState[S] // Last state of every user taking part
+}
+
+// States returns the state every step left its user in.
+func (t Transcript[S, U]) States() []string {
+	states := make([]string, len(t.Steps))
+	for i, step := range t.Steps {
+		states[i] = step.To
+	}
+	return states
+}
+
+// Prompts returns the states whose prompt was sent, in order.
+func (t Transcript[S, U]) Prompts() []string {
+	var prompts []string
+	for _, step := range t.Steps {
+		prompts = append(prompts, step.Prompts...)
+	}
+	return prompts
+}
+
+// Run handles the updates in order. It stops at the first update failing to
+// be handled, returning the transcript up to and including that step along
+// with the error. Prompts are recorded as they are sent, so those sent in the
+// background, by a PromptDispatcher or a prompt retry, are recorded with the
+// step during which they went out. The manager built must not be frozen, as
+// Run registers an event handler with it.
+func (s *Simulator[S, U]) Run(updates ...U) (Transcript[S, U], error) {
+	manager, err := s.build(tgsm.NewInMemoryStorage[S]())
+	if err != nil {
+		return Transcript[S, U]{}, err
+	}
+	var mu sync.Mutex
+	var prompts []string
+	err = manager.OnEvent(func(event tgsm.Event) {
+		if event.Kind == tgsm.EventPromptSent {
+			mu.Lock()
+			prompts = append(prompts, event.State)
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		return Transcript[S, U]{}, err
+	}
+
+	t := Transcript[S, U]{Final: make(map[int64]tgsm.UserState[S])}
+	for _, update := range updates {
+		step := Step[S, U]{Update: update}
+		step.Handled, step.Err = manager.Handle(update)
+		mu.Lock()
+		step.Prompts, prompts = prompts, nil
+		mu.Unlock()
+
+		key, ok := manager.Key(update)
+		if ok {
+			step.Key = key
+			step.From = t.Final[key].CurrentState
+			state, exists, err := manager.Current(key)
+			if err == nil && exists {
+				step.To, step.Data = state.CurrentState, state.Data
+				t.Final[key] = state
+			}
+		}
+		t.Steps = append(t.Steps, step)
+		if step.Err != nil {
+			return t, step.Err
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,100 @@
+package tgsmtest
+
+import (
+	"slices"
+	"sync"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// Op is a storage operation recorded by a RecordingStorage.
+type Op string
+
+const (
+	OpGet    Op = "get"
+	OpSet    Op = "set"
+	OpDelete Op = "delete"
+)
+
+// Call is a storage call recorded by a RecordingStorage.
+type Call[S any] struct {
+	Op    Op
+	ID    int64
+	State tgsm.UserState[S] // State stored by OpSet, or returned by OpGet
+	Found bool              // Whether OpGet found a state
+	Err   error
+}
+
+// RecordingStorage records every call made to the storage it wraps. It is
+// safe for concurrent use.
+type RecordingStorage[S any] struct {
+	backend tgsm.StateStorage[S]
+	mu      sync.Mutex
+	calls   []Call[S]
+}
+
+// NewRecordingStorage creates a storage recording the calls made to backend,
+// or to a fresh in-memory storage when backend is nil.
+func NewRecordingStorage[S any](backend tgsm.StateStorage[S]) *RecordingStorage[S] {
+	if backend == nil {
+		backend = tgsm.NewInMemoryStorage[S]()
+	}
+	return &RecordingStorage[S]{backend: backend}
+}
+
+// Get retrieves the user state for a given ID.
+func (s *RecordingStorage[S]) Get(id int64) (tgsm.UserState[S], bool, error) {
+	state, ok, err := s.backend.Get(id)
+	s.record(Call[S]{Op: OpGet, ID: id, State: state, Found: ok, Err: err})
+	return state, ok, err
+}
+
+// Set stores the user state for a given ID.
+func (s *RecordingStorage[S]) Set(id int64, state tgsm.UserState[S]) error {
+	err := s.backend.Set(id, state)
+	s.record(Call[S]{Op: OpSet, ID: id, State: state, Err: err})
+	return err
+}
+
+// Delete removes the user state for a given ID.
+func (s *RecordingStorage[S]) Delete(id int64) error {
+	err := tgsm.ErrNotDeletable
+	if deleter, ok := s.backend.(tgsm.Deleter[S]); ok {
+		err = deleter.Delete(id)
+	}
+	s.record(Call[S]{Op: OpDelete, ID: id, Err: err})
+	return err
+}
+
+// record appends a call.
+func (s *RecordingStorage[S]) record(call Call[S]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+// Calls returns the calls recorded so far, oldest first, optionally limited
+// to the given operations.
+func (s *RecordingStorage[S]) Calls(ops ...Op) []Call[S] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var calls []Call[S]
+	for _, call := range s.calls {
+		if len(ops) == 0 || slices.Contains(ops, call.Op) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Count returns the number of recorded calls of the operation.
+func (s *RecordingStorage[S]) Count(op Op) int {
+	return len(s.Calls(op))
+}
+
+// Reset forgets the recorded calls.
+func (s *RecordingStorage[S]) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+}
@@ -0,0 +1,73 @@
+// Package tgsmtest provides helpers for testing flows built with
+// tg-state-manager: flow testers and simulators, a recording storage, a fake
+// clock and builders of telebot updates.
+package tgsmtest
+
+import (
+	"reflect"
+	"testing"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// FlowTester drives a StateManager through conversations in tests.
+type FlowTester[S, U any] struct {
+	t       testing.TB
+	manager *tgsm.StateManager[S, U]
+}
+
+// NewFlowTester creates a tester driving manager.
+func NewFlowTester[S, U any](t testing.TB, manager *tgsm.StateManager[S, U]) *FlowTester[S, U] {
+	return &FlowTester[S, U]{t: t, manager: manager}
+}
+
+// Send handles updates in order, failing the test on the first error. It
+// returns whether the last update was handled.
+func (f *FlowTester[S, U]) Send(updates ...U) bool {
+	f.t.Helper()
+	handled := false
+	for _, update := range updates {
+		var err error
+		if handled, err = f.manager.Handle(update); err != nil {
+			f.t.Fatalf("handling update %+v: %v", update, err)
+		}
+	}
+	return handled
+}
+
+// State returns the state of the user identified by key, failing the test
+// when it cannot be read.
+func (f *FlowTester[S, U]) State(key int64) tgsm.UserState[S] {
+	f.t.Helper()
+	state, _, err := f.manager.Current(key)
+	if err != nil {
+		f.t.Fatalf("reading state of %d: %v", key, err)
+	}
+	return state
+}
+
+// AssertState fails the test unless the user identified by key is in the
+// named state. An empty name asserts that the user finished the flow.
+func (f *FlowTester[S, U]) AssertState(key int64, name string) {
+	f.t.Helper()
+	if got := f.State(key).CurrentState; got != name {
+		f.t.Errorf("user %d is in state %q, want %q", key, got, name)
+	}
+}
+
+// AssertData fails the test unless the data collected from the user
+// identified by key deeply equals want.
+func (f *FlowTester[S, U]) AssertData(key int64, want S) {
+	f.t.Helper()
+	if got := f.State(key).Data; !reflect.DeepEqual(got, want) {
+		f.t.Errorf("user %d has data %+v, want %+v", key, got, want)
+	}
+}
+
+// Cover records the states and transitions the manager goes through into
+// coverage. Share one Coverage between the testers of a suite to measure the
+// coverage of the whole suite.
+func (f *FlowTester[S, U]) Cover(coverage *Coverage) {
+	coverage.register(f.manager.States())
+	f.manager.OnEvent(coverage.record)
+}
@@ -0,0 +1,229 @@
+package tgsmtest_test
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/tgsmtele"
+	"github.com/sudosz/tg-state-manager/tgsmtest"
+)
+
+type (
+	update struct {
+		ChatID int64
+		Text   string
+	}
+
+	order struct {
+		Item     string
+		Delivery bool
+	}
+)
+
+func newManager(t *testing.T) *tgsm.StateManager[order, update] {
+	sm := tgsm.NewStateManager[order, update](tgsm.NewInMemoryStorage[order](), func(u update) int64 { return u.ChatID })
+	sm.SetInitialState("item")
+	require.NoError(t, sm.Add(
+		&tgsm.State[order, update]{
+			Name: "item",
+			Handle: func(u update, data *order) (string, error) {
+				data.Item = u.Text
+				return "delivery", nil
+			},
+		},
+		&tgsm.State[order, update]{
+			Name: "delivery",
+			Handle: func(u update, data *order) (string, error) {
+				data.Delivery = u.Text == "yes"
+				return "", nil
+			},
+			Transitions: []tgsm.Transition[order, update]{{
+				To:   "address",
+				When: func(u update, data *order) bool { return data.Delivery },
+			}},
+		},
+		&tgsm.State[order, update]{
+			Name:   "address",
+			Handle: func(u update, data *order) (string, error) { return "", nil },
+		},
+	))
+	return sm
+}
+
+func TestFlowTesterCoverage(t *testing.T) {
+	coverage := tgsmtest.NewCoverage()
+
+	ft := tgsmtest.NewFlowTester(t, newManager(t))
+	ft.Cover(coverage)
+	assert.True(t, ft.Send(update{ChatID: 1, Text: "pizza"}, update{ChatID: 1, Text: "no"}))
+	ft.AssertState(1, "")
+	assert.Equal(t, "pizza", ft.State(1).Data.Item)
+
+	report := coverage.Report()
+	assert.Equal(t, 2, report.CoveredStates)
+	assert.Equal(t, []string{"address"}, report.UncoveredStates)
+	assert.Equal(t, []tgsmtest.Edge{{From: "delivery", To: "address"}}, report.UncoveredEdges)
+
+	ft = tgsmtest.NewFlowTester(t, newManager(t))
+	ft.Cover(coverage)
+	ft.Send(update{ChatID: 2, Text: "sushi"}, update{ChatID: 2, Text: "yes"}, update{ChatID: 2, Text: "Main St"})
+	coverage.Require(t, 1)
+	assert.Equal(t, 1.0, coverage.Report().EdgeCoverage())
+}
+
+func TestSimulator(t *testing.T) {
+	sim := tgsmtest.NewSimulator(func(storage tgsm.StateStorage[order]) (*tgsm.StateManager[order, update], error) {
+		sm := tgsm.NewStateManager[order, update](storage, func(u update) int64 { return u.ChatID })
+		sm.SetInitialState("item")
+		if err := sm.SetReentry(tgsm.Reentry[order, update]{
+			Policy:  tgsm.ReentryResume,
+			IsStart: func(u update) bool { return u.Text == "/start" },
+		}); err != nil {
+			return nil, err
+		}
+		return sm, sm.Add(
+			&tgsm.State[order, update]{
+				Name:   "item",
+				Prompt: func(u update, data *order) error { return nil },
+				Handle: func(u update, data *order) (string, error) {
+					if u.Text == "" {
+						return "", tgsm.ErrValidation
+					}
+					data.Item = u.Text
+					return "address", nil
+				},
+			},
+			&tgsm.State[order, update]{
+				Name:   "address",
+				Prompt: func(u update, data *order) error { return nil },
+				Handle: func(u update, data *order) (string, error) {
+					data.Delivery = true
+					return "", nil
+				},
+			},
+		)
+	})
+
+	transcript, err := sim.Run(
+		update{ChatID: 1, Text: "/start"},
+		update{ChatID: 1},
+		update{ChatID: 1, Text: "pizza"},
+		update{ChatID: 2, Text: "/start"},
+		update{ChatID: 1, Text: "/start"},
+		update{ChatID: 1, Text: "Main St"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"item", "item", "address", "item", "address", ""}, transcript.States())
+	assert.Equal(t, []string{"item", "address", "item", "address"}, transcript.Prompts(), "re-prompts are recorded")
+	assert.Equal(t, []string{"address"}, transcript.Steps[4].Prompts)
+	assert.Equal(t, "item", transcript.Steps[2].From)
+	assert.Equal(t, "pizza", transcript.Steps[2].Data.Item)
+	assert.Equal(t, int64(2), transcript.Steps[3].Key)
+	assert.True(t, transcript.Final[1].Finished)
+	assert.True(t, transcript.Final[1].Data.Delivery)
+
+	// Every run starts from scratch
+	transcript, err = sim.Run(update{ChatID: 1, Text: "/start"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"item"}, transcript.States())
+}
+
+func TestRecordingStorageAndClock(t *testing.T) {
+	storage := tgsmtest.NewRecordingStorage[order](nil)
+	clock := tgsmtest.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	sm := tgsm.NewStateManager[order, update](storage, func(u update) int64 { return u.ChatID })
+	require.NoError(t, sm.SetClock(clock.Now))
+	sm.SetInitialState("item")
+	require.NoError(t, sm.Add(&tgsm.State[order, update]{
+		Name: "item",
+		Handle: func(u update, data *order) (string, error) {
+			data.Item = u.Text
+			return "item", nil
+		},
+	}))
+
+	ft := tgsmtest.NewFlowTester(t, sm)
+	ft.Send(update{ChatID: 1, Text: "pizza"})
+	ft.AssertData(1, order{Item: "pizza"})
+	created := ft.State(1).CreatedAt
+
+	clock.Advance(time.Hour)
+	ft.Send(update{ChatID: 1, Text: "sushi"})
+	ft.AssertState(1, "item")
+	assert.Equal(t, created, ft.State(1).CreatedAt)
+	assert.Equal(t, created.Add(time.Hour), ft.State(1).UpdatedAt)
+
+	sets := storage.Calls(tgsmtest.OpSet)
+	require.Len(t, sets, 2)
+	assert.Equal(t, "sushi", sets[1].State.Data.Item)
+	assert.Positive(t, storage.Count(tgsmtest.OpGet))
+
+	storage.Reset()
+	assert.Empty(t, storage.Calls())
+}
+
+func TestUpdateBuilders(t *testing.T) {
+	u := tgsmtest.Command(7, "start", "ref42")
+	assert.Equal(t, int64(7), tgsmtele.ChatID(u))
+	assert.Equal(t, "/start ref42", u.Message.Text)
+	assert.Equal(t, "ref42", u.Message.Payload)
+	assert.True(t, tgsmtele.IsStart(u))
+
+	u = tgsmtest.Callback(7, "choice:1")
+	assert.Equal(t, int64(7), tgsmtele.ChatID(u))
+	assert.Equal(t, "choice:1", u.Callback.Data)
+
+	assert.NotEqual(t, tgsmtest.Text(7, "a").Message.ID, tgsmtest.Text(7, "b").Message.ID)
+}
+
+func TestGenerator(t *testing.T) {
+	type signup struct {
+		Name     string    `tgsm:"min=3,max=12"`
+		Age      int8      `tgsm:"min=18,max=99"`
+		Plan     string    `tgsm:"options=Free|Pro"`
+		Birthday time.Time `tgsm:"layout=02.01.2006"`
+		Code     string    `tgsm:"pattern=^[A-Z]{2}-[0-9]{3}$"`
+		Tags     []string
+		Extra    *order
+	}
+
+	g, err := tgsmtest.NewGenerator[signup](42)
+	require.NoError(t, err)
+	code := regexp.MustCompile(`^[A-Z]{2}-[0-9]{3}$`)
+	for range 100 {
+		data := g.Data()
+		assert.GreaterOrEqual(t, utf8.RuneCountInString(data.Name), 3)
+		assert.LessOrEqual(t, utf8.RuneCountInString(data.Name), 12)
+		assert.Equal(t, strings.TrimSpace(data.Name), data.Name)
+		assert.GreaterOrEqual(t, data.Age, int8(18))
+		assert.LessOrEqual(t, data.Age, int8(99))
+		assert.Contains(t, []string{"Free", "Pro"}, data.Plan)
+		assert.Regexp(t, code, data.Code)
+		assert.Equal(t, data.Birthday.Truncate(24*time.Hour), data.Birthday)
+
+		answers := g.Answers(data)
+		require.Len(t, answers, 5)
+		assert.Equal(t, strconv.Itoa(int(data.Age)), answers[1])
+		assert.Equal(t, data.Birthday.Format("02.01.2006"), answers[3])
+	}
+
+	// The same seed generates the same values
+	other, err := tgsmtest.NewGenerator[signup](42)
+	require.NoError(t, err)
+	g, err = tgsmtest.NewGenerator[signup](42)
+	require.NoError(t, err)
+	assert.Equal(t, g.UserState(), other.UserState())
+
+	_, err = tgsmtest.NewGenerator[struct {
+		Age bool `tgsm:"min=1"`
+	}](1)
+	assert.ErrorIs(t, err, tgsm.ErrFormTag)
+}
@@ -0,0 +1,54 @@
+package tgsmtest
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// lastID numbers the messages and callbacks of built updates.
+var lastID atomic.Int64
+
+// Text builds a telebot update carrying a private text message from the user
+// with the given ID.
+func Text(userID int64, text string) tele.Update {
+	return tele.Update{Message: message(userID, text)}
+}
+
+// Command builds a telebot update carrying a bot command with its arguments,
+// as sent by the user with the given ID. The command may be given with or
+// without its leading slash.
+func Command(userID int64, command string, args ...string) tele.Update {
+	command = "/" + strings.TrimPrefix(command, "/")
+	u := Text(userID, strings.Join(append([]string{command}, args...), " "))
+	u.Message.Payload = strings.Join(args, " ")
+	u.Message.Entities = tele.Entities{{Type: tele.EntityCommand, Length: len(command)}}
+	return u
+}
+
+// Callback builds a telebot update carrying the press of an inline button with
+// the given data, under a message the bot sent to the user.
+func Callback(userID int64, data string) tele.Update {
+	msg := message(userID, "")
+	msg.Sender = &tele.User{IsBot: true}
+	return tele.Update{Callback: &tele.Callback{
+		ID:      strconv.FormatInt(lastID.Add(1), 10),
+		Sender:  &tele.User{ID: userID},
+		Message: msg,
+		Data:    data,
+	}}
+}
+
+// message builds a message in the private chat with the user.
+func message(userID int64, text string) *tele.Message {
+	return &tele.Message{
+		ID:       int(lastID.Add(1)),
+		Sender:   &tele.User{ID: userID},
+		Chat:     &tele.Chat{ID: userID, Type: tele.ChatPrivate},
+		Text:     text,
+		Unixtime: time.Now().Unix(),
+	}
+}
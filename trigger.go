@@ -0,0 +1,55 @@
+package tgstatemanager
+
+import "fmt"
+
+// Trigger moves users to a state whenever one of their updates matches,
+// whatever state they are in, even mid-flow or after finishing one. Triggers
+// take precedence over the current state, navigation actions and the
+// interceptor, e.g. for a persistent "Main menu" button.
+type Trigger[U any] struct {
+	When  func(update U) bool
+	State string // State entered, keeping the user's flow and data
+	Flow  string // Optional: Named flow started instead, discarding the user's state and data
+}
+
+// AddTriggers registers triggers, consulted in the order they were added. The
+// state or flow of every trigger must already be registered.
+func (m *StateManager[S, U]) AddTriggers(triggers ...Trigger[U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	for _, trigger := range triggers {
+		if trigger.Flow != "" {
+			if _, ok := m.flows[trigger.Flow]; !ok {
+				return fmt.Errorf("%w: %s", ErrUnknownFlow, trigger.Flow)
+			}
+		} else if _, ok := m.states[trigger.State]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownState, trigger.State)
+		}
+	}
+	m.triggers = append(m.triggers, triggers...)
+	return nil
+}
+
+// trigger returns the first trigger matching the update.
+func (m *StateManager[S, U]) trigger(update U) (Trigger[U], bool) {
+	for _, trigger := range m.triggers {
+		if trigger.When(update) {
+			return trigger, true
+		}
+	}
+	return Trigger[U]{}, false
+}
+
+// fire moves the user as the trigger says and sends the prompt of the state
+// entered.
+func (m *StateManager[S, U]) fire(update U, userState UserState[S], trigger Trigger[U], key int64) error {
+	if trigger.Flow != "" {
+		fresh := UserState[S]{Flow: trigger.Flow, Source: m.source(update), LastUpdateID: userState.LastUpdateID, Language: userState.Language, Meta: userState.Meta}
+		return m.transition(update, &fresh, m.flows[trigger.Flow], key)
+	}
+	if _, ok := m.states[userState.CurrentState]; ok && userState.CurrentState != trigger.State {
+		userState.History = append(userState.History, userState.CurrentState)
+	}
+	return m.transition(update, &userState, trigger.State, key)
+}
@@ -0,0 +1,92 @@
+package tgstatemanager
+
+import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Random is a source of randomness. Storages draw TTL jitter from it and
+// managers the IDs of outbox intents, so injecting a seeded source makes
+// their behavior deterministic.
+type Random interface {
+	// Int64N returns a random number in [0, n).
+	Int64N(n int64) int64
+}
+
+// NewRandom returns a deterministic Random seeded with seed, safe for
+// concurrent use.
+func NewRandom(seed uint64) Random {
+	return &lockedRandom{r: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// lockedRandom guards a rand.Rand, which is not safe for concurrent use.
+type lockedRandom struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRandom) Int64N(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int64N(n)
+}
+
+// globalRandom draws from the global source of math/rand/v2.
+type globalRandom struct{}
+
+func (globalRandom) Int64N(n int64) int64 {
+	return rand.Int64N(n)
+}
+
+// TTLStorage is implemented by storages able to give a state a lifetime of its
+// own. States whose State has a TTL are stored with it; storages without
+// support store them with their own TTL.
+type TTLStorage[S any] interface {
+	StateStorage[S]
+	// SetWithTTL stores state expiring ttl after now, extended by the
+	// storage's jitter. A zero ttl stores it with the storage's TTL, as Set.
+	SetWithTTL(id int64, state UserState[S], ttl time.Duration) error
+}
+
+// setWithTTL stores state with ttl when storage implements TTLStorage, or
+// with Set otherwise.
+func setWithTTL[S any](storage StateStorage[S], id int64, state UserState[S], ttl time.Duration) error {
+	if s, ok := storage.(TTLStorage[S]); ok {
+		return s.SetWithTTL(id, state, ttl)
+	}
+	return storage.Set(id, state)
+}
+
+// jittered returns ttl extended by a random duration in [0, jitter] drawn
+// from r, so sessions created in a burst do not all expire at the same
+// moment. A nil r draws from the global source.
+func jittered(r Random, ttl, jitter time.Duration) time.Duration {
+	if ttl <= 0 {
+		return ttl
+	}
+	return ttl + randomDuration(r, jitter)
+}
+
+// randomDuration returns a random duration in [0, limit] drawn from r, or
+// from the global source when r is nil.
+func randomDuration(r Random, limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	if r == nil {
+		r = globalRandom{}
+	}
+	return time.Duration(r.Int64N(int64(limit) + 1))
+}
+
+// randomID returns a random identifier drawn from r, or from the global
+// source when r is nil.
+func randomID(r Random) string {
+	if r == nil {
+		r = globalRandom{}
+	}
+	return strconv.FormatInt(r.Int64N(math.MaxInt64), 36) + strconv.FormatInt(r.Int64N(math.MaxInt64), 36)
+}
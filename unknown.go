@@ -0,0 +1,70 @@
+package tgstatemanager
+
+import "fmt"
+
+// ResetState is a special state name an UnknownStateHandler returns to restart
+// the user's flow from its initial state with fresh data.
+const ResetState = "<reset>"
+
+// UnknownStateHandler decides what happens to a user whose stored state is no
+// longer registered, typically after a deploy renamed states. It returns the
+// state to move the user to, keeping the collected data, ResetState to
+// restart the flow, or an empty string to ignore the update. A returned error
+// aborts Handle.
+type UnknownStateHandler[S, U any] func(update U, userState UserState[S]) (string, error)
+
+// SetUnknownStateHandler sets the handler consulted when a user's stored
+// state is not registered. Without one such updates are ignored.
+func (m *StateManager[S, U]) SetUnknownStateHandler(fn UnknownStateHandler[S, U]) error {
+	if m.frozen.Load() {
+		return ErrFrozen
+	}
+	m.onUnknown = fn
+	return nil
+}
+
+// RemapStates returns an UnknownStateHandler moving users from renamed states
+// to their new names and restarting the flow of users in any other unknown
+// state.
+func RemapStates[S, U any](renames map[string]string) UnknownStateHandler[S, U] {
+	return func(_ U, userState UserState[S]) (string, error) {
+		if to, ok := renames[userState.CurrentState]; ok {
+			return to, nil
+		}
+		return ResetState, nil
+	}
+}
+
+// recover moves a user out of an unregistered state as decided by the
+// unknown state handler, then handles the update in the new state. The update
+// is not loaded again, as its ID was already recorded and it would be
+// mistaken for a redelivery.
+func (m *StateManager[S, U]) recover(update U, userState UserState[S], key int64) (bool, error) {
+	next, err := m.onUnknown(update, userState)
+	if err != nil || next == "" {
+		return false, err
+	}
+
+	if next == ResetState {
+		fresh := UserState[S]{Flow: userState.Flow, Source: userState.Source, LastUpdateID: userState.LastUpdateID, Language: userState.Language, Meta: userState.Meta}
+		next = m.flows[userState.Flow]
+		if userState.Flow == "" {
+			if fresh.Flow, next, fresh.Data, err = m.initial(update); err != nil {
+				return false, err
+			}
+		}
+		userState = fresh
+	}
+	state, ok := m.states[next]
+	if !ok {
+		return false, fmt.Errorf("%w: %s", ErrUnknownState, next)
+	}
+
+	previous := userState.CurrentState
+	userState.Enter(next)
+	if err := m.save(key, &userState); err != nil {
+		return false, err
+	}
+	m.moved(key, &userState, previous)
+	return m.handleIn(update, userState, true, state, key)
+}
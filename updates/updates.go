@@ -0,0 +1,178 @@
+// Package updates reads the updates of bot frameworks through a common
+// interface, so prebuilt states work with any framework an Adapter is
+// written for. The adapter of package tgsmtele supports telebot, building its
+// own prebuilt states on these.
+package updates
+
+import (
+	"strconv"
+	"strings"
+
+	tgsm "github.com/sudosz/tg-state-manager"
+)
+
+// choicePrefix prefixes the callback data of the buttons of choice states.
+const choicePrefix = "tgsm:choice:"
+
+// Accessor extracts what prebuilt states need from the updates of a bot
+// framework.
+type Accessor[U any] interface {
+	Text(u U) string                 // Text of the message carried, empty when none
+	ChatID(u U) (int64, bool)        // Chat the update belongs to, false when none
+	CallbackData(u U) (string, bool) // Data of the pressed inline button, false for other updates
+}
+
+// Button is an inline button sent with a message.
+type Button struct {
+	Text string // Label
+	Data string // Callback data sent back when pressed
+}
+
+// Adapter is the thin layer prebuilt states need over a bot framework.
+type Adapter[U any] interface {
+	Accessor[U]
+	// Send sends text to the chat with an inline keyboard of buttons, by row,
+	// when given.
+	Send(chatID int64, text string, buttons [][]Button) error
+	// Answer stops the loading indicator of a pressed button. It does nothing
+	// for other updates.
+	Answer(u U) error
+}
+
+// Input describes a state asking the user to type an answer.
+type Input struct {
+	Name    string // State name
+	Prompt  string // Optional: Sent when entering the state, the state has no prompt when empty
+	Invalid string // Optional: Sent when an answer is rejected
+	Next    string // State entered after a valid answer
+}
+
+// Choice is an option offered by a choice state.
+type Choice struct {
+	Text  string // Button label
+	Value string // Stored selection, Text when empty
+}
+
+// value returns the selection stored for the choice.
+func (c Choice) value() string {
+	if c.Value == "" {
+		return c.Text
+	}
+	return c.Value
+}
+
+// TextState creates a state accepting any non-blank text message.
+func TextState[S, U any](a Adapter[U], in Input, set func(state *S, value string)) *tgsm.State[S, U] {
+	return InputState(a, in, func(text string) (string, bool) {
+		return text, strings.TrimSpace(text) != ""
+	}, set)
+}
+
+// InputState creates a state parsing the text of the user's answer with
+// parse, passing the value to set. Answers parse rejects, and updates without
+// text, fail validation after the Invalid message of in is sent.
+func InputState[S, U, T any](a Adapter[U], in Input, parse func(text string) (T, bool), set func(state *S, value T)) *tgsm.State[S, U] {
+	state := &tgsm.State[S, U]{Name: in.Name}
+	if in.Prompt != "" {
+		state.PromptWith = sendPrompt[S](a, in.Prompt, nil)
+	}
+	state.Handle = func(u U, data *S) (string, error) {
+		var value T
+		ok := false
+		if text := a.Text(u); text != "" {
+			value, ok = parse(text)
+		}
+		if !ok {
+			return "", reject(a, u, in.Invalid)
+		}
+		set(data, value)
+		return in.Next, nil
+	}
+	return state
+}
+
+// ChoiceState creates a state asking the user to pick one of choices from an
+// inline keyboard sent with prompt, one choice per row as made by
+// ChoiceButtons. Pressed buttons are answered, the chosen value is passed to
+// set and the user moves on to next. Typing the label of a choice selects it
+// as well; anything else is rejected as invalid. The state has no prompt when
+// prompt is empty.
+func ChoiceState[S, U any](a Adapter[U], name, prompt string, choices []Choice, next string, set func(state *S, value string)) *tgsm.State[S, U] {
+	state := &tgsm.State[S, U]{Name: name}
+	if prompt != "" {
+		state.PromptWith = sendPrompt[S](a, prompt, ChoiceButtons(name, choices))
+	}
+	state.Handle = func(u U, data *S) (string, error) {
+		choice, ok := chosen(a, u, name, choices)
+		if err := a.Answer(u); err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", tgsm.ErrValidation
+		}
+		set(data, choice.value())
+		return next, nil
+	}
+	return state
+}
+
+// ChoiceButtons returns the buttons selecting choices in the choice state
+// name, one per row. Button callback data embeds the state name, which
+// therefore must be short enough to keep the data within the limits of the
+// bot platform, 64 bytes for Telegram.
+func ChoiceButtons(name string, choices []Choice) [][]Button {
+	buttons := make([][]Button, len(choices))
+	for i, choice := range choices {
+		buttons[i] = []Button{{Text: choice.Text, Data: choicePrefix + name + ":" + strconv.Itoa(i)}}
+	}
+	return buttons
+}
+
+// chosen returns the choice the update selects, either by a button press or
+// by the typed label.
+func chosen[U any](a Accessor[U], u U, state string, choices []Choice) (Choice, bool) {
+	if data, ok := a.CallbackData(u); ok {
+		index, ok := strings.CutPrefix(data, choicePrefix+state+":")
+		if !ok {
+			return Choice{}, false
+		}
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= len(choices) {
+			return Choice{}, false
+		}
+		return choices[i], true
+	}
+	text := strings.TrimSpace(a.Text(u))
+	for _, choice := range choices {
+		if strings.EqualFold(text, choice.Text) {
+			return choice, true
+		}
+	}
+	return Choice{}, false
+}
+
+// sendPrompt returns a PromptWith func sending text with buttons to the chat
+// of the update triggering the prompt, or to the chat whose ID is the user's
+// key when the prompt is sent without an update.
+func sendPrompt[S, U any](a Adapter[U], text string, buttons [][]Button) func(tgsm.PromptContext[U], *S) error {
+	return func(pc tgsm.PromptContext[U], _ *S) error {
+		chatID := pc.Key
+		if pc.Update != nil {
+			if id, ok := a.ChatID(*pc.Update); ok {
+				chatID = id
+			}
+		}
+		return a.Send(chatID, text, buttons)
+	}
+}
+
+// reject sends the invalid message, if any, to the chat of the update and
+// fails validation.
+func reject[U any](a Adapter[U], u U, invalid string) error {
+	if chatID, ok := a.ChatID(u); ok && invalid != "" {
+		if err := a.Send(chatID, invalid, nil); err != nil {
+			return err
+		}
+	}
+	return tgsm.ErrValidation
+}
@@ -0,0 +1,82 @@
+package updates_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tgsm "github.com/sudosz/tg-state-manager"
+	"github.com/sudosz/tg-state-manager/tgsmtest"
+	"github.com/sudosz/tg-state-manager/updates"
+)
+
+type (
+	// update is the update of a minimal bot framework.
+	update struct {
+		Chat int64
+		Text string
+		Data string // Callback data of a pressed button
+	}
+
+	// framework adapts update, recording the messages sent.
+	framework struct {
+		sent     []string
+		buttons  [][]updates.Button
+		answered int
+	}
+
+	order struct {
+		Name string
+		Size string
+	}
+)
+
+func (f *framework) Text(u update) string { return u.Text }
+
+func (f *framework) ChatID(u update) (int64, bool) { return u.Chat, u.Chat != 0 }
+
+func (f *framework) CallbackData(u update) (string, bool) { return u.Data, u.Data != "" }
+
+func (f *framework) Send(chatID int64, text string, buttons [][]updates.Button) error {
+	f.sent = append(f.sent, text)
+	f.buttons = buttons
+	return nil
+}
+
+func (f *framework) Answer(u update) error {
+	if u.Data != "" {
+		f.answered++
+	}
+	return nil
+}
+
+func TestStates(t *testing.T) {
+	f := &framework{}
+	sm := tgsm.NewStateManager[order, update](tgsm.NewInMemoryStorage[order](), func(u update) int64 { return u.Chat })
+	sm.SetInitialState("name")
+	require.NoError(t, sm.Add(
+		updates.TextState(f, updates.Input{Name: "name", Prompt: "Name?", Invalid: "Type your name", Next: "size"}, func(o *order, value string) {
+			o.Name = value
+		}),
+		updates.ChoiceState(f, "size", "Size?", []updates.Choice{{Text: "Small", Value: "S"}, {Text: "Large", Value: "L"}}, "", func(o *order, value string) {
+			o.Size = value
+		}),
+	))
+
+	tester := tgsmtest.NewFlowTester(t, sm)
+	tester.Send(update{Chat: 1, Text: "/start"})
+	tester.Send(update{Chat: 1, Text: " "})
+	tester.Send(update{Chat: 1, Text: "Ann"})
+	assert.Equal(t, []string{"Name?", "Type your name", "Size?"}, f.sent)
+	require.Len(t, f.buttons, 2)
+	assert.Equal(t, "tgsm:choice:size:1", f.buttons[1][0].Data)
+
+	tester.Send(update{Chat: 1, Data: "tgsm:choice:size:9"})
+	tester.AssertState(1, "size")
+	tester.Send(update{Chat: 1, Data: f.buttons[1][0].Data})
+	state, _, err := sm.Current(1)
+	require.NoError(t, err)
+	assert.True(t, state.Finished)
+	assert.Equal(t, order{Name: "Ann", Size: "L"}, state.Data)
+	assert.Equal(t, 2, f.answered)
+}
@@ -0,0 +1,97 @@
+package tgstatemanager
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ErrNoInitialState is returned by Validate when the manager has neither an
+// initial state, an InitialStateFunc nor a named flow to start users in.
+var ErrNoInitialState = errors.New("no initial state")
+
+// ErrNoSkipTo is returned by Validate for an Optional state without SkipTo,
+// which skipping it would otherwise fall back to when no transition matches.
+var ErrNoSkipTo = errors.New("optional state without SkipTo")
+
+// ErrNoFallback is returned by Validate for a state whose Breaker has no
+// Fallback, leaving nowhere to route users while it is open.
+var ErrNoFallback = errors.New("breaker without a fallback state")
+
+// validation records whether Validate succeeded, shared with the copies made
+// by HandleBatch.
+type validation struct {
+	mu    sync.Mutex
+	valid bool
+}
+
+// Validate checks the state names declared up front resolve to registered
+// states: the initial state, the targets of guarded transitions, SkipTo and
+// breaker fallbacks. Optional states need a SkipTo, breakers a Fallback and
+// states with a PromptKey need a PromptProvider or a Localizer. Problems are
+// reported with the Owner of the state they concern, when it has one. Every
+// problem found is reported, joined into one error. Next states returned by
+// Handle are only known at runtime and are not checked.
+//
+// Handle calls Validate until it succeeds once, failing with its error for as
+// long as the configuration is invalid.
+func (m *StateManager[S, U]) Validate() error {
+	var errs []error
+	if m.initialState == "" && len(m.flows) == 0 && m.initialFunc == nil {
+		errs = append(errs, ErrNoInitialState)
+	}
+	if _, ok := m.states[m.initialState]; m.initialState != "" && !ok {
+		errs = append(errs, fmt.Errorf("%w: %s (initial state)", ErrUnknownState, m.initialState))
+	}
+
+	names := make([]string, 0, len(m.states))
+	for name := range m.states {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	check := func(state, target, role string) {
+		if _, ok := m.states[target]; moves(target) && !ok {
+			errs = append(errs, fmt.Errorf("%w: %s (%s of %s)", ErrUnknownState, target, role, state))
+		}
+	}
+	for _, name := range names {
+		state := m.states[name]
+		label := name
+		if state.Owner != "" {
+			label += ", owned by " + state.Owner
+		}
+		for _, t := range state.Transitions {
+			check(label, t.To, "transition")
+		}
+		check(label, state.SkipTo, "SkipTo")
+		if state.Optional && state.SkipTo == "" {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrNoSkipTo, label))
+		}
+		if state.Breaker != nil && state.Breaker.Fallback == "" {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrNoFallback, label))
+		} else if state.Breaker != nil {
+			check(label, state.Breaker.Fallback, "breaker fallback")
+		}
+		if state.PromptKey != "" && m.promptProvider == nil && m.localizer == nil {
+			errs = append(errs, fmt.Errorf("%w: %s (PromptKey %q without a PromptProvider or Localizer)", ErrNoPrompt, label, state.PromptKey))
+		}
+	}
+
+	err := errors.Join(errs...)
+	m.validation.mu.Lock()
+	defer m.validation.mu.Unlock()
+	m.validation.valid = err == nil
+	return err
+}
+
+// validated validates the manager unless it already passed validation.
+func (m *StateManager[S, U]) validated() error {
+	m.validation.mu.Lock()
+	valid := m.validation.valid
+	m.validation.mu.Unlock()
+	if valid {
+		return nil
+	}
+	return m.Validate()
+}